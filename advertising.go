@@ -0,0 +1,287 @@
+package noblechild
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+// maxEIRPacketLength is the length of an advertisement or a scan response.
+const maxEIRPacketLength = 31
+
+// AD types, Bluetooth Core Spec Supplement Part A.
+const (
+	adFlags                 = 0x01
+	adIncomplete16BitUUIDs  = 0x02
+	adComplete16BitUUIDs    = 0x03
+	adIncomplete128BitUUIDs = 0x06
+	adComplete128BitUUIDs   = 0x07
+	adShortName             = 0x08
+	adCompleteName          = 0x09
+	adTxPower               = 0x0a
+	adServiceData16         = 0x16
+	adServiceData128        = 0x21
+	adManufacturerData      = 0xff
+)
+
+// Flags of the AD flags field.
+const (
+	flagLimitedDiscoverable = 0x01
+	flagGeneralDiscoverable = 0x02
+	flagBREDRNotSupported   = 0x04
+)
+
+// appendAD appends an AD structure of type typ to b.
+func appendAD(b []byte, typ byte, data []byte) []byte {
+	b = append(b, byte(len(data)+1), typ)
+	return append(b, data...)
+}
+
+// uuidBytes returns u in the little-endian order used on air.
+func uuidBytes(u gatt.UUID) []byte {
+	b, _ := hex.DecodeString(u.String())
+	return reverse(b)
+}
+
+// advFields are the parsed fields of an advertisement, given by a stack
+// which does not pass the raw data, such as bluetoothd or noble.
+type advFields struct {
+	name         string
+	txPower      *int
+	uuids        []gatt.UUID
+	manufacturer [][]byte // each begins with the company ID, little-endian
+	serviceData  []gatt.ServiceData
+}
+
+// eir rebuilds the advertising data from f.
+func (f advFields) eir() []byte {
+	var b []byte
+	if f.name != "" {
+		b = appendAD(b, adCompleteName, []byte(f.name))
+	}
+	if f.txPower != nil {
+		b = appendAD(b, adTxPower, []byte{byte(int8(*f.txPower))})
+	}
+	var u16, u128 []byte
+	for _, u := range f.uuids {
+		if u.Len() == 2 {
+			u16 = append(u16, uuidBytes(u)...)
+		} else {
+			u128 = append(u128, uuidBytes(u)...)
+		}
+	}
+	if len(u16) > 0 {
+		b = appendAD(b, adComplete16BitUUIDs, u16)
+	}
+	if len(u128) > 0 {
+		b = appendAD(b, adComplete128BitUUIDs, u128)
+	}
+	for _, m := range f.manufacturer {
+		b = appendAD(b, adManufacturerData, m)
+	}
+	for _, sd := range f.serviceData {
+		typ := byte(adServiceData16)
+		if sd.UUID.Len() != 2 {
+			typ = adServiceData128
+		}
+		b = appendAD(b, typ, append(uuidBytes(sd.UUID), sd.Data...))
+	}
+	return b
+}
+
+// nameAndServicesAdvertisement builds an advertisement with the services
+// which fit in it, and the name. If the name does not fit, it goes to the
+// scan response.
+func nameAndServicesAdvertisement(name string, uu []gatt.UUID) (adv, scanRsp []byte) {
+	adv = appendAD(adv, adFlags, []byte{flagGeneralDiscoverable | flagBREDRNotSupported})
+
+	var u16, u128 []byte
+	for _, u := range uu {
+		if b := uuidBytes(u); len(b) == 2 {
+			u16 = append(u16, b...)
+		} else {
+			u128 = append(u128, b...)
+		}
+	}
+
+	// put as many services as fit, and mark the list incomplete if some
+	// do not.
+	room := maxEIRPacketLength - len(adv)
+	if n := min(len(u16), (room-2)/2*2); n > 0 {
+		typ := byte(adComplete16BitUUIDs)
+		if n < len(u16) {
+			typ = adIncomplete16BitUUIDs
+		}
+		adv = appendAD(adv, typ, u16[:n])
+		room -= n + 2
+	}
+	if n := min(len(u128), (room-2)/16*16); n > 0 {
+		typ := byte(adComplete128BitUUIDs)
+		if n < len(u128) {
+			typ = adIncomplete128BitUUIDs
+		}
+		adv = appendAD(adv, typ, u128[:n])
+	}
+
+	if name == "" {
+		return adv, nil
+	}
+	if len(adv)+len(name)+2 <= maxEIRPacketLength {
+		return appendAD(adv, adCompleteName, []byte(name)), nil
+	}
+	if len(name) > maxEIRPacketLength-2 {
+		return adv, appendAD(nil, adShortName, []byte(name[:maxEIRPacketLength-2]))
+	}
+	return adv, appendAD(nil, adCompleteName, []byte(name))
+}
+
+// companyApple is the company identifier used by iBeacon.
+const companyApple = 0x004c
+
+// eddystoneUUID is the 16-bit service UUID of Eddystone, little-endian.
+var eddystoneUUID = []byte{0xaa, 0xfe}
+
+// Eddystone frame types.
+const (
+	eddystoneUID = 0x00
+	eddystoneURL = 0x10
+	eddystoneTLM = 0x20
+)
+
+var ErrInvalidBeacon = errors.New("invalid beacon parameter")
+
+// IBeaconPacket builds an iBeacon advertisement. u must be a 128-bit UUID,
+// and pwr is the measured power at 1m.
+func IBeaconPacket(u gatt.UUID, major, minor uint16, pwr int8) (*gatt.AdvPacket, error) {
+	if u.Len() != 16 {
+		return nil, fmt.Errorf("%w: iBeacon needs a 128-bit UUID: %s", ErrInvalidBeacon, u)
+	}
+	b := make([]byte, 0, 23)
+	b = append(b, 0x02, 0x15)
+	b = append(b, reverse(uuidBytes(u))...)
+	b = binary.BigEndian.AppendUint16(b, major)
+	b = binary.BigEndian.AppendUint16(b, minor)
+	b = append(b, byte(pwr))
+	return IBeaconDataPacket(b), nil
+}
+
+// IBeaconDataPacket builds an advertisement with b as the manufacturer
+// data of Apple, as gatt's AdvertiseIBeaconData does.
+func IBeaconDataPacket(b []byte) *gatt.AdvPacket {
+	a := &gatt.AdvPacket{}
+	a.AppendFlags(flagGeneralDiscoverable | flagBREDRNotSupported)
+	a.AppendManufacturerData(companyApple, b)
+	return a
+}
+
+// EddystoneUIDPacket builds an Eddystone-UID advertisement. txPower is the
+// calibrated power at 0m.
+func EddystoneUIDPacket(namespace [10]byte, instance [6]byte, txPower int8) *gatt.AdvPacket {
+	f := []byte{eddystoneUID, byte(txPower)}
+	f = append(f, namespace[:]...)
+	f = append(f, instance[:]...)
+	f = append(f, 0x00, 0x00) // RFU
+	return eddystonePacket(f)
+}
+
+var eddystoneSchemes = []string{"http://www.", "https://www.", "http://", "https://"}
+
+// eddystoneExpansions are the encodings of the URL, in the order of their
+// codes.
+var eddystoneExpansions = []string{
+	".com/", ".org/", ".edu/", ".net/", ".info/", ".biz/", ".gov/",
+	".com", ".org", ".edu", ".net", ".info", ".biz", ".gov",
+}
+
+// EddystoneURLPacket builds an Eddystone-URL advertisement. The encoded url
+// must fit in 17 bytes.
+func EddystoneURLPacket(url string, txPower int8) (*gatt.AdvPacket, error) {
+	b, err := encodeEddystoneURL(url)
+	if err != nil {
+		return nil, err
+	}
+	f := append([]byte{eddystoneURL, byte(txPower)}, b...)
+	return eddystonePacket(f), nil
+}
+
+func encodeEddystoneURL(url string) ([]byte, error) {
+	var b []byte
+	for i, s := range eddystoneSchemes {
+		if strings.HasPrefix(url, s) {
+			b = append(b, byte(i))
+			url = url[len(s):]
+			break
+		}
+	}
+	if b == nil {
+		return nil, fmt.Errorf("%w: unsupported URL scheme: %s", ErrInvalidBeacon, url)
+	}
+
+	for len(url) > 0 {
+		code := -1
+		for i, e := range eddystoneExpansions {
+			if strings.HasPrefix(url, e) {
+				code = i
+				url = url[len(e):]
+				break
+			}
+		}
+		if code >= 0 {
+			b = append(b, byte(code))
+			continue
+		}
+		if url[0] <= 0x20 || url[0] >= 0x7f {
+			return nil, fmt.Errorf("%w: invalid character in URL: %q", ErrInvalidBeacon, url[0])
+		}
+		b = append(b, url[0])
+		url = url[1:]
+	}
+	if len(b) > 18 {
+		return nil, fmt.Errorf("%w: URL too long: %d bytes encoded", ErrInvalidBeacon, len(b)-1)
+	}
+	return b, nil
+}
+
+// EddystoneTLM is the telemetry sent by an Eddystone-TLM frame.
+type EddystoneTLM struct {
+	Battery     uint16        // battery voltage in mV, 0 if unknown
+	Temperature float64       // beacon temperature in Celsius, NaN if unknown
+	AdvCount    uint32        // advertisements sent since power-up
+	Uptime      time.Duration // time since power-up
+}
+
+// EddystoneTLMPacket builds an unencrypted Eddystone-TLM advertisement.
+func EddystoneTLMPacket(t EddystoneTLM) *gatt.AdvPacket {
+	f := []byte{eddystoneTLM, 0x00}
+	f = binary.BigEndian.AppendUint16(f, t.Battery)
+	temp := uint16(0x8000)
+	if !math.IsNaN(t.Temperature) {
+		// signed 8.8 fixed point
+		temp = uint16(int16(math.Max(-128, math.Min(127, t.Temperature)) * 256))
+	}
+	f = binary.BigEndian.AppendUint16(f, temp)
+	f = binary.BigEndian.AppendUint32(f, t.AdvCount)
+	f = binary.BigEndian.AppendUint32(f, uint32(t.Uptime/(100*time.Millisecond)))
+	return eddystonePacket(f)
+}
+
+// eddystonePacket builds an advertisement with the Eddystone frame f.
+func eddystonePacket(f []byte) *gatt.AdvPacket {
+	a := &gatt.AdvPacket{}
+	a.AppendFlags(flagGeneralDiscoverable | flagBREDRNotSupported)
+	a.AppendField(adComplete16BitUUIDs, eddystoneUUID)
+	a.AppendField(adServiceData16, append(append([]byte{}, eddystoneUUID...), f...))
+	return a
+}
+
+// advPacketBytes returns the bytes of a.
+func advPacketBytes(a *gatt.AdvPacket) []byte {
+	b := a.Bytes()
+	return b[:a.Len()]
+}
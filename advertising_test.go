@@ -0,0 +1,125 @@
+package noblechild
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IBeaconPacket(t *testing.T) {
+	assert := assert.New(t)
+
+	u := gatt.MustParseUUID("e2c56db5-dffb-48d2-b060-d0f5a71096e0")
+	a, err := IBeaconPacket(u, 1, 0x0203, -59)
+	assert.Nil(err)
+	assert.Equal([]byte{
+		0x02, 0x01, 0x06,
+		0x1a, 0xff, 0x4c, 0x00, 0x02, 0x15,
+		0xe2, 0xc5, 0x6d, 0xb5, 0xdf, 0xfb, 0x48, 0xd2,
+		0xb0, 0x60, 0xd0, 0xf5, 0xa7, 0x10, 0x96, 0xe0,
+		0x00, 0x01, 0x02, 0x03, 0xc5,
+	}, advPacketBytes(a))
+	assert.Equal(30, a.Len())
+
+	_, err = IBeaconPacket(gatt.UUID16(0x180d), 1, 2, -59)
+	assert.True(errors.Is(err, ErrInvalidBeacon))
+}
+
+func Test_EddystoneUIDPacket(t *testing.T) {
+	assert := assert.New(t)
+
+	ns := [10]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	inst := [6]byte{0xa, 0xb, 0xc, 0xd, 0xe, 0xf}
+	a := EddystoneUIDPacket(ns, inst, -20)
+	assert.Equal([]byte{
+		0x02, 0x01, 0x06,
+		0x03, 0x03, 0xaa, 0xfe,
+		0x17, 0x16, 0xaa, 0xfe, 0x00, 0xec,
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9,
+		0xa, 0xb, 0xc, 0xd, 0xe, 0xf,
+		0x00, 0x00,
+	}, advPacketBytes(a))
+}
+
+func Test_EddystoneURLPacket(t *testing.T) {
+	assert := assert.New(t)
+
+	a, err := EddystoneURLPacket("https://www.example.com/", -20)
+	assert.Nil(err)
+	assert.Equal([]byte{
+		0x02, 0x01, 0x06,
+		0x03, 0x03, 0xaa, 0xfe,
+		0x0e, 0x16, 0xaa, 0xfe, 0x10, 0xec,
+		0x01, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x00,
+	}, advPacketBytes(a))
+
+	b, err := encodeEddystoneURL("http://goo.gl/abc")
+	assert.Nil(err)
+	assert.Equal([]byte{0x02, 'g', 'o', 'o', '.', 'g', 'l', '/', 'a', 'b', 'c'}, b)
+	b, err = encodeEddystoneURL("http://a.info.org")
+	assert.Nil(err)
+	assert.Equal([]byte{0x02, 'a', 0x0b, 0x08}, b)
+
+	_, err = encodeEddystoneURL("ftp://example.com")
+	assert.True(errors.Is(err, ErrInvalidBeacon))
+	_, err = encodeEddystoneURL("https://a very long.example.com/")
+	assert.True(errors.Is(err, ErrInvalidBeacon))
+	_, err = EddystoneURLPacket("https://www.averyverylongdomain.com/", 0)
+	assert.True(errors.Is(err, ErrInvalidBeacon))
+}
+
+func Test_EddystoneTLMPacket(t *testing.T) {
+	assert := assert.New(t)
+
+	a := EddystoneTLMPacket(EddystoneTLM{
+		Battery:     3000,
+		Temperature: 25.5,
+		AdvCount:    0x01020304,
+		Uptime:      10 * time.Second,
+	})
+	assert.Equal([]byte{
+		0x02, 0x01, 0x06,
+		0x03, 0x03, 0xaa, 0xfe,
+		0x11, 0x16, 0xaa, 0xfe, 0x20, 0x00,
+		0x0b, 0xb8,
+		0x19, 0x80,
+		0x01, 0x02, 0x03, 0x04,
+		0x00, 0x00, 0x00, 0x64,
+	}, advPacketBytes(a))
+
+	b := advPacketBytes(EddystoneTLMPacket(EddystoneTLM{Temperature: -1.5}))
+	assert.Equal([]byte{0xfe, 0x80}, b[15:17])
+	b = advPacketBytes(EddystoneTLMPacket(EddystoneTLM{Temperature: math.NaN()}))
+	assert.Equal([]byte{0x80, 0x00}, b[15:17])
+}
+
+func Test_advFieldsEIR(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := -4
+	u := gatt.MustParseUUID("6e400001-b5a3-f393-e0a9-e50e24dcca9e")
+	f := advFields{
+		name:    "fake",
+		txPower: &tx,
+		uuids:   []gatt.UUID{gatt.UUID16(0x180f), u},
+		serviceData: []gatt.ServiceData{
+			{UUID: gatt.UUID16(0xfeaa), Data: []byte{0x10}},
+			{UUID: u, Data: []byte{0x01, 0x02}},
+		},
+	}
+	a, _, err := parseEIR(f.eir())
+	assert.Nil(err)
+	assert.Equal("fake", a.LocalName)
+	assert.Equal(-4, a.TxPowerLevel)
+	assert.Equal(f.uuids, a.Services)
+	if assert.Equal(2, len(a.ServiceData)) {
+		assert.Equal("feaa", a.ServiceData[0].UUID.String())
+		assert.Equal([]byte{0x10}, a.ServiceData[0].Data)
+		assert.True(a.ServiceData[1].UUID.Equal(u))
+		assert.Equal([]byte{0x01, 0x02}, a.ServiceData[1].Data)
+	}
+}
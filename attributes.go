@@ -0,0 +1,184 @@
+package noblechild
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/paypal/gatt"
+)
+
+// AttributeTable holds the values and handlers of the characteristics and
+// descriptors served by an ATTServer. gatt.Characteristic and
+// gatt.Descriptor keep them unexported, so an ATTServer serves only what
+// is registered here, never what is given to their own SetValue and
+// Handle* methods. Each method sets the properties of the characteristic.
+type AttributeTable struct {
+	mu    sync.RWMutex
+	chars map[*gatt.Characteristic]*attrEntry
+	descs map[*gatt.Descriptor]*attrEntry
+}
+
+// attrEntry is what the table knows of a characteristic or a descriptor.
+type attrEntry struct {
+	value  []byte
+	read   gatt.ReadHandler
+	write  gatt.WriteHandler
+	notify gatt.NotifyHandler
+}
+
+// NewAttributeTable returns an empty table.
+func NewAttributeTable() *AttributeTable {
+	return &AttributeTable{
+		chars: map[*gatt.Characteristic]*attrEntry{},
+		descs: map[*gatt.Descriptor]*attrEntry{},
+	}
+}
+
+// Attributes returns the table of the services of d, served to the
+// centrals in the peripheral role.
+func Attributes(d gatt.Device) (*AttributeTable, error) {
+	dd, ok := d.(*device)
+	if !ok {
+		return nil, errors.New("not a noblechild device")
+	}
+	return dd.attrs, nil
+}
+
+func (t *AttributeTable) char(c *gatt.Characteristic) *attrEntry {
+	e := t.chars[c]
+	if e == nil {
+		e = &attrEntry{}
+		t.chars[c] = e
+	}
+	return e
+}
+
+func (t *AttributeTable) desc(d *gatt.Descriptor) *attrEntry {
+	e := t.descs[d]
+	if e == nil {
+		e = &attrEntry{}
+		t.descs[d] = e
+	}
+	return e
+}
+
+// SetValue makes c readable with the static value b.
+func (t *AttributeTable) SetValue(c *gatt.Characteristic, b []byte) {
+	c.SetValue(b)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.char(c)
+	e.value = append([]byte{}, b...)
+	e.read = nil
+}
+
+// HandleRead makes h serve the reads of c.
+func (t *AttributeTable) HandleRead(c *gatt.Characteristic, h gatt.ReadHandler) {
+	c.HandleRead(h)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.char(c)
+	e.read = h
+	e.value = nil
+}
+
+// HandleWrite makes h serve the writes of c.
+func (t *AttributeTable) HandleWrite(c *gatt.Characteristic, h gatt.WriteHandler) {
+	c.HandleWrite(h)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.char(c).write = h
+}
+
+// HandleNotify makes h send the notifications or indications of c.
+func (t *AttributeTable) HandleNotify(c *gatt.Characteristic, h gatt.NotifyHandler) {
+	c.HandleNotify(h)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.char(c).notify = h
+}
+
+// SetDescriptorValue makes d readable with the static value b.
+func (t *AttributeTable) SetDescriptorValue(d *gatt.Descriptor, b []byte) {
+	d.SetValue(b)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.desc(d)
+	e.value = append([]byte{}, b...)
+	e.read = nil
+}
+
+// HandleDescriptorRead makes h serve the reads of d. The request has the
+// characteristic of d.
+func (t *AttributeTable) HandleDescriptorRead(d *gatt.Descriptor, h gatt.ReadHandler) {
+	d.HandleRead(h)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.desc(d)
+	e.read = h
+	e.value = nil
+}
+
+// HandleDescriptorWrite makes h serve the writes of d.
+func (t *AttributeTable) HandleDescriptorWrite(d *gatt.Descriptor, h gatt.WriteHandler) {
+	d.HandleWrite(h)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.desc(d).write = h
+}
+
+// check returns an error if a property of a characteristic of ss has no
+// value or handler in t.
+func (t *AttributeTable) check(ss []*gatt.Service) error {
+	if t == nil {
+		t = NewAttributeTable()
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, s := range ss {
+		for _, c := range s.Characteristics() {
+			var e attrEntry
+			if t.chars[c] != nil {
+				e = *t.chars[c]
+			}
+			p := c.Properties()
+			switch {
+			case p&gatt.CharRead != 0 && e.read == nil && e.value == nil:
+				return fmt.Errorf("characteristic %s is readable without a value or a read handler in the attribute table", c.UUID())
+			case p&(gatt.CharWrite|gatt.CharWriteNR) != 0 && e.write == nil:
+				return fmt.Errorf("characteristic %s is writable without a write handler in the attribute table", c.UUID())
+			case p&(gatt.CharNotify|gatt.CharIndicate) != 0 && e.notify == nil:
+				return fmt.Errorf("characteristic %s notifies without a notify handler in the attribute table", c.UUID())
+			}
+		}
+	}
+	return nil
+}
+
+// charEntry returns a copy of the entry of c, empty if c is unknown. A
+// readable entry has a read handler or a non-nil value.
+func (t *AttributeTable) charEntry(c *gatt.Characteristic) attrEntry {
+	if t == nil {
+		return attrEntry{}
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if e := t.chars[c]; e != nil {
+		return *e
+	}
+	return attrEntry{}
+}
+
+// descEntry returns a copy of the entry of d, empty if d is unknown.
+func (t *AttributeTable) descEntry(d *gatt.Descriptor) attrEntry {
+	if t == nil {
+		return attrEntry{}
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if e := t.descs[d]; e != nil {
+		return *e
+	}
+	return attrEntry{}
+}
@@ -0,0 +1,740 @@
+package noblechild
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/paypal/gatt"
+)
+
+// ATTServer serves a tree of gatt.Service over a stream of ATT PDUs. Each
+// Read of the stream must return one PDU, and each Write sends one PDU,
+// like the l2cap-ble children do.
+type ATTServer struct {
+	// Central is given to the handlers in gatt.Request. It may be nil.
+	Central gatt.Central
+
+	d     *device
+	rw    io.ReadWriter
+	table *AttributeTable
+	attrs []attr
+
+	wmu sync.Mutex // serializes writes of responses and notifications
+
+	mu       sync.Mutex // protects the fields below
+	mtu      uint16
+	prepared []prepWrite
+	notifier map[uint16]*notifier // value handle -> running notifier
+}
+
+// attr is an attribute of the server.
+type attr struct {
+	h     uint16
+	endh  uint16 // end of the group for service declarations
+	typ   gatt.UUID
+	value []byte // value of declarations
+
+	c     *gatt.Characteristic // for a characteristic value, CCCD and descriptors
+	desc  *gatt.Descriptor     // for descriptors
+	props gatt.Property        // of the characteristic value
+}
+
+type prepWrite struct {
+	h      uint16
+	offset uint16
+	value  []byte
+}
+
+// NewATTServer builds the attribute table of svcs and returns a server
+// which answers on rw with the values and handlers registered in t.
+// Handles are numbered from 0x0001 in the order of svcs. A Client
+// Characteristic Configuration descriptor is added to the characteristics
+// which notify or indicate and do not have one.
+func NewATTServer(svcs []*gatt.Service, t *AttributeTable, rw io.ReadWriter) *ATTServer {
+	return newATTServer(nil, svcs, t, rw)
+}
+
+func newATTServer(d *device, svcs []*gatt.Service, t *AttributeTable, rw io.ReadWriter) *ATTServer {
+	return &ATTServer{
+		d:        d,
+		rw:       rw,
+		table:    t,
+		attrs:    generateAttributes(svcs),
+		mtu:      defaultMTU,
+		notifier: map[uint16]*notifier{},
+	}
+}
+
+func generateAttributes(svcs []*gatt.Service) []attr {
+	var attrs []attr
+	h := uint16(1)
+	for _, s := range svcs {
+		sa := attr{h: h, typ: attrPrimaryServiceUUID, value: uuidBytes(s.UUID())}
+		si := len(attrs)
+		attrs = append(attrs, sa)
+		h++
+
+		for _, c := range s.Characteristics() {
+			vh := h + 1
+			decl := append([]byte{byte(c.Properties()), byte(vh), byte(vh >> 8)}, uuidBytes(c.UUID())...)
+			attrs = append(attrs, attr{h: h, typ: attrCharacteristicUUID, value: decl, c: c})
+			attrs = append(attrs, attr{h: vh, typ: c.UUID(), c: c, props: c.Properties()})
+			h += 2
+
+			hasCCCD := false
+			for _, d := range c.Descriptors() {
+				a := attr{h: h, typ: d.UUID(), c: c, desc: d}
+				if d.UUID().Equal(attrClientCharacteristicConfigUUID) {
+					// the server keeps the CCCD of each connection
+					hasCCCD = true
+					a.desc = nil
+				}
+				attrs = append(attrs, a)
+				h++
+			}
+			if !hasCCCD && c.Properties()&(gatt.CharNotify|gatt.CharIndicate) != 0 {
+				attrs = append(attrs, attr{h: h, typ: attrClientCharacteristicConfigUUID, c: c})
+				h++
+			}
+		}
+		attrs[si].endh = h - 1
+		s.SetHandle(attrs[si].h)
+		s.SetEndHandle(attrs[si].endh)
+	}
+	return attrs
+}
+
+// MTU returns the ATT MTU of the connection.
+func (s *ATTServer) MTU() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.mtu)
+}
+
+// Serve answers the requests until rw is closed. Running notifications are
+// stopped when it returns.
+func (s *ATTServer) Serve() error {
+	defer s.stopNotifiers()
+
+	buf := make([]byte, maxMTU)
+	for {
+		n, err := s.rw.Read(buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		req := make([]byte, n)
+		copy(req, buf)
+
+		rsp := s.handleReq(req)
+		if rsp == nil {
+			continue
+		}
+		if err := s.write(rsp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *ATTServer) write(b []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	_, err := s.rw.Write(b)
+	return err
+}
+
+// handleReq returns the response to the PDU b, or nil for commands.
+func (s *ATTServer) handleReq(b []byte) []byte {
+	op := b[0]
+	s.d.log().Debug("att server request", "opcode", opcode(b), "pdu", fmt.Sprintf("%x", b))
+
+	switch op {
+	case attOpMtuReq:
+		return s.handleMTU(b)
+	case attOpFindInfoReq:
+		return s.handleFindInfo(b)
+	case attOpFindByTypeValueReq:
+		return s.handleFindByTypeValue(b)
+	case attOpReadByTypeReq:
+		return s.handleReadByType(b)
+	case attOpReadReq, attOpReadBlobReq:
+		return s.handleRead(b)
+	case attOpReadByGroupReq:
+		return s.handleReadByGroup(b)
+	case attOpWriteReq, attOpWriteCmd:
+		return s.handleWrite(b)
+	case attOpPrepWriteReq:
+		return s.handlePrepWrite(b)
+	case attOpExecWriteReq:
+		return s.handleExecWrite(b)
+	case attOpHandleCnf, attOpSignedWriteCmd:
+		return nil
+	}
+	if op&0x40 != 0 {
+		// unknown commands are ignored
+		return nil
+	}
+	return attErrorRsp(op, 0x0000, attEcodeReqNotSupp)
+}
+
+func (s *ATTServer) handleMTU(b []byte) []byte {
+	if len(b) != 3 {
+		return attErrorRsp(b[0], 0x0000, attEcodeInvalidPDU)
+	}
+	mtu := binary.LittleEndian.Uint16(b[1:3])
+	if mtu < defaultMTU {
+		mtu = defaultMTU
+	}
+	if mtu > maxMTU {
+		mtu = maxMTU
+	}
+	s.mu.Lock()
+	s.mtu = mtu
+	s.mu.Unlock()
+
+	// answer our receive MTU; both sides use the smaller one.
+	return []byte{attOpMtuRsp, byte(maxMTU & 0xff), byte(maxMTU >> 8)}
+}
+
+// handleRange parses the handle range of b and checks it.
+func handleRange(b []byte) (start, end uint16, rsp []byte) {
+	start = binary.LittleEndian.Uint16(b[1:3])
+	end = binary.LittleEndian.Uint16(b[3:5])
+	if start == 0 || start > end {
+		return 0, 0, attErrorRsp(b[0], start, attEcodeInvalidHandle)
+	}
+	return start, end, nil
+}
+
+// parseUUID parses the little-endian UUID b.
+func parseUUID(b []byte) (gatt.UUID, error) {
+	return gatt.ParseUUID(ByteToString(reverse(b)))
+}
+
+func (s *ATTServer) handleFindInfo(b []byte) []byte {
+	if len(b) != 5 {
+		return attErrorRsp(b[0], 0x0000, attEcodeInvalidPDU)
+	}
+	start, end, rsp := handleRange(b)
+	if rsp != nil {
+		return rsp
+	}
+
+	var w bytes.Buffer
+	w.WriteByte(attOpFindInfoRsp)
+	format := 0
+	for _, a := range s.attrs {
+		if a.h < start || a.h > end {
+			continue
+		}
+		u := uuidBytes(a.typ)
+		f := 1
+		if len(u) == 16 {
+			f = 2
+		}
+		if format == 0 {
+			format = f
+			w.WriteByte(byte(f))
+		}
+		if f != format || w.Len()+2+len(u) > s.MTU() {
+			break
+		}
+		binary.Write(&w, binary.LittleEndian, a.h)
+		w.Write(u)
+	}
+	if format == 0 {
+		return attErrorRsp(b[0], start, attEcodeAttrNotFound)
+	}
+	return w.Bytes()
+}
+
+func (s *ATTServer) handleFindByTypeValue(b []byte) []byte {
+	if len(b) < 7 {
+		return attErrorRsp(b[0], 0x0000, attEcodeInvalidPDU)
+	}
+	start, end, rsp := handleRange(b)
+	if rsp != nil {
+		return rsp
+	}
+	typ := gatt.UUID16(binary.LittleEndian.Uint16(b[5:7]))
+	value := b[7:]
+
+	var w bytes.Buffer
+	w.WriteByte(attOpFindByTypeValueRsp)
+	for _, a := range s.attrs {
+		if a.h < start || a.h > end || !a.typ.Equal(typ) || !bytes.Equal(a.value, value) {
+			continue
+		}
+		if w.Len()+4 > s.MTU() {
+			break
+		}
+		endh := a.endh
+		if endh == 0 {
+			endh = a.h
+		}
+		binary.Write(&w, binary.LittleEndian, a.h)
+		binary.Write(&w, binary.LittleEndian, endh)
+	}
+	if w.Len() == 1 {
+		return attErrorRsp(b[0], start, attEcodeAttrNotFound)
+	}
+	return w.Bytes()
+}
+
+func (s *ATTServer) handleReadByType(b []byte) []byte {
+	if len(b) != 7 && len(b) != 21 {
+		return attErrorRsp(b[0], 0x0000, attEcodeInvalidPDU)
+	}
+	start, end, rsp := handleRange(b)
+	if rsp != nil {
+		return rsp
+	}
+	typ, err := parseUUID(b[5:])
+	if err != nil {
+		return attErrorRsp(b[0], start, attEcodeInvalidPDU)
+	}
+
+	mtu := s.MTU()
+	var w bytes.Buffer
+	w.WriteByte(attOpReadByTypeRsp)
+	l := 0
+	for i := range s.attrs {
+		a := &s.attrs[i]
+		if a.h < start || a.h > end || !a.typ.Equal(typ) {
+			continue
+		}
+		v, ecode := s.read(a, 0, mtu-4)
+		if ecode != attEcodeSuccess {
+			if l == 0 {
+				return attErrorRsp(b[0], a.h, ecode)
+			}
+			break
+		}
+		// each value is at most 253 bytes, and all must have the same length
+		if len(v) > 253 {
+			v = v[:253]
+		}
+		if l == 0 {
+			l = len(v) + 2
+			w.WriteByte(byte(l))
+		}
+		if len(v)+2 != l || w.Len()+l > mtu {
+			break
+		}
+		binary.Write(&w, binary.LittleEndian, a.h)
+		w.Write(v)
+	}
+	if l == 0 {
+		return attErrorRsp(b[0], start, attEcodeAttrNotFound)
+	}
+	return w.Bytes()
+}
+
+func (s *ATTServer) handleRead(b []byte) []byte {
+	op := b[0]
+	var offset int
+	switch {
+	case op == attOpReadReq && len(b) == 3:
+	case op == attOpReadBlobReq && len(b) == 5:
+		offset = int(binary.LittleEndian.Uint16(b[3:5]))
+	default:
+		return attErrorRsp(op, 0x0000, attEcodeInvalidPDU)
+	}
+	h := binary.LittleEndian.Uint16(b[1:3])
+	a := s.attr(h)
+	if a == nil {
+		return attErrorRsp(op, h, attEcodeInvalidHandle)
+	}
+
+	v, ecode := s.read(a, offset, s.MTU()-1)
+	if ecode != attEcodeSuccess {
+		return attErrorRsp(op, h, ecode)
+	}
+	return append([]byte{attRspFor[op]}, v...)
+}
+
+func (s *ATTServer) handleReadByGroup(b []byte) []byte {
+	if len(b) != 7 && len(b) != 21 {
+		return attErrorRsp(b[0], 0x0000, attEcodeInvalidPDU)
+	}
+	start, end, rsp := handleRange(b)
+	if rsp != nil {
+		return rsp
+	}
+	typ, err := parseUUID(b[5:])
+	if err != nil {
+		return attErrorRsp(b[0], start, attEcodeInvalidPDU)
+	}
+	if !typ.Equal(attrPrimaryServiceUUID) && !typ.Equal(attrSecondaryServiceUUID) {
+		return attErrorRsp(b[0], start, attEcodeUnsuppGrpType)
+	}
+
+	var w bytes.Buffer
+	w.WriteByte(attOpReadByGroupRsp)
+	l := 0
+	for _, a := range s.attrs {
+		if a.h < start || a.h > end || !a.typ.Equal(typ) {
+			continue
+		}
+		if l == 0 {
+			l = len(a.value) + 4
+			w.WriteByte(byte(l))
+		}
+		if len(a.value)+4 != l || w.Len()+l > s.MTU() {
+			break
+		}
+		binary.Write(&w, binary.LittleEndian, a.h)
+		binary.Write(&w, binary.LittleEndian, a.endh)
+		w.Write(a.value)
+	}
+	if l == 0 {
+		return attErrorRsp(b[0], start, attEcodeAttrNotFound)
+	}
+	return w.Bytes()
+}
+
+func (s *ATTServer) handleWrite(b []byte) []byte {
+	op := b[0]
+	if len(b) < 3 {
+		if op == attOpWriteCmd {
+			return nil
+		}
+		return attErrorRsp(op, 0x0000, attEcodeInvalidPDU)
+	}
+	h := binary.LittleEndian.Uint16(b[1:3])
+	ecode := attEcodeInvalidHandle
+	if a := s.attr(h); a != nil {
+		ecode = s.writeAttr(a, b[3:], op == attOpWriteCmd)
+	}
+	if op == attOpWriteCmd {
+		return nil
+	}
+	if ecode != attEcodeSuccess {
+		return attErrorRsp(op, h, ecode)
+	}
+	return []byte{attOpWriteRsp}
+}
+
+// maxPrepWrites limits the prepare queue of a connection.
+const maxPrepWrites = 64
+
+func (s *ATTServer) handlePrepWrite(b []byte) []byte {
+	if len(b) < 5 {
+		return attErrorRsp(b[0], 0x0000, attEcodeInvalidPDU)
+	}
+	h := binary.LittleEndian.Uint16(b[1:3])
+	a := s.attr(h)
+	if a == nil {
+		return attErrorRsp(b[0], h, attEcodeInvalidHandle)
+	}
+	if ecode := s.writable(a); ecode != attEcodeSuccess {
+		return attErrorRsp(b[0], h, ecode)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.prepared) >= maxPrepWrites {
+		return attErrorRsp(b[0], h, attEcodePrepQueueFull)
+	}
+	w := prepWrite{
+		h:      h,
+		offset: binary.LittleEndian.Uint16(b[3:5]),
+		value:  append([]byte(nil), b[5:]...),
+	}
+	s.prepared = append(s.prepared, w)
+
+	rsp := append([]byte(nil), b...)
+	rsp[0] = attOpPrepWriteRsp
+	return rsp
+}
+
+func (s *ATTServer) handleExecWrite(b []byte) []byte {
+	if len(b) != 2 {
+		return attErrorRsp(b[0], 0x0000, attEcodeInvalidPDU)
+	}
+	s.mu.Lock()
+	prepared := s.prepared
+	s.prepared = nil
+	s.mu.Unlock()
+
+	if b[1] == 0x00 {
+		// cancel all prepared writes
+		return []byte{attOpExecWriteRsp}
+	}
+
+	// join the parts of each handle; the offsets must be contiguous.
+	var order []uint16
+	values := map[uint16][]byte{}
+	for _, w := range prepared {
+		v, ok := values[w.h]
+		if !ok {
+			order = append(order, w.h)
+		}
+		if int(w.offset) != len(v) {
+			return attErrorRsp(b[0], w.h, attEcodeInvalidOffset)
+		}
+		values[w.h] = append(v, w.value...)
+	}
+	for _, h := range order {
+		if len(values[h]) > 512 {
+			return attErrorRsp(b[0], h, attEcodeInvalAttrValueLen)
+		}
+	}
+	for _, h := range order {
+		if ecode := s.writeAttr(s.attr(h), values[h], false); ecode != attEcodeSuccess {
+			return attErrorRsp(b[0], h, ecode)
+		}
+	}
+	return []byte{attOpExecWriteRsp}
+}
+
+func (s *ATTServer) attr(h uint16) *attr {
+	for i := range s.attrs {
+		if s.attrs[i].h == h {
+			return &s.attrs[i]
+		}
+	}
+	return nil
+}
+
+// read returns the value of a from offset, at most max bytes.
+func (s *ATTServer) read(a *attr, offset, max int) ([]byte, attEcode) {
+	var v []byte
+	switch {
+	case a.value != nil:
+		v = a.value
+	case a.desc != nil:
+		e := s.table.descEntry(a.desc)
+		if e.read != nil {
+			return s.serveRead(e.read, s.request(a.c), offset, max)
+		}
+		if e.value == nil {
+			s.d.log().Error("no value in the attribute table", "handle", fmt.Sprintf("0x%04x", a.h), "uuid", a.typ.String())
+			return nil, attEcodeUnlikely
+		}
+		v = e.value
+	case a.typ.Equal(attrClientCharacteristicConfigUUID):
+		vh := s.valueHandle(a.c)
+		s.mu.Lock()
+		n := s.notifier[vh]
+		s.mu.Unlock()
+		v = []byte{0x00, 0x00}
+		if n != nil {
+			v[0] = byte(n.flag)
+		}
+	case a.c != nil:
+		if a.props&gatt.CharRead == 0 {
+			return nil, attEcodeReadNotPerm
+		}
+		e := s.table.charEntry(a.c)
+		if e.read != nil {
+			return s.serveRead(e.read, s.request(a.c), offset, max)
+		}
+		if e.value == nil {
+			s.d.log().Error("no value in the attribute table", "handle", fmt.Sprintf("0x%04x", a.h), "uuid", a.typ.String())
+			return nil, attEcodeUnlikely
+		}
+		v = e.value
+	}
+
+	if offset > len(v) {
+		return nil, attEcodeInvalidOffset
+	}
+	v = v[offset:]
+	if len(v) > max {
+		v = v[:max]
+	}
+	return v, attEcodeSuccess
+}
+
+func (s *ATTServer) serveRead(h gatt.ReadHandler, r gatt.Request, offset, max int) ([]byte, attEcode) {
+	rsp := &responseWriter{capacity: max}
+	h.ServeRead(rsp, &gatt.ReadRequest{Request: r, Cap: max, Offset: offset})
+	switch rsp.status {
+	case gatt.StatusSuccess:
+	case gatt.StatusInvalidOffset:
+		return nil, attEcodeInvalidOffset
+	default:
+		return nil, attEcodeUnlikely
+	}
+	return rsp.buf.Bytes(), attEcodeSuccess
+}
+
+// request returns the request given to the handlers of c and its
+// descriptors.
+func (s *ATTServer) request(c *gatt.Characteristic) gatt.Request {
+	return gatt.Request{Central: s.Central, Service: c.Service(), Characteristic: c}
+}
+
+// writeHandler returns the handler of the writes of a, nil if it can not
+// be written.
+func (s *ATTServer) writeHandler(a *attr) gatt.WriteHandler {
+	switch {
+	case a.desc != nil:
+		return s.table.descEntry(a.desc).write
+	case a.c != nil && a.value == nil && a.props&(gatt.CharWrite|gatt.CharWriteNR) != 0:
+		return s.table.charEntry(a.c).write
+	}
+	return nil
+}
+
+// writable checks that a can be written.
+func (s *ATTServer) writable(a *attr) attEcode {
+	switch {
+	case a.desc != nil:
+		if s.writeHandler(a) == nil {
+			return attEcodeWriteNotPerm
+		}
+	case a.typ.Equal(attrClientCharacteristicConfigUUID):
+	case a.c != nil && a.value == nil:
+		if s.writeHandler(a) == nil {
+			return attEcodeWriteNotPerm
+		}
+	default:
+		return attEcodeWriteNotPerm
+	}
+	return attEcodeSuccess
+}
+
+func (s *ATTServer) writeAttr(a *attr, data []byte, noRsp bool) attEcode {
+	if ecode := s.writable(a); ecode != attEcodeSuccess {
+		return ecode
+	}
+	switch {
+	case a.desc != nil:
+		return writeStatus(s.writeHandler(a).ServeWrite(s.request(a.c), data))
+	case a.typ.Equal(attrClientCharacteristicConfigUUID):
+		if len(data) != 2 {
+			return attEcodeInvalAttrValueLen
+		}
+		s.setNotify(a.c, binary.LittleEndian.Uint16(data))
+		return attEcodeSuccess
+	default:
+		if noRsp && a.props&gatt.CharWriteNR == 0 {
+			return attEcodeWriteNotPerm
+		}
+		return writeStatus(s.writeHandler(a).ServeWrite(s.request(a.c), data))
+	}
+}
+
+func writeStatus(status byte) attEcode {
+	switch status {
+	case gatt.StatusSuccess:
+		return attEcodeSuccess
+	case gatt.StatusInvalidOffset:
+		return attEcodeInvalidOffset
+	}
+	return attEcodeUnlikely
+}
+
+// setNotify starts or stops the NotifyHandler of c after its CCCD is
+// written with ccc.
+func (s *ATTServer) setNotify(c *gatt.Characteristic, ccc uint16) {
+	vh := s.valueHandle(c)
+	h := s.table.charEntry(c).notify
+
+	s.mu.Lock()
+	old := s.notifier[vh]
+	delete(s.notifier, vh)
+	var n *notifier
+	flag := ccc & (gattCCCNotifyFlag | gattCCCIndicateFlag)
+	if flag != 0 && h != nil {
+		n = &notifier{s: s, h: vh, flag: flag}
+		s.notifier[vh] = n
+	}
+	s.mu.Unlock()
+
+	if old != nil {
+		old.stop()
+	}
+	if n != nil {
+		go h.ServeNotify(s.request(c), n)
+	}
+}
+
+// valueHandle returns the handle of the value of c in this server.
+func (s *ATTServer) valueHandle(c *gatt.Characteristic) uint16 {
+	for _, a := range s.attrs {
+		if a.c == c && a.typ.Equal(c.UUID()) && a.desc == nil {
+			return a.h
+		}
+	}
+	return 0
+}
+
+func (s *ATTServer) stopNotifiers() {
+	s.mu.Lock()
+	ns := s.notifier
+	s.notifier = map[uint16]*notifier{}
+	s.mu.Unlock()
+	for _, n := range ns {
+		n.stop()
+	}
+}
+
+// responseWriter implements gatt.ResponseWriter for read handlers.
+type responseWriter struct {
+	capacity int
+	buf      bytes.Buffer
+	status   byte
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if avail := w.capacity - w.buf.Len(); len(b) > avail {
+		b = b[:avail]
+	}
+	return w.buf.Write(b)
+}
+
+func (w *responseWriter) SetStatus(status byte) { w.status = status }
+
+// notifier implements gatt.Notifier. It sends notifications or
+// indications of the value handle h.
+type notifier struct {
+	s    *ATTServer
+	h    uint16
+	flag uint16
+
+	mu   sync.Mutex
+	done bool
+}
+
+func (n *notifier) Write(data []byte) (int, error) {
+	if n.Done() {
+		return 0, io.ErrClosedPipe
+	}
+	op := byte(attOpHandleNotify)
+	if n.flag&gattCCCNotifyFlag == 0 {
+		op = attOpHandleInd
+	}
+	if len(data) > n.Cap() {
+		data = data[:n.Cap()]
+	}
+	b := append([]byte{op, byte(n.h), byte(n.h >> 8)}, data...)
+	if err := n.s.write(b); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (n *notifier) Cap() int { return n.s.MTU() - 3 }
+
+func (n *notifier) Done() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.done
+}
+
+func (n *notifier) stop() {
+	n.mu.Lock()
+	n.done = true
+	n.mu.Unlock()
+}
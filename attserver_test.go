@@ -0,0 +1,258 @@
+package noblechild
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+var testLongValue = bytes.Repeat([]byte("0123456789"), 10)
+
+// testServices returns services with their values and handlers in a new
+// table.
+func testServices(written chan []byte) ([]*gatt.Service, *AttributeTable) {
+	t := NewAttributeTable()
+	gap := gatt.NewService(gatt.UUID16(0x1800))
+	t.SetValue(gap.AddCharacteristic(gatt.UUID16(0x2a00)), []byte("noblechild"))
+
+	s := gatt.NewService(gatt.MustParseUUID("09fc95c0-c111-11e3-9904-0002a5d5c51b"))
+	t.HandleRead(s.AddCharacteristic(gatt.MustParseUUID("11fac9e0-c111-11e3-9246-0002a5d5c51b")), gatt.ReadHandlerFunc(
+		func(rsp gatt.ResponseWriter, req *gatt.ReadRequest) {
+			if req.Offset > len(testLongValue) {
+				rsp.SetStatus(gatt.StatusInvalidOffset)
+				return
+			}
+			rsp.Write(testLongValue[req.Offset:])
+		}))
+	t.HandleWrite(s.AddCharacteristic(gatt.MustParseUUID("16fe0d80-c111-11e3-b8c8-0002a5d5c51b")), gatt.WriteHandlerFunc(
+		func(r gatt.Request, data []byte) byte {
+			written <- data
+			return gatt.StatusSuccess
+		}))
+	t.HandleNotify(s.AddCharacteristic(gatt.MustParseUUID("1c927b50-c116-11e3-8a33-0800200c9a66")), gatt.NotifyHandlerFunc(
+		func(r gatt.Request, n gatt.Notifier) {
+			n.Write([]byte("hello"))
+		}))
+	return []*gatt.Service{gap, s}, t
+}
+
+// newTestPeripheral connects a peripheral to an ATTServer over a pipe.
+func newTestPeripheral(svcs []*gatt.Service, t *AttributeTable) (*peripheral, *ATTServer, func()) {
+	cc, sc := net.Pipe()
+	srv := NewATTServer(svcs, t, sc)
+	go srv.Serve()
+	p := newPeripheral(nil, nil, cc, "aabbccddeeff")
+	return &p, srv, func() { cc.Close(); sc.Close() }
+}
+
+func Test_ATTServerDiscovery(t *testing.T) {
+	assert := assert.New(t)
+
+	svcs, table := testServices(make(chan []byte, 1))
+	p, _, done := newTestPeripheral(svcs, table)
+	defer done()
+
+	ss, err := p.DiscoverServices(nil)
+	assert.Nil(err)
+	assert.Equal(2, len(ss))
+	assert.Equal("1800", ss[0].UUID().String())
+	assert.Equal(uint16(1), ss[0].Handle())
+	assert.Equal(uint16(3), ss[0].EndHandle())
+	assert.Equal(svcs[1].UUID().String(), ss[1].UUID().String())
+	assert.Equal(uint16(4), ss[1].Handle())
+	assert.Equal(uint16(11), ss[1].EndHandle())
+
+	cs, err := p.DiscoverCharacteristics(nil, ss[0])
+	assert.Nil(err)
+	assert.Equal(1, len(cs))
+	assert.Equal(uint16(3), cs[0].VHandle())
+
+	cs, err = p.DiscoverCharacteristics(nil, ss[1])
+	assert.Nil(err)
+	assert.Equal(3, len(cs))
+	assert.Equal(gatt.CharRead, cs[0].Properties())
+	assert.Equal(gatt.CharNotify, cs[2].Properties())
+
+	ds, err := p.DiscoverDescriptors(nil, cs[2])
+	assert.Nil(err)
+	assert.Equal(1, len(ds))
+	assert.Equal("2902", ds[0].UUID().String())
+	assert.Equal(uint16(11), ds[0].Handle())
+}
+
+func Test_ATTServerReadWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	written := make(chan []byte, 1)
+	p, srv, done := newTestPeripheral(testServices(written))
+	defer done()
+
+	ss, _ := p.DiscoverServices(nil)
+	gap, _ := p.DiscoverCharacteristics(nil, ss[0])
+	cs, _ := p.DiscoverCharacteristics(nil, ss[1])
+
+	b, err := p.ReadCharacteristic(gap[0])
+	assert.Nil(err)
+	assert.Equal("noblechild", string(b))
+
+	// read blob
+	b, err = p.ReadLongCharacteristic(cs[0])
+	assert.Nil(err)
+	assert.Equal(testLongValue, b)
+
+	// the MTU limits the responses
+	assert.Nil(p.SetMTU(185))
+	assert.Equal(185, srv.MTU())
+	b, err = p.ReadCharacteristic(cs[0])
+	assert.Nil(err)
+	assert.Equal(testLongValue, b)
+
+	assert.Nil(p.WriteCharacteristic(cs[1], []byte("abc"), false))
+	assert.Equal([]byte("abc"), <-written)
+	assert.Nil(p.WriteCharacteristic(cs[1], []byte("def"), true))
+	assert.Equal([]byte("def"), <-written)
+
+	assert.Equal(attEcodeWriteNotPerm, p.WriteCharacteristic(cs[0], []byte("abc"), false))
+	_, err = p.ReadCharacteristic(cs[1])
+	assert.Equal(attEcodeReadNotPerm, err)
+}
+
+func Test_ATTServerPrepareWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	written := make(chan []byte, 1)
+	p, _, done := newTestPeripheral(testServices(written))
+	defer done()
+
+	// the value handle of the writable characteristic is 8
+	rsp, _ := p.sendReq(attOpPrepWriteReq, []byte{attOpPrepWriteReq, 0x08, 0x00, 0x00, 0x00, 'a', 'b'})
+	assert.Equal([]byte{attOpPrepWriteRsp, 0x08, 0x00, 0x00, 0x00, 'a', 'b'}, rsp)
+	p.sendReq(attOpPrepWriteReq, []byte{attOpPrepWriteReq, 0x08, 0x00, 0x02, 0x00, 'c'})
+	rsp, _ = p.sendReq(attOpExecWriteReq, []byte{attOpExecWriteReq, 0x01})
+	assert.Equal([]byte{attOpExecWriteRsp}, rsp)
+	assert.Equal([]byte("abc"), <-written)
+
+	// cancel
+	p.sendReq(attOpPrepWriteReq, []byte{attOpPrepWriteReq, 0x08, 0x00, 0x00, 0x00, 'x'})
+	rsp, _ = p.sendReq(attOpExecWriteReq, []byte{attOpExecWriteReq, 0x00})
+	assert.Equal([]byte{attOpExecWriteRsp}, rsp)
+	select {
+	case <-written:
+		t.Error("cancelled write was executed")
+	default:
+	}
+
+	// a gap between the offsets
+	p.sendReq(attOpPrepWriteReq, []byte{attOpPrepWriteReq, 0x08, 0x00, 0x05, 0x00, 'x'})
+	rsp, _ = p.sendReq(attOpExecWriteReq, []byte{attOpExecWriteReq, 0x01})
+	assert.Equal(attErrorRsp(attOpExecWriteReq, 0x0008, attEcodeInvalidOffset), rsp)
+
+	// not writable
+	rsp, _ = p.sendReq(attOpPrepWriteReq, []byte{attOpPrepWriteReq, 0x06, 0x00, 0x00, 0x00, 'x'})
+	assert.Equal(attErrorRsp(attOpPrepWriteReq, 0x0006, attEcodeWriteNotPerm), rsp)
+
+	rsp, _ = p.sendReq(attOpReadMultiReq, []byte{attOpReadMultiReq, 0x03, 0x00, 0x06, 0x00})
+	assert.Equal(attErrorRsp(attOpReadMultiReq, 0x0000, attEcodeReqNotSupp), rsp)
+}
+
+func Test_ATTServerNotify(t *testing.T) {
+	assert := assert.New(t)
+
+	p, _, done := newTestPeripheral(testServices(make(chan []byte, 1)))
+	defer done()
+
+	ss, _ := p.DiscoverServices(nil)
+	cs, _ := p.DiscoverCharacteristics(nil, ss[1])
+	_, err := p.DiscoverDescriptors(nil, cs[2])
+	assert.Nil(err)
+
+	notified := make(chan []byte, 1)
+	err = p.SetNotifyValue(cs[2], func(c *gatt.Characteristic, b []byte, err error) {
+		notified <- b
+	})
+	assert.Nil(err)
+
+	select {
+	case b := <-notified:
+		assert.Equal([]byte("hello"), b)
+	case <-time.After(time.Second):
+		t.Fatal("no notification")
+	}
+
+	b, err := p.ReadDescriptor(cs[2].Descriptor())
+	assert.Nil(err)
+	assert.Equal([]byte{0x01, 0x00}, b)
+}
+
+func Test_ATTServerDescriptor(t *testing.T) {
+	assert := assert.New(t)
+
+	table := NewAttributeTable()
+	s := gatt.NewService(gatt.UUID16(0x180f))
+	c := s.AddCharacteristic(gatt.UUID16(0x2a19))
+	table.SetValue(c, []byte{0x64})
+	table.SetDescriptorValue(c.AddDescriptor(gatt.UUID16(0x2901)), []byte("level"))
+	written := make(chan []byte, 1)
+	d := c.AddDescriptor(gatt.UUID16(0x2908))
+	table.HandleDescriptorRead(d, gatt.ReadHandlerFunc(func(rsp gatt.ResponseWriter, req *gatt.ReadRequest) {
+		assert.Equal(c, req.Characteristic)
+		rsp.Write([]byte{0x01, 0x02})
+	}))
+	table.HandleDescriptorWrite(d, gatt.WriteHandlerFunc(func(r gatt.Request, data []byte) byte {
+		written <- data
+		return gatt.StatusSuccess
+	}))
+
+	p, _, done := newTestPeripheral([]*gatt.Service{s}, table)
+	defer done()
+	ss, _ := p.DiscoverServices(nil)
+	cs, _ := p.DiscoverCharacteristics(nil, ss[0])
+	ds, err := p.DiscoverDescriptors(nil, cs[0])
+	assert.Nil(err)
+	assert.Equal(2, len(ds))
+
+	b, err := p.ReadCharacteristic(cs[0])
+	assert.Nil(err)
+	assert.Equal([]byte{0x64}, b)
+	b, err = p.ReadDescriptor(ds[0])
+	assert.Nil(err)
+	assert.Equal("level", string(b))
+	b, err = p.ReadDescriptor(ds[1])
+	assert.Nil(err)
+	assert.Equal([]byte{0x01, 0x02}, b)
+	assert.Nil(p.WriteDescriptor(ds[1], []byte{0x03}))
+	assert.Equal([]byte{0x03}, <-written)
+	assert.Equal(attEcodeWriteNotPerm, p.WriteDescriptor(ds[0], []byte{0x03}))
+
+	// a characteristic missing from the table is not readable
+	p, _, done2 := newTestPeripheral([]*gatt.Service{s}, nil)
+	defer done2()
+	ss, _ = p.DiscoverServices(nil)
+	cs, _ = p.DiscoverCharacteristics(nil, ss[0])
+	_, err = p.ReadCharacteristic(cs[0])
+	assert.Equal(attEcodeUnlikely, err)
+}
+
+func Test_AttributeTableCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	svcs, table := testServices(make(chan []byte, 1))
+	assert.Nil(table.check(svcs))
+
+	// the value and the handler given to gatt are not served
+	s := gatt.NewService(gatt.UUID16(0x180f))
+	s.AddCharacteristic(gatt.UUID16(0x2a19)).SetValue([]byte{100})
+	assert.NotNil(table.check([]*gatt.Service{s}))
+	w := gatt.NewService(gatt.UUID16(0x180a))
+	w.AddCharacteristic(gatt.UUID16(0x2a29)).HandleWriteFunc(func(r gatt.Request, data []byte) byte { return gatt.StatusSuccess })
+	assert.NotNil(table.check([]*gatt.Service{w}))
+
+	d := &device{attrs: table}
+	assert.Nil(d.SetServices(svcs))
+	assert.NotNil(d.AddService(s))
+	assert.Equal(svcs, d.svcs)
+}
@@ -0,0 +1,109 @@
+package noblechild
+
+import (
+	"fmt"
+
+	gatt "github.com/paypal/gatt"
+)
+
+// Backend selects how a device talks to the adapter in the central role.
+type Backend int
+
+const (
+	// BackendChildren runs hci-ble and l2cap-ble of noble. It is the default.
+	BackendChildren Backend = iota
+	// BackendSocket talks HCI and L2CAP over the Bluetooth sockets of Linux.
+	BackendSocket
+	// BackendAuto uses BackendSocket if the adapter can be opened, and
+	// falls back to BackendChildren.
+	BackendAuto
+	// BackendBlueZ drives bluetoothd through its org.bluez D-Bus API.
+	BackendBlueZ
+	// BackendNode runs a Node script over the JavaScript API of noble, for
+	// noble versions which do not build hci-ble and l2cap-ble.
+	BackendNode
+	// BackendWebSocket connects to noble's ws-slave.js on another host,
+	// given by WebSocketURL.
+	BackendWebSocket
+)
+
+func (b Backend) String() string {
+	switch b {
+	case BackendChildren:
+		return "children"
+	case BackendSocket:
+		return "socket"
+	case BackendAuto:
+		return "auto"
+	case BackendBlueZ:
+		return "bluez"
+	case BackendNode:
+		return "node"
+	case BackendWebSocket:
+		return "websocket"
+	}
+	return fmt.Sprintf("Backend(%d)", int(b))
+}
+
+// ParseBackend returns the Backend named s, as given by String.
+func ParseBackend(s string) (Backend, error) {
+	for b := BackendChildren; b <= BackendWebSocket; b++ {
+		if b.String() == s {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown backend: %q", s)
+}
+
+// backend scans and connects for a device. Advertisements go to
+// device.handleEvent and the adapter state to the stateChanged handler.
+type backend interface {
+	Init() error
+	startScan(dup bool) error
+	StopScan() error
+	Close() error
+	// newL2CAP starts connecting to address. The result is reported by
+	// the connectResult of the returned L2CAP_BLE.
+	newL2CAP(address, addressType string) (*L2CAP_BLE, error)
+}
+
+// peripheralBackend is a backend with its own peripherals, which do not
+// exchange ATT PDUs through an L2CAP_BLE.
+type peripheralBackend interface {
+	newPeripheral(e *HCIEvent) gatt.Peripheral
+	connect(p gatt.Peripheral)
+	cancelConnection(p gatt.Peripheral)
+}
+
+// newBackend opens the backend chosen by SetBackend. It
+// returns nil if the children should be used.
+func (d *device) newBackend() (backend, error) {
+	switch d.backendKind {
+	case BackendChildren:
+		return nil, nil
+	case BackendBlueZ:
+		return newBlueZ(d)
+	case BackendNode:
+		return newNodeHelper(d)
+	case BackendWebSocket:
+		return newWSSlave(d)
+	}
+	b, err := newHCISocket(d)
+	if err == nil {
+		return b, nil
+	}
+	if d.backendKind == BackendSocket {
+		return nil, err
+	}
+	d.log().Info("bluetooth socket is not available, using the children", "error", err)
+	return nil, nil
+}
+
+// setState reports the adapter state to the stateChanged handler.
+func (d *device) setState(s gatt.State) {
+	d.dispatch(func() {
+		if d.stateChanged != nil {
+			d.stateChanged(d, s)
+		}
+	})
+}
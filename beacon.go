@@ -0,0 +1,255 @@
+package noblechild
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+// Beacon is the beacon data found in an advertisement. A field is nil when
+// the advertisement does not carry it. An Eddystone beacon usually sends
+// its frames in different advertisements.
+type Beacon struct {
+	IBeacon      *IBeacon
+	AltBeacon    *AltBeacon
+	EddystoneUID *EddystoneUID
+	EddystoneURL *EddystoneURL
+	EddystoneTLM *EddystoneTLM
+	EddystoneEID *EddystoneEID
+}
+
+// IBeacon is an iBeacon advertisement.
+type IBeacon struct {
+	UUID          gatt.UUID
+	Major         uint16
+	Minor         uint16
+	MeasuredPower int8 // RSSI at 1m
+}
+
+// AltBeacon is an AltBeacon advertisement.
+type AltBeacon struct {
+	ManufacturerID uint16
+	ID             [20]byte
+	ReferenceRSSI  int8 // RSSI at 1m
+	Reserved       byte
+}
+
+// EddystoneUID is an Eddystone-UID frame.
+type EddystoneUID struct {
+	TxPower   int8 // power at 0m
+	Namespace [10]byte
+	Instance  [6]byte
+}
+
+// EddystoneURL is an Eddystone-URL frame.
+type EddystoneURL struct {
+	TxPower int8 // power at 0m
+	URL     string
+}
+
+// EddystoneEID is an Eddystone-EID frame.
+type EddystoneEID struct {
+	TxPower int8 // power at 0m
+	EID     [8]byte
+}
+
+const eddystoneEID = 0x30
+
+// eddystoneLoss is the signal loss at 1m assumed by Eddystone.
+const eddystoneLoss = 41
+
+// Beacon decodes the beacon data of the advertisement of e. Every
+// manufacturer specific data is looked at.
+func (e *HCIEvent) Beacon() (*Beacon, error) {
+	if e.Advertisement == nil {
+		return nil, nil
+	}
+	var mds [][]byte
+	for _, md := range e.Manufacturers {
+		mds = append(mds, md.Bytes())
+	}
+	return parseBeacon(mds, e.Advertisement.ServiceData)
+}
+
+// ParseBeacon decodes the beacon data in a. It returns nil without an error
+// when a is not a beacon.
+func ParseBeacon(a *gatt.Advertisement) (*Beacon, error) {
+	if a == nil {
+		return nil, nil
+	}
+	return parseBeacon([][]byte{a.ManufacturerData}, a.ServiceData)
+}
+
+func parseBeacon(mds [][]byte, sds []gatt.ServiceData) (*Beacon, error) {
+	b := &Beacon{}
+	found := false
+
+	for _, m := range mds {
+		if len(m) < 4 {
+			continue
+		}
+		switch {
+		case binary.LittleEndian.Uint16(m) == companyApple && m[2] == 0x02 && m[3] == 0x15:
+			ib, err := parseIBeacon(m[2:])
+			if err != nil {
+				return nil, err
+			}
+			b.IBeacon = ib
+			found = true
+		case m[2] == 0xbe && m[3] == 0xac:
+			ab, err := parseAltBeacon(m)
+			if err != nil {
+				return nil, err
+			}
+			b.AltBeacon = ab
+			found = true
+		}
+	}
+
+	for _, sd := range sds {
+		if !bytes.Equal(uuidBytes(sd.UUID), eddystoneUUID) {
+			continue
+		}
+		if err := b.parseEddystone(sd.Data); err != nil {
+			return nil, err
+		}
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// parseIBeacon parses the iBeacon data following the company ID of Apple.
+func parseIBeacon(m []byte) (*IBeacon, error) {
+	if len(m) != 23 || m[0] != 0x02 || m[1] != 0x15 {
+		return nil, fmt.Errorf("%w: iBeacon length %d", ErrInvalidBeacon, len(m))
+	}
+	u, err := gatt.ParseUUID(hex.EncodeToString(m[2:18]))
+	if err != nil {
+		return nil, err
+	}
+	return &IBeacon{
+		UUID:          u,
+		Major:         binary.BigEndian.Uint16(m[18:]),
+		Minor:         binary.BigEndian.Uint16(m[20:]),
+		MeasuredPower: int8(m[22]),
+	}, nil
+}
+
+func parseAltBeacon(m []byte) (*AltBeacon, error) {
+	if len(m) != 26 {
+		return nil, fmt.Errorf("%w: AltBeacon length %d", ErrInvalidBeacon, len(m))
+	}
+	ab := &AltBeacon{
+		ManufacturerID: binary.LittleEndian.Uint16(m),
+		ReferenceRSSI:  int8(m[24]),
+		Reserved:       m[25],
+	}
+	copy(ab.ID[:], m[4:24])
+	return ab, nil
+}
+
+func (b *Beacon) parseEddystone(f []byte) error {
+	if len(f) < 2 {
+		return fmt.Errorf("%w: Eddystone frame length %d", ErrInvalidBeacon, len(f))
+	}
+	switch f[0] {
+	case eddystoneUID:
+		// the RFU bytes may be omitted
+		if len(f) != 18 && len(f) != 20 {
+			return fmt.Errorf("%w: Eddystone-UID length %d", ErrInvalidBeacon, len(f))
+		}
+		uid := &EddystoneUID{TxPower: int8(f[1])}
+		copy(uid.Namespace[:], f[2:12])
+		copy(uid.Instance[:], f[12:18])
+		b.EddystoneUID = uid
+	case eddystoneURL:
+		url, err := decodeEddystoneURL(f[2:])
+		if err != nil {
+			return err
+		}
+		b.EddystoneURL = &EddystoneURL{TxPower: int8(f[1]), URL: url}
+	case eddystoneTLM:
+		if f[1] != 0x00 {
+			// encrypted TLM can not be read without the key
+			return nil
+		}
+		if len(f) != 14 {
+			return fmt.Errorf("%w: Eddystone-TLM length %d", ErrInvalidBeacon, len(f))
+		}
+		t := &EddystoneTLM{
+			Battery:     binary.BigEndian.Uint16(f[2:]),
+			Temperature: math.NaN(),
+			AdvCount:    binary.BigEndian.Uint32(f[6:]),
+			Uptime:      time.Duration(binary.BigEndian.Uint32(f[10:])) * 100 * time.Millisecond,
+		}
+		if temp := binary.BigEndian.Uint16(f[4:]); temp != 0x8000 {
+			t.Temperature = float64(int16(temp)) / 256
+		}
+		b.EddystoneTLM = t
+	case eddystoneEID:
+		if len(f) != 10 {
+			return fmt.Errorf("%w: Eddystone-EID length %d", ErrInvalidBeacon, len(f))
+		}
+		eid := &EddystoneEID{TxPower: int8(f[1])}
+		copy(eid.EID[:], f[2:])
+		b.EddystoneEID = eid
+	}
+	return nil
+}
+
+func decodeEddystoneURL(b []byte) (string, error) {
+	if len(b) == 0 || int(b[0]) >= len(eddystoneSchemes) {
+		return "", fmt.Errorf("%w: Eddystone-URL scheme", ErrInvalidBeacon)
+	}
+	url := eddystoneSchemes[b[0]]
+	for _, c := range b[1:] {
+		if int(c) < len(eddystoneExpansions) {
+			url += eddystoneExpansions[c]
+		} else {
+			url += string(rune(c))
+		}
+	}
+	return url, nil
+}
+
+// MeasuredPower returns the expected RSSI at 1m sent by the beacon. ok is
+// false when b has no power.
+func (b *Beacon) MeasuredPower() (power int, ok bool) {
+	switch {
+	case b.IBeacon != nil:
+		return int(b.IBeacon.MeasuredPower), true
+	case b.AltBeacon != nil:
+		return int(b.AltBeacon.ReferenceRSSI), true
+	case b.EddystoneUID != nil:
+		return int(b.EddystoneUID.TxPower) - eddystoneLoss, true
+	case b.EddystoneURL != nil:
+		return int(b.EddystoneURL.TxPower) - eddystoneLoss, true
+	case b.EddystoneEID != nil:
+		return int(b.EddystoneEID.TxPower) - eddystoneLoss, true
+	}
+	return 0, false
+}
+
+// Distance estimates the distance to the beacon in meters from rssi.
+func (b *Beacon) Distance(rssi int) (float64, bool) {
+	power, ok := b.MeasuredPower()
+	if !ok {
+		return 0, false
+	}
+	return Distance(rssi, power), true
+}
+
+// Distance estimates the distance in meters from rssi and the RSSI measured
+// at 1m, with the free space path loss model.
+func Distance(rssi, measuredPower int) float64 {
+	return math.Pow(10, float64(measuredPower-rssi)/20)
+}
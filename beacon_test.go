@@ -0,0 +1,111 @@
+package noblechild
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+// advEvent builds an hci-ble event line of a.
+func advEvent(a *gatt.AdvPacket, rssi string) string {
+	return "event 00:11:22:33:44:55,random," + hex.EncodeToString(advPacketBytes(a)) + "," + rssi
+}
+
+func Test_ParseBeaconIBeacon(t *testing.T) {
+	assert := assert.New(t)
+
+	u := gatt.MustParseUUID("e2c56db5-dffb-48d2-b060-d0f5a71096e0")
+	a, _ := IBeaconPacket(u, 1, 2, -59)
+	e, err := parseEvent(advEvent(a, "-59"))
+	assert.Nil(err)
+
+	b, err := e.Beacon()
+	assert.Nil(err)
+	assert.Equal(&IBeacon{UUID: u, Major: 1, Minor: 2, MeasuredPower: -59}, b.IBeacon)
+	assert.Nil(b.EddystoneUID)
+
+	d, ok := b.Distance(e.RSSI)
+	assert.True(ok)
+	assert.InDelta(1.0, d, 0.001)
+	assert.InDelta(10.0, Distance(-79, -59), 0.001)
+}
+
+func Test_ParseBeaconAltBeacon(t *testing.T) {
+	assert := assert.New(t)
+
+	m := []byte{0x18, 0x01, 0xbe, 0xac}
+	for i := 0; i < 20; i++ {
+		m = append(m, byte(i))
+	}
+	m = append(m, 0xc5, 0x00)
+	b, err := ParseBeacon(&gatt.Advertisement{ManufacturerData: m})
+	assert.Nil(err)
+	assert.Equal(uint16(0x0118), b.AltBeacon.ManufacturerID)
+	assert.Equal(byte(19), b.AltBeacon.ID[19])
+	assert.Equal(int8(-59), b.AltBeacon.ReferenceRSSI)
+
+	_, err = ParseBeacon(&gatt.Advertisement{ManufacturerData: m[:20]})
+	assert.True(errors.Is(err, ErrInvalidBeacon))
+}
+
+func Test_ParseBeaconEddystone(t *testing.T) {
+	assert := assert.New(t)
+
+	ns := [10]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	inst := [6]byte{0xa, 0xb, 0xc, 0xd, 0xe, 0xf}
+	e, err := parseEvent(advEvent(EddystoneUIDPacket(ns, inst, -20), "-61"))
+	assert.Nil(err)
+	b, err := e.Beacon()
+	assert.Nil(err)
+	assert.Equal(&EddystoneUID{TxPower: -20, Namespace: ns, Instance: inst}, b.EddystoneUID)
+	p, _ := b.MeasuredPower()
+	assert.Equal(-61, p)
+
+	a, _ := EddystoneURLPacket("https://www.example.com/", -20)
+	e, _ = parseEvent(advEvent(a, "-61"))
+	b, err = e.Beacon()
+	assert.Nil(err)
+	assert.Equal("https://www.example.com/", b.EddystoneURL.URL)
+
+	tlm := EddystoneTLM{Battery: 3000, Temperature: 25.5, AdvCount: 10, Uptime: time.Minute}
+	e, _ = parseEvent(advEvent(EddystoneTLMPacket(tlm), "-61"))
+	b, err = e.Beacon()
+	assert.Nil(err)
+	assert.Equal(&tlm, b.EddystoneTLM)
+	_, ok := b.MeasuredPower()
+	assert.False(ok)
+
+	e, _ = parseEvent(advEvent(EddystoneTLMPacket(EddystoneTLM{Temperature: math.NaN()}), "-61"))
+	b, _ = e.Beacon()
+	assert.True(math.IsNaN(b.EddystoneTLM.Temperature))
+
+	eid := eddystonePacket([]byte{eddystoneEID, 0xec, 1, 2, 3, 4, 5, 6, 7, 8})
+	e, _ = parseEvent(advEvent(eid, "-61"))
+	b, err = e.Beacon()
+	assert.Nil(err)
+	assert.Equal(&EddystoneEID{TxPower: -20, EID: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}, b.EddystoneEID)
+
+	_, err = ParseBeacon(&gatt.Advertisement{ServiceData: []gatt.ServiceData{
+		{UUID: gatt.UUID16(0xfeaa), Data: []byte{eddystoneUID, 0x00, 0x01}},
+	}})
+	assert.True(errors.Is(err, ErrInvalidBeacon))
+}
+
+func Test_ParseBeaconNone(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := parseEvent("event 20:73:77:65:43:21,public,02010509ff0f000202f202203a100957494345442053656e7365204b6974,-77")
+	assert.Nil(err)
+	b, err := e.Beacon()
+	assert.Nil(err)
+	assert.Nil(b)
+
+	// truncated EIR does not panic
+	_, err = parseEvent("event 20:73:77:65:43:21,public,02010509ff0f00,-77")
+	assert.Nil(err)
+}
@@ -0,0 +1,154 @@
+package noblechild
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// blenoLayouts are the directories under a search root where bleno's
+// hci-ble and l2cap-ble are built.
+var blenoLayouts = []string{
+	filepath.Join("node_modules", "bleno", "build", "Release"),
+	filepath.Join("node_modules", "@abandonware", "bleno", "build", "Release"),
+}
+
+// FindBlenoModule finds bleno's hci-ble and l2cap-ble, which are used for
+// the peripheral role. The same directories as FindNobleModule are
+// searched.
+func FindBlenoModule() (NobleModule, error) {
+	return FindBlenoModuleIn(DefaultNobleSearchPaths()...)
+}
+
+// FindBlenoModuleIn finds bleno's binaries under the given roots.
+func FindBlenoModuleIn(roots ...string) (NobleModule, error) {
+	return findModule(blenoLayouts, roots)
+}
+
+var (
+	blenoAddressRegex = regexp.MustCompile("^address (.*)$")
+)
+
+// BLENO_HCI_BLE is a struct to use bleno's hci-ble binary, which
+// advertises.
+//
+// It reads a line of "<advertisement hex> <scan response hex>" from stdin
+// to start advertising, and an empty line to stop.
+type BLENO_HCI_BLE struct {
+	path       string
+	stdinPipe  io.WriteCloser
+	stdoutPipe io.ReadCloser
+	command    *exec.Cmd
+	exited     chan struct{} // closed when hci-ble has exited
+
+	device *device
+
+	// Address is the address of the adapter.
+	Address      string
+	AdapterState string
+}
+
+func NewBlenoHCI(d *device, path string) (*BLENO_HCI_BLE, error) {
+	hci := BLENO_HCI_BLE{
+		path:   path,
+		device: d,
+	}
+
+	return &hci, nil
+}
+
+func (hci *BLENO_HCI_BLE) Init() error {
+	cmd := exec.Command(hci.path)
+	cmd.Env = hci.device.childEnv()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	hci.stdinPipe = stdin
+	hci.stdoutPipe = stdout
+	hci.command = cmd
+	hci.exited = make(chan struct{})
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	go hci.Out()
+
+	return nil
+}
+
+// Close stops advertising and terminates hci-ble.
+func (hci *BLENO_HCI_BLE) Close() error {
+	if hci.command == nil || hci.command.Process == nil {
+		return nil
+	}
+	hci.StopAdvertising()
+	hci.stdinPipe.Close()
+
+	err := stopProcess(hci.device.log(), hci.command.Process, hci.exited, hci.device.stopTimeoutOption())
+	if err != nil {
+		return fmt.Errorf("bleno hci close: %s", err)
+	}
+	return nil
+}
+
+// Out read stdout from hci
+func (hci *BLENO_HCI_BLE) Out() {
+	scanner := bufio.NewScanner(hci.stdoutPipe)
+	for scanner.Scan() {
+		buf := scanner.Text()
+		err := hci.ParseStdout(buf)
+		if err != nil {
+			hci.device.log().Error("bleno hci-ble output", "pid", pid(hci.command), "error", err)
+		}
+	}
+
+	hci.command.Wait()
+	close(hci.exited)
+}
+
+func (hci *BLENO_HCI_BLE) ParseStdout(buf string) error {
+	switch {
+	case adapterRegex.MatchString(buf):
+		tmp := adapterRegex.FindStringSubmatch(buf)
+		hci.AdapterState = tmp[1]
+		switch tmp[1] {
+		case "unsupported":
+			hci.device.log().Error("bleno: adapter does not support Bluetooth Low Energy (BLE, Bluetooth Smart)", "pid", pid(hci.command))
+		case "unauthorized":
+			hci.device.log().Error("bleno: adapter state unauthorized, please run as root or with sudo", "pid", pid(hci.command))
+		}
+	case blenoAddressRegex.MatchString(buf):
+		tmp := blenoAddressRegex.FindStringSubmatch(buf)
+		hci.Address = tmp[1]
+	default:
+		return fmt.Errorf("unknown stdout: %s", buf)
+	}
+	return nil
+}
+
+// StartAdvertising advertises adv, and answers scan requests with scanRsp.
+func (hci *BLENO_HCI_BLE) StartAdvertising(adv, scanRsp []byte) error {
+	if len(adv) > maxEIRPacketLength || len(scanRsp) > maxEIRPacketLength {
+		return fmt.Errorf("advertisement too long: %d, %d", len(adv), len(scanRsp))
+	}
+	line := strings.TrimSpace(ByteToString(adv)+" "+ByteToString(scanRsp)) + "\n"
+	_, err := io.WriteString(hci.stdinPipe, line)
+	return err
+}
+
+// StopAdvertising stops advertising.
+func (hci *BLENO_HCI_BLE) StopAdvertising() error {
+	_, err := io.WriteString(hci.stdinPipe, "\n")
+	return err
+}
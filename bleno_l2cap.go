@@ -0,0 +1,186 @@
+package noblechild
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	acceptRegex          = regexp.MustCompile("^accept (.*)$")
+	blenoDisconnectRegex = regexp.MustCompile("^disconnect (.*)$")
+	rssiUpdateRegex      = regexp.MustCompile("^rssiUpdate (.*)$")
+	blenoSecurityRegex   = regexp.MustCompile("^security (.*)$")
+)
+
+// BLENO_L2CAP_BLE is a struct to use bleno's l2cap-ble binary. It listens
+// on the ATT channel and accepts one central at a time.
+type BLENO_L2CAP_BLE struct {
+	path       string
+	stdinPipe  io.WriteCloser
+	stdoutPipe io.ReadCloser
+	command    *exec.Cmd
+	exited     chan struct{} // closed when l2cap-ble has exited
+
+	device *device
+
+	mu      sync.Mutex // protects central
+	central *central
+}
+
+func NewBlenoL2CAP(d *device, path string) (*BLENO_L2CAP_BLE, error) {
+	l2cap := BLENO_L2CAP_BLE{
+		path:   path,
+		device: d,
+	}
+
+	return &l2cap, nil
+}
+
+func (l2cap *BLENO_L2CAP_BLE) Init() error {
+	cmd := exec.Command(l2cap.path)
+	cmd.Env = l2cap.device.childEnv()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	l2cap.stdinPipe = stdin
+	l2cap.stdoutPipe = stdout
+	l2cap.command = cmd
+	l2cap.exited = make(chan struct{})
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	go l2cap.Out()
+
+	return nil
+}
+
+// Close terminates l2cap-ble. The connected central, if any, is
+// disconnected.
+func (l2cap *BLENO_L2CAP_BLE) Close() error {
+	if l2cap.command == nil || l2cap.command.Process == nil {
+		return nil
+	}
+	l2cap.stdinPipe.Close()
+
+	err := stopProcess(l2cap.device.log(), l2cap.command.Process, l2cap.exited, l2cap.device.stopTimeoutOption())
+	if err != nil {
+		return fmt.Errorf("bleno l2cap close: %s", err)
+	}
+	return nil
+}
+
+func (l2cap *BLENO_L2CAP_BLE) Out() {
+	scanner := bufio.NewScanner(l2cap.stdoutPipe)
+	for scanner.Scan() {
+		buf := scanner.Text()
+		err := l2cap.ParseStdout(buf)
+		if err != nil {
+			l2cap.device.log().Error("bleno l2cap-ble output", "pid", pid(l2cap.command), "error", err)
+		}
+	}
+
+	l2cap.command.Wait()
+	close(l2cap.exited)
+	l2cap.disconnected()
+}
+
+func (l2cap *BLENO_L2CAP_BLE) ParseStdout(buf string) error {
+	switch {
+	case acceptRegex.MatchString(buf):
+		tmp := acceptRegex.FindStringSubmatch(buf)
+		l2cap.disconnected()
+
+		c := newCentral(l2cap.device, l2cap, tmp[1])
+		l2cap.mu.Lock()
+		l2cap.central = c
+		l2cap.mu.Unlock()
+		go c.loop()
+
+		if l2cap.device.centralConnected != nil {
+			go l2cap.device.centralConnected(c)
+		}
+	case blenoDisconnectRegex.MatchString(buf):
+		l2cap.disconnected()
+	case dataRegex.MatchString(buf):
+		tmp := dataRegex.FindStringSubmatch(buf)
+		b, err := StringToByte(tmp[1])
+		if err != nil {
+			return fmt.Errorf("invalid data line: %s", buf)
+		}
+		l2cap.mu.Lock()
+		c := l2cap.central
+		l2cap.mu.Unlock()
+		if c == nil {
+			return fmt.Errorf("data without central: %s", buf)
+		}
+		l2cap.device.trace(c.address, DirectionReceived, b)
+		c.datac <- b
+	case rssiUpdateRegex.MatchString(buf):
+		tmp := rssiUpdateRegex.FindStringSubmatch(buf)
+		l2cap.device.log().Debug("central rssi", "pid", pid(l2cap.command), "rssi", tmp[1])
+	case blenoSecurityRegex.MatchString(buf):
+		tmp := blenoSecurityRegex.FindStringSubmatch(buf)
+		l2cap.device.log().Debug("central security", "pid", pid(l2cap.command), "security", tmp[1])
+	default:
+		return fmt.Errorf("unknown stdout: %s", buf)
+	}
+	return nil
+}
+
+// disconnected ends the current central, if any.
+func (l2cap *BLENO_L2CAP_BLE) disconnected() {
+	l2cap.mu.Lock()
+	c := l2cap.central
+	l2cap.central = nil
+	l2cap.mu.Unlock()
+	if c == nil {
+		return
+	}
+
+	close(c.datac)
+	if l2cap.device.centralDisconnected != nil {
+		go l2cap.device.centralDisconnected(c)
+	}
+}
+
+// Write sends an ATT PDU to the central.
+func (l2cap *BLENO_L2CAP_BLE) Write(buf []byte) (int, error) {
+	data := strings.TrimSpace(ByteToString(buf)) + "\n"
+	l2cap.device.log().Debug("bleno l2cap write", "pid", pid(l2cap.command), "opcode", opcode(buf), "data", strings.TrimSpace(data))
+
+	l2cap.mu.Lock()
+	if c := l2cap.central; c != nil {
+		l2cap.device.trace(c.address, DirectionSent, buf)
+	}
+	l2cap.mu.Unlock()
+
+	_, err := io.WriteString(l2cap.stdinPipe, data)
+	if err != nil {
+		return -1, fmt.Errorf("bleno l2cap write err: %s", err)
+	}
+	return len(buf), nil
+}
+
+// Disconnect disconnects the current central.
+func (l2cap *BLENO_L2CAP_BLE) Disconnect() error {
+	return l2cap.command.Process.Signal(syscall.SIGHUP)
+}
+
+// UpdateRssi asks the RSSI of the current central.
+func (l2cap *BLENO_L2CAP_BLE) UpdateRssi() error {
+	return l2cap.command.Process.Signal(syscall.SIGUSR1)
+}
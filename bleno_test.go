@@ -0,0 +1,85 @@
+package noblechild
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+// lineBuffer is a stdin of a child which records the written lines.
+type lineBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lineBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+func (b *lineBuffer) Close() error { return nil }
+func (b *lineBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func Test_BlenoL2CAPParseStdout(t *testing.T) {
+	assert := assert.New(t)
+
+	connected := make(chan gatt.Central, 1)
+	disconnected := make(chan gatt.Central, 1)
+	d := &device{}
+	d.Handle(
+		CentralConnected(func(c gatt.Central) { connected <- c }),
+		CentralDisconnected(func(c gatt.Central) { disconnected <- c }),
+	)
+	stdin := &lineBuffer{}
+	l2cap := &BLENO_L2CAP_BLE{device: d, stdinPipe: stdin}
+
+	assert.Nil(l2cap.ParseStdout("accept 11:22:33:44:55:66"))
+	c := <-connected
+	assert.Equal("112233445566", c.ID())
+	assert.Equal(23, c.MTU())
+
+	// MTU exchange
+	assert.Nil(l2cap.ParseStdout("data 029e00"))
+	assert.Eventually(func() bool { return stdin.String() == "030502\n" }, time.Second, time.Millisecond)
+	assert.Equal(0x9e, c.MTU())
+
+	assert.Nil(l2cap.ParseStdout("rssiUpdate -60"))
+	assert.Nil(l2cap.ParseStdout("disconnect 11:22:33:44:55:66"))
+	assert.Equal(c, <-disconnected)
+
+	assert.NotNil(l2cap.ParseStdout("data 0a0300"))
+	assert.NotNil(l2cap.ParseStdout("unknown"))
+}
+
+func Test_nameAndServicesAdvertisement(t *testing.T) {
+	assert := assert.New(t)
+
+	adv, rsp := nameAndServicesAdvertisement("edison", []gatt.UUID{gatt.UUID16(0x180d)})
+	assert.Equal([]byte{
+		0x02, 0x01, 0x06,
+		0x03, 0x03, 0x0d, 0x18,
+		0x07, 0x09, 'e', 'd', 'i', 's', 'o', 'n',
+	}, adv)
+	assert.Nil(rsp)
+
+	// the name goes to the scan response when it does not fit
+	u := gatt.MustParseUUID("39e1fa0084a811e2afba0002a5d5c51b")
+	adv, rsp = nameAndServicesAdvertisement("a long peripheral name", []gatt.UUID{u})
+	assert.Equal(3+18, len(adv))
+	assert.Equal(byte(adComplete128BitUUIDs), adv[4])
+	assert.Equal(byte(0x1b), adv[5])
+	assert.Equal(append([]byte{23, adCompleteName}, "a long peripheral name"...), rsp)
+
+	// services which do not fit are dropped and the list is incomplete
+	adv, _ = nameAndServicesAdvertisement("", []gatt.UUID{u, u})
+	assert.Equal(byte(adIncomplete128BitUUIDs), adv[4])
+	assert.True(len(adv) <= maxEIRPacketLength)
+}
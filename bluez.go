@@ -0,0 +1,936 @@
+package noblechild
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	gatt "github.com/paypal/gatt"
+)
+
+// The org.bluez D-Bus API used by the BlueZ backend.
+const (
+	bluezService       = "org.bluez"
+	bluezAdapter       = "org.bluez.Adapter1"
+	bluezDevice        = "org.bluez.Device1"
+	bluezGattService   = "org.bluez.GattService1"
+	bluezGattChar      = "org.bluez.GattCharacteristic1"
+	bluezGattDesc      = "org.bluez.GattDescriptor1"
+	dbusObjectManager  = "org.freedesktop.DBus.ObjectManager"
+	dbusProperties     = "org.freedesktop.DBus.Properties"
+	bluetoothBaseUUID  = "-0000-1000-8000-00805f9b34fb"
+	bluezManagedObject = "/"
+)
+
+// ErrBlueZConnect is returned by the BlueZ backend where an L2CAP_BLE is
+// asked for. Its peripherals are connected by bluetoothd.
+var ErrBlueZConnect = errors.New("bluez: connections are made by bluetoothd")
+
+// managedObjects is the result of GetManagedObjects.
+type managedObjects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+
+// bluez is the BlueZ backend. It drives bluetoothd over the system bus,
+// or DBUS_SYSTEM_BUS_ADDRESS, so nothing else talks to the adapter.
+type bluez struct {
+	device  *device
+	adapter dbus.ObjectPath
+
+	mu      sync.Mutex // protects the fields below
+	conn    *dbus.Conn // nil when closed
+	devices map[dbus.ObjectPath]map[string]dbus.Variant
+	conns   map[dbus.ObjectPath]*bluezPeripheral // connecting or connected
+	exited  chan struct{}
+}
+
+// newBlueZ connects to bluetoothd and checks the adapter given by
+// HCIDeviceID, hci0 by default.
+func newBlueZ(d *device) (backend, error) {
+	dev := d.hciDeviceID
+	if dev < 0 {
+		dev = 0
+	}
+	b := &bluez{
+		device:  d,
+		adapter: dbus.ObjectPath(fmt.Sprintf("/org/bluez/hci%d", dev)),
+		devices: map[dbus.ObjectPath]map[string]dbus.Variant{},
+		conns:   map[dbus.ObjectPath]*bluezPeripheral{},
+	}
+	conn, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return b, nil
+}
+
+func (b *bluez) open() (*dbus.Conn, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("bluez: %w", err)
+	}
+	if _, err := conn.Object(bluezService, b.adapter).GetProperty(bluezAdapter + ".Powered"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("bluez: %s: %w", b.adapter, err)
+	}
+	return conn, nil
+}
+
+// Init connects to the bus and reports whether the adapter is powered.
+func (b *bluez) Init() error {
+	conn, err := b.open()
+	if err != nil {
+		return err
+	}
+	for _, m := range []string{"InterfacesAdded", "InterfacesRemoved"} {
+		err = conn.AddMatchSignal(dbus.WithMatchSender(bluezService), dbus.WithMatchInterface(dbusObjectManager), dbus.WithMatchMember(m))
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("bluez: %w", err)
+		}
+	}
+	err = conn.AddMatchSignal(dbus.WithMatchSender(bluezService), dbus.WithMatchInterface(dbusProperties), dbus.WithMatchMember("PropertiesChanged"))
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("bluez: %w", err)
+	}
+	sigc := make(chan *dbus.Signal, 64)
+	conn.Signal(sigc)
+
+	b.mu.Lock()
+	old := b.conn
+	b.conn = conn
+	b.exited = make(chan struct{})
+	go b.loop(sigc, b.exited)
+	b.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	v, err := conn.Object(bluezService, b.adapter).GetProperty(bluezAdapter + ".Powered")
+	if err != nil {
+		return fmt.Errorf("bluez: %w", err)
+	}
+	b.setPowered(v)
+	return nil
+}
+
+func (b *bluez) setPowered(v dbus.Variant) {
+	if on, _ := v.Value().(bool); on {
+		b.device.setState(gatt.StatePoweredOn)
+	} else {
+		b.device.setState(gatt.StatePoweredOff)
+	}
+}
+
+// bus returns the connection, or an error if the backend is closed.
+func (b *bluez) bus() (*dbus.Conn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil, errors.New("bluez: not initialized")
+	}
+	return b.conn, nil
+}
+
+func (b *bluez) call(p dbus.ObjectPath, method string, args ...interface{}) *dbus.Call {
+	conn, err := b.bus()
+	if err != nil {
+		return &dbus.Call{Err: err}
+	}
+	return conn.Object(bluezService, p).Call(method, 0, args...)
+}
+
+func (b *bluez) startScan(dup bool) error {
+	filter := map[string]dbus.Variant{
+		"Transport":     dbus.MakeVariant("le"),
+		"DuplicateData": dbus.MakeVariant(dup),
+	}
+	if err := b.call(b.adapter, bluezAdapter+".SetDiscoveryFilter", filter).Err; err != nil {
+		return fmt.Errorf("bluez: %w", err)
+	}
+	if err := b.call(b.adapter, bluezAdapter+".StartDiscovery").Err; err != nil {
+		return fmt.Errorf("bluez: %w", err)
+	}
+	return nil
+}
+
+func (b *bluez) StopScan() error {
+	if err := b.call(b.adapter, bluezAdapter+".StopDiscovery").Err; err != nil {
+		return fmt.Errorf("bluez: %w", err)
+	}
+	return nil
+}
+
+// Close disconnects the peripherals and closes the connection to the bus.
+func (b *bluez) Close() error {
+	b.mu.Lock()
+	conn, exited := b.conn, b.exited
+	ps := make([]*bluezPeripheral, 0, len(b.conns))
+	for _, p := range b.conns {
+		ps = append(ps, p)
+	}
+	b.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+
+	b.StopScan()
+	for _, p := range ps {
+		b.cancelConnection(p)
+	}
+
+	b.mu.Lock()
+	b.conn = nil
+	b.mu.Unlock()
+	err := conn.Close()
+	<-exited
+	return err
+}
+
+func (b *bluez) newL2CAP(address, addressType string) (*L2CAP_BLE, error) {
+	return nil, ErrBlueZConnect
+}
+
+func (b *bluez) loop(sigc chan *dbus.Signal, exited chan struct{}) {
+	defer close(exited)
+	for s := range sigc {
+		b.handle(s)
+	}
+}
+
+func (b *bluez) handle(s *dbus.Signal) {
+	switch s.Name {
+	case dbusObjectManager + ".InterfacesAdded":
+		var p dbus.ObjectPath
+		var ifaces map[string]map[string]dbus.Variant
+		if dbus.Store(s.Body, &p, &ifaces) != nil {
+			return
+		}
+		if props, ok := ifaces[bluezDevice]; ok && b.owns(p) {
+			b.deviceChanged(p, props)
+		}
+	case dbusObjectManager + ".InterfacesRemoved":
+		var p dbus.ObjectPath
+		var ifaces []string
+		if dbus.Store(s.Body, &p, &ifaces) != nil {
+			return
+		}
+		b.mu.Lock()
+		delete(b.devices, p)
+		b.mu.Unlock()
+	case dbusProperties + ".PropertiesChanged":
+		var iface string
+		var changed map[string]dbus.Variant
+		var invalidated []string
+		if dbus.Store(s.Body, &iface, &changed, &invalidated) != nil {
+			return
+		}
+		switch iface {
+		case bluezAdapter:
+			if v, ok := changed["Powered"]; ok && s.Path == b.adapter {
+				b.setPowered(v)
+			}
+		case bluezDevice:
+			if b.owns(s.Path) {
+				b.deviceChanged(s.Path, changed)
+			}
+		case bluezGattChar:
+			if v, ok := changed["Value"]; ok {
+				b.notified(s.Path, v)
+			}
+		}
+	}
+}
+
+// owns reports whether p is a device of the adapter.
+func (b *bluez) owns(p dbus.ObjectPath) bool {
+	return strings.HasPrefix(string(p), string(b.adapter)+"/")
+}
+
+// deviceChanged merges the changed properties of the device at p. New
+// advertising data is reported as an advertisement.
+func (b *bluez) deviceChanged(p dbus.ObjectPath, changed map[string]dbus.Variant) {
+	b.mu.Lock()
+	props, ok := b.devices[p]
+	if !ok {
+		props = map[string]dbus.Variant{}
+		b.devices[p] = props
+	}
+	for k, v := range changed {
+		props[k] = v
+	}
+	merged := make(map[string]dbus.Variant, len(props))
+	for k, v := range props {
+		merged[k] = v
+	}
+	bp := b.conns[p]
+	b.mu.Unlock()
+
+	if bp != nil {
+		if v, ok := changed["ServicesResolved"]; ok {
+			if resolved, _ := v.Value().(bool); resolved {
+				bp.resolvedOnce.Do(func() { close(bp.resolved) })
+			}
+		}
+		if v, ok := changed["Connected"]; ok {
+			if connected, _ := v.Value().(bool); !connected {
+				b.disconnected(bp)
+			}
+		}
+	}
+
+	_, rssi := changed["RSSI"]
+	_, md := changed["ManufacturerData"]
+	_, sd := changed["ServiceData"]
+	if !rssi && !md && !sd {
+		return
+	}
+	if _, ok := merged["RSSI"]; !ok {
+		return
+	}
+	e, err := bluezEvent(merged)
+	if err != nil {
+		b.device.log().Error("invalid bluez device", "path", p, "error", err)
+		return
+	}
+	b.device.handleEvent(e)
+}
+
+// bluezEvent makes an HCIEvent from the properties of a Device1. The
+// advertising data is rebuilt from them, as bluetoothd does not give it.
+func bluezEvent(props map[string]dbus.Variant) (HCIEvent, error) {
+	var e HCIEvent
+	addr, _ := props["Address"].Value().(string)
+	if addr == "" {
+		return e, errors.New("no address")
+	}
+	e.Address = strings.ToLower(strings.Replace(addr, ":", "", -1))
+	e.AddressType, _ = props["AddressType"].Value().(string)
+	if e.AddressType == "" {
+		e.AddressType = "public"
+	}
+	if v, ok := props["RSSI"].Value().(int16); ok {
+		e.RSSI = int(v)
+	}
+
+	var f advFields
+	f.name, _ = props["Name"].Value().(string)
+	if tx, ok := props["TxPower"].Value().(int16); ok {
+		t := int(tx)
+		f.txPower = &t
+	}
+	ss, _ := props["UUIDs"].Value().([]string)
+	for _, s := range ss {
+		u, err := bluezUUID(s)
+		if err != nil {
+			return e, err
+		}
+		f.uuids = append(f.uuids, u)
+	}
+	if mds, ok := props["ManufacturerData"].Value().(map[uint16]dbus.Variant); ok {
+		ids := make([]int, 0, len(mds))
+		for id := range mds {
+			ids = append(ids, int(id))
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			data, _ := mds[uint16(id)].Value().([]byte)
+			f.manufacturer = append(f.manufacturer, append([]byte{byte(id), byte(id >> 8)}, data...))
+		}
+	}
+	if sds, ok := props["ServiceData"].Value().(map[string]dbus.Variant); ok {
+		keys := make([]string, 0, len(sds))
+		for k := range sds {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			u, err := bluezUUID(k)
+			if err != nil {
+				return e, err
+			}
+			data, _ := sds[k].Value().([]byte)
+			f.serviceData = append(f.serviceData, gatt.ServiceData{UUID: u, Data: data})
+		}
+	}
+
+	eir := f.eir()
+	e.EIR = hex.EncodeToString(eir)
+	return e, e.setEIR(eir)
+}
+
+// bluezUUID parses a UUID given by bluetoothd. UUIDs of the Bluetooth
+// base are shortened to 16 bits.
+func bluezUUID(s string) (gatt.UUID, error) {
+	s = strings.ToLower(s)
+	if len(s) == 36 && strings.HasPrefix(s, "0000") && strings.HasSuffix(s, bluetoothBaseUUID) {
+		s = s[4:8]
+	}
+	return gatt.ParseUUID(s)
+}
+
+// bluezHandle returns the handle in the last element of a GATT object
+// path, e.g. 0x000b of .../service000a/char000b.
+func bluezHandle(p dbus.ObjectPath) (uint16, error) {
+	base := path.Base(string(p))
+	if len(base) < 4 {
+		return 0, fmt.Errorf("no handle in %s", p)
+	}
+	h, err := strconv.ParseUint(base[len(base)-4:], 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("no handle in %s", p)
+	}
+	return uint16(h), nil
+}
+
+// bluezProps maps the flags of a GattCharacteristic1 to properties.
+var bluezProps = map[string]gatt.Property{
+	"broadcast":                   gatt.CharBroadcast,
+	"read":                        gatt.CharRead,
+	"write-without-response":      gatt.CharWriteNR,
+	"write":                       gatt.CharWrite,
+	"notify":                      gatt.CharNotify,
+	"indicate":                    gatt.CharIndicate,
+	"authenticated-signed-writes": gatt.CharSignedWrite,
+	"extended-properties":         gatt.CharExtended,
+}
+
+func (b *bluez) newPeripheral(e *HCIEvent) gatt.Peripheral {
+	return &bluezPeripheral{
+		b:       b,
+		path:    b.devicePath(e.Address),
+		event:   e,
+		address: e.Address,
+		name:    e.Advertisement.LocalName,
+	}
+}
+
+// devicePath returns the object path of a device, e.g.
+// /org/bluez/hci0/dev_AA_BB_CC_DD_EE_FF.
+func (b *bluez) devicePath(address string) dbus.ObjectPath {
+	a := strings.ToUpper(AddrToCommaAddr(strings.ToLower(address)))
+	return b.adapter + dbus.ObjectPath("/dev_"+strings.Replace(a, ":", "_", -1))
+}
+
+// connect asks bluetoothd to connect p, and reports the result when its
+// services are resolved.
+func (b *bluez) connect(gp gatt.Peripheral) {
+	p, ok := gp.(*bluezPeripheral)
+	if !ok {
+		b.device.log().Error("not a bluez peripheral", "address", gp.ID())
+		return
+	}
+	b.mu.Lock()
+	if _, ok := b.conns[p.path]; ok {
+		b.mu.Unlock()
+		b.device.log().Info("already connected peripheral", "address", p.address)
+		return
+	}
+	p.resolved = make(chan struct{})
+	p.resolvedOnce = sync.Once{}
+	p.disconnectOnce = sync.Once{}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	b.conns[p.path] = p
+	conn := b.conn
+	b.mu.Unlock()
+
+	go func() {
+		ctx := p.ctx
+		if t := b.device.connectTimeoutOption(); t > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, t)
+			defer cancel()
+		}
+		err := b.waitConnected(ctx, conn, p)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = ErrConnectTimeout
+		} else if errors.Is(err, context.Canceled) {
+			err = ErrLocalHostTerminated
+		}
+		f := b.device.peripheralConnected
+		if err != nil {
+			b.forget(p)
+			b.device.stats().connectFailure()
+			b.call(p.path, bluezDevice+".Disconnect")
+			if f != nil {
+				b.device.dispatch(func() { f(p, err) })
+			}
+			return
+		}
+		// The connection is queued while p.mu is held, so that the
+		// disconnection, which waits for p.mu, is reported after it.
+		p.mu.Lock()
+		p.connected = true
+		if f != nil {
+			b.device.dispatch(func() { f(p, nil) })
+		}
+		p.mu.Unlock()
+	}()
+}
+
+func (b *bluez) waitConnected(ctx context.Context, conn *dbus.Conn, p *bluezPeripheral) error {
+	if conn == nil {
+		return errors.New("bluez: not initialized")
+	}
+	obj := conn.Object(bluezService, p.path)
+	if err := obj.CallWithContext(ctx, bluezDevice+".Connect", 0).Err; err != nil {
+		return err
+	}
+	if v, err := obj.GetProperty(bluezDevice + ".ServicesResolved"); err == nil {
+		if resolved, _ := v.Value().(bool); resolved {
+			return nil
+		}
+	}
+	select {
+	case <-p.resolved:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *bluez) cancelConnection(gp gatt.Peripheral) {
+	p, ok := gp.(*bluezPeripheral)
+	if !ok {
+		return
+	}
+	b.mu.Lock()
+	_, ok = b.conns[p.path]
+	b.mu.Unlock()
+	if !ok {
+		b.device.log().Info("no such peripheral connected", "address", p.address)
+		return
+	}
+	p.mu.Lock()
+	p.localClose = true
+	connected := p.connected
+	p.mu.Unlock()
+	if !connected {
+		// the connect goroutine reports the failure
+		p.cancel()
+		return
+	}
+	if err := b.call(p.path, bluezDevice+".Disconnect").Err; err != nil {
+		b.device.log().Error("bluez disconnect failed", "address", p.address, "error", err)
+	}
+	b.disconnected(p)
+}
+
+func (b *bluez) forget(p *bluezPeripheral) {
+	b.mu.Lock()
+	if b.conns[p.path] == p {
+		delete(b.conns, p.path)
+	}
+	b.mu.Unlock()
+}
+
+// disconnected reports the end of the connection of p once.
+func (b *bluez) disconnected(p *bluezPeripheral) {
+	p.mu.Lock()
+	connected, local := p.connected, p.localClose
+	p.connected = false
+	p.mu.Unlock()
+	if !connected {
+		return
+	}
+	p.disconnectOnce.Do(func() {
+		b.forget(p)
+		reason := ErrDisconnected
+		if local {
+			reason = ErrLocalHostTerminated
+		}
+		b.device.stats().disconnect(reason)
+		if f := b.device.peripheralDisconnected; f != nil {
+			b.device.dispatch(func() { f(p, reason) })
+		}
+	})
+}
+
+func (b *bluez) notified(charPath dbus.ObjectPath, v dbus.Variant) {
+	data, ok := v.Value().([]byte)
+	if !ok {
+		return
+	}
+	b.mu.Lock()
+	var f func([]byte)
+	for p, bp := range b.conns {
+		if strings.HasPrefix(string(charPath), string(p)+"/") {
+			f = bp.notifier(charPath)
+		}
+	}
+	b.mu.Unlock()
+	if f != nil {
+		if h, err := bluezHandle(charPath); err == nil {
+			b.device.stats().notification(h + 1)
+		}
+		go f(data)
+	}
+}
+
+// bluezPeripheral is a peripheral of the BlueZ backend. Its GATT
+// operations are D-Bus calls on the objects of bluetoothd.
+type bluezPeripheral struct {
+	b       *bluez
+	path    dbus.ObjectPath
+	event   *HCIEvent
+	address string
+	name    string
+
+	ctx            context.Context
+	cancel         context.CancelFunc
+	resolved       chan struct{} // closed when ServicesResolved
+	resolvedOnce   sync.Once
+	disconnectOnce sync.Once
+
+	mu         sync.Mutex // protects the fields below
+	connected  bool
+	localClose bool
+	svcs       []*gatt.Service
+	paths      map[interface{}]dbus.ObjectPath // of services, characteristics and descriptors
+	notify     map[dbus.ObjectPath]func([]byte)
+}
+
+func (p *bluezPeripheral) Device() gatt.Device { return p.b.device }
+func (p *bluezPeripheral) ID() string          { return strings.ToUpper(p.address) }
+func (p *bluezPeripheral) Name() string        { return p.name }
+
+func (p *bluezPeripheral) Services() []*gatt.Service {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.svcs
+}
+
+func (p *bluezPeripheral) notifier(charPath dbus.ObjectPath) func([]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.notify[charPath]
+}
+
+// objects returns the objects of interface iface whose property parent
+// is the object at parent, sorted by handle.
+func (p *bluezPeripheral) objects(iface, parent string, pp dbus.ObjectPath) ([]dbus.ObjectPath, map[dbus.ObjectPath]map[string]dbus.Variant, error) {
+	var objs managedObjects
+	err := p.b.call(bluezManagedObject, dbusObjectManager+".GetManagedObjects").Store(&objs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bluez: %w", err)
+	}
+	props := map[dbus.ObjectPath]map[string]dbus.Variant{}
+	var paths []dbus.ObjectPath
+	for op, ifaces := range objs {
+		pr, ok := ifaces[iface]
+		if !ok {
+			continue
+		}
+		if v, _ := pr[parent].Value().(dbus.ObjectPath); v != pp {
+			continue
+		}
+		paths = append(paths, op)
+		props[op] = pr
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i] < paths[j] })
+	return paths, props, nil
+}
+
+func (p *bluezPeripheral) pathOf(a interface{}) (dbus.ObjectPath, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	op, ok := p.paths[a]
+	if !ok {
+		return "", errors.New("bluez: attribute is not discovered")
+	}
+	return op, nil
+}
+
+func (p *bluezPeripheral) setPath(a interface{}, op dbus.ObjectPath) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paths == nil {
+		p.paths = map[interface{}]dbus.ObjectPath{}
+	}
+	p.paths[a] = op
+}
+
+// services returns every service of p, sorted by handle, with the paths
+// and the properties of the services. bluetoothd exports the secondary
+// services too.
+func (p *bluezPeripheral) services() ([]*gatt.Service, []dbus.ObjectPath, map[dbus.ObjectPath]map[string]dbus.Variant, error) {
+	paths, props, err := p.objects(bluezGattService, "Device", p.path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var all []*gatt.Service
+	for _, op := range paths {
+		u, err := bluezUUID(stringProp(props[op], "UUID"))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		h, err := bluezHandle(op)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		s := gatt.NewService(u)
+		s.SetHandle(h)
+		if n := len(all); n > 0 {
+			all[n-1].SetEndHandle(h - 1)
+		}
+		s.SetEndHandle(0xffff)
+		p.setPath(s, op)
+		all = append(all, s)
+	}
+	return all, paths, props, nil
+}
+
+func (p *bluezPeripheral) DiscoverServices(ss []gatt.UUID) ([]*gatt.Service, error) {
+	all, paths, props, err := p.services()
+	if err != nil {
+		return nil, err
+	}
+	var ret []*gatt.Service
+	for i, s := range all {
+		if primary, ok := props[paths[i]]["Primary"].Value().(bool); ok && !primary {
+			continue
+		}
+		if len(ss) == 0 || IncludesUUID(s.UUID(), ss) {
+			ret = append(ret, s)
+		}
+	}
+	p.mu.Lock()
+	p.svcs = ret
+	p.mu.Unlock()
+	return ret, nil
+}
+
+// DiscoverIncludedServices returns the services in the Includes property
+// of s.
+func (p *bluezPeripheral) DiscoverIncludedServices(ss []gatt.UUID, s *gatt.Service) ([]*gatt.Service, error) {
+	sp, err := p.pathOf(s)
+	if err != nil {
+		return nil, err
+	}
+	all, paths, props, err := p.services()
+	if err != nil {
+		return nil, err
+	}
+	includes, _ := props[sp]["Includes"].Value().([]dbus.ObjectPath)
+	var ret []*gatt.Service
+	for _, op := range includes {
+		for i, is := range all {
+			if paths[i] == op && (len(ss) == 0 || IncludesUUID(is.UUID(), ss)) {
+				ret = append(ret, is)
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (p *bluezPeripheral) DiscoverCharacteristics(cs []gatt.UUID, s *gatt.Service) ([]*gatt.Characteristic, error) {
+	sp, err := p.pathOf(s)
+	if err != nil {
+		return nil, err
+	}
+	paths, props, err := p.objects(bluezGattChar, "Service", sp)
+	if err != nil {
+		return nil, err
+	}
+	var all []*gatt.Characteristic
+	for _, op := range paths {
+		u, err := bluezUUID(stringProp(props[op], "UUID"))
+		if err != nil {
+			return nil, err
+		}
+		h, err := bluezHandle(op)
+		if err != nil {
+			return nil, err
+		}
+		var prop gatt.Property
+		flags, _ := props[op]["Flags"].Value().([]string)
+		for _, f := range flags {
+			prop |= bluezProps[f]
+		}
+		c := gatt.NewCharacteristic(u, s, prop, h, h+1)
+		if n := len(all); n > 0 {
+			all[n-1].SetEndHandle(h - 1)
+		}
+		c.SetEndHandle(s.EndHandle())
+		p.setPath(c, op)
+		all = append(all, c)
+	}
+
+	var ret []*gatt.Characteristic
+	for _, c := range all {
+		if len(cs) == 0 || IncludesUUID(c.UUID(), cs) {
+			ret = append(ret, c)
+		}
+	}
+	s.SetCharacteristics(ret)
+	return ret, nil
+}
+
+func (p *bluezPeripheral) DiscoverDescriptors(ds []gatt.UUID, c *gatt.Characteristic) ([]*gatt.Descriptor, error) {
+	cp, err := p.pathOf(c)
+	if err != nil {
+		return nil, err
+	}
+	paths, props, err := p.objects(bluezGattDesc, "Characteristic", cp)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*gatt.Descriptor
+	for _, op := range paths {
+		u, err := bluezUUID(stringProp(props[op], "UUID"))
+		if err != nil {
+			return nil, err
+		}
+		h, err := bluezHandle(op)
+		if err != nil {
+			return nil, err
+		}
+		d := gatt.NewDescriptor(u, h, c)
+		p.setPath(d, op)
+		if u.Equal(attrClientCharacteristicConfigUUID) {
+			c.SetDescriptor(d)
+		}
+		if len(ds) == 0 || IncludesUUID(u, ds) {
+			ret = append(ret, d)
+		}
+	}
+	c.SetDescriptors(ret)
+	return ret, nil
+}
+
+func (p *bluezPeripheral) readValue(a interface{}, iface string) ([]byte, error) {
+	op, err := p.pathOf(a)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	start := time.Now()
+	err = p.b.call(op, iface+".ReadValue", map[string]dbus.Variant{}).Store(&b)
+	p.b.device.stats().attResult(attOpReadReq, err, time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("bluez: %w", err)
+	}
+	return b, nil
+}
+
+func (p *bluezPeripheral) writeValue(a interface{}, iface string, b []byte, opts map[string]dbus.Variant) error {
+	op, err := p.pathOf(a)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = p.b.call(op, iface+".WriteValue", b, opts).Err
+	if typ, _ := opts["type"].Value().(string); typ != "command" {
+		p.b.device.stats().attResult(attOpWriteReq, err, time.Since(start))
+	}
+	if err != nil {
+		return fmt.Errorf("bluez: %w", err)
+	}
+	return nil
+}
+
+func (p *bluezPeripheral) ReadCharacteristic(c *gatt.Characteristic) ([]byte, error) {
+	return p.readValue(c, bluezGattChar)
+}
+
+// ReadLongCharacteristic is ReadCharacteristic, as bluetoothd reads the
+// whole value.
+func (p *bluezPeripheral) ReadLongCharacteristic(c *gatt.Characteristic) ([]byte, error) {
+	return p.readValue(c, bluezGattChar)
+}
+
+func (p *bluezPeripheral) ReadDescriptor(d *gatt.Descriptor) ([]byte, error) {
+	return p.readValue(d, bluezGattDesc)
+}
+
+func (p *bluezPeripheral) WriteCharacteristic(c *gatt.Characteristic, b []byte, noRsp bool) error {
+	typ := "request"
+	if noRsp {
+		typ = "command"
+	}
+	return p.writeValue(c, bluezGattChar, b, map[string]dbus.Variant{"type": dbus.MakeVariant(typ)})
+}
+
+func (p *bluezPeripheral) WriteDescriptor(d *gatt.Descriptor, b []byte) error {
+	return p.writeValue(d, bluezGattDesc, b, map[string]dbus.Variant{})
+}
+
+// SetNotifyValue starts the notifications of c, or stops them if f is
+// nil. bluetoothd writes the CCCD.
+func (p *bluezPeripheral) SetNotifyValue(c *gatt.Characteristic, f func(*gatt.Characteristic, []byte, error)) error {
+	op, err := p.pathOf(c)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		p.mu.Lock()
+		delete(p.notify, op)
+		p.mu.Unlock()
+		if err := p.notifyCall(op, "StopNotify"); err != nil {
+			return fmt.Errorf("bluez: %w", err)
+		}
+		return nil
+	}
+	p.mu.Lock()
+	if p.notify == nil {
+		p.notify = map[dbus.ObjectPath]func([]byte){}
+	}
+	p.notify[op] = func(b []byte) { f(c, b, nil) }
+	p.mu.Unlock()
+	if err := p.notifyCall(op, "StartNotify"); err != nil {
+		p.mu.Lock()
+		delete(p.notify, op)
+		p.mu.Unlock()
+		return fmt.Errorf("bluez: %w", err)
+	}
+	return nil
+}
+
+// notifyCall calls StartNotify or StopNotify, which write the CCCD.
+func (p *bluezPeripheral) notifyCall(op dbus.ObjectPath, method string) error {
+	start := time.Now()
+	err := p.b.call(op, bluezGattChar+"."+method).Err
+	p.b.device.stats().attResult(attOpWriteReq, err, time.Since(start))
+	return err
+}
+
+// SetIndicateValue is SetNotifyValue; bluetoothd chooses indications when
+// c does not notify.
+func (p *bluezPeripheral) SetIndicateValue(c *gatt.Characteristic, f func(*gatt.Characteristic, []byte, error)) error {
+	return p.SetNotifyValue(c, f)
+}
+
+// ReadRSSI returns the last RSSI seen by bluetoothd, or -1.
+func (p *bluezPeripheral) ReadRSSI() int {
+	conn, err := p.b.bus()
+	if err != nil {
+		return -1
+	}
+	v, err := conn.Object(bluezService, p.path).GetProperty(bluezDevice + ".RSSI")
+	if err != nil {
+		return -1
+	}
+	rssi, ok := v.Value().(int16)
+	if !ok {
+		return -1
+	}
+	return int(rssi)
+}
+
+// SetMTU does nothing, as bluetoothd exchanges the MTU by itself.
+func (p *bluezPeripheral) SetMTU(mtu uint16) error {
+	return nil
+}
+
+func stringProp(props map[string]dbus.Variant, name string) string {
+	s, _ := props[name].Value().(string)
+	return s
+}
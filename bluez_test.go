@@ -0,0 +1,402 @@
+package noblechild
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	gatt "github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startTestBus runs a private bus and makes it the system bus of the test.
+func startTestBus(t *testing.T) string {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(conf, []byte(fmt.Sprintf(testBusConfig, filepath.Join(dir, "bus"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(daemon, "--config-file="+conf, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("dbus-daemon does not start: %s", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Skipf("dbus-daemon does not start: %s", err)
+	}
+	addr = strings.TrimSpace(addr)
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", addr)
+	return addr
+}
+
+const (
+	testAdapter = dbus.ObjectPath("/org/bluez/hci0")
+	testDevice  = testAdapter + "/dev_AA_BB_CC_DD_EE_FF"
+	testService = testDevice + "/service000a"
+	testBattery = testDevice + "/service0010" // included by testService
+	testChar    = testService + "/char000b"
+	testDesc    = testChar + "/desc000d"
+)
+
+// fakeBlueZ stands in for bluetoothd with one peripheral.
+type fakeBlueZ struct {
+	conn *dbus.Conn
+
+	mu          sync.Mutex
+	objects     managedObjects
+	values      map[dbus.ObjectPath][]byte
+	discovering bool
+	filter      map[string]dbus.Variant
+}
+
+func newFakeBlueZ(t *testing.T, addr string) *fakeBlueZ {
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	f := &fakeBlueZ{
+		conn: conn,
+		objects: managedObjects{
+			testAdapter: {bluezAdapter: {"Powered": dbus.MakeVariant(true)}},
+		},
+		values: map[dbus.ObjectPath][]byte{
+			testChar: {0x64},
+			testDesc: {0x00, 0x00},
+		},
+	}
+	conn.Export(fakeObjectManager{f}, "/", dbusObjectManager)
+	conn.Export(fakeAdapter{f}, testAdapter, bluezAdapter)
+	conn.Export(fakeDevice{f}, testDevice, bluezDevice)
+	conn.Export(fakeAttribute{f, testChar}, testChar, bluezGattChar)
+	conn.Export(fakeAttribute{f, testDesc}, testDesc, bluezGattDesc)
+	for _, p := range []dbus.ObjectPath{testAdapter, testDevice, testService, testBattery, testChar, testDesc} {
+		conn.Export(fakeProperties{f, p}, p, dbusProperties)
+	}
+	reply, err := conn.RequestName(bluezService, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("request name: %v %v", reply, err)
+	}
+	return f
+}
+
+func (f *fakeBlueZ) setProps(p dbus.ObjectPath, iface string, changed map[string]dbus.Variant) {
+	f.mu.Lock()
+	for k, v := range changed {
+		f.objects[p][iface][k] = v
+	}
+	f.mu.Unlock()
+	f.conn.Emit(p, dbusProperties+".PropertiesChanged", iface, changed, []string{})
+}
+
+type fakeObjectManager struct{ f *fakeBlueZ }
+
+func (m fakeObjectManager) GetManagedObjects() (managedObjects, *dbus.Error) {
+	m.f.mu.Lock()
+	defer m.f.mu.Unlock()
+	return m.f.objects, nil
+}
+
+type fakeProperties struct {
+	f *fakeBlueZ
+	p dbus.ObjectPath
+}
+
+func (p fakeProperties) Get(iface, name string) (dbus.Variant, *dbus.Error) {
+	p.f.mu.Lock()
+	defer p.f.mu.Unlock()
+	v, ok := p.f.objects[p.p][iface][name]
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("no property %s", name))
+	}
+	return v, nil
+}
+
+type fakeAdapter struct{ f *fakeBlueZ }
+
+func (a fakeAdapter) SetDiscoveryFilter(filter map[string]dbus.Variant) *dbus.Error {
+	a.f.mu.Lock()
+	a.f.filter = filter
+	a.f.mu.Unlock()
+	return nil
+}
+
+// StartDiscovery finds the peripheral with its GATT database.
+func (a fakeAdapter) StartDiscovery() *dbus.Error {
+	f := a.f
+	f.mu.Lock()
+	f.discovering = true
+	dev := map[string]dbus.Variant{
+		"Address":          dbus.MakeVariant("AA:BB:CC:DD:EE:FF"),
+		"AddressType":      dbus.MakeVariant("random"),
+		"Name":             dbus.MakeVariant("fake"),
+		"RSSI":             dbus.MakeVariant(int16(-42)),
+		"UUIDs":            dbus.MakeVariant([]string{"0000180f-0000-1000-8000-00805f9b34fb"}),
+		"ManufacturerData": dbus.MakeVariant(map[uint16]dbus.Variant{0x0059: dbus.MakeVariant([]byte{1, 2})}),
+		"Connected":        dbus.MakeVariant(false),
+		"ServicesResolved": dbus.MakeVariant(false),
+	}
+	f.objects[testDevice] = map[string]map[string]dbus.Variant{bluezDevice: dev}
+	f.objects[testService] = map[string]map[string]dbus.Variant{bluezGattService: {
+		"UUID":     dbus.MakeVariant("0000180f-0000-1000-8000-00805f9b34fb"),
+		"Device":   dbus.MakeVariant(testDevice),
+		"Primary":  dbus.MakeVariant(true),
+		"Includes": dbus.MakeVariant([]dbus.ObjectPath{testBattery}),
+	}}
+	f.objects[testBattery] = map[string]map[string]dbus.Variant{bluezGattService: {
+		"UUID":     dbus.MakeVariant("0000180a-0000-1000-8000-00805f9b34fb"),
+		"Device":   dbus.MakeVariant(testDevice),
+		"Primary":  dbus.MakeVariant(false),
+		"Includes": dbus.MakeVariant([]dbus.ObjectPath{}),
+	}}
+	f.objects[testChar] = map[string]map[string]dbus.Variant{bluezGattChar: {
+		"UUID":    dbus.MakeVariant("00002a19-0000-1000-8000-00805f9b34fb"),
+		"Service": dbus.MakeVariant(testService),
+		"Flags":   dbus.MakeVariant([]string{"read", "write", "notify"}),
+	}}
+	f.objects[testDesc] = map[string]map[string]dbus.Variant{bluezGattDesc: {
+		"UUID":           dbus.MakeVariant("00002902-0000-1000-8000-00805f9b34fb"),
+		"Characteristic": dbus.MakeVariant(testChar),
+	}}
+	f.mu.Unlock()
+	f.conn.Emit("/", dbusObjectManager+".InterfacesAdded", testDevice, map[string]map[string]dbus.Variant{bluezDevice: dev})
+	return nil
+}
+
+func (a fakeAdapter) StopDiscovery() *dbus.Error {
+	a.f.mu.Lock()
+	a.f.discovering = false
+	a.f.mu.Unlock()
+	return nil
+}
+
+type fakeDevice struct{ f *fakeBlueZ }
+
+func (d fakeDevice) Connect() *dbus.Error {
+	d.f.setProps(testDevice, bluezDevice, map[string]dbus.Variant{"Connected": dbus.MakeVariant(true)})
+	d.f.setProps(testDevice, bluezDevice, map[string]dbus.Variant{"ServicesResolved": dbus.MakeVariant(true)})
+	return nil
+}
+
+func (d fakeDevice) Disconnect() *dbus.Error {
+	d.f.setProps(testDevice, bluezDevice, map[string]dbus.Variant{
+		"Connected":        dbus.MakeVariant(false),
+		"ServicesResolved": dbus.MakeVariant(false),
+	})
+	return nil
+}
+
+type fakeAttribute struct {
+	f *fakeBlueZ
+	p dbus.ObjectPath
+}
+
+func (a fakeAttribute) ReadValue(opts map[string]dbus.Variant) ([]byte, *dbus.Error) {
+	a.f.mu.Lock()
+	defer a.f.mu.Unlock()
+	return a.f.values[a.p], nil
+}
+
+func (a fakeAttribute) WriteValue(b []byte, opts map[string]dbus.Variant) *dbus.Error {
+	a.f.mu.Lock()
+	defer a.f.mu.Unlock()
+	if typ, _ := opts["type"].Value().(string); typ == "command" {
+		b = append([]byte("command:"), b...)
+	}
+	a.f.values[a.p] = b
+	return nil
+}
+
+// StartNotify notifies the value once.
+func (a fakeAttribute) StartNotify() *dbus.Error {
+	go a.f.conn.Emit(a.p, dbusProperties+".PropertiesChanged", bluezGattChar,
+		map[string]dbus.Variant{"Value": dbus.MakeVariant([]byte{0x63})}, []string{})
+	return nil
+}
+
+func (a fakeAttribute) StopNotify() *dbus.Error { return nil }
+
+func Test_BlueZ(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeBlueZ(t, startTestBus(t))
+
+	m := NewMetrics()
+	d, err := NewDevice(SetBackend(BackendBlueZ), SetMetrics(m))
+	if !assert.Nil(err) {
+		return
+	}
+
+	discovered := make(chan gatt.Peripheral, 1)
+	connected := make(chan error, 1)
+	disconnected := make(chan error, 1)
+	d.Handle(
+		PeripheralDiscovered(func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+			assert.Equal("fake", a.LocalName)
+			assert.Equal([]gatt.UUID{gatt.UUID16(0x180f)}, a.Services)
+			assert.Equal(-42, rssi)
+			select {
+			case discovered <- p:
+			default:
+			}
+		}),
+		PeripheralConnected(func(p gatt.Peripheral, err error) { connected <- err }),
+		PeripheralDisconnected(func(p gatt.Peripheral, err error) { disconnected <- err }),
+	)
+	states := make(chan gatt.State, 1)
+	assert.Nil(d.Init(func(d gatt.Device, s gatt.State) { states <- s }))
+	defer d.Stop()
+	assert.Equal(gatt.StatePoweredOn, <-states)
+
+	d.Scan(nil, true)
+	var p gatt.Peripheral
+	select {
+	case p = <-discovered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not discovered")
+	}
+	assert.Equal("AABBCCDDEEFF", p.ID())
+	e, ok := DiscoveryEvent(p)
+	assert.True(ok)
+	assert.Equal("random", e.AddressType)
+	assert.Equal(uint16(0x0059), e.Manufacturers[0].CompanyID)
+	f.mu.Lock()
+	assert.True(f.discovering)
+	assert.Equal(true, f.filter["DuplicateData"].Value())
+	f.mu.Unlock()
+
+	d.Connect(p)
+	select {
+	case err := <-connected:
+		assert.Nil(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	ss, err := p.DiscoverServices(nil)
+	assert.Nil(err)
+	assert.Equal(1, len(ss))
+	assert.Equal("180f", ss[0].UUID().String())
+	assert.Equal(uint16(0x000a), ss[0].Handle())
+	assert.Equal(uint16(0x000f), ss[0].EndHandle())
+
+	// the secondary service is found through the primary one
+	is, err := p.DiscoverIncludedServices(nil, ss[0])
+	assert.Nil(err)
+	assert.Equal(1, len(is))
+	assert.Equal("180a", is[0].UUID().String())
+	assert.Equal(uint16(0x0010), is[0].Handle())
+	is, err = p.DiscoverIncludedServices([]gatt.UUID{gatt.UUID16(0x180f)}, ss[0])
+	assert.Nil(err)
+	assert.Empty(is)
+
+	cs, err := p.DiscoverCharacteristics(nil, ss[0])
+	assert.Nil(err)
+	assert.Equal(1, len(cs))
+	assert.Equal("2a19", cs[0].UUID().String())
+	assert.Equal(gatt.CharRead|gatt.CharWrite|gatt.CharNotify, cs[0].Properties())
+
+	ds, err := p.DiscoverDescriptors(nil, cs[0])
+	assert.Nil(err)
+	assert.Equal(1, len(ds))
+	assert.Equal(uint16(0x000d), ds[0].Handle())
+	assert.Equal(ds[0], cs[0].Descriptor())
+
+	b, err := p.ReadCharacteristic(cs[0])
+	assert.Nil(err)
+	assert.Equal([]byte{0x64}, b)
+	assert.Nil(p.WriteCharacteristic(cs[0], []byte{0x01}, false))
+	assert.Nil(p.WriteCharacteristic(cs[0], []byte{0x02}, true))
+	f.mu.Lock()
+	assert.Equal([]byte("command:\x02"), f.values[testChar])
+	f.mu.Unlock()
+	b, err = p.ReadDescriptor(ds[0])
+	assert.Nil(err)
+	assert.Equal([]byte{0, 0}, b)
+	assert.Equal(-42, p.ReadRSSI())
+
+	notified := make(chan []byte, 1)
+	assert.Nil(p.SetNotifyValue(cs[0], func(c *gatt.Characteristic, b []byte, err error) { notified <- b }))
+	select {
+	case b := <-notified:
+		assert.Equal([]byte{0x63}, b)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not notified")
+	}
+
+	// the write command is not timed; StartNotify writes the CCCD
+	var mb strings.Builder
+	m.WriteTo(&mb)
+	assert.Contains(mb.String(), `noblechild_att_request_duration_seconds_count{opcode="0x0a"} 2`)
+	assert.Contains(mb.String(), `noblechild_att_request_duration_seconds_count{opcode="0x12"} 2`)
+
+	d.CancelConnection(p)
+	select {
+	case err := <-disconnected:
+		assert.Equal(ErrLocalHostTerminated, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not disconnected")
+	}
+}
+
+func Test_bluezEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := bluezEvent(map[string]dbus.Variant{
+		"Address":     dbus.MakeVariant("AA:BB:CC:DD:EE:FF"),
+		"Name":        dbus.MakeVariant("hello"),
+		"RSSI":        dbus.MakeVariant(int16(-70)),
+		"TxPower":     dbus.MakeVariant(int16(-4)),
+		"UUIDs":       dbus.MakeVariant([]string{"0000feaa-0000-1000-8000-00805f9b34fb"}),
+		"ServiceData": dbus.MakeVariant(map[string]dbus.Variant{"0000feaa-0000-1000-8000-00805f9b34fb": dbus.MakeVariant([]byte{0x10})}),
+	})
+	assert.Nil(err)
+	assert.Equal("aabbccddeeff", e.Address)
+	assert.Equal("public", e.AddressType)
+	assert.Equal(-70, e.RSSI)
+	assert.Equal("060968656c6c6f020afc0303aafe0416aafe10", e.EIR)
+	assert.Equal("hello", e.Advertisement.LocalName)
+	assert.Equal(-4, e.Advertisement.TxPowerLevel)
+
+	_, err = bluezEvent(map[string]dbus.Variant{})
+	assert.NotNil(err)
+
+	h, err := bluezHandle(testDesc)
+	assert.Nil(err)
+	assert.Equal(uint16(0x000d), h)
+	_, err = bluezHandle(testDevice)
+	assert.NotNil(err)
+}
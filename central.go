@@ -0,0 +1,56 @@
+package noblechild
+
+import (
+	"io"
+	"strings"
+)
+
+// central is a remote device connected to us in the peripheral role. It
+// implements gatt.Central.
+type central struct {
+	d       *device
+	l2cap   *BLENO_L2CAP_BLE
+	address string
+
+	srv *ATTServer
+
+	datac chan []byte // ATT PDUs from the central; closed on disconnect
+}
+
+func newCentral(d *device, l2cap *BLENO_L2CAP_BLE, address string) *central {
+	c := &central{
+		d:       d,
+		l2cap:   l2cap,
+		address: strings.ToLower(strings.Replace(address, ":", "", -1)),
+		datac:   make(chan []byte),
+	}
+	c.srv = newATTServer(d, d.services(), d.attrs, c)
+	c.srv.Central = c
+	return c
+}
+
+func (c *central) ID() string   { return strings.ToUpper(c.address) }
+func (c *central) Close() error { return c.l2cap.Disconnect() }
+
+func (c *central) MTU() int { return c.srv.MTU() }
+
+// Read reads an ATT PDU sent by the central.
+func (c *central) Read(b []byte) (int, error) {
+	d, ok := <-c.datac
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, d), nil
+}
+
+// Write sends an ATT PDU to the central.
+func (c *central) Write(b []byte) (int, error) {
+	return c.l2cap.Write(b)
+}
+
+// loop serves the services of the device until the central disconnects.
+func (c *central) loop() {
+	if err := c.srv.Serve(); err != nil {
+		c.d.log().Error("central", "address", c.address, "error", err)
+	}
+}
@@ -0,0 +1,47 @@
+package noblechild
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// DefaultStopTimeout is how long a child process is given to exit after
+// SIGINT before it is killed.
+const DefaultStopTimeout = 3 * time.Second
+
+// stopProcess asks the child to exit with SIGINT and waits until exited is
+// closed. If the child is still alive after timeout, it is killed.
+func stopProcess(l Logger, p *os.Process, exited <-chan struct{}, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
+	}
+
+	err := p.Signal(syscall.SIGINT)
+	if errors.Is(err, os.ErrProcessDone) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	l.Warn("child did not exit, killing", "pid", p.Pid, "timeout", timeout)
+	err = p.Kill()
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("pid %d did not exit after SIGKILL", p.Pid)
+	}
+}
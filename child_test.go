@@ -0,0 +1,41 @@
+package noblechild
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startChild(t *testing.T, script string) (*exec.Cmd, chan struct{}) {
+	cmd := exec.Command("sh", "-c", script)
+	if err := cmd.Start(); err != nil {
+		t.Skipf("can not start sh: %s", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	return cmd, exited
+}
+
+func Test_stopProcess(t *testing.T) {
+	assert := assert.New(t)
+
+	// exits on SIGINT
+	cmd, exited := startChild(t, "sleep 10 & wait")
+	assert.Nil(stopProcess(NopLogger, cmd.Process, exited, time.Second))
+	<-exited
+
+	// ignores SIGINT, so it must be killed
+	cmd, exited = startChild(t, `trap "" INT; while :; do sleep 0.1; done`)
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	assert.Nil(stopProcess(NopLogger, cmd.Process, exited, 200*time.Millisecond))
+	assert.True(time.Since(start) >= 200*time.Millisecond)
+
+	// already finished
+	assert.Nil(stopProcess(NopLogger, cmd.Process, exited, time.Second))
+}
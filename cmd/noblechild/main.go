@@ -0,0 +1,248 @@
+// Command noblechild scans for BLE peripherals and reads, writes and
+// subscribes to their characteristics.
+//
+//	noblechild [global flags] scan [-json] [-name prefix] [-service uuid,...]
+//	noblechild [global flags] explore [-format text|json|yaml] <addr>
+//	noblechild [global flags] read <addr> <uuid|handle>
+//	noblechild [global flags] write <addr> <uuid|handle> <value>
+//	noblechild [global flags] subscribe <addr> <uuid|handle>
+//	noblechild [global flags] rssi <addr>
+//
+// Handles are given as 0x0012. The exit status is 0 on success, 1 when
+// the operation fails, 2 on a usage error, 3 when the peripheral or the
+// attribute is not found and 4 when the adapter is not powered on.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	gatt "github.com/paypal/gatt"
+	"github.com/shirou/noblechild"
+)
+
+// Exit statuses.
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+	exitAdapter  = 4
+)
+
+// exitErr is an error with the exit status it causes.
+type exitErr struct {
+	code int
+	err  error
+}
+
+func (e *exitErr) Error() string { return e.err.Error() }
+func (e *exitErr) Unwrap() error { return e.err }
+
+func failf(code int, format string, args ...interface{}) error {
+	return &exitErr{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// errUsage is returned when the arguments are wrong. The usage is already
+// printed.
+var errUsage = &exitErr{code: exitUsage, err: errors.New("usage")}
+
+// command is a subcommand.
+type command struct {
+	args  string
+	short string
+	run   func(ctx context.Context, c *cli, args []string) error
+}
+
+// commands is filled by init, as the commands refer to it for their usage.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"scan":      {"[flags]", "scan and print the advertisements", runScan},
+		"explore":   {"[flags] <addr>", "connect and dump the services, characteristics and descriptors", runExplore},
+		"read":      {"[flags] <addr> <uuid|handle>", "read a characteristic or a descriptor", runRead},
+		"write":     {"[flags] <addr> <uuid|handle> <value>", "write a characteristic or a descriptor", runWrite},
+		"subscribe": {"[flags] <addr> <uuid|handle>", "print the notifications of a characteristic", runSubscribe},
+		"rssi":      {"<addr>", "connect and print the RSSI", runRSSI},
+	}
+}
+
+// cli holds the global flags.
+type cli struct {
+	stdout, stderr io.Writer
+
+	backend string
+	hci     int
+	url     string
+	node    string
+	timeout time.Duration
+	verbose bool
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// run runs the command line args and returns the exit status.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	c := &cli{stdout: stdout, stderr: stderr}
+	fs := flag.NewFlagSet("noblechild", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&c.backend, "backend", "children", "children, socket, auto, bluez, node or websocket")
+	fs.IntVar(&c.hci, "hci", -1, "adapter index (hciN)")
+	fs.StringVar(&c.url, "url", "", "ws-slave URL of the websocket backend")
+	fs.StringVar(&c.node, "node", "", "node binary of the node backend")
+	fs.DurationVar(&c.timeout, "timeout", 10*time.Second, "how long to wait for the adapter, the peripheral and the connection")
+	fs.BoolVar(&c.verbose, "v", false, "log the device")
+	fs.Usage = func() { c.usage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		c.usage(fs)
+		return exitUsage
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "noblechild: unknown command %q\n", fs.Arg(0))
+		c.usage(fs)
+		return exitUsage
+	}
+
+	err := cmd.run(ctx, c, fs.Args()[1:])
+	if err == nil {
+		return exitOK
+	}
+	var e *exitErr
+	if errors.As(err, &e) {
+		if e != errUsage {
+			fmt.Fprintf(stderr, "noblechild %s: %s\n", fs.Arg(0), e.err)
+		}
+		return e.code
+	}
+	fmt.Fprintf(stderr, "noblechild %s: %s\n", fs.Arg(0), err)
+	return exitError
+}
+
+func (c *cli) usage(fs *flag.FlagSet) {
+	fmt.Fprintf(c.stderr, "usage: noblechild [global flags] <command> [arguments]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(c.stderr, "  %-10s %s\n", name, commands[name].short)
+	}
+	fmt.Fprintf(c.stderr, "\nglobal flags:\n")
+	fs.PrintDefaults()
+}
+
+// flags returns the flag set of a command, which prints its usage.
+func (c *cli) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "usage: noblechild %s %s\n", name, commands[name].args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the flags of a command, which takes n arguments.
+func parse(fs *flag.FlagSet, args []string, n int) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != n {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// newDevice opens the device given by the global flags.
+func (c *cli) newDevice(opts ...gatt.Option) (gatt.Device, error) {
+	b, err := noblechild.ParseBackend(c.backend)
+	if err != nil {
+		return nil, failf(exitUsage, "%s", err)
+	}
+	opts = append(opts, noblechild.SetBackend(b), noblechild.ConnectTimeout(c.timeout))
+	if c.hci >= 0 {
+		opts = append(opts, noblechild.HCIDeviceID(c.hci))
+	}
+	if c.url != "" {
+		opts = append(opts, noblechild.WebSocketURL(c.url))
+	}
+	if c.node != "" {
+		opts = append(opts, noblechild.NodePath(c.node))
+	}
+	if c.verbose {
+		l := log.New()
+		l.Out = c.stderr
+		l.Level = log.DebugLevel
+		opts = append(opts, noblechild.SetLogger(noblechild.LogrusLogger(l)))
+	} else {
+		opts = append(opts, noblechild.SetLogger(noblechild.NopLogger))
+	}
+
+	d, err := noblechild.NewDevice(opts...)
+	if err != nil {
+		return nil, failf(exitAdapter, "open device: %s", err)
+	}
+	return d, nil
+}
+
+// init initializes d and waits until the adapter is powered on.
+func (c *cli) init(ctx context.Context, d gatt.Device) error {
+	states := make(chan gatt.State, 8)
+	err := d.Init(func(d gatt.Device, s gatt.State) {
+		select {
+		case states <- s:
+		default:
+		}
+	})
+	if err != nil {
+		return failf(exitAdapter, "init device: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	for {
+		select {
+		case s := <-states:
+			switch s {
+			case gatt.StatePoweredOn:
+				return nil
+			case gatt.StateUnsupported, gatt.StateUnauthorized:
+				return failf(exitAdapter, "adapter is %s", s)
+			}
+		case <-ctx.Done():
+			return failf(exitAdapter, "adapter is not powered on")
+		}
+	}
+}
+
+// splitList splits a comma separated flag value.
+func splitList(s string) []string {
+	var ret []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
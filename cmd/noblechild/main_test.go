@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	gatt "github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_run(t *testing.T) {
+	assert := assert.New(t)
+
+	var stdout, stderr bytes.Buffer
+	ctx := context.Background()
+	assert.Equal(exitUsage, run(ctx, nil, &stdout, &stderr))
+	assert.Contains(stderr.String(), "subscribe")
+	assert.Equal(exitUsage, run(ctx, []string{"connect"}, &stdout, &stderr))
+	assert.Equal(exitUsage, run(ctx, []string{"-nope", "scan"}, &stdout, &stderr))
+	assert.Equal(exitUsage, run(ctx, []string{"read", "aabbccddeeff"}, &stdout, &stderr))
+	assert.Equal(exitUsage, run(ctx, []string{"read", "-format", "base64", "aabbccddeeff", "2a19"}, &stdout, &stderr))
+	assert.Equal(exitUsage, run(ctx, []string{"write", "aabbccddeeff", "2a19", "zz"}, &stdout, &stderr))
+	assert.Equal(exitUsage, run(ctx, []string{"rssi", "aabbcc"}, &stdout, &stderr))
+	assert.Equal(exitUsage, run(ctx, []string{"-backend", "usb", "rssi", "aabbccddeeff"}, &stdout, &stderr))
+	assert.Equal(exitUsage, run(ctx, []string{"scan", "-name-regexp", "("}, &stdout, &stderr))
+	assert.Empty(stdout.String())
+}
+
+func Test_parseValue(t *testing.T) {
+	assert := assert.New(t)
+
+	b, err := parseValue("0102ff", "hex")
+	assert.Nil(err)
+	assert.Equal([]byte{1, 2, 0xff}, b)
+	b, err = parseValue("0x01:02", "hex")
+	assert.Nil(err)
+	assert.Equal([]byte{1, 2}, b)
+	b, err = parseValue("on", "utf8")
+	assert.Nil(err)
+	assert.Equal([]byte("on"), b)
+	_, err = parseValue("012", "hex")
+	assert.NotNil(err)
+	_, err = parseValue("01", "base64")
+	assert.NotNil(err)
+
+	assert.Equal("6f6e", formatValue([]byte("on"), "hex"))
+	assert.Equal("on", formatValue([]byte("on"), "utf8"))
+	assert.Equal("ff", formatValue([]byte{0xff}, "utf8"))
+}
+
+func Test_parseTarget(t *testing.T) {
+	assert := assert.New(t)
+
+	tg, err := parseTarget("0x0012")
+	assert.Nil(err)
+	assert.Equal(target{handle: 0x12}, tg)
+	assert.Equal("0x0012", tg.String())
+	tg, err = parseTarget("2a19")
+	assert.Nil(err)
+	assert.True(tg.byUUID)
+	assert.True(tg.uuid.Equal(gatt.UUID16(0x2a19)))
+	_, err = parseTarget("0x")
+	assert.NotNil(err)
+	_, err = parseTarget("0x10000")
+	assert.NotNil(err)
+	_, err = parseTarget("battery")
+	assert.NotNil(err)
+
+	a, err := parseAddress("AA:BB:CC:DD:EE:FF")
+	assert.Nil(err)
+	assert.Equal("aabbccddeeff", a)
+	_, err = parseAddress("aa:bb")
+	assert.NotNil(err)
+}
+
+func Test_propString(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("read,notify", propString(gatt.CharRead|gatt.CharNotify))
+	assert.Equal("", propString(0))
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	gatt "github.com/paypal/gatt"
+	"github.com/shirou/noblechild"
+)
+
+// conn is a connected peripheral.
+type conn struct {
+	d gatt.Device
+	p gatt.Peripheral
+
+	// disconnected receives the error of the disconnection.
+	disconnected chan error
+}
+
+// close disconnects the peripheral and stops the device.
+func (cn *conn) close() {
+	cn.d.CancelConnection(cn.p)
+	cn.d.Stop()
+}
+
+// parseAddress checks a peripheral address, given as "AA:BB:CC:DD:EE:FF"
+// or "aabbccddeeff".
+func parseAddress(s string) (string, error) {
+	a := strings.Replace(s, ":", "", -1)
+	if b, err := hex.DecodeString(a); err != nil || len(b) != 6 {
+		return "", fmt.Errorf("invalid address: %q", s)
+	}
+	return strings.ToLower(a), nil
+}
+
+// connect scans for the peripheral at addr and connects to it.
+func (c *cli) connect(ctx context.Context, addr string) (*conn, error) {
+	addr, err := parseAddress(addr)
+	if err != nil {
+		return nil, failf(exitUsage, "%s", err)
+	}
+	d, err := c.newDevice(noblechild.ScanFilter(noblechild.FilterAllow(addr)))
+	if err != nil {
+		return nil, err
+	}
+
+	discovered := make(chan gatt.Peripheral, 1)
+	connected := make(chan error, 1)
+	cn := &conn{d: d, disconnected: make(chan error, 1)}
+	d.Handle(
+		noblechild.PeripheralDiscovered(func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+			select {
+			case discovered <- p:
+			default:
+			}
+		}),
+		noblechild.PeripheralConnected(func(p gatt.Peripheral, err error) {
+			select {
+			case connected <- err:
+			default:
+			}
+		}),
+		noblechild.PeripheralDisconnected(func(p gatt.Peripheral, err error) {
+			select {
+			case cn.disconnected <- err:
+			default:
+			}
+		}),
+	)
+	if err := c.init(ctx, d); err != nil {
+		d.Stop()
+		return nil, err
+	}
+
+	d.Scan(nil, false)
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case cn.p = <-discovered:
+	case <-timer.C:
+		d.Stop()
+		return nil, failf(exitNotFound, "%s not found", addr)
+	case <-ctx.Done():
+		d.Stop()
+		return nil, ctx.Err()
+	}
+	d.StopScanning()
+
+	// ConnectTimeout gives up the connection, this is only a safety net.
+	timer.Reset(c.timeout + time.Second)
+	d.Connect(cn.p)
+	select {
+	case err = <-connected:
+	case <-timer.C:
+		err = errors.New("timed out")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cn.close()
+		return nil, failf(exitError, "connect %s: %s", addr, err)
+	}
+	return cn, nil
+}
+
+// discover discovers every service, characteristic and descriptor.
+func discover(p gatt.Peripheral) ([]*gatt.Service, error) {
+	ss, err := p.DiscoverServices(nil)
+	if err != nil {
+		return nil, fmt.Errorf("discover services: %s", err)
+	}
+	for _, s := range ss {
+		cs, err := p.DiscoverCharacteristics(nil, s)
+		if err != nil {
+			return nil, fmt.Errorf("discover characteristics of %s: %s", s.UUID(), err)
+		}
+		for _, ch := range cs {
+			if _, err := p.DiscoverDescriptors(nil, ch); err != nil {
+				return nil, fmt.Errorf("discover descriptors of %s: %s", ch.UUID(), err)
+			}
+		}
+	}
+	return ss, nil
+}
+
+// target is a characteristic or a descriptor, given by UUID or by handle.
+type target struct {
+	handle uint16
+	uuid   gatt.UUID
+	byUUID bool
+}
+
+// parseTarget parses a UUID, or a handle such as 0x0012.
+func parseTarget(s string) (target, error) {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		h, err := strconv.ParseUint(s[2:], 16, 16)
+		if err != nil || h == 0 {
+			return target{}, fmt.Errorf("invalid handle: %q", s)
+		}
+		return target{handle: uint16(h)}, nil
+	}
+	u, err := gatt.ParseUUID(s)
+	if err != nil {
+		return target{}, fmt.Errorf("invalid UUID: %q", s)
+	}
+	return target{uuid: u, byUUID: true}, nil
+}
+
+func (t target) String() string {
+	if t.byUUID {
+		return t.uuid.String()
+	}
+	return fmt.Sprintf("0x%04x", t.handle)
+}
+
+// find returns the first characteristic or descriptor of ss matching t.
+// A handle matches the declaration or the value of a characteristic.
+func (t target) find(ss []*gatt.Service) (*gatt.Characteristic, *gatt.Descriptor) {
+	for _, s := range ss {
+		for _, c := range s.Characteristics() {
+			if t.byUUID && c.UUID().Equal(t.uuid) || !t.byUUID && (c.Handle() == t.handle || c.VHandle() == t.handle) {
+				return c, nil
+			}
+		}
+	}
+	for _, s := range ss {
+		for _, c := range s.Characteristics() {
+			for _, d := range c.Descriptors() {
+				if t.byUUID && d.UUID().Equal(t.uuid) || !t.byUUID && d.Handle() == t.handle {
+					return nil, d
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// lookup connects to addr and finds the attribute given by arg.
+func (c *cli) lookup(ctx context.Context, addr, arg string) (*conn, *gatt.Characteristic, *gatt.Descriptor, error) {
+	t, err := parseTarget(arg)
+	if err != nil {
+		return nil, nil, nil, failf(exitUsage, "%s", err)
+	}
+	cn, err := c.connect(ctx, addr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ss, err := discover(cn.p)
+	if err != nil {
+		cn.close()
+		return nil, nil, nil, err
+	}
+	ch, d := t.find(ss)
+	if ch == nil && d == nil {
+		cn.close()
+		return nil, nil, nil, failf(exitNotFound, "%s not found", t)
+	}
+	return cn, ch, d, nil
+}
+
+// parseValue parses a value given as hex ("0102", "01:02") or utf8.
+func parseValue(s, format string) ([]byte, error) {
+	switch format {
+	case "hex":
+		s = strings.NewReplacer(":", "", " ", "").Replace(strings.TrimPrefix(s, "0x"))
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex value: %s", err)
+		}
+		return b, nil
+	case "utf8":
+		return []byte(s), nil
+	}
+	return nil, fmt.Errorf("unknown format: %q", format)
+}
+
+// formatValue formats b as hex or utf8. Invalid UTF-8 is printed as hex.
+func formatValue(b []byte, format string) string {
+	if format == "utf8" && utf8.Valid(b) {
+		return string(b)
+	}
+	return hex.EncodeToString(b)
+}
+
+func validFormat(format string) error {
+	if format != "hex" && format != "utf8" {
+		return failf(exitUsage, "unknown format: %q", format)
+	}
+	return nil
+}
+
+var propNames = []struct {
+	p    gatt.Property
+	name string
+}{
+	{gatt.CharBroadcast, "broadcast"},
+	{gatt.CharRead, "read"},
+	{gatt.CharWriteNR, "write-without-response"},
+	{gatt.CharWrite, "write"},
+	{gatt.CharNotify, "notify"},
+	{gatt.CharIndicate, "indicate"},
+	{gatt.CharSignedWrite, "signed-write"},
+	{gatt.CharExtended, "extended"},
+}
+
+func propString(p gatt.Property) string {
+	var names []string
+	for _, n := range propNames {
+		if p&n.p != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func runExplore(ctx context.Context, c *cli, args []string) error {
+	fs := c.flags("explore")
+	format := fs.String("format", "text", "text, or a snapshot as json or yaml")
+	noValues := fs.Bool("no-values", false, "do not read the values")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" && *format != "yaml" {
+		return failf(exitUsage, "unknown format: %q", *format)
+	}
+	cn, err := c.connect(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer cn.close()
+	ss, err := discover(cn.p)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "json":
+		return noblechild.NewSnapshot(cn.p, !*noValues).WriteJSON(c.stdout)
+	case "yaml":
+		return noblechild.NewSnapshot(cn.p, !*noValues).WriteYAML(c.stdout)
+	}
+	w := c.stdout
+	fmt.Fprintf(w, "peripheral %s %s\n", cn.p.ID(), cn.p.Name())
+	for _, s := range ss {
+		fmt.Fprintf(w, "service %s handles 0x%04x-0x%04x\n", s.UUID(), s.Handle(), s.EndHandle())
+		for _, ch := range s.Characteristics() {
+			fmt.Fprintf(w, "  characteristic %s handle 0x%04x value 0x%04x [%s]\n",
+				ch.UUID(), ch.Handle(), ch.VHandle(), propString(ch.Properties()))
+			if ch.Properties()&gatt.CharRead != 0 && !*noValues {
+				if b, err := cn.p.ReadCharacteristic(ch); err != nil {
+					fmt.Fprintf(w, "    error: %s\n", err)
+				} else {
+					fmt.Fprintf(w, "    value: %s\n", hex.EncodeToString(b))
+				}
+			}
+			for _, d := range ch.Descriptors() {
+				fmt.Fprintf(w, "    descriptor %s handle 0x%04x\n", d.UUID(), d.Handle())
+				if *noValues {
+					continue
+				}
+				if b, err := cn.p.ReadDescriptor(d); err != nil {
+					fmt.Fprintf(w, "      error: %s\n", err)
+				} else {
+					fmt.Fprintf(w, "      value: %s\n", hex.EncodeToString(b))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func runRead(ctx context.Context, c *cli, args []string) error {
+	fs := c.flags("read")
+	format := fs.String("format", "hex", "print the value as hex or utf8")
+	if err := parse(fs, args, 2); err != nil {
+		return err
+	}
+	if err := validFormat(*format); err != nil {
+		return err
+	}
+	cn, ch, d, err := c.lookup(ctx, fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer cn.close()
+
+	var b []byte
+	if ch != nil {
+		b, err = cn.p.ReadLongCharacteristic(ch)
+	} else {
+		b, err = cn.p.ReadDescriptor(d)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, formatValue(b, *format))
+	return nil
+}
+
+func runWrite(ctx context.Context, c *cli, args []string) error {
+	fs := c.flags("write")
+	format := fs.String("format", "hex", "the value is hex or utf8")
+	noRsp := fs.Bool("no-response", false, "write a characteristic without response")
+	if err := parse(fs, args, 3); err != nil {
+		return err
+	}
+	b, err := parseValue(fs.Arg(2), *format)
+	if err != nil {
+		return failf(exitUsage, "%s", err)
+	}
+	cn, ch, d, err := c.lookup(ctx, fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer cn.close()
+
+	if ch != nil {
+		return cn.p.WriteCharacteristic(ch, b, *noRsp)
+	}
+	return cn.p.WriteDescriptor(d, b)
+}
+
+func runSubscribe(ctx context.Context, c *cli, args []string) error {
+	fs := c.flags("subscribe")
+	format := fs.String("format", "hex", "print the values as hex or utf8")
+	count := fs.Int("count", 0, "exit after `n` values, 0 for no limit")
+	duration := fs.Duration("duration", 0, "exit after this time, 0 until interrupted")
+	if err := parse(fs, args, 2); err != nil {
+		return err
+	}
+	if err := validFormat(*format); err != nil {
+		return err
+	}
+	cn, ch, _, err := c.lookup(ctx, fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer cn.close()
+	if ch == nil {
+		return failf(exitUsage, "%s is not a characteristic", fs.Arg(1))
+	}
+
+	values := make(chan []byte, 16)
+	f := func(_ *gatt.Characteristic, b []byte, err error) {
+		if err != nil {
+			return
+		}
+		select {
+		case values <- b:
+		default:
+		}
+	}
+	switch {
+	case ch.Properties()&gatt.CharNotify != 0:
+		err = cn.p.SetNotifyValue(ch, f)
+	case ch.Properties()&gatt.CharIndicate != 0:
+		err = cn.p.SetIndicateValue(ch, f)
+	default:
+		return failf(exitError, "%s does not notify nor indicate", ch.UUID())
+	}
+	if err != nil {
+		return err
+	}
+
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	for n := 0; *count == 0 || n < *count; n++ {
+		select {
+		case b := <-values:
+			fmt.Fprintln(c.stdout, formatValue(b, *format))
+		case err := <-cn.disconnected:
+			return fmt.Errorf("disconnected: %v", err)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+func runRSSI(ctx context.Context, c *cli, args []string) error {
+	fs := c.flags("rssi")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	cn, err := c.connect(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer cn.close()
+
+	rssi := cn.p.ReadRSSI()
+	if rssi == -1 {
+		return errors.New("RSSI is not available")
+	}
+	fmt.Fprintln(c.stdout, rssi)
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	gatt "github.com/paypal/gatt"
+	"github.com/shirou/noblechild"
+)
+
+// scanRecord is a line of scan -json.
+type scanRecord struct {
+	Time          time.Time            `json:"time"`
+	Address       string               `json:"address"`
+	AddressType   string               `json:"addressType,omitempty"`
+	RSSI          int                  `json:"rssi"`
+	Name          string               `json:"name,omitempty"`
+	TxPower       *int                 `json:"txPower,omitempty"`
+	Services      []string             `json:"services,omitempty"`
+	Manufacturers []manufacturerRecord `json:"manufacturers,omitempty"`
+	ServiceData   []serviceDataRecord  `json:"serviceData,omitempty"`
+}
+
+type manufacturerRecord struct {
+	CompanyID uint16 `json:"companyId"`
+	Data      string `json:"data"`
+}
+
+type serviceDataRecord struct {
+	UUID string `json:"uuid"`
+	Data string `json:"data"`
+}
+
+func newScanRecord(t time.Time, di noblechild.Discovered) scanRecord {
+	r := scanRecord{
+		Time:    t,
+		Address: di.Peripheral.ID(),
+		RSSI:    di.RSSI,
+	}
+	if e, ok := noblechild.DiscoveryEvent(di.Peripheral); ok {
+		r.AddressType = e.AddressType
+		for _, m := range e.Manufacturers {
+			r.Manufacturers = append(r.Manufacturers, manufacturerRecord{m.CompanyID, hex.EncodeToString(m.Data)})
+		}
+	}
+	if a := di.Advertisement; a != nil {
+		r.Name = a.LocalName
+		if a.TxPowerLevel != 0 {
+			tx := a.TxPowerLevel
+			r.TxPower = &tx
+		}
+		for _, u := range a.Services {
+			r.Services = append(r.Services, u.String())
+		}
+		for _, sd := range a.ServiceData {
+			r.ServiceData = append(r.ServiceData, serviceDataRecord{sd.UUID.String(), hex.EncodeToString(sd.Data)})
+		}
+	}
+	return r
+}
+
+// scanFilter builds the filter given by the flags of scan.
+func scanFilter(name, nameRegexp, services, companies, addresses string, minRSSI int) (noblechild.Filter, error) {
+	var fs []noblechild.Filter
+	if name != "" {
+		fs = append(fs, noblechild.FilterNamePrefix(name))
+	}
+	if nameRegexp != "" {
+		re, err := regexp.Compile(nameRegexp)
+		if err != nil {
+			return nil, fmt.Errorf("-name-regexp: %s", err)
+		}
+		fs = append(fs, noblechild.FilterNameRegexp(re))
+	}
+	if services != "" {
+		var uu []gatt.UUID
+		for _, s := range splitList(services) {
+			u, err := gatt.ParseUUID(s)
+			if err != nil {
+				return nil, fmt.Errorf("-service: %s", err)
+			}
+			uu = append(uu, u)
+		}
+		fs = append(fs, noblechild.FilterServices(uu...))
+	}
+	if companies != "" {
+		var ids []uint16
+		for _, s := range splitList(companies) {
+			id, err := strconv.ParseUint(s, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("-company: %s", err)
+			}
+			ids = append(ids, uint16(id))
+		}
+		fs = append(fs, noblechild.FilterCompanyID(ids...))
+	}
+	if addresses != "" {
+		fs = append(fs, noblechild.FilterAllow(splitList(addresses)...))
+	}
+	if minRSSI != 0 {
+		fs = append(fs, noblechild.FilterMinRSSI(minRSSI))
+	}
+	return noblechild.FilterAll(fs...), nil
+}
+
+func runScan(ctx context.Context, c *cli, args []string) error {
+	fs := c.flags("scan")
+	duration := fs.Duration("duration", 5*time.Second, "how long to scan, 0 until interrupted")
+	name := fs.String("name", "", "only names starting with `prefix`")
+	nameRegexp := fs.String("name-regexp", "", "only names matching `re`")
+	services := fs.String("service", "", "only advertisements with one of the comma separated service `uuids`")
+	companies := fs.String("company", "", "only manufacturer data of the comma separated company `ids`")
+	addresses := fs.String("address", "", "only the comma separated `addresses`")
+	minRSSI := fs.Int("min-rssi", 0, "only advertisements received at `dBm` or stronger")
+	dup := fs.Bool("dup", false, "print every advertisement, not only the first of each peripheral")
+	asJSON := fs.Bool("json", false, "print JSON lines")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	f, err := scanFilter(*name, *nameRegexp, *services, *companies, *addresses, *minRSSI)
+	if err != nil {
+		return failf(exitUsage, "%s", err)
+	}
+	policy := noblechild.ReportFirstSighting()
+	if *dup {
+		policy = noblechild.ReportEveryPacket()
+	}
+
+	d, err := c.newDevice(noblechild.ScanFilter(f), noblechild.SetReportPolicy(policy))
+	if err != nil {
+		return err
+	}
+	defer d.Stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	ch, err := noblechild.DiscoveredChan(ctx, d, 64, noblechild.OverflowDropOldest)
+	if err != nil {
+		return err
+	}
+	if err := c.init(ctx, d); err != nil {
+		return err
+	}
+	d.Scan(nil, *dup)
+
+	enc := json.NewEncoder(c.stdout)
+	found := 0
+	for di := range ch {
+		found++
+		r := newScanRecord(time.Now(), di)
+		if *asJSON {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(c.stdout, "%s %4d %s\n", r.Address, r.RSSI, r.Name)
+	}
+	d.StopScanning()
+	if found == 0 {
+		return failf(exitNotFound, "no peripheral found")
+	}
+	return nil
+}
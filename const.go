@@ -26,6 +26,11 @@ var (
 	attrServiceChangedUUID    = gatt.UUID16(0x2A05)
 )
 
+const (
+	defaultMTU = 23  // ATT_MTU for LE before an exchange
+	maxMTU     = 517 // the longest attribute value is 512 bytes
+)
+
 const (
 	gattCCCNotifyFlag   = 0x0001
 	gattCCCIndicateFlag = 0x0002
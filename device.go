@@ -3,8 +3,13 @@ package noblechild
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
-	log "github.com/Sirupsen/logrus"
 	gatt "github.com/paypal/gatt"
 )
 
@@ -12,6 +17,30 @@ var (
 	NotImplementedError = errors.New("not implemented")
 )
 
+// Disconnect reasons given to the PeripheralDisconnected handler. Use
+// errors.Is to match them.
+var (
+	// ErrRemoteUserTerminated means the remote device closed the connection.
+	ErrRemoteUserTerminated = errors.New("remote user terminated connection")
+	// ErrSupervisionTimeout means the link was lost, e.g. the remote device went out of range.
+	ErrSupervisionTimeout = errors.New("connection supervision timeout")
+	// ErrLocalHostTerminated means the connection was closed by CancelConnection or Stop.
+	ErrLocalHostTerminated = errors.New("connection terminated by local host")
+	// ErrChildExited means l2cap-ble, or the noble helper of BackendNode,
+	// exited without reporting a disconnect. It is wrapped with the name of
+	// the child.
+	ErrChildExited = errors.New("child process exited unexpectedly")
+	// ErrDisconnected is used when the reason is unknown. l2cap-ble prints
+	// no reason, so with BackendChildren a remote close and a supervision
+	// timeout are both ErrDisconnected; so are they with BackendBlueZ and
+	// BackendWebSocket. BackendSocket and BackendNode give the reasons
+	// above.
+	ErrDisconnected = errors.New("disconnected")
+	// ErrConnectTimeout is given to the PeripheralConnected handler when
+	// the connection was not established within the ConnectTimeout.
+	ErrConnectTimeout = errors.New("connect timeout")
+)
+
 type device struct {
 	stateChanged           func(d gatt.Device, s gatt.State)
 	centralConnected       func(c gatt.Central)
@@ -19,20 +48,100 @@ type device struct {
 	peripheralDiscovered   func(p gatt.Peripheral, a *gatt.Advertisement, rssi int)
 	peripheralConnected    func(p gatt.Peripheral, err error)
 	peripheralDisconnected func(p gatt.Peripheral, err error)
-
-	state  gatt.State
-	hci    *HCI_BLE
-	l2caps map[string]*L2CAP_BLE // peripheralUuid -> L2CAP_BLE
-
+	peripheralLost         func(di Discovery)
+	peripheralZoneChanged  func(di Discovery, from Zone)
+
+	state       gatt.State
+	backend     backend               // hci, or the socket backend
+	backendKind Backend               // given by SetBackend
+	hci         *HCI_BLE              // nil with the socket backend
+	l2caps      map[string]*L2CAP_BLE // peripheralUuid -> L2CAP_BLE
+
+	discoveries *registry
+	dispatcher  *dispatcher // runs the handlers of hci-ble events
+	scanFilter  Filter      // given by ScanFilter
+	filter      Filter      // scanFilter and the services given to Scan, nil passes all
+
+	mu      sync.Mutex // protects l2caps, stopped, sweepStop and the peripheral role
+	stopped bool
+	// sweepStop is closed by Stop to end the sweep started by Init.
+	sweepStop chan struct{}
+
+	// hciDeviceID is the adapter index given to the children as
+	// NOBLE_HCI_DEVICE_ID. -1 leaves the environment as it is.
+	hciDeviceID int
+
+	// nobleModules is found once by NewDevice and used by every child.
 	nobleModules NobleModule
+	// hciPath and l2capPath are given by NoblePaths.
+	hciPath   string
+	l2capPath string
+	// nobleSearchPaths are searched before DefaultNobleSearchPaths.
+	nobleSearchPaths []string
+	// nodePath is given by NodePath.
+	nodePath string
+	// wsURL is given by WebSocketURL.
+	wsURL string
+
+	// created is set when NewDevice returns. Some options can not be
+	// changed after that.
+	created bool
+	// given are the names of the options given to NewDevice.
+	given []string
+
+	// peripheral role
+	svcs           []*gatt.Service
+	attrs          *AttributeTable // values and handlers of svcs
+	blenoHCI       *BLENO_HCI_BLE
+	blenoL2CAP     *BLENO_L2CAP_BLE
+	blenoHCIPath   string // given by BlenoPaths
+	blenoL2CAPPath string
+
+	// optMu protects the options read by the child and dispatch
+	// goroutines, which can be changed by Option at any time.
+	optMu        sync.RWMutex
+	logger       Logger
+	tracer       func(TracePDU) // given by Trace
+	recorder     *Recorder      // given by Record
+	metrics      *Metrics       // given by SetMetrics
+	preferredMTU uint16         // exchanged after connect, 0 to keep the default
+	// stopTimeout is how long Stop waits for each child before killing it.
+	stopTimeout    time.Duration
+	connectTimeout time.Duration // 0 to wait forever
+	scanMode       ScanMode
+
+	// replay is set by NewReplayDevice. No child is started.
+	replay bool
 }
 
 func NewDevice(opts ...gatt.Option) (gatt.Device, error) {
 	d := device{
-		l2caps: map[string]*L2CAP_BLE{},
+		l2caps:      map[string]*L2CAP_BLE{},
+		discoveries: newRegistry(),
+		dispatcher:  newDispatcher(),
+		attrs:       NewAttributeTable(),
+		stopTimeout: DefaultStopTimeout,
+		hciDeviceID: -1,
+	}
+
+	err := d.Option(opts...)
+	if err != nil {
+		return &d, err
+	}
+	if err := d.checkGivenOptions(); err != nil {
+		return &d, err
 	}
 
-	noble, err := FindNobleModule()
+	d.backend, err = d.newBackend()
+	if err != nil {
+		return &d, err
+	}
+	if d.backend != nil {
+		d.created = true
+		return &d, nil
+	}
+
+	noble, err := d.findNobleModule()
 	if err != nil {
 		return &d, err
 	}
@@ -43,119 +152,456 @@ func NewDevice(opts ...gatt.Option) (gatt.Device, error) {
 		return &d, err
 	}
 	d.hci = hci
+	d.backend = hci
+	d.created = true
 
 	return &d, nil
 }
 
 func (d *device) Init(f func(gatt.Device, gatt.State)) error {
-	err := d.hci.Init()
-	if err != nil {
-		return err
+	// f is set first as the socket backend reports the state at once.
+	d.stateChanged = f
+	if !d.replay {
+		err := d.backend.Init()
+		if err != nil {
+			return err
+		}
 	}
 
+	if d.dispatcher != nil {
+		d.dispatcher.start()
+	}
+	d.mu.Lock()
+	d.stopped = false
+	if d.sweepStop == nil && d.discoveries != nil {
+		d.sweepStop = make(chan struct{})
+		go d.sweep(d.sweepStop)
+	}
+	d.mu.Unlock()
+
 	d.state = gatt.StatePoweredOn
-	d.stateChanged = f
 
 	return nil
 }
 
+// Stop terminates hci-ble and every l2cap-ble child. It closes all of them
+// even if some fail, and returns all the errors joined. Calling Stop again
+// does nothing.
 func (d *device) Stop() error {
-	err := d.hci.Close()
-	if err != nil {
-		return fmt.Errorf("device Stop failed: %s", err)
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return nil
 	}
-	d.state = gatt.StatePoweredOff
-	for uuid, l2cap := range d.l2caps {
-		err := l2cap.Close()
-		if err != nil {
-			return fmt.Errorf("device Stop l2cap failed: uuid:%s, %s", uuid, err)
-		}
+	d.stopped = true
+	if d.sweepStop != nil {
+		close(d.sweepStop)
+		d.sweepStop = nil
+	}
+	l2caps := d.l2caps
+	d.l2caps = map[string]*L2CAP_BLE{}
+	blenoHCI, blenoL2CAP := d.blenoHCI, d.blenoL2CAP
+	d.blenoHCI, d.blenoL2CAP = nil, nil
+	d.mu.Unlock()
+
+	if d.dispatcher != nil {
+		defer d.dispatcher.closeAll()
 	}
-	d.l2caps = nil
 
-	return nil
+	var (
+		errs []error
+		emu  sync.Mutex
+		wg   sync.WaitGroup
+	)
+	for uuid, l2cap := range l2caps {
+		wg.Add(1)
+		go func(uuid string, l2cap *L2CAP_BLE) {
+			defer wg.Done()
+			if err := l2cap.Close(); err != nil {
+				emu.Lock()
+				errs = append(errs, fmt.Errorf("device Stop l2cap failed: uuid:%s, %s", uuid, err))
+				emu.Unlock()
+			}
+		}(uuid, l2cap)
+	}
+	if d.backend != nil {
+		if err := d.backend.Close(); err != nil {
+			emu.Lock()
+			errs = append(errs, fmt.Errorf("device Stop failed: %s", err))
+			emu.Unlock()
+		}
+	}
+	if blenoL2CAP != nil {
+		if err := blenoL2CAP.Close(); err != nil {
+			emu.Lock()
+			errs = append(errs, fmt.Errorf("device Stop failed: %s", err))
+			emu.Unlock()
+		}
+	}
+	if blenoHCI != nil {
+		if err := blenoHCI.Close(); err != nil {
+			emu.Lock()
+			errs = append(errs, fmt.Errorf("device Stop failed: %s", err))
+			emu.Unlock()
+		}
+	}
+	wg.Wait()
+	d.state = gatt.StatePoweredOff
 
+	return errors.Join(errs...)
 }
 
+// AddService adds s to the services served in the peripheral role. The
+// values and handlers of its characteristics must be in the table given
+// by Attributes.
 func (d *device) AddService(s *gatt.Service) error {
-	return NotImplementedError
+	if err := d.attrs.check([]*gatt.Service{s}); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.svcs = append(d.svcs, s)
+	return nil
 }
 
 func (d *device) RemoveAllServices() error {
-	return NotImplementedError
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.svcs = nil
+	return nil
 }
 
+// SetServices sets the services served in the peripheral role, like
+// AddService.
 func (d *device) SetServices(s []*gatt.Service) error {
-	return NotImplementedError
+	if err := d.attrs.check(s); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.svcs = s
+	return nil
+}
+
+// setFilter sets the filter of a scan for the services ss.
+func (d *device) setFilter(ss []gatt.UUID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.filter = d.scanFilter
+	if len(ss) == 0 {
+		return
+	}
+	svcs := FilterServices(ss...)
+	if d.filter != nil {
+		d.filter = FilterAll(d.scanFilter, svcs)
+	} else {
+		d.filter = svcs
+	}
+}
+
+// passes reports whether e passes the filter of the current scan.
+func (d *device) passes(e *HCIEvent) bool {
+	d.mu.Lock()
+	f := d.filter
+	d.mu.Unlock()
+	return f == nil || f(e)
+}
+
+// services returns the services served in the peripheral role.
+func (d *device) services() []*gatt.Service {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.svcs
 }
 
+// Advertise advertises a as is. Use IBeaconPacket or the Eddystone
+// builders to make one.
 func (d *device) Advertise(a *gatt.AdvPacket) error {
-	return NotImplementedError
+	if a == nil {
+		return errors.New("nil advertising packet")
+	}
+	return d.advertise(advPacketBytes(a), nil)
 }
 
 func (d *device) AdvertiseNameAndServices(name string, uu []gatt.UUID) error {
-	return NotImplementedError
+	adv, scanRsp := nameAndServicesAdvertisement(name, uu)
+	return d.advertise(adv, scanRsp)
 }
 
 func (d *device) AdvertiseIBeaconData(b []byte) error {
-	return NotImplementedError
+	return d.Advertise(IBeaconDataPacket(b))
 }
 
 func (d *device) AdvertiseIBeacon(u gatt.UUID, major, minor uint16, pwr int8) error {
-	return NotImplementedError
+	a, err := IBeaconPacket(u, major, minor, pwr)
+	if err != nil {
+		return err
+	}
+	return d.Advertise(a)
 }
 
 func (d *device) StopAdvertising() error {
-	return NotImplementedError
+	d.mu.Lock()
+	hci := d.blenoHCI
+	d.mu.Unlock()
+	if hci == nil {
+		return nil
+	}
+	return hci.StopAdvertising()
+}
+
+// advertise starts the peripheral role if needed, and advertises.
+func (d *device) advertise(adv, scanRsp []byte) error {
+	if err := d.startPeripheralRole(); err != nil {
+		return err
+	}
+	return d.blenoHCI.StartAdvertising(adv, scanRsp)
+}
+
+// startPeripheralRole starts bleno's hci-ble and l2cap-ble unless they are
+// running already.
+func (d *device) startPeripheralRole() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return errors.New("device is stopped")
+	}
+	if d.blenoHCI != nil {
+		return nil
+	}
+
+	bleno, err := d.findBlenoModule()
+	if err != nil {
+		return err
+	}
+	hci, err := NewBlenoHCI(d, bleno.HCIPath)
+	if err != nil {
+		return err
+	}
+	if err := hci.Init(); err != nil {
+		return fmt.Errorf("bleno hci-ble start failed: %s", err)
+	}
+	l2cap, err := NewBlenoL2CAP(d, bleno.L2CAPPath)
+	if err != nil {
+		hci.Close()
+		return err
+	}
+	if err := l2cap.Init(); err != nil {
+		hci.Close()
+		return fmt.Errorf("bleno l2cap-ble start failed: %s", err)
+	}
+	d.blenoHCI = hci
+	d.blenoL2CAP = l2cap
+	return nil
 }
 
+// Scan starts scanning. Only advertisements with one of the services ss,
+// if given, and passing the ScanFilter are reported.
 func (d *device) Scan(ss []gatt.UUID, dup bool) {
-	err := d.hci.StartScan()
+	d.setFilter(ss)
+	if d.replay {
+		return
+	}
+
+	switch d.scanModeOption() {
+	case ScanModeFilterDuplicates:
+		dup = false
+	case ScanModeAllowDuplicates:
+		dup = true
+	}
+	err := d.backend.startScan(dup)
 	if err != nil {
-		log.Printf("start scan failed: %s", err)
+		d.log().Error("start scan failed", "error", err)
 	}
 }
 
 func (d *device) StopScanning() {
-	err := d.hci.StopScan()
+	if d.replay {
+		return
+	}
+	err := d.backend.StopScan()
 	if err != nil {
-		log.Printf("stop scan failed: %s", err)
+		d.log().Error("stop scan failed", "error", err)
 	}
 }
 
 func (d *device) Connect(p gatt.Peripheral) {
 	address := p.ID()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		d.log().Info("device is stopped, can not connect", "address", address)
+		return
+	}
 	l2cap, ok := d.l2caps[address]
 	if ok {
-		log.Printf("already connected perfipheral: %s", address)
+		d.log().Info("already connected peripheral", "address", address)
 		return
 	}
-	l2cap, err := NewL2CAP(d, d.nobleModules.L2CAPPath)
-	if err != nil {
-		log.Printf("l2cap start failed: %s", address)
+	d.stats().connectAttempt()
+	if pb, ok := d.backend.(peripheralBackend); ok {
+		pb.connect(p)
+		return
+	}
+	if d.replay {
+		d.replayL2CAPLocked(address)
 		return
 	}
-	addressType := "public"
-	err = l2cap.Init(address, addressType)
+	l2cap, err := d.backend.newL2CAP(address, d.addressType(address))
 	if err != nil {
-		log.Printf("l2cap init failed: %s", address)
+		d.log().Error("l2cap start failed", "address", address, "error", err)
 		return
 	}
 	d.l2caps[address] = l2cap
+
+	if t := d.connectTimeoutOption(); t > 0 {
+		l2cap.mu.Lock()
+		if !l2cap.connectReported {
+			l2cap.connectTimer = time.AfterFunc(t, func() {
+				if l2cap.connectResult(ErrConnectTimeout) {
+					l2cap.Close()
+				}
+			})
+		}
+		l2cap.mu.Unlock()
+	}
 }
 
 func (d *device) CancelConnection(p gatt.Peripheral) {
 	address := p.ID()
+	if pb, ok := d.backend.(peripheralBackend); ok {
+		pb.cancelConnection(p)
+		return
+	}
+
+	d.mu.Lock()
 	l2cap, ok := d.l2caps[address]
 	if !ok {
-		log.Printf("no such perfipheral id connected: %s", address)
+		d.mu.Unlock()
+		d.log().Info("no such peripheral connected", "address", address)
 		return
 	}
 	delete(d.l2caps, address)
+	d.mu.Unlock()
 
 	l2cap.Close()
 }
 
+// findNobleModule returns the binaries given by NoblePaths, or searches
+// them in nobleSearchPaths and DefaultNobleSearchPaths.
+func (d *device) findNobleModule() (NobleModule, error) {
+	if d.hciPath == "" && d.l2capPath == "" {
+		return FindNobleModuleIn(append(d.nobleSearchPaths, DefaultNobleSearchPaths()...)...)
+	}
+	return explicitModule(d.hciPath, d.l2capPath)
+}
+
+// findBlenoModule is findNobleModule for bleno.
+func (d *device) findBlenoModule() (NobleModule, error) {
+	if d.blenoHCIPath == "" && d.blenoL2CAPPath == "" {
+		return FindBlenoModuleIn(append(d.nobleSearchPaths, DefaultNobleSearchPaths()...)...)
+	}
+	return explicitModule(d.blenoHCIPath, d.blenoL2CAPPath)
+}
+
+// explicitModule checks the binaries given by an option.
+func explicitModule(hciPath, l2capPath string) (NobleModule, error) {
+	if hciPath == "" || l2capPath == "" {
+		return NobleModule{}, fmt.Errorf("both hci-ble and l2cap-ble paths are required")
+	}
+	if err := checkExecutable(hciPath); err != nil {
+		return NobleModule{}, fmt.Errorf("hci-ble: %s", err)
+	}
+	if err := checkExecutable(l2capPath); err != nil {
+		return NobleModule{}, fmt.Errorf("l2cap-ble: %s", err)
+	}
+	m := NobleModule{
+		Directory: filepath.Dir(hciPath),
+		HCIPath:   hciPath,
+		L2CAPPath: l2capPath,
+	}
+	return m, nil
+}
+
+// log returns the logger of the device.
+func (d *device) log() Logger {
+	if d == nil {
+		return defaultLogger
+	}
+	d.optMu.RLock()
+	defer d.optMu.RUnlock()
+	if d.logger == nil {
+		return defaultLogger
+	}
+	return d.logger
+}
+
+// exchangeMTU returns the MTU given by PreferredMTU, 0 if none.
+func (d *device) exchangeMTU() uint16 {
+	d.optMu.RLock()
+	defer d.optMu.RUnlock()
+	return d.preferredMTU
+}
+
+// connectTimeoutOption returns the timeout given by ConnectTimeout, 0 if
+// none.
+func (d *device) connectTimeoutOption() time.Duration {
+	d.optMu.RLock()
+	defer d.optMu.RUnlock()
+	return d.connectTimeout
+}
+
+// stopTimeoutOption returns the timeout given by StopTimeout.
+func (d *device) stopTimeoutOption() time.Duration {
+	d.optMu.RLock()
+	defer d.optMu.RUnlock()
+	return d.stopTimeout
+}
+
+// scanModeOption returns the mode given by SetScanMode.
+func (d *device) scanModeOption() ScanMode {
+	d.optMu.RLock()
+	defer d.optMu.RUnlock()
+	return d.scanMode
+}
+
+// childEnv returns the environment for the children of this device.
+func (d *device) childEnv() []string {
+	env := os.Environ()
+	if d.hciDeviceID < 0 {
+		return env
+	}
+	ret := make([]string, 0, len(env)+1)
+	for _, e := range env {
+		if !strings.HasPrefix(e, "NOBLE_HCI_DEVICE_ID=") {
+			ret = append(ret, e)
+		}
+	}
+	return append(ret, fmt.Sprintf("NOBLE_HCI_DEVICE_ID=%d", d.hciDeviceID))
+}
+
+// addressType returns the address type of a discovered peripheral, or
+// "public".
+func (d *device) addressType(address string) string {
+	di, ok := d.discoveries.get(strings.ToLower(address))
+	if !ok || di.Event.AddressType == "" {
+		return "public"
+	}
+	return di.Event.AddressType
+}
+
+// removeL2CAP forgets l2cap if it is still the connection of its address.
+func (d *device) removeL2CAP(l2cap *L2CAP_BLE) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for address, l := range d.l2caps {
+		if l == l2cap {
+			delete(d.l2caps, address)
+		}
+	}
+}
+
 /*
 func (d *device) SendHCIRawCommand(c cmd.CmdParam) ([]byte, error) {
 	return []byte{}, NotImplementedError
@@ -168,12 +614,33 @@ func (d *device) Handle(hh ...gatt.Handler) {
 		h(d)
 	}
 }
+
+// Option applies the options to the device. Only the options of this
+// package can be used; others return ErrUnsupportedOption. All the
+// options are applied and the errors are joined.
 func (d *device) Option(opts ...gatt.Option) error {
-	var err error
+	var errs []error
 	for _, opt := range opts {
-		err = opt(d)
+		if err := d.option(opt); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	return err
+	return errors.Join(errs...)
+}
+
+// option applies opt. Options of other gatt.Device implementations
+// type-assert their own device and panic, so that panic is recovered. Any
+// other panic is a bug and goes on.
+func (d *device) option(opt gatt.Option) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*runtime.TypeAssertionError); !ok {
+				panic(r)
+			}
+			err = fmt.Errorf("%w: %v", ErrUnsupportedOption, r)
+		}
+	}()
+	return opt(d)
 }
 
 func CentralConnected(f func(gatt.Central)) gatt.Handler {
@@ -191,3 +658,15 @@ func PeripheralConnected(f func(gatt.Peripheral, error)) gatt.Handler {
 func PeripheralDisconnected(f func(gatt.Peripheral, error)) gatt.Handler {
 	return func(d gatt.Device) { d.(*device).peripheralDisconnected = f }
 }
+
+// PeripheralLost is called when a discovered peripheral has not been seen
+// for the LostTimeout.
+func PeripheralLost(f func(Discovery)) gatt.Handler {
+	return func(d gatt.Device) { d.(*device).peripheralLost = f }
+}
+
+// PeripheralZoneChanged is called when a discovered peripheral moves to
+// another proximity zone. It needs the ProximityZones option.
+func PeripheralZoneChanged(f func(di Discovery, from Zone)) gatt.Handler {
+	return func(d gatt.Device) { d.(*device).peripheralZoneChanged = f }
+}
@@ -0,0 +1,270 @@
+package noblechild
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_deviceStopTwice(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &device{
+		l2caps: map[string]*L2CAP_BLE{
+			"AABBCCDDEEFF": &L2CAP_BLE{Address: "AABBCCDDEEFF"},
+		},
+		stopTimeout: DefaultStopTimeout,
+	}
+	assert.Nil(d.Stop())
+	assert.Nil(d.Stop())
+	assert.Equal(gatt.StatePoweredOff, d.state)
+	assert.NotNil(d.l2caps)
+
+	// must not panic after Stop
+	p := &peripheral{d: d, Address: "aabbccddeeff"}
+	d.Connect(p)
+	assert.Equal(0, len(d.l2caps))
+}
+
+func Test_deviceStopFailingChild(t *testing.T) {
+	assert := assert.New(t)
+
+	// The child answers a request nobody reads and waits for its stdin.
+	script := filepath.Join(t.TempDir(), "l2cap-ble")
+	err := os.WriteFile(script, []byte("#!/bin/sh\necho 'data 0b01'\necho 'data 0b02'\nexec cat >/dev/null\n"), 0755)
+	assert.Nil(err)
+
+	d := &device{l2caps: map[string]*L2CAP_BLE{}, stopTimeout: 200 * time.Millisecond}
+	var good []*L2CAP_BLE
+	for _, addr := range []string{"112233445566", "112233445577"} {
+		l2cap, _ := NewL2CAP(d, script)
+		assert.Nil(l2cap.Init(addr, "public"))
+		d.l2caps[addr] = l2cap
+		good = append(good, l2cap)
+	}
+
+	// A child which is never reaped does not exit for Stop.
+	cmd := exec.Command("sleep", "10")
+	assert.Nil(cmd.Start())
+	defer cmd.Wait()
+	bad, _ := NewL2CAP(d, "sleep")
+	bad.command = cmd
+	bad.stdinPipe = &lineBuffer{}
+	bad.stdoutPipe = io.NopCloser(strings.NewReader(""))
+	bad.exited = make(chan struct{})
+	d.l2caps["112233445588"] = bad
+
+	err = d.Stop()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "uuid:112233445588")
+	assert.NotContains(err.Error(), "uuid:112233445566")
+	assert.NotContains(err.Error(), "uuid:112233445577")
+	for _, l2cap := range good {
+		select {
+		case <-l2cap.exited:
+		default:
+			t.Errorf("l2cap-ble of %s is not stopped", l2cap.Address)
+		}
+	}
+	assert.Equal(gatt.StatePoweredOff, d.state)
+}
+
+func Test_deviceReadRSSI(t *testing.T) {
+	assert := assert.New(t)
+
+	// hci-ble reports one peripheral, l2cap-ble connects and prints the
+	// RSSI on SIGUSR1.
+	dir := t.TempDir()
+	hciPath := filepath.Join(dir, "hci-ble")
+	l2capPath := filepath.Join(dir, "l2cap-ble")
+	err := os.WriteFile(hciPath, []byte("#!/bin/sh\necho 'adapterState poweredOn'\necho 'event aa:bb:cc:dd:ee:ff,random,020106,-60'\nexec cat >/dev/null\n"), 0755)
+	assert.Nil(err)
+	err = os.WriteFile(l2capPath, []byte("#!/bin/sh\ntrap 'echo \"rssi = -55\"' USR1\necho 'connect success'\nwhile :; do sleep 0.05; done\n"), 0755)
+	assert.Nil(err)
+
+	d, err := NewDevice(NoblePaths(hciPath, l2capPath))
+	if !assert.Nil(err) {
+		return
+	}
+	discovered := make(chan gatt.Peripheral, 1)
+	connected := make(chan gatt.Peripheral, 1)
+	d.Handle(
+		PeripheralDiscovered(func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+			select {
+			case discovered <- p:
+			default:
+			}
+		}),
+		PeripheralConnected(func(p gatt.Peripheral, err error) {
+			assert.Nil(err)
+			connected <- p
+		}),
+	)
+	assert.Nil(d.Init(func(gatt.Device, gatt.State) {}))
+	defer d.Stop()
+
+	var p gatt.Peripheral
+	select {
+	case p = <-discovered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not discovered")
+	}
+	// not connected
+	assert.Equal(-1, p.ReadRSSI())
+
+	d.Connect(p)
+	var cp gatt.Peripheral
+	select {
+	case cp = <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+	assert.Equal(-55, cp.ReadRSSI())
+	assert.Equal(-55, p.ReadRSSI())
+}
+
+func Test_deviceOptionConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &device{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			d.log().Debug("running")
+			d.trace("112233445566", DirectionSent, []byte{0x0a})
+			d.record(ChildL2CAP, "112233445566", 1, DirIn, "0a")
+			d.stats().connectAttempt()
+			d.exchangeMTU()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		assert.Nil(d.Option(
+			SetLogger(NopLogger),
+			Trace(func(TracePDU) {}),
+			Record(nil),
+			SetMetrics(NewMetrics()),
+			PreferredMTU(185),
+		))
+	}
+	<-done
+}
+
+func Test_HCIDeviceID(t *testing.T) {
+	assert := assert.New(t)
+
+	d0 := &device{hciDeviceID: -1}
+	d1 := &device{hciDeviceID: -1}
+	assert.Nil(d0.Option(HCIDeviceID(0)))
+	assert.Nil(d1.Option(HCIDeviceID(1)))
+	assert.NotNil(d1.Option(HCIDeviceID(-1)))
+
+	assert.Contains(d0.childEnv(), "NOBLE_HCI_DEVICE_ID=0")
+	assert.Contains(d1.childEnv(), "NOBLE_HCI_DEVICE_ID=1")
+	assert.NotContains(d1.childEnv(), "NOBLE_HCI_DEVICE_ID=0")
+}
+
+func Test_deviceOption(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &device{hciDeviceID: -1}
+
+	// an option of another gatt.Device type-asserts its own device
+	foreign := func(gd gatt.Device) error {
+		_ = gd.(interface{ NotNoblechild() })
+		return nil
+	}
+	err := d.Option(foreign)
+	assert.True(errors.Is(err, ErrUnsupportedOption))
+
+	// other panics are bugs and are not hidden
+	assert.Panics(func() { d.Option(func(gatt.Device) error { panic("bug") }) })
+	// the device has no discovery registry
+	assert.NotNil(d.Option(LostTimeout(time.Second)))
+
+	assert.Nil(d.Option(PreferredMTU(185), ConnectTimeout(time.Second), SetScanMode(ScanModeAllowDuplicates)))
+	assert.Equal(uint16(185), d.preferredMTU)
+	assert.Equal(time.Second, d.connectTimeout)
+	assert.Equal(ScanModeAllowDuplicates, d.scanMode)
+
+	// all errors are returned
+	err = d.Option(PreferredMTU(10), ConnectTimeout(-1), SetLogger(nil))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "PreferredMTU")
+	assert.Contains(err.Error(), "ConnectTimeout")
+	assert.Contains(err.Error(), "Logger")
+
+	d.created = true
+	err = d.Option(HCIDeviceID(1))
+	assert.True(errors.Is(err, ErrOptionAfterNewDevice))
+	assert.Nil(d.Option(StopTimeout(time.Second)))
+}
+
+func Test_deviceChildExited(t *testing.T) {
+	assert := assert.New(t)
+
+	// l2cap-ble connects and exits without printing disconnect
+	dir := t.TempDir()
+	hciPath := filepath.Join(dir, "hci-ble")
+	l2capPath := filepath.Join(dir, "l2cap-ble")
+	err := os.WriteFile(hciPath, []byte("#!/bin/sh\necho 'adapterState poweredOn'\necho 'event aa:bb:cc:dd:ee:ff,random,020106,-60'\nexec cat >/dev/null\n"), 0755)
+	assert.Nil(err)
+	err = os.WriteFile(l2capPath, []byte("#!/bin/sh\necho 'connect success'\nsleep 0.2\nexit 1\n"), 0755)
+	assert.Nil(err)
+
+	d, err := NewDevice(NoblePaths(hciPath, l2capPath))
+	if !assert.Nil(err) {
+		return
+	}
+	discovered := make(chan gatt.Peripheral, 1)
+	disconnected := make(chan error, 1)
+	d.Handle(
+		PeripheralDiscovered(func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+			select {
+			case discovered <- p:
+			default:
+			}
+		}),
+		PeripheralDisconnected(func(p gatt.Peripheral, err error) { disconnected <- err }),
+	)
+	assert.Nil(d.Init(func(gatt.Device, gatt.State) {}))
+	defer d.Stop()
+
+	select {
+	case p := <-discovered:
+		d.Connect(p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not discovered")
+	}
+	select {
+	case err := <-disconnected:
+		assert.True(errors.Is(err, ErrChildExited))
+		assert.Contains(err.Error(), "l2cap-ble")
+	case <-time.After(5 * time.Second):
+		t.Fatal("not disconnected")
+	}
+}
+
+func Test_backendOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	// before or after SetBackend
+	_, err := NewDevice(PreferredMTU(185), SetBackend(BackendBlueZ))
+	assert.True(errors.Is(err, ErrUnsupportedOption))
+	_, err = NewDevice(SetBackend(BackendWebSocket), NoblePaths("hci-ble", "l2cap-ble"))
+	assert.True(errors.Is(err, ErrUnsupportedOption))
+
+	d := &device{backendKind: BackendNode}
+	assert.Nil(d.Option(NobleSearchPaths("node_modules")))
+	assert.True(errors.Is(d.Option(BlenoPaths("hci-ble", "l2cap-ble")), ErrUnsupportedOption))
+	assert.True(errors.Is(d.Option(PreferredMTU(185)), ErrUnsupportedOption))
+	assert.Nil(d.Option(ConnectTimeout(time.Second)))
+}
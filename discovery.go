@@ -0,0 +1,260 @@
+package noblechild
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+const (
+	// DefaultLostTimeout is how long a peripheral may be unseen before it
+	// is lost.
+	DefaultLostTimeout = 30 * time.Second
+	// DefaultMaxDiscoveries bounds the number of peripherals remembered.
+	DefaultMaxDiscoveries = 1024
+
+	// rssiHistoryLen is the number of RSSI samples kept per peripheral.
+	rssiHistoryLen = 32
+)
+
+// RSSISample is an RSSI reported at Time.
+type RSSISample struct {
+	Time time.Time
+	RSSI int
+}
+
+// Discovery is what is known about a peripheral seen by scanning.
+type Discovery struct {
+	Address   string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Seen is the number of advertisements received.
+	Seen int
+	// RSSI is the recent RSSI history, oldest first.
+	RSSI []RSSISample
+	// Interval is the smoothed interval between advertisements, 0 until
+	// two are received.
+	Interval time.Duration
+	// SmoothedRSSI is the RSSI smoothed by the filter given by SmoothRSSI,
+	// or the last RSSI without one.
+	SmoothedRSSI float64
+	// Zone is the proximity zone when ProximityZones is given.
+	Zone Zone
+	// Event is the last event of the peripheral.
+	Event HCIEvent
+
+	filter RSSIFilter
+
+	// the last report to PeripheralDiscovered
+	lastReport     time.Time
+	lastReportRSSI int
+	lastReportEIR  string
+}
+
+// sighting is the result of recording an event.
+type sighting struct {
+	e      HCIEvent    // the event with Count set
+	rssi   int         // the smoothed RSSI
+	report bool        // the ReportPolicy lets it be reported
+	zc     *zoneChange // the zone changed
+}
+
+// zoneChange is a change of the zone of a peripheral.
+type zoneChange struct {
+	di   Discovery
+	from Zone
+}
+
+// registry remembers the discovered peripherals. Peripherals which are not
+// seen for lostAfter are removed and reported as lost, and the least
+// recently seen one is evicted when there are more than max.
+type registry struct {
+	mu        sync.Mutex
+	m         map[string]*Discovery
+	lostAfter time.Duration // 0 never loses
+	max       int
+	now       func() time.Time
+
+	newFilter func() RSSIFilter // nil passes the RSSI as is
+	zones     *Zones            // nil does not classify
+	policy    ReportPolicy
+}
+
+func newRegistry() *registry {
+	return &registry{
+		m:         map[string]*Discovery{},
+		lostAfter: DefaultLostTimeout,
+		max:       DefaultMaxDiscoveries,
+		now:       time.Now,
+		policy:    ReportEvenEvents(),
+	}
+}
+
+// seen records e.
+func (r *registry) seen(e HCIEvent) sighting {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	di, ok := r.m[e.Address]
+	if !ok {
+		di = &Discovery{Address: e.Address, FirstSeen: now, LastSeen: now}
+		r.m[e.Address] = di
+		r.evict()
+	} else {
+		e.Count = di.Event.Count + 1
+		iv := now.Sub(di.LastSeen)
+		if di.Interval == 0 {
+			di.Interval = iv
+		} else {
+			di.Interval += (iv - di.Interval) / 8
+		}
+	}
+	di.LastSeen = now
+	di.Seen++
+	di.RSSI = append(di.RSSI, RSSISample{Time: now, RSSI: e.RSSI})
+	if len(di.RSSI) > rssiHistoryLen {
+		di.RSSI = append(di.RSSI[:0], di.RSSI[len(di.RSSI)-rssiHistoryLen:]...)
+	}
+	di.Event = e
+
+	di.SmoothedRSSI = float64(e.RSSI)
+	if r.newFilter != nil {
+		if di.filter == nil {
+			di.filter = r.newFilter()
+		}
+		di.SmoothedRSSI = di.filter.Filter(e.RSSI)
+	}
+
+	var zc *zoneChange
+	if r.zones != nil {
+		if z := r.zones.Classify(di.Zone, di.SmoothedRSSI); z != di.Zone {
+			from := di.Zone
+			di.Zone = z
+			zc = &zoneChange{di: di.copy(), from: from}
+		}
+	}
+	st := sighting{e: e, rssi: int(math.Round(di.SmoothedRSSI)), zc: zc}
+	st.report = r.policy(ReportState{
+		Event:      e,
+		RSSI:       st.rssi,
+		Now:        now,
+		Reported:   !di.lastReport.IsZero(),
+		LastReport: di.lastReport,
+		LastRSSI:   di.lastReportRSSI,
+		AdvChanged: di.lastReport.IsZero() || e.EIR != di.lastReportEIR,
+	})
+	if st.report {
+		di.lastReport = now
+		di.lastReportRSSI = st.rssi
+		di.lastReportEIR = e.EIR
+	}
+	return st
+}
+
+// evict removes the least recently seen peripherals over max.
+func (r *registry) evict() {
+	if r.max <= 0 || len(r.m) <= r.max {
+		return
+	}
+	all := make([]*Discovery, 0, len(r.m))
+	for _, di := range r.m {
+		all = append(all, di)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].LastSeen.Before(all[j].LastSeen) })
+	for _, di := range all[:len(all)-r.max] {
+		delete(r.m, di.Address)
+	}
+}
+
+// sweep removes and returns the lost peripherals.
+func (r *registry) sweep() []Discovery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lostAfter <= 0 {
+		return nil
+	}
+
+	var lost []Discovery
+	now := r.now()
+	for addr, di := range r.m {
+		if now.Sub(di.LastSeen) >= r.lostAfter {
+			delete(r.m, addr)
+			lost = append(lost, di.copy())
+		}
+	}
+	return lost
+}
+
+// sweepInterval is how often sweep should be called.
+func (r *registry) sweepInterval() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	iv := r.lostAfter / 4
+	if iv <= 0 || iv > 5*time.Second {
+		iv = 5 * time.Second
+	}
+	if iv < 100*time.Millisecond {
+		iv = 100 * time.Millisecond
+	}
+	return iv
+}
+
+// sweep reports the lost peripherals to the PeripheralLost handler until
+// stop is closed. It runs from Init to Stop, whatever the backend.
+func (d *device) sweep(stop <-chan struct{}) {
+	t := time.NewTimer(d.discoveries.sweepInterval())
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		for _, di := range d.discoveries.sweep() {
+			if d.peripheralLost != nil {
+				d.dispatch(func() { d.peripheralLost(di) })
+			}
+		}
+		t.Reset(d.discoveries.sweepInterval())
+	}
+}
+
+func (r *registry) get(addr string) (Discovery, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	di, ok := r.m[addr]
+	if !ok {
+		return Discovery{}, false
+	}
+	return di.copy(), true
+}
+
+func (r *registry) all() []Discovery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := make([]Discovery, 0, len(r.m))
+	for _, di := range r.m {
+		ret = append(ret, di.copy())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Address < ret[j].Address })
+	return ret
+}
+
+func (di *Discovery) copy() Discovery {
+	c := *di
+	c.RSSI = append([]RSSISample(nil), di.RSSI...)
+	return c
+}
+
+// Discoveries returns the peripherals remembered by d, sorted by address.
+func Discoveries(d gatt.Device) []Discovery {
+	dd, ok := d.(*device)
+	if !ok {
+		return nil
+	}
+	return dd.discoveries.all()
+}
@@ -0,0 +1,106 @@
+package noblechild
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time      { return c.t }
+func (c *fakeClock) add(d time.Duration) { c.t = c.t.Add(d) }
+
+func Test_registrySeen(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	r := newRegistry()
+	r.now = clock.now
+
+	e := r.seen(HCIEvent{Address: "aa", RSSI: -60}).e
+	assert.Equal(0, e.Count)
+	for i := 0; i < 40; i++ {
+		clock.add(100 * time.Millisecond)
+		e = r.seen(HCIEvent{Address: "aa", RSSI: -61 - i}).e
+	}
+	assert.Equal(40, e.Count)
+
+	di, ok := r.get("aa")
+	assert.True(ok)
+	assert.Equal(41, di.Seen)
+	assert.Equal(time.Unix(1000, 0), di.FirstSeen)
+	assert.Equal(clock.t, di.LastSeen)
+	assert.Equal(100*time.Millisecond, di.Interval)
+	assert.Equal(rssiHistoryLen, len(di.RSSI))
+	assert.Equal(-100, di.RSSI[len(di.RSSI)-1].RSSI)
+	assert.Equal(-69, di.RSSI[0].RSSI)
+	assert.Equal(-100, di.Event.RSSI)
+
+	// the interval is smoothed
+	clock.add(900 * time.Millisecond)
+	r.seen(HCIEvent{Address: "aa"})
+	di, _ = r.get("aa")
+	assert.Equal(200*time.Millisecond, di.Interval)
+}
+
+func Test_registrySweep(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	r := newRegistry()
+	r.now = clock.now
+	r.lostAfter = 10 * time.Second
+
+	r.seen(HCIEvent{Address: "aa"})
+	clock.add(5 * time.Second)
+	r.seen(HCIEvent{Address: "bb"})
+	assert.Nil(r.sweep())
+
+	clock.add(5 * time.Second)
+	lost := r.sweep()
+	assert.Equal(1, len(lost))
+	assert.Equal("aa", lost[0].Address)
+	_, ok := r.get("aa")
+	assert.False(ok)
+
+	// seen again, it starts over
+	e := r.seen(HCIEvent{Address: "aa"}).e
+	assert.Equal(0, e.Count)
+	assert.Equal(2, len(r.all()))
+
+	r.lostAfter = 0
+	clock.add(time.Hour)
+	assert.Nil(r.sweep())
+}
+
+func Test_registryEvict(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	r := newRegistry()
+	r.now = clock.now
+	r.max = 2
+
+	for _, addr := range []string{"aa", "bb", "aa", "cc"} {
+		clock.add(time.Second)
+		r.seen(HCIEvent{Address: addr})
+	}
+	all := r.all()
+	assert.Equal(2, len(all))
+	assert.Equal("aa", all[0].Address)
+	assert.Equal("cc", all[1].Address)
+}
+
+func Test_LostOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &device{discoveries: newRegistry()}
+	assert.Nil(d.Option(LostTimeout(time.Minute), MaxDiscoveries(10)))
+	assert.Equal(time.Minute, d.discoveries.lostAfter)
+	assert.Equal(10, d.discoveries.max)
+	assert.Equal(5*time.Second, d.discoveries.sweepInterval())
+	assert.NotNil(d.Option(MaxDiscoveries(0)))
+	assert.Equal(0, len(Discoveries(d)))
+}
@@ -0,0 +1,251 @@
+package noblechild
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"sync"
+
+	"github.com/paypal/gatt"
+)
+
+// dispatchQueueLen is the number of callbacks which can wait for the
+// dispatcher before parsing is blocked.
+const dispatchQueueLen = 256
+
+// Discovered is a discovery given to DiscoveredChan and DiscoveredSeq.
+type Discovered struct {
+	Peripheral    gatt.Peripheral
+	Advertisement *gatt.Advertisement
+	RSSI          int
+}
+
+// OverflowPolicy decides what happens when a discovery channel is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest drops the discovery which does not fit.
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest discovery in the channel.
+	OverflowDropOldest
+	// OverflowBlock waits for the reader. It delays the handlers and the
+	// other channels, and parsing once the queue is full.
+	OverflowBlock
+)
+
+// dispatcher runs the handlers and feeds the discovery channels on its own
+// goroutine, so slow handlers do not stall parsing of hci-ble output.
+type dispatcher struct {
+	q chan func()
+
+	mu   sync.Mutex // protects subs and done
+	subs map[*subscription]struct{}
+	done chan struct{} // closed by closeAll to end run
+}
+
+func newDispatcher() *dispatcher {
+	dp := &dispatcher{
+		q:    make(chan func(), dispatchQueueLen),
+		subs: map[*subscription]struct{}{},
+	}
+	dp.start()
+	return dp
+}
+
+// start runs the dispatcher goroutine, unless it is running.
+func (dp *dispatcher) start() {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	if dp.done != nil {
+		return
+	}
+	dp.done = make(chan struct{})
+	go dp.run(dp.done)
+}
+
+func (dp *dispatcher) run(done <-chan struct{}) {
+	for {
+		select {
+		case f := <-dp.q:
+			f()
+		case <-done:
+			return
+		}
+	}
+}
+
+// dispatch runs f on the dispatcher goroutine, or in place when the device
+// has no dispatcher. f is dropped once the device is stopped.
+func (d *device) dispatch(f func()) {
+	if d.dispatcher == nil {
+		f()
+		return
+	}
+	d.dispatcher.mu.Lock()
+	done := d.dispatcher.done
+	d.dispatcher.mu.Unlock()
+	if done == nil {
+		return
+	}
+	select {
+	case d.dispatcher.q <- f:
+	case <-done:
+	}
+}
+
+// discovered reports a discovery to the handler and the channels.
+func (d *device) discovered(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+	d.dispatch(func() {
+		if d.peripheralDiscovered != nil {
+			d.peripheralDiscovered(p, a, rssi)
+		}
+		if d.dispatcher != nil {
+			d.dispatcher.publish(Discovered{Peripheral: p, Advertisement: a, RSSI: rssi})
+		}
+	})
+}
+
+func (dp *dispatcher) publish(ev Discovered) {
+	dp.mu.Lock()
+	subs := make([]*subscription, 0, len(dp.subs))
+	for s := range dp.subs {
+		subs = append(subs, s)
+	}
+	dp.mu.Unlock()
+	for _, s := range subs {
+		s.send(ev)
+	}
+}
+
+// closeAll closes every channel and ends the dispatcher goroutine, when
+// the device is stopped. Init starts it again.
+func (dp *dispatcher) closeAll() {
+	dp.mu.Lock()
+	subs := dp.subs
+	dp.subs = map[*subscription]struct{}{}
+	if dp.done != nil {
+		close(dp.done)
+		dp.done = nil
+	}
+	dp.mu.Unlock()
+	for s := range subs {
+		s.close()
+	}
+}
+
+func (dp *dispatcher) remove(s *subscription) {
+	dp.mu.Lock()
+	delete(dp.subs, s)
+	dp.mu.Unlock()
+	s.close()
+}
+
+type subscription struct {
+	c      chan Discovered
+	policy OverflowPolicy
+	done   chan struct{} // closed first, to unblock send
+	once   sync.Once
+
+	mu     sync.Mutex // protects c against close
+	closed bool
+}
+
+func (s *subscription) send(ev Discovered) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	switch s.policy {
+	case OverflowBlock:
+		select {
+		case s.c <- ev:
+		case <-s.done:
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.c <- ev:
+				return
+			default:
+			}
+			select {
+			case <-s.c:
+			default:
+			}
+		}
+	default:
+		select {
+		case s.c <- ev:
+		default:
+		}
+	}
+}
+
+func (s *subscription) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		s.closed = true
+		close(s.c)
+		s.mu.Unlock()
+	})
+}
+
+// DiscoveredChan returns a channel of the discoveries of d, which also go
+// to the PeripheralDiscovered handler. The channel holds size discoveries,
+// and policy decides what happens when it is full. It is closed when ctx
+// is done or d is stopped.
+func DiscoveredChan(ctx context.Context, d gatt.Device, size int, policy OverflowPolicy) (<-chan Discovered, error) {
+	dd, ok := d.(*device)
+	if !ok || dd.dispatcher == nil {
+		return nil, errors.New("not a noblechild device")
+	}
+	if size < 1 && policy != OverflowBlock {
+		return nil, errors.New("size must be positive unless OverflowBlock")
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	s := &subscription{
+		c:      make(chan Discovered, size),
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+	dp := dd.dispatcher
+	dp.mu.Lock()
+	dp.subs[s] = struct{}{}
+	dp.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			dp.remove(s)
+		case <-s.done:
+		}
+	}()
+	return s.c, nil
+}
+
+// DiscoveredSeq is an iterator over the discoveries of d, as given by
+// DiscoveredChan. It ends when ctx is done or d is stopped. An error is
+// returned if d is not a noblechild device.
+func DiscoveredSeq(ctx context.Context, d gatt.Device, size int, policy OverflowPolicy) (iter.Seq[Discovered], error) {
+	if dd, ok := d.(*device); !ok || dd.dispatcher == nil {
+		return nil, errors.New("not a noblechild device")
+	}
+	return func(yield func(Discovered) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		c, err := DiscoveredChan(ctx, d, size, policy)
+		if err != nil {
+			return
+		}
+		for ev := range c {
+			if !yield(ev) {
+				return
+			}
+		}
+	}, nil
+}
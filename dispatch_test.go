@@ -0,0 +1,170 @@
+package noblechild
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DispatchHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &device{dispatcher: newDispatcher()}
+	release := make(chan struct{})
+	got := make(chan int, 2)
+	d.peripheralDiscovered = func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+		<-release
+		got <- rssi
+	}
+
+	// a slow handler does not block the caller
+	done := make(chan struct{})
+	go func() {
+		d.discovered(nil, nil, -1)
+		d.discovered(nil, nil, -2)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("discovered blocked on the handler")
+	}
+	close(release)
+	assert.Equal(-1, <-got)
+	assert.Equal(-2, <-got)
+}
+
+// flush waits until the dispatcher has run everything queued so far.
+func flush(d *device) {
+	c := make(chan struct{})
+	d.dispatch(func() { close(c) })
+	<-c
+}
+
+func Test_DiscoveredChanOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &device{dispatcher: newDispatcher()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newest, err := DiscoveredChan(ctx, d, 2, OverflowDropNewest)
+	assert.Nil(err)
+	oldest, err := DiscoveredChan(ctx, d, 2, OverflowDropOldest)
+	assert.Nil(err)
+	for i := 1; i <= 4; i++ {
+		d.discovered(nil, nil, -i)
+	}
+	flush(d)
+
+	assert.Equal(-1, (<-newest).RSSI)
+	assert.Equal(-2, (<-newest).RSSI)
+	assert.Equal(-3, (<-oldest).RSSI)
+	assert.Equal(-4, (<-oldest).RSSI)
+
+	_, err = DiscoveredChan(ctx, d, 0, OverflowDropNewest)
+	assert.NotNil(err)
+	_, err = DiscoveredChan(ctx, &device{}, 1, OverflowBlock)
+	assert.NotNil(err)
+}
+
+func Test_DiscoveredChanClose(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &device{dispatcher: newDispatcher()}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// a blocked send is released by the cancel
+	c, _ := DiscoveredChan(ctx, d, 0, OverflowBlock)
+	d.discovered(nil, nil, -1)
+	cancel()
+	for range c {
+	}
+
+	// Stop closes the channels
+	c, _ = DiscoveredChan(context.Background(), d, 1, OverflowDropNewest)
+	assert.Nil(d.Stop())
+	_, ok := <-c
+	assert.False(ok)
+}
+
+// dispatcherGoroutines counts the dispatcher goroutines, including those
+// of the devices other tests did not stop.
+func dispatcherGoroutines() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return strings.Count(string(buf[:n]), "created by github.com/shirou/noblechild.(*dispatcher).start")
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+func Test_DispatcherStop(t *testing.T) {
+	assert := assert.New(t)
+
+	n := dispatcherGoroutines()
+	var ds []*device
+	for i := 0; i < 10; i++ {
+		ds = append(ds, &device{dispatcher: newDispatcher()})
+	}
+	assert.Greater(dispatcherGoroutines(), n)
+	for _, d := range ds {
+		assert.Nil(d.Stop())
+	}
+	assert.Eventually(func() bool { return dispatcherGoroutines() <= n }, time.Second, time.Millisecond)
+
+	// the callbacks are dropped after Stop, and run again after start
+	d := ds[0]
+	for i := 0; i < dispatchQueueLen+1; i++ {
+		d.dispatch(func() { t.Error("run after Stop") })
+	}
+	d.dispatcher.start()
+	flush(d)
+}
+
+func Test_DiscoveredSeq(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &device{dispatcher: newDispatcher()}
+	seq, err := DiscoveredSeq(context.Background(), d, 4, OverflowBlock)
+	assert.Nil(err)
+
+	go func() {
+		// wait for the iteration to subscribe
+		for {
+			d.dispatcher.mu.Lock()
+			n := len(d.dispatcher.subs)
+			d.dispatcher.mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		for i := 1; i <= 3; i++ {
+			d.discovered(nil, nil, -i)
+		}
+	}()
+
+	var got []int
+	for ev := range seq {
+		got = append(got, ev.RSSI)
+		if len(got) == 2 {
+			break
+		}
+	}
+	assert.Equal([]int{-1, -2}, got)
+
+	// breaking the loop unsubscribes
+	assert.Eventually(func() bool {
+		d.dispatcher.mu.Lock()
+		defer d.dispatcher.mu.Unlock()
+		return len(d.dispatcher.subs) == 0
+	}, time.Second, time.Millisecond)
+}
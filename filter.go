@@ -0,0 +1,133 @@
+package noblechild
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/paypal/gatt"
+)
+
+// Filter selects the advertisements which are reported while scanning.
+// Filters are applied before a peripheral is built, so dropped
+// advertisements cost little.
+type Filter func(e *HCIEvent) bool
+
+// FilterAll passes what every f passes. No filter passes everything.
+func FilterAll(fs ...Filter) Filter {
+	return func(e *HCIEvent) bool {
+		for _, f := range fs {
+			if !f(e) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// FilterAny passes what one of fs passes.
+func FilterAny(fs ...Filter) Filter {
+	return func(e *HCIEvent) bool {
+		for _, f := range fs {
+			if f(e) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// FilterNot passes what f drops.
+func FilterNot(f Filter) Filter {
+	return func(e *HCIEvent) bool { return !f(e) }
+}
+
+// FilterServices passes advertisements with one of the services uu.
+func FilterServices(uu ...gatt.UUID) Filter {
+	return func(e *HCIEvent) bool {
+		if e.Advertisement == nil {
+			return false
+		}
+		for _, u := range e.Advertisement.Services {
+			if IncludesUUID(u, uu) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// FilterNamePrefix passes advertisements whose local name starts with
+// prefix.
+func FilterNamePrefix(prefix string) Filter {
+	return func(e *HCIEvent) bool {
+		return e.Advertisement != nil && strings.HasPrefix(e.Advertisement.LocalName, prefix)
+	}
+}
+
+// FilterNameRegexp passes advertisements whose local name matches re.
+func FilterNameRegexp(re *regexp.Regexp) Filter {
+	return func(e *HCIEvent) bool {
+		return e.Advertisement != nil && re.MatchString(e.Advertisement.LocalName)
+	}
+}
+
+// normalizeAddress makes an address comparable with HCIEvent.Address.
+func normalizeAddress(addr string) string {
+	return strings.ToLower(strings.Replace(addr, ":", "", -1))
+}
+
+func addressSet(addrs []string) map[string]bool {
+	m := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		m[normalizeAddress(a)] = true
+	}
+	return m
+}
+
+// FilterAllow passes only the addresses, given as "AA:BB:CC:DD:EE:FF" or
+// "aabbccddeeff".
+func FilterAllow(addrs ...string) Filter {
+	m := addressSet(addrs)
+	return func(e *HCIEvent) bool { return m[e.Address] }
+}
+
+// FilterDeny drops the addresses.
+func FilterDeny(addrs ...string) Filter {
+	m := addressSet(addrs)
+	return func(e *HCIEvent) bool { return !m[e.Address] }
+}
+
+// FilterMinRSSI passes advertisements received at rssi or stronger.
+func FilterMinRSSI(rssi int) Filter {
+	return func(e *HCIEvent) bool { return e.RSSI >= rssi }
+}
+
+// FilterCompanyID passes advertisements with manufacturer data of one of
+// the companies.
+func FilterCompanyID(ids ...uint16) Filter {
+	return func(e *HCIEvent) bool {
+		for _, md := range e.Manufacturers {
+			for _, id := range ids {
+				if md.CompanyID == id {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// FilterServiceData passes advertisements with service data of one of uu.
+func FilterServiceData(uu ...gatt.UUID) Filter {
+	return func(e *HCIEvent) bool {
+		if e.Advertisement == nil {
+			return false
+		}
+		for _, sd := range e.Advertisement.ServiceData {
+			if IncludesUUID(sd.UUID, uu) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,76 @@
+package noblechild
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Filters(t *testing.T) {
+	assert := assert.New(t)
+
+	u := gatt.MustParseUUID("39e1fa0084a811e2afba0002a5d5c51b")
+	e := HCIEvent{
+		Address: "a0143d472502",
+		RSSI:    -70,
+		Advertisement: &gatt.Advertisement{
+			LocalName:   "edison-01",
+			Services:    []gatt.UUID{u},
+			ServiceData: []gatt.ServiceData{{UUID: gatt.UUID16(0xfeaa)}},
+		},
+		Manufacturers: []ManufacturerData{{CompanyID: companyRuuvi}},
+	}
+
+	assert.True(FilterServices(gatt.UUID16(0x180d), u)(&e))
+	assert.False(FilterServices(gatt.UUID16(0x180d))(&e))
+	assert.True(FilterNamePrefix("edison")(&e))
+	assert.False(FilterNamePrefix("ruuvi")(&e))
+	assert.True(FilterNameRegexp(regexp.MustCompile(`-\d+$`))(&e))
+	assert.True(FilterAllow("A0:14:3D:47:25:02")(&e))
+	assert.False(FilterAllow("a0143d472503")(&e))
+	assert.False(FilterDeny("A0:14:3D:47:25:02")(&e))
+	assert.True(FilterMinRSSI(-70)(&e))
+	assert.False(FilterMinRSSI(-69)(&e))
+	assert.True(FilterCompanyID(companyApple, companyRuuvi)(&e))
+	assert.False(FilterCompanyID(companyApple)(&e))
+	assert.True(FilterServiceData(gatt.UUID16(0xfeaa))(&e))
+	assert.False(FilterServiceData(gatt.UUID16(0xfe95))(&e))
+
+	assert.True(FilterAll()(&e))
+	assert.False(FilterAll(FilterNamePrefix("edison"), FilterMinRSSI(-60))(&e))
+	assert.True(FilterAny(FilterNamePrefix("ruuvi"), FilterMinRSSI(-80))(&e))
+	assert.True(FilterNot(FilterDeny("a0143d472502"))(&e))
+
+	// without advertisement
+	assert.False(FilterNamePrefix("")(&HCIEvent{}))
+	assert.False(FilterServices(u)(&HCIEvent{}))
+}
+
+func Test_ScanFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	strong := HCIEvent{Address: "aa", RSSI: -50, Advertisement: &gatt.Advertisement{
+		Services: []gatt.UUID{gatt.UUID16(0x180d)},
+	}}
+	weak := HCIEvent{Address: "bb", RSSI: -90, Advertisement: &gatt.Advertisement{}}
+
+	d := &device{}
+	assert.True(d.passes(&weak))
+
+	assert.Nil(d.Option(ScanFilter(FilterMinRSSI(-80))))
+	d.setFilter(nil)
+	assert.True(d.passes(&strong))
+	assert.False(d.passes(&weak))
+
+	// the services given to Scan are filtered too
+	d.setFilter([]gatt.UUID{gatt.UUID16(0x180f)})
+	assert.False(d.passes(&strong))
+	d.setFilter([]gatt.UUID{gatt.UUID16(0x180d)})
+	assert.True(d.passes(&strong))
+
+	assert.Nil(d.Option(ScanFilter(nil)))
+	d.setFilter(nil)
+	assert.True(d.passes(&weak))
+}
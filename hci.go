@@ -2,9 +2,12 @@ package noblechild
 
 import (
 	"bufio"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
@@ -12,7 +15,6 @@ import (
 	"syscall"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/paypal/gatt"
 )
 
@@ -27,13 +29,14 @@ type HCI_BLE struct {
 	stdinPipe  io.WriteCloser
 	stdoutPipe io.ReadCloser
 	command    *exec.Cmd
+	exited     chan struct{} // closed when hci-ble has exited
 
 	device *device
 
 	previousAdapterState string
 	currentAdapterState  string
 
-	discoveries map[string]HCIEvent
+	discoveries *registry
 }
 
 // HCIEvent represents some events from hci.
@@ -44,15 +47,20 @@ type HCIEvent struct {
 	Advertisement *gatt.Advertisement // JSON
 	RSSI          int
 	Count         int
+
+	// Manufacturers are all the manufacturer specific data in the
+	// advertisement, in order.
+	Manufacturers []ManufacturerData
+	// ServiceData are the service data in the advertisement, in order,
+	// decoded by the decoders given to RegisterServiceDataDecoder.
+	ServiceData []ServiceData
 }
 
 func NewHCI(d *device, path string) (*HCI_BLE, error) {
-	di := make(map[string]HCIEvent)
-
 	hci := HCI_BLE{
 		path:        path,
 		device:      d,
-		discoveries: di,
+		discoveries: d.discoveries,
 	}
 
 	return &hci, nil
@@ -60,6 +68,7 @@ func NewHCI(d *device, path string) (*HCI_BLE, error) {
 
 func (hci *HCI_BLE) Init() error {
 	cmd := exec.Command(hci.path)
+	cmd.Env = hci.device.childEnv()
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -72,26 +81,36 @@ func (hci *HCI_BLE) Init() error {
 	hci.stdinPipe = stdin
 	hci.stdoutPipe = stdout
 	hci.command = cmd
+	hci.exited = make(chan struct{})
 
-	go hci.Out()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
 
-	cmd.Start()
+	hci.device.stats().childStarted(ChildHCI)
 
-	go cmd.Wait()
+	go hci.Out()
 
 	return nil
 }
 
+// Close stops scanning and terminates hci-ble. It waits for the child to
+// exit and kills it if it does not exit within stopTimeout.
 func (hci *HCI_BLE) Close() error {
+	if hci.command == nil || hci.command.Process == nil {
+		return nil
+	}
+
+	var errs []error
 	err := hci.StopScan()
-	if err != nil {
-		return fmt.Errorf("hci close: stop scan failed:%s", err)
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		errs = append(errs, fmt.Errorf("hci close: stop scan failed:%s", err))
 	}
-	err = hci.command.Process.Signal(syscall.SIGINT)
+	err = stopProcess(hci.device.log(), hci.command.Process, hci.exited, hci.device.stopTimeoutOption())
 	if err != nil {
-		return fmt.Errorf("hci close: stop hci failed:%s", err)
+		errs = append(errs, fmt.Errorf("hci close: stop hci failed:%s", err))
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 // Out read stdout from hci
@@ -99,20 +118,39 @@ func (hci *HCI_BLE) Out() {
 	scanner := bufio.NewScanner(hci.stdoutPipe)
 	for scanner.Scan() {
 		buf := scanner.Text()
+		hci.device.record(ChildHCI, "", pid(hci.command), DirOut, buf)
 		hci.ParseStdout(buf)
 	}
+
+	hci.command.Wait()
+	close(hci.exited)
 }
 
 func (hci *HCI_BLE) StartScan() error {
-	log.Debugf("noblechild: start scan  pid: %d", hci.command.Process.Pid)
-	time.Sleep(3 * time.Second)
-
-	return hci.command.Process.Signal(syscall.SIGUSR1)
+	return hci.startScan(false)
 }
+
+// StartScanFilter starts scanning without the duplicate filter of the
+// controller, so every advertisement is reported.
 func (hci *HCI_BLE) StartScanFilter() error {
+	hci.device.record(ChildHCI, "", pid(hci.command), DirSignal, "SIGUSR2")
 	return hci.command.Process.Signal(syscall.SIGUSR2)
 }
+
+// startScan starts scanning. If dup is true, duplicates are reported.
+func (hci *HCI_BLE) startScan(dup bool) error {
+	hci.device.log().Debug("start scan", "pid", pid(hci.command), "duplicates", dup)
+	time.Sleep(3 * time.Second)
+
+	if dup {
+		return hci.StartScanFilter()
+	}
+	hci.device.record(ChildHCI, "", pid(hci.command), DirSignal, "SIGUSR1")
+	return hci.command.Process.Signal(syscall.SIGUSR1)
+}
+
 func (hci *HCI_BLE) StopScan() error {
+	hci.device.record(ChildHCI, "", pid(hci.command), DirSignal, "SIGHUP")
 	return hci.command.Process.Signal(syscall.SIGHUP)
 }
 
@@ -121,7 +159,7 @@ func (hci *HCI_BLE) ParseStdout(buf string) {
 	case adapterRegex.MatchString(buf):
 		tmp := adapterRegex.FindStringSubmatch(buf)
 		if len(tmp) != 2 {
-			log.Println("invalid adapter state line: %s", buf)
+			hci.device.log().Error("invalid adapter state line", "pid", pid(hci.command), "line", buf)
 			return
 		}
 		adapterState := tmp[1]
@@ -135,10 +173,10 @@ func (hci *HCI_BLE) ParseStdout(buf string) {
 		case "unknown":
 			state = gatt.StateUnknown
 		case "unsupported":
-			log.Error("noble warning: adapter does not support Bluetooth Low Energy (BLE, Bluetooth Smart).")
+			hci.device.log().Error("noble: adapter does not support Bluetooth Low Energy (BLE, Bluetooth Smart)", "pid", pid(hci.command))
 			state = gatt.StateUnsupported
 		case "unauthorized":
-			log.Error("warning: adapter state unauthorized, please run as root or with sudo")
+			hci.device.log().Error("noble: adapter state unauthorized, please run as root or with sudo", "pid", pid(hci.command))
 			state = gatt.StateUnauthorized
 		case "poweredOff":
 			state = gatt.StatePoweredOff
@@ -146,45 +184,68 @@ func (hci *HCI_BLE) ParseStdout(buf string) {
 			state = gatt.StatePoweredOn
 		}
 
-		hci.device.stateChanged(hci.device, state)
+		hci.device.setState(state)
 	case eventRegex.MatchString(buf):
 		tmp := eventRegex.FindStringSubmatch(buf)
 		if len(tmp) != 2 {
-			log.Errorf("invalid event line: %s", buf)
+			hci.device.log().Error("invalid event line", "pid", pid(hci.command), "line", buf)
 			return
 		}
 		event := tmp[1]
 		e, err := parseEvent(event)
 		if err != nil {
-			log.Errorf("parse event failed: %s", err)
+			hci.device.log().Error("parse event failed", "pid", pid(hci.command), "error", err)
 			return
 		}
 
-		prevE, ok := hci.discoveries[e.Address]
-		if ok {
-			e.Count = prevE.Count + 1
-		}
-		hci.discoveries[e.Address] = e
+		hci.device.handleEvent(e)
 
-		// only report after an even number of events, so more advertisement data can be collected
-		if e.Count%2 == 0 {
-			noble, err := FindNobleModule()
-			if err != nil {
-				log.Errorf("could not find l2cap at ParseStdout: %s", err)
-				return
-			}
-			l2cap, err := NewL2CAP(hci.device, noble.L2CAPPath)
-			if err != nil {
-				log.Errorf("could not new l2cap at ParseStdout: %s", err)
-				return
-			}
+	default:
+		hci.device.log().Error("unknown hci-ble output", "pid", pid(hci.command), "line", buf)
+	}
+}
 
-			p := NewPeripheral(hci.device, l2cap, e.Address)
-			hci.device.peripheralDiscovered(&p, e.Advertisement, e.RSSI)
+// newL2CAP starts l2cap-ble for address.
+func (hci *HCI_BLE) newL2CAP(address, addressType string) (*L2CAP_BLE, error) {
+	l2cap, err := NewL2CAP(hci.device, hci.device.nobleModules.L2CAPPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := l2cap.Init(address, addressType); err != nil {
+		return nil, err
+	}
+	return l2cap, nil
+}
+
+// handleEvent reports an advertisement seen by the backend.
+func (d *device) handleEvent(e HCIEvent) {
+	d.stats().advertisement()
+	if !d.passes(&e) {
+		return
+	}
+	st := d.discoveries.seen(e)
+	if st.zc != nil && d.peripheralZoneChanged != nil {
+		zc := st.zc
+		d.dispatch(func() { d.peripheralZoneChanged(zc.di, zc.from) })
+	}
+
+	if pb, ok := d.backend.(peripheralBackend); ok && st.report {
+		p := pb.newPeripheral(&st.e)
+		d.stats().discovery()
+		d.discovered(p, st.e.Advertisement, st.rssi)
+		return
+	}
+	if st.report {
+		l2cap, err := NewL2CAP(d, d.nobleModules.L2CAPPath)
+		if err != nil {
+			d.log().Error("could not new l2cap", "address", st.e.Address, "error", err)
+			return
 		}
 
-	default:
-		log.Errorf("unknown output: %s", buf)
+		p := NewPeripheral(d, l2cap, st.e.Address)
+		p.event = &st.e
+		d.stats().discovery()
+		d.discovered(&p, st.e.Advertisement, st.rssi)
 	}
 }
 
@@ -200,15 +261,14 @@ func parseEvent(event string) (HCIEvent, error) {
 	ret.Address = strings.Replace(tmp, ":", "", -1)
 
 	ret.AddressType = splitEvent[1]
+	ret.EIR = splitEvent[2]
 	eir, err := hex.DecodeString(splitEvent[2])
 	if err != nil {
 		return ret, fmt.Errorf("invalid event eir: %s, %s", err, event)
 	}
-	adv, err := parseEIR(eir)
-	if err != nil {
+	if err := ret.setEIR(eir); err != nil {
 		return ret, fmt.Errorf("parse EIR failed: %s, %s", err, event)
 	}
-	ret.Advertisement = &adv
 
 	rssi, err := strconv.Atoi(splitEvent[3])
 	if err != nil {
@@ -219,8 +279,27 @@ func parseEvent(event string) (HCIEvent, error) {
 	return ret, nil
 }
 
-func parseEIR(eir []byte) (gatt.Advertisement, error) {
+// setEIR sets the advertisement, the manufacturer data and the service
+// data of e from eir.
+func (e *HCIEvent) setEIR(eir []byte) error {
+	adv, mds, err := parseEIR(eir)
+	if err != nil {
+		return err
+	}
+	e.Advertisement = &adv
+	e.Manufacturers = mds
+	e.ServiceData = nil
+	for _, sd := range adv.ServiceData {
+		e.ServiceData = append(e.ServiceData, decodeServiceData(sd))
+	}
+	return nil
+}
+
+// parseEIR parses the advertising data. Every manufacturer specific data
+// is returned, while the advertisement keeps the last one.
+func parseEIR(eir []byte) (gatt.Advertisement, []ManufacturerData, error) {
 	ret := gatt.Advertisement{}
+	var mds []ManufacturerData
 
 	i := 0
 	for {
@@ -228,41 +307,25 @@ func parseEIR(eir []byte) (gatt.Advertisement, error) {
 			break
 		}
 		length := int(eir[i])
+		if length == 0 || i+1+length > len(eir) {
+			break
+		}
 		t := eir[i+1]
 		data := eir[i+2 : i+2+length-1]
 		switch t {
 		case 0x02: // Incomplete List of 16-bit Service Class UUID
 			fallthrough
 		case 0x03: // Complete List of 16-bit Service Class UUIDs
-			// TODO
-
-			/*
-			   for (j = 0; j < bytes.length; j += 2) {
-			     serviceUuid = bytes.readUInt16LE(j).toString(16);
-			     if (advertisement.serviceUuids.indexOf(serviceUuid) === -1) {
-			       advertisement.serviceUuids.push(serviceUuid);
-			     }
-			   }*/
-			/*
-				for j := 0; j < len(data); j += 2 {
-					tmp := binary.LittleEndian.Uint32([]byte{data[j]})
-					fmt.Printf("%v", data)
-					fmt.Printf("%02x", data[j:j+1])
-					hex := fmt.Sprintf("%02x", data[j:j+1])
-					uuid, err := gatt.ParseUUID(hex)
-					if err != nil {
-						return ret, err
-					}
-
-					if !stringInUUID(uuid, ret.Services) {
-						ret.Services = append(ret.Services, uuid)
-					}
+			for j := 0; j+2 <= len(data); j += 2 {
+				uuid := gatt.UUID16(binary.LittleEndian.Uint16(data[j:]))
+				if !IncludesUUID(uuid, ret.Services) {
+					ret.Services = append(ret.Services, uuid)
 				}
-			*/
+			}
 		case 0x06: // Incomplete List of 128-bit Service Class UUIDs
 			fallthrough
 		case 0x07: // Complete List of 128-bit Service Class UUIDs
-			for j := 0; j < len(data); j += 16 {
+			for j := 0; j+16 <= len(data); j += 16 {
 				var hex []string
 				buf := data[j : j+16]
 				// hex should be reverse
@@ -271,7 +334,7 @@ func parseEIR(eir []byte) (gatt.Advertisement, error) {
 				}
 				uuid, err := gatt.ParseUUID(strings.Join(hex, ""))
 				if err != nil {
-					return ret, err
+					return ret, mds, err
 				}
 				if !IncludesUUID(uuid, ret.Services) {
 					ret.Services = append(ret.Services, uuid)
@@ -282,26 +345,39 @@ func parseEIR(eir []byte) (gatt.Advertisement, error) {
 		case 0x09: // Complete Local Name»
 			ret.LocalName = string(data)
 		case 0x0a: // Tx Power Level
-			ret.TxPowerLevel = int(data[0])
+			if len(data) > 0 {
+				ret.TxPowerLevel = int(int8(data[0]))
+			}
 		case 0x16: // Service Data, there can be multiple occurences
-			// TODO
-			/*
-			   var serviceDataUuid = bytes.slice(0, 2).toString('hex').match(/.{1,2}/g).reverse().join('');
-			   var serviceData = bytes.slice(2, bytes.length);
-
-			   advertisement.serviceData.push({
-			     uuid: serviceDataUuid,
-			     data: serviceData
-			   });
-			*/
+			if len(data) < 2 {
+				break
+			}
+			ret.ServiceData = append(ret.ServiceData, gatt.ServiceData{
+				UUID: gatt.UUID16(binary.LittleEndian.Uint16(data)),
+				Data: data[2:],
+			})
+		case 0x21: // Service Data - 128-bit UUID
+			if len(data) < 16 {
+				break
+			}
+			uuid, err := gatt.ParseUUID(fmt.Sprintf("%x", reverse(data[:16])))
+			if err != nil {
+				return ret, mds, err
+			}
+			ret.ServiceData = append(ret.ServiceData, gatt.ServiceData{
+				UUID: uuid,
+				Data: data[16:],
+			})
 		case 0xff: // Manufacturer Specific Data
 			ret.ManufacturerData = data
-			break
+			if md, ok := decodeManufacturerData(data); ok {
+				mds = append(mds, md)
+			}
 		}
 
 		i = i + length + 1
 	}
-	return ret, nil
+	return ret, mds, nil
 }
 
 type ByteSlice []byte
@@ -47,7 +47,7 @@ func Test_parseEvent(t *testing.T) {
 		assert.Nil(err)
 		assert.Equal("public", e.AddressType)
 		assert.Equal(-53, e.RSSI)
-		assert.Equal(0, len(e.Advertisement.Services))
+		assert.Equal([]gatt.UUID{gatt.UUID16(0xffe0)}, e.Advertisement.Services)
 	}
 	{
 		e, err := parseEvent("event B4:99:4C:64:A6:E0,public,08094e65787475726e051210009001,-53")
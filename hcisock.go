@@ -0,0 +1,188 @@
+package noblechild
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// HCI packets used by the socket backend.
+const (
+	hciCommandPkt = 0x01
+	hciEventPkt   = 0x04
+
+	hciEvtCommandComplete = 0x0e
+	hciEvtCommandStatus   = 0x0f
+	hciEvtLEMeta          = 0x3e
+
+	hciSubEvtLEAdvertisingReport = 0x02
+
+	hciOpLESetScanParameters = 0x200b
+	hciOpLESetScanEnable     = 0x200c
+	hciOpReadRSSI            = 0x1405
+)
+
+// hciEvent is an HCI event packet read from the HCI socket.
+type hciEvent struct {
+	code   byte
+	params []byte
+}
+
+// parseHCIEvent parses an HCI event packet, starting with its packet type.
+func parseHCIEvent(b []byte) (hciEvent, error) {
+	if len(b) < 3 || b[0] != hciEventPkt {
+		return hciEvent{}, fmt.Errorf("not an hci event: %x", b)
+	}
+	if int(b[2]) != len(b)-3 {
+		return hciEvent{}, fmt.Errorf("invalid hci event length %d: %x", b[2], b)
+	}
+	return hciEvent{code: b[1], params: b[3:]}, nil
+}
+
+// commandResult returns the opcode and the status of a Command Complete
+// or Command Status event. ok is false for other events.
+func (e hciEvent) commandResult() (op uint16, status byte, ok bool) {
+	switch {
+	case e.code == hciEvtCommandComplete && len(e.params) >= 4:
+		return binary.LittleEndian.Uint16(e.params[1:3]), e.params[3], true
+	case e.code == hciEvtCommandStatus && len(e.params) >= 4:
+		return binary.LittleEndian.Uint16(e.params[2:4]), e.params[0], true
+	}
+	return 0, 0, false
+}
+
+// rssiResult returns the connection handle, the status and the RSSI of
+// the Command Complete event of Read RSSI. ok is false for other events.
+func (e hciEvent) rssiResult() (handle uint16, status byte, rssi int, ok bool) {
+	if op, _, ok := e.commandResult(); !ok || op != hciOpReadRSSI || e.code != hciEvtCommandComplete || len(e.params) < 7 {
+		return 0, 0, 0, false
+	}
+	return binary.LittleEndian.Uint16(e.params[4:6]), e.params[3], int(int8(e.params[6])), true
+}
+
+// advertisingReports returns the reports of an LE Advertising Report
+// event, or nil for other events. The reports follow one another, each
+// with its event type, address type, address, data length, data and RSSI,
+// as the kernel and BlueZ read them.
+func (e hciEvent) advertisingReports() ([]HCIEvent, error) {
+	p := e.params
+	if e.code != hciEvtLEMeta || len(p) < 2 || p[0] != hciSubEvtLEAdvertisingReport {
+		return nil, nil
+	}
+	n := int(p[1])
+	p = p[2:]
+
+	ret := make([]HCIEvent, n)
+	for i := range ret {
+		// event type, address type, address and data length
+		if len(p) < 9 {
+			return nil, fmt.Errorf("short advertising report: %x", e.params)
+		}
+		addrType, addr, l := p[1], p[2:8], int(p[8])
+		p = p[9:]
+		// data and RSSI
+		if len(p) < l+1 {
+			return nil, fmt.Errorf("short advertising data: %x", e.params)
+		}
+		eir := p[:l]
+		rssi := p[l]
+		p = p[l+1:]
+
+		ev := &ret[i]
+		ev.Address = bdaddrString(addr)
+		ev.AddressType = "public"
+		if addrType == 0x01 {
+			ev.AddressType = "random"
+		}
+		ev.EIR = hex.EncodeToString(eir)
+		if err := ev.setEIR(eir); err != nil {
+			return nil, err
+		}
+		ev.RSSI = int(int8(rssi))
+	}
+	return ret, nil
+}
+
+// hciCommand makes an HCI command packet.
+func hciCommand(op uint16, params ...byte) []byte {
+	b := []byte{hciCommandPkt, byte(op), byte(op >> 8), byte(len(params))}
+	return append(b, params...)
+}
+
+// leSetScanParameters is an active scan of 10ms every 10ms.
+func leSetScanParameters() []byte {
+	return hciCommand(hciOpLESetScanParameters,
+		0x01,       // active
+		0x10, 0x00, // interval
+		0x10, 0x00, // window
+		0x00, // public own address
+		0x00, // accept all advertisements
+	)
+}
+
+// leSetScanEnable enables or disables scanning. dup reports the duplicate
+// advertisements too.
+func leSetScanEnable(enable, dup bool) []byte {
+	var e, f byte
+	if enable {
+		e = 0x01
+	}
+	if !dup {
+		f = 0x01
+	}
+	return hciCommand(hciOpLESetScanEnable, e, f)
+}
+
+// hciReadRSSI reads the RSSI of the connection of handle.
+func hciReadRSSI(handle uint16) []byte {
+	return hciCommand(hciOpReadRSSI, byte(handle), byte(handle>>8))
+}
+
+// connInfoHandle returns the hci_handle of a struct l2cap_conninfo whose
+// first 4 bytes are read as an int.
+func connInfoHandle(v int) uint16 {
+	var b [4]byte
+	binary.NativeEndian.PutUint32(b[:], uint32(v))
+	return binary.NativeEndian.Uint16(b[:])
+}
+
+// bdaddrString returns a little-endian bdaddr as an HCIEvent.Address.
+func bdaddrString(b []byte) string {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return hex.EncodeToString(r)
+}
+
+// parseBdaddr parses an address in the display order, with or without
+// colons.
+func parseBdaddr(s string) ([6]byte, error) {
+	var a [6]byte
+	b, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil || len(b) != len(a) {
+		return a, fmt.Errorf("invalid address: %s", s)
+	}
+	copy(a[:], b)
+	return a, nil
+}
+
+// socketDisconnectReason converts the error which ended an L2CAP socket
+// to a disconnect reason.
+func socketDisconnectReason(err error, local bool) error {
+	switch {
+	case local, errors.Is(err, os.ErrClosed):
+		return ErrLocalHostTerminated
+	case errors.Is(err, syscall.ECONNRESET):
+		return ErrRemoteUserTerminated
+	case errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, syscall.EHOSTDOWN):
+		return ErrSupervisionTimeout
+	case err == nil:
+		return ErrDisconnected
+	}
+	return fmt.Errorf("%w: %s", ErrDisconnected, err)
+}
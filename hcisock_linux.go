@@ -0,0 +1,392 @@
+//go:build linux
+
+package noblechild
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	gatt "github.com/paypal/gatt"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	hciFilter     = 2          // HCI_FILTER socket option
+	hciGetDevInfo = 0x800448d3 // HCIGETDEVINFO ioctl
+	hciDevUp      = 1 << 0     // HCI_UP flag of hci_dev_info
+	l2capConnInfo = 2          // L2CAP_CONNINFO socket option
+)
+
+// hciSocket is the socket backend. It scans on a raw HCI socket and
+// connects with the L2CAP sockets of the kernel, so bluetoothd can keep
+// running.
+type hciSocket struct {
+	device *device
+	dev    int
+
+	mu     sync.Mutex // protects f and exited
+	f      *os.File   // nil when closed
+	exited chan struct{}
+
+	rssiMu sync.Mutex    // serializes readRSSI
+	rssic  chan hciEvent // the results of Read RSSI
+}
+
+// newHCISocket opens the adapter given by HCIDeviceID, hci0 by default.
+func newHCISocket(d *device) (backend, error) {
+	dev := d.hciDeviceID
+	if dev < 0 {
+		dev = 0
+	}
+	f, err := openHCISocket(dev)
+	if err != nil {
+		return nil, err
+	}
+	return &hciSocket{device: d, dev: dev, f: f, rssic: make(chan hciEvent, 1)}, nil
+}
+
+func openHCISocket(dev int) (*os.File, error) {
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.BTPROTO_HCI)
+	if err != nil {
+		return nil, fmt.Errorf("hci socket: %w", err)
+	}
+	err = unix.Bind(fd, &unix.SockaddrHCI{Dev: uint16(dev), Channel: unix.HCI_CHANNEL_RAW})
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("hci%d bind: %w", dev, err)
+	}
+
+	// struct hci_filter: the event packets, and the events we handle
+	var filter [14]byte
+	filter[0] = 1 << hciEventPkt
+	for _, e := range []uint{hciEvtCommandComplete, hciEvtCommandStatus, hciEvtLEMeta} {
+		filter[4+e/8] |= 1 << (e % 8)
+	}
+	err = unix.SetsockoptString(fd, unix.SOL_HCI, hciFilter, string(filter[:]))
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("hci%d filter: %w", dev, err)
+	}
+	return os.NewFile(uintptr(fd), fmt.Sprintf("hci%d", dev)), nil
+}
+
+// devInfo returns the address, in the display order, and whether the
+// adapter is up.
+func (h *hciSocket) devInfo(f *os.File) (addr [6]byte, up bool, err error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return addr, false, err
+	}
+	// struct hci_dev_info: dev_id, name[8], bdaddr, flags, ...
+	var info [128]byte
+	info[0], info[1] = byte(h.dev), byte(h.dev>>8)
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall(unix.SYS_IOCTL, fd, hciGetDevInfo, uintptr(unsafe.Pointer(&info[0])))
+	})
+	if err != nil {
+		return addr, false, err
+	}
+	if errno != 0 {
+		return addr, false, fmt.Errorf("hci%d info: %w", h.dev, errno)
+	}
+	for i := range addr {
+		addr[i] = info[10+5-i]
+	}
+	flags := uint32(info[16]) | uint32(info[17])<<8 | uint32(info[18])<<16 | uint32(info[19])<<24
+	return addr, flags&hciDevUp != 0, nil
+}
+
+// Init starts reading the HCI socket. The adapter state is reported when
+// the scan parameters are set.
+func (h *hciSocket) Init() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f == nil {
+		f, err := openHCISocket(h.dev)
+		if err != nil {
+			return err
+		}
+		h.f = f
+	}
+	h.exited = make(chan struct{})
+	go h.loop(h.f, h.exited)
+
+	if _, up, err := h.devInfo(h.f); err == nil && !up {
+		h.device.setState(gatt.StatePoweredOff)
+		return nil
+	}
+	return h.writeLocked(leSetScanParameters())
+}
+
+func (h *hciSocket) startScan(dup bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.device.log().Debug("start scan", "hci", h.dev, "duplicates", dup)
+	return h.writeLocked(leSetScanEnable(true, dup))
+}
+
+func (h *hciSocket) StopScan() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.writeLocked(leSetScanEnable(false, false))
+}
+
+func (h *hciSocket) writeLocked(b []byte) error {
+	if h.f == nil {
+		return os.ErrClosed
+	}
+	_, err := h.f.Write(b)
+	if errors.Is(err, unix.ENETDOWN) {
+		h.device.setState(gatt.StatePoweredOff)
+	}
+	return err
+}
+
+// Close stops scanning and closes the HCI socket.
+func (h *hciSocket) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f == nil {
+		return nil
+	}
+	h.writeLocked(leSetScanEnable(false, false))
+	err := h.f.Close()
+	h.f = nil
+	if h.exited != nil {
+		<-h.exited
+	}
+	return err
+}
+
+func (h *hciSocket) loop(f *os.File, exited chan struct{}) {
+	defer close(exited)
+	b := make([]byte, 1024)
+	for {
+		n, err := f.Read(b)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				h.device.log().Error("hci socket read failed", "hci", h.dev, "error", err)
+			}
+			return
+		}
+		h.handle(b[:n])
+	}
+}
+
+func (h *hciSocket) handle(b []byte) {
+	e, err := parseHCIEvent(b)
+	if err != nil {
+		h.device.log().Error("parse hci event failed", "hci", h.dev, "error", err)
+		return
+	}
+	if _, _, _, ok := e.rssiResult(); ok {
+		select {
+		case h.rssic <- e:
+		default:
+		}
+		return
+	}
+	if op, status, ok := e.commandResult(); ok {
+		if op == hciOpLESetScanParameters {
+			if status == 0 {
+				h.device.setState(gatt.StatePoweredOn)
+			} else {
+				h.device.log().Error("adapter does not support Bluetooth Low Energy (BLE, Bluetooth Smart)", "hci", h.dev, "status", status)
+				h.device.setState(gatt.StateUnsupported)
+			}
+		} else if status != 0 {
+			h.device.log().Error("hci command failed", "hci", h.dev, "opcode", fmt.Sprintf("0x%04x", op), "status", status)
+		}
+		return
+	}
+	es, err := e.advertisingReports()
+	if err != nil {
+		h.device.log().Error("parse advertising report failed", "hci", h.dev, "error", err)
+		return
+	}
+	for _, e := range es {
+		h.device.handleEvent(e)
+	}
+}
+
+// readRSSI reads the RSSI of the connection of the L2CAP socket conn with
+// HCI Read RSSI.
+func (h *hciSocket) readRSSI(conn io.ReadWriteCloser) (int, error) {
+	f, ok := conn.(*os.File)
+	if !ok {
+		return 0, errors.New("not an l2cap socket")
+	}
+	handle, err := connHandle(f)
+	if err != nil {
+		return 0, err
+	}
+
+	h.rssiMu.Lock()
+	defer h.rssiMu.Unlock()
+	// drop the result of a request which timed out
+	select {
+	case <-h.rssic:
+	default:
+	}
+	h.mu.Lock()
+	err = h.writeLocked(hciReadRSSI(handle))
+	h.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	t := time.NewTimer(rssiTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case e := <-h.rssic:
+			hd, status, rssi, _ := e.rssiResult()
+			if hd != handle {
+				// another connection, read by bluetoothd
+				continue
+			}
+			if status != 0 {
+				return 0, fmt.Errorf("hci%d read rssi: status 0x%02x", h.dev, status)
+			}
+			return rssi, nil
+		case <-t.C:
+			return 0, fmt.Errorf("hci%d read rssi: timeout", h.dev)
+		}
+	}
+}
+
+// connHandle returns the HCI handle of the connection of an L2CAP socket.
+func connHandle(f *os.File) (uint16, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	// struct l2cap_conninfo: hci_handle, dev_class[3]. The kernel copies
+	// as many bytes as asked for.
+	var (
+		v    int
+		serr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		v, serr = unix.GetsockoptInt(int(fd), unix.SOL_L2CAP, l2capConnInfo)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if serr != nil {
+		return 0, fmt.Errorf("l2cap conninfo: %w", serr)
+	}
+	return connInfoHandle(v), nil
+}
+
+// newL2CAP connects an L2CAP socket on the ATT channel to address.
+func (h *hciSocket) newL2CAP(address, addressType string) (*L2CAP_BLE, error) {
+	remote, err := parseBdaddr(address)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	f := h.f
+	h.mu.Unlock()
+	if f == nil {
+		return nil, os.ErrClosed
+	}
+	local, _, err := h.devInfo(f)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.BTPROTO_L2CAP)
+	if err != nil {
+		return nil, fmt.Errorf("l2cap socket: %w", err)
+	}
+	err = unix.Bind(fd, &unix.SockaddrL2{CID: attCID, Addr: local, AddrType: unix.BDADDR_LE_PUBLIC})
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("l2cap bind: %w", err)
+	}
+	sa := &unix.SockaddrL2{CID: attCID, Addr: remote, AddrType: unix.BDADDR_LE_PUBLIC}
+	if addressType == "random" {
+		sa.AddrType = unix.BDADDR_LE_RANDOM
+	}
+
+	l2cap, _ := NewL2CAP(h.device, "")
+	l2cap.Address = address
+	l2cap.exited = make(chan struct{})
+	conn := os.NewFile(uintptr(fd), "l2cap "+address)
+	l2cap.conn = conn
+	go l2cap.serveSocket(conn, sa)
+	return l2cap, nil
+}
+
+// serveSocket connects conn to sa and gives the received PDUs to Read
+// until the connection ends.
+func (l2cap *L2CAP_BLE) serveSocket(conn *os.File, sa unix.Sockaddr) {
+	defer close(l2cap.exited)
+
+	err := connectSocket(conn, sa)
+	if err == nil {
+		l2cap.connectResult(nil)
+		b := make([]byte, 1024)
+		for {
+			var n int
+			n, err = conn.Read(b)
+			if err != nil {
+				break
+			}
+			l2cap.ack(ByteToString(b[:n]))
+		}
+	}
+	close(l2cap.ackChan)
+	conn.Close()
+	l2cap.disconnected(socketDisconnectReason(err, l2cap.localClose.Load()))
+}
+
+// connectSocket connects the non-blocking conn. It returns when the
+// connection is established or fails, or conn is closed.
+func connectSocket(conn *os.File, sa unix.Sockaddr) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var (
+		started bool
+		cerr    error
+	)
+	// connect in the callback, after the poller is reset for writing
+	err = rc.Write(func(fd uintptr) bool {
+		if !started {
+			started = true
+			cerr = unix.Connect(int(fd), sa)
+			if cerr == unix.EINPROGRESS {
+				cerr = nil
+				return false
+			}
+			return true
+		}
+		n, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			cerr = err
+			return true
+		}
+		switch e := syscall.Errno(n); e {
+		case unix.EINPROGRESS, unix.EALREADY, unix.EINTR:
+			return false
+		case 0:
+			return true
+		default:
+			cerr = e
+			return true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return cerr
+}
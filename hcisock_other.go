@@ -0,0 +1,13 @@
+//go:build !linux
+
+package noblechild
+
+import (
+	"errors"
+	"runtime"
+)
+
+// newHCISocket fails as Bluetooth sockets are only in Linux.
+func newHCISocket(d *device) (backend, error) {
+	return nil, errors.New("bluetooth sockets are not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,203 @@
+package noblechild
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseHCIEventAdvertisingReport(t *testing.T) {
+	assert := assert.New(t)
+
+	// ADV_IND from a random address with flags and a complete local name
+	b := []byte{
+		0x04, 0x3e, 0x16,
+		0x02, 0x01, 0x00, 0x01,
+		0xff, 0xee, 0xdd, 0xcc, 0xbb, 0xaa,
+		0x0a, 0x02, 0x01, 0x06, 0x06, 0x09, 'h', 'e', 'l', 'l', 'o',
+		0xc4,
+	}
+	e, err := parseHCIEvent(b)
+	assert.Nil(err)
+	_, _, ok := e.commandResult()
+	assert.False(ok)
+
+	es, err := e.advertisingReports()
+	assert.Nil(err)
+	assert.Equal(1, len(es))
+	assert.Equal("aabbccddeeff", es[0].Address)
+	assert.Equal("random", es[0].AddressType)
+	assert.Equal("02010606096865", es[0].EIR[:14])
+	assert.Equal("hello", es[0].Advertisement.LocalName)
+	assert.Equal(-60, es[0].RSSI)
+}
+
+func Test_parseHCIEventAdvertisingReports(t *testing.T) {
+	assert := assert.New(t)
+
+	// An ADV_IND and its SCAN_RSP batched in one event. Each report is
+	// complete before the next one begins.
+	b := []byte{
+		0x04, 0x3e, 0x2a,
+		0x02, 0x02,
+		// ADV_IND, random, c4:7c:8d:6a:3e:8f, flags and a 16-bit service
+		0x00, 0x01, 0x8f, 0x3e, 0x6a, 0x8d, 0x7c, 0xc4, 0x07,
+		0x02, 0x01, 0x06, 0x03, 0x03, 0x0f, 0x18,
+		0xb5,
+		// SCAN_RSP, random, c4:7c:8d:6a:3e:8f, complete name "Flower care"
+		0x04, 0x01, 0x8f, 0x3e, 0x6a, 0x8d, 0x7c, 0xc4, 0x0d,
+		0x0c, 0x09, 'F', 'l', 'o', 'w', 'e', 'r', ' ', 'c', 'a', 'r', 'e',
+		0xb4,
+	}
+	e, err := parseHCIEvent(b)
+	assert.Nil(err)
+	es, err := e.advertisingReports()
+	assert.Nil(err)
+	assert.Equal(2, len(es))
+	assert.Equal("c47c8d6a3e8f", es[0].Address)
+	assert.Equal("random", es[0].AddressType)
+	assert.Equal("02010603030f18", es[0].EIR)
+	assert.Equal([]gatt.UUID{gatt.UUID16(0x180f)}, es[0].Advertisement.Services)
+	assert.Equal(-75, es[0].RSSI)
+	assert.Equal("c47c8d6a3e8f", es[1].Address)
+	assert.Equal("random", es[1].AddressType)
+	assert.Equal("Flower care", es[1].Advertisement.LocalName)
+	assert.Equal(-76, es[1].RSSI)
+
+	// the RSSI of the second report is missing
+	_, err = hciEvent{code: hciEvtLEMeta, params: b[3 : len(b)-1]}.advertisingReports()
+	assert.NotNil(err)
+	// the second report is missing
+	_, err = hciEvent{code: hciEvtLEMeta, params: b[3:22]}.advertisingReports()
+	assert.NotNil(err)
+}
+
+func Test_parseHCIEventTruncatedUUIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	// ADV_IND whose complete list of 128-bit services has 5 bytes
+	b := []byte{
+		0x04, 0x3e, 0x1b,
+		0x02, 0x01,
+		0x00, 0x00, 0xff, 0xee, 0xdd, 0xcc, 0xbb, 0xaa, 0x0f,
+		0x02, 0x01, 0x06,
+		0x06, 0x07, 0x01, 0x02, 0x03, 0x04, 0x05,
+		0x04, 0x09, 'a', 'b', 'c',
+		0xc4,
+	}
+	e, err := parseHCIEvent(b)
+	assert.Nil(err)
+	es, err := e.advertisingReports()
+	assert.Nil(err)
+	if assert.Equal(1, len(es)) {
+		assert.Empty(es[0].Advertisement.Services)
+		assert.Equal("abc", es[0].Advertisement.LocalName)
+	}
+
+	// and the incomplete list of 17 bytes keeps the first UUID
+	adv, _, err := parseEIR(append([]byte{0x12, 0x06}, make([]byte, 17)...))
+	assert.Nil(err)
+	assert.Equal(1, len(adv.Services))
+}
+
+func Test_parseHCIEventCommandResult(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := parseHCIEvent([]byte{0x04, 0x0e, 0x04, 0x01, 0x0b, 0x20, 0x00})
+	assert.Nil(err)
+	op, status, ok := e.commandResult()
+	assert.True(ok)
+	assert.Equal(uint16(hciOpLESetScanParameters), op)
+	assert.Equal(byte(0), status)
+	es, err := e.advertisingReports()
+	assert.Nil(err)
+	assert.Nil(es)
+
+	e, err = parseHCIEvent([]byte{0x04, 0x0f, 0x04, 0x01, 0x01, 0x0c, 0x20})
+	assert.Nil(err)
+	op, status, ok = e.commandResult()
+	assert.True(ok)
+	assert.Equal(uint16(hciOpLESetScanEnable), op)
+	assert.Equal(byte(1), status)
+
+	// Read RSSI of the connection 0x0040
+	e, err = parseHCIEvent([]byte{0x04, 0x0e, 0x07, 0x01, 0x05, 0x14, 0x00, 0x40, 0x00, 0xc5})
+	assert.Nil(err)
+	handle, status, rssi, ok := e.rssiResult()
+	assert.True(ok)
+	assert.Equal(uint16(0x0040), handle)
+	assert.Equal(byte(0), status)
+	assert.Equal(-59, rssi)
+	e, _ = parseHCIEvent([]byte{0x04, 0x0e, 0x04, 0x01, 0x0b, 0x20, 0x00})
+	_, _, _, ok = e.rssiResult()
+	assert.False(ok)
+
+	_, err = parseHCIEvent([]byte{0x04, 0x3e, 0x05, 0x02})
+	assert.NotNil(err)
+	_, err = parseHCIEvent([]byte{0x02, 0x40, 0x00})
+	assert.NotNil(err)
+}
+
+func Test_hciCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]byte{0x01, 0x0b, 0x20, 0x07, 0x01, 0x10, 0x00, 0x10, 0x00, 0x00, 0x00}, leSetScanParameters())
+	assert.Equal([]byte{0x01, 0x0c, 0x20, 0x02, 0x01, 0x01}, leSetScanEnable(true, false))
+	assert.Equal([]byte{0x01, 0x0c, 0x20, 0x02, 0x01, 0x00}, leSetScanEnable(true, true))
+	assert.Equal([]byte{0x01, 0x0c, 0x20, 0x02, 0x00, 0x01}, leSetScanEnable(false, false))
+	assert.Equal([]byte{0x01, 0x05, 0x14, 0x02, 0x40, 0x00}, hciReadRSSI(0x0040))
+}
+
+func Test_connInfoHandle(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, h := range []uint16{0x0040, 0x0100, 0x0e01} {
+		// hci_handle and the first byte of dev_class
+		var b [4]byte
+		binary.NativeEndian.PutUint16(b[:], h)
+		b[2] = 0x1f
+		assert.Equal(h, connInfoHandle(int(int32(binary.NativeEndian.Uint32(b[:])))))
+	}
+}
+
+func Test_parseBdaddr(t *testing.T) {
+	assert := assert.New(t)
+
+	a, err := parseBdaddr("AA:BB:CC:DD:EE:FF")
+	assert.Nil(err)
+	assert.Equal([6]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, a)
+	b, err := parseBdaddr("aabbccddeeff")
+	assert.Nil(err)
+	assert.Equal(a, b)
+	_, err = parseBdaddr("aabbcc")
+	assert.NotNil(err)
+}
+
+func Test_socketDisconnectReason(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(ErrLocalHostTerminated, socketDisconnectReason(syscall.ECONNRESET, true))
+	assert.Equal(ErrLocalHostTerminated, socketDisconnectReason(os.ErrClosed, false))
+	assert.Equal(ErrRemoteUserTerminated, socketDisconnectReason(&os.PathError{Err: syscall.ECONNRESET}, false))
+	assert.Equal(ErrSupervisionTimeout, socketDisconnectReason(syscall.ETIMEDOUT, false))
+	assert.True(errors.Is(socketDisconnectReason(syscall.EIO, false), ErrDisconnected))
+}
+
+func Test_SetBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewDevice(SetBackend(Backend(9)))
+	assert.NotNil(err)
+	assert.Equal("auto", BackendAuto.String())
+
+	b, err := ParseBackend("bluez")
+	assert.Nil(err)
+	assert.Equal(BackendBlueZ, b)
+	_, err = ParseBackend("usb")
+	assert.NotNil(err)
+}
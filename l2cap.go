@@ -7,16 +7,18 @@ import (
 	"io"
 	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
-
-	log "github.com/Sirupsen/logrus"
+	"time"
 )
 
 var (
 	infoRegex       = regexp.MustCompile("^info (.*)$")
 	connectRegex    = regexp.MustCompile("^connect (.*)$")
-	disconnectRegex = regexp.MustCompile("^disconnect$")
+	disconnectRegex = regexp.MustCompile("^disconnect(?: (.*))?$")
 	rssiRegex       = regexp.MustCompile("^rssi = (.*)$")
 	securityRegex   = regexp.MustCompile("^security = (.*)$")
 	writeRegex      = regexp.MustCompile("^write = (.*)$")
@@ -39,12 +41,35 @@ type L2CAP_BLE struct {
 	stdinPipe  io.WriteCloser
 	stdoutPipe io.ReadCloser
 	command    *exec.Cmd
+	exited     chan struct{} // closed when l2cap-ble has exited
+	// conn is the L2CAP socket of the socket backend, used instead of
+	// l2cap-ble.
+	conn io.ReadWriteCloser
 
 	device *device
 
 	Address string
 
 	ackChan chan string
+	// rssi receives the RSSI printed by l2cap-ble on UpdateRssi.
+	rssi   chan int
+	rssiMu sync.Mutex // serializes readRSSI
+	// closing is closed by Close, so that a response nobody reads does not
+	// keep Out from reaching the end of stdout.
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	mu sync.Mutex // protects p, connected, connectReported and connectTimer
+	// p is the peripheral handed to the connected and disconnected handlers.
+	p *peripheral
+	// connected is set by "connect success".
+	connected bool
+	// connectReported is set when the PeripheralConnected handler is called.
+	connectReported bool
+	connectTimer    *time.Timer
+	// localClose is set when this side asked the child to disconnect.
+	localClose     atomic.Bool
+	disconnectOnce sync.Once
 }
 
 func NewL2CAP(d *device, path string) (*L2CAP_BLE, error) {
@@ -52,6 +77,8 @@ func NewL2CAP(d *device, path string) (*L2CAP_BLE, error) {
 		path:    path,
 		device:  d,
 		ackChan: make(chan string),
+		rssi:    make(chan int, 1),
+		closing: make(chan struct{}),
 	}
 
 	return &l2cap, nil
@@ -59,8 +86,9 @@ func NewL2CAP(d *device, path string) (*L2CAP_BLE, error) {
 
 func (l2cap *L2CAP_BLE) Init(address, addressType string) error {
 	addr := AddrToCommaAddr(address)
-	log.Debugf("l2cap init: %s %s %s", l2cap.path, addr, addressType)
+	l2cap.device.log().Debug("l2cap init", "path", l2cap.path, "address", addr, "addressType", addressType)
 	cmd := exec.Command(l2cap.path, addr, addressType)
+	cmd.Env = l2cap.device.childEnv()
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -73,35 +101,63 @@ func (l2cap *L2CAP_BLE) Init(address, addressType string) error {
 	l2cap.stdinPipe = stdin
 	l2cap.stdoutPipe = stdout
 	l2cap.command = cmd
+	l2cap.exited = make(chan struct{})
 	l2cap.Address = address
 
-	go l2cap.Out()
-
-	cmd.Start()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
 
-	go cmd.Wait()
+	go l2cap.Out()
 
 	return nil
 }
 
+// Close disconnects and terminates l2cap-ble. It waits for the child to
+// exit and kills it if it does not exit within stopTimeout.
 func (l2cap *L2CAP_BLE) Close() error {
-	var errFinished = errors.New("os: process already finished")
+	l2cap.closeOnce.Do(func() {
+		if l2cap.closing != nil {
+			close(l2cap.closing)
+		}
+	})
+	if l2cap.conn != nil {
+		l2cap.localClose.Store(true)
+		err := l2cap.conn.Close()
+		<-l2cap.exited
+		return err
+	}
+	if l2cap.command == nil || l2cap.command.Process == nil {
+		return nil
+	}
+
+	l2cap.localClose.Store(true)
 
 	l2cap.stdinPipe.Close()
 	l2cap.stdoutPipe.Close()
 
-	err := l2cap.command.Process.Signal(syscall.SIGINT)
-	if err != nil && err != errFinished {
-		log.Infof("fail to stop l2cap: %s, %s", l2cap.Address, err)
+	err := stopProcess(l2cap.device.log(), l2cap.command.Process, l2cap.exited, l2cap.device.stopTimeoutOption())
+	if err != nil {
+		l2cap.device.log().Info("fail to stop l2cap", "address", l2cap.Address, "pid", pid(l2cap.command), "error", err)
 		return err
 	}
 	return nil
 }
 
 func (l2cap *L2CAP_BLE) Write(buf []byte) (int, error) {
+	if l2cap.conn != nil {
+		l2cap.device.trace(l2cap.Address, DirectionSent, buf)
+		n, err := l2cap.conn.Write(buf)
+		if err != nil {
+			return -1, fmt.Errorf("l2cap write err: %s", err)
+		}
+		return n, nil
+	}
 	data := ByteToString(buf)
 	data = strings.TrimSpace(data) + "\n"
-	log.Debugf("l2cap write:%v,%s", buf, strings.TrimSpace(data))
+	l2cap.device.log().Debug("l2cap write", "address", l2cap.Address, "pid", pid(l2cap.command), "opcode", opcode(buf), "data", strings.TrimSpace(data))
+	l2cap.device.trace(l2cap.Address, DirectionSent, buf)
+	l2cap.device.record(ChildL2CAP, l2cap.Address, pid(l2cap.command), DirIn, strings.TrimSpace(data))
 
 	n, err := io.WriteString(l2cap.stdinPipe, data)
 	if err != nil {
@@ -122,6 +178,7 @@ func (l2cap *L2CAP_BLE) Read(b []byte) (int, error) {
 	if err != nil {
 		return 0, fmt.Errorf("StringToByte failed: %s", err)
 	}
+	l2cap.device.trace(l2cap.Address, DirectionReceived, dd)
 	copy(b, dd)
 
 	return len(dd), nil
@@ -130,20 +187,116 @@ func (l2cap *L2CAP_BLE) Out() {
 	scanner := bufio.NewScanner(l2cap.stdoutPipe)
 	for scanner.Scan() {
 		buf := scanner.Text()
+		l2cap.device.record(ChildL2CAP, l2cap.Address, pid(l2cap.command), DirOut, buf)
 		err := l2cap.ParseStdout(buf)
 		if err != nil {
-			log.Errorf("l2cap Out failed:%s", err)
+			l2cap.device.log().Error("l2cap-ble output", "address", l2cap.Address, "pid", pid(l2cap.command), "error", err)
 		}
 	}
+	close(l2cap.ackChan)
+
+	// stdout is closed, so the child has gone. If it did not say
+	// "disconnect" first, it crashed or was killed.
+	err := l2cap.command.Wait()
+	close(l2cap.exited)
+	switch {
+	case l2cap.localClose.Load():
+		l2cap.disconnected(ErrLocalHostTerminated)
+	case err != nil:
+		l2cap.disconnected(fmt.Errorf("%w: l2cap-ble: %s", ErrChildExited, err))
+	default:
+		l2cap.disconnected(fmt.Errorf("%w: l2cap-ble", ErrChildExited))
+	}
+}
+
+// ack hands a response to Read. It is dropped once Close is called.
+func (l2cap *L2CAP_BLE) ack(lineData string) {
+	select {
+	case l2cap.ackChan <- lineData:
+	case <-l2cap.closing:
+	}
+}
+
+// peripheral returns the peripheral which is bound to this connection.
+func (l2cap *L2CAP_BLE) peripheral() *peripheral {
+	l2cap.mu.Lock()
+	defer l2cap.mu.Unlock()
+	if l2cap.p == nil {
+		p := NewPeripheral(l2cap.device, l2cap, l2cap.Address)
+		l2cap.p = &p
+	}
+	return l2cap.p
+}
+
+// connectResult reports the result of the connection to the
+// PeripheralConnected handler. Only the first result is reported; it
+// returns false if a result was already reported.
+func (l2cap *L2CAP_BLE) connectResult(err error) bool {
+	l2cap.mu.Lock()
+	if l2cap.connectReported {
+		l2cap.mu.Unlock()
+		return false
+	}
+	l2cap.connectReported = true
+	l2cap.connected = err == nil
+	if l2cap.connectTimer != nil {
+		l2cap.connectTimer.Stop()
+	}
+	l2cap.mu.Unlock()
+	if err != nil {
+		l2cap.device.stats().connectFailure()
+	}
+
+	// The MTU is exchanged on the dispatcher, so that a disconnection
+	// during the exchange is reported after the connection.
+	p := l2cap.peripheral()
+	mtu := l2cap.device.exchangeMTU()
+	f := l2cap.device.peripheralConnected
+	l2cap.device.dispatch(func() {
+		if err == nil && mtu > 0 {
+			if err := p.SetMTU(mtu); err != nil {
+				l2cap.device.log().Error("mtu exchange failed", "address", l2cap.Address, "error", err)
+			}
+		}
+		if f != nil {
+			f(p, err)
+		}
+	})
+	return true
+}
+
+// disconnected reports the end of the connection to the
+// PeripheralDisconnected handler. Only the first reason is reported. If
+// the connection was never established, the reason goes to the
+// PeripheralConnected handler instead.
+func (l2cap *L2CAP_BLE) disconnected(reason error) {
+	l2cap.disconnectOnce.Do(func() {
+		l2cap.device.log().Debug("l2cap disconnected", "address", l2cap.Address, "reason", reason)
+		l2cap.device.removeL2CAP(l2cap)
+		if l2cap.connectResult(reason) {
+			return
+		}
+
+		l2cap.mu.Lock()
+		connected := l2cap.connected
+		l2cap.mu.Unlock()
+		if connected {
+			l2cap.device.stats().disconnect(reason)
+		}
+		if f := l2cap.device.peripheralDisconnected; connected && f != nil {
+			p := l2cap.peripheral()
+			l2cap.device.dispatch(func() { f(p, reason) })
+		}
+	})
 }
 
 func (l2cap *L2CAP_BLE) ParseStdout(buf string) error {
-	log.Debugf("line = %s", buf)
+	l2cap.device.log().Debug("l2cap-ble output", "address", l2cap.Address, "pid", pid(l2cap.command), "line", buf)
 
 	switch {
 	case infoRegex.MatchString(buf):
 		// do nothing
-		log.Printf(buf)
+		l2cap.device.log().Info("l2cap-ble info", "address", l2cap.Address, "line", buf)
 	case connectRegex.MatchString(buf):
 		tmp := connectRegex.FindStringSubmatch(buf)
 		if len(tmp) != 2 {
@@ -153,39 +306,44 @@ func (l2cap *L2CAP_BLE) ParseStdout(buf string) error {
 		if tmp[1] == "success" {
 			err = nil
 		} else {
-			err = fmt.Errorf(tmp[1])
-		}
-
-		p := NewPeripheral(l2cap.device, l2cap, l2cap.Address)
-		if l2cap.device.peripheralConnected != nil {
-			go l2cap.device.peripheralConnected(&p, err)
+			err = errors.New(tmp[1])
 		}
+		l2cap.connectResult(err)
 	case disconnectRegex.MatchString(buf):
-		p := NewPeripheral(l2cap.device, l2cap, l2cap.Address)
-		if l2cap.device.peripheralDisconnected != nil {
-			go l2cap.device.peripheralDisconnected(&p, nil)
+		// l2cap-ble exits by itself after printing disconnect. It prints
+		// the address of the peripheral, not the reason.
+		if l2cap.localClose.Load() {
+			l2cap.disconnected(ErrLocalHostTerminated)
+		} else {
+			l2cap.disconnected(ErrDisconnected)
 		}
-
-		l2cap.Close()
 	case rssiRegex.MatchString(buf):
 		tmp := rssiRegex.FindStringSubmatch(buf)
 		if len(tmp) != 2 {
 			return fmt.Errorf("invalid rssi line: %s", buf)
 		}
-		fmt.Printf("rssi: %d", tmp[1])
+		rssi, err := strconv.Atoi(tmp[1])
+		if err != nil {
+			return fmt.Errorf("invalid rssi line: %s", buf)
+		}
+		l2cap.device.log().Debug("rssi", "address", l2cap.Address, "rssi", rssi)
+		select {
+		case l2cap.rssi <- rssi:
+		default:
+		}
 	case securityRegex.MatchString(buf):
 		tmp := securityRegex.FindStringSubmatch(buf)
 		if len(tmp) != 2 {
 			return fmt.Errorf("invalid security line: %s", buf)
 		}
-		fmt.Printf("security: %d", tmp[1])
+		l2cap.device.log().Debug("security", "address", l2cap.Address, "security", tmp[1])
 	case writeRegex.MatchString(buf):
 		tmp := writeRegex.FindStringSubmatch(buf)
 		if len(tmp) != 2 {
 			return fmt.Errorf("invalid write line: %s", buf)
 		}
 		if tmp[1] != "success" {
-			log.Printf("write failed:%s", tmp)
+			l2cap.device.log().Error("write failed", "address", l2cap.Address, "result", tmp[1])
 			// TODO: re-issue current command
 		}
 	case dataRegex.MatchString(buf):
@@ -193,8 +351,7 @@ func (l2cap *L2CAP_BLE) ParseStdout(buf string) error {
 		if len(tmp) != 2 {
 			return fmt.Errorf("invalid data line: %s", buf)
 		}
-		lineData := tmp[1]
-		l2cap.ackChan <- lineData
+		l2cap.ack(tmp[1])
 	default:
 		return fmt.Errorf("unknown stdout: %s", buf)
 	}
@@ -202,11 +359,96 @@ func (l2cap *L2CAP_BLE) ParseStdout(buf string) error {
 }
 
 func (l2cap *L2CAP_BLE) Disconnect() error {
+	l2cap.localClose.Store(true)
 	return l2cap.command.Process.Signal(syscall.SIGHUP)
 }
 func (l2cap *L2CAP_BLE) UpdateRssi() error {
 	return l2cap.command.Process.Signal(syscall.SIGUSR1)
 }
+
+// rssiTimeout is how long readRSSI waits for the RSSI.
+const rssiTimeout = 2 * time.Second
+
+// connRSSIReader is a backend which reads the RSSI of a connection of its
+// L2CAP sockets.
+type connRSSIReader interface {
+	readRSSI(conn io.ReadWriteCloser) (int, error)
+}
+
+// readRSSI reads the RSSI of the connection, from l2cap-ble or from the
+// socket backend.
+func (l2cap *L2CAP_BLE) readRSSI() (int, error) {
+	if l2cap.conn != nil {
+		r, ok := l2cap.device.backend.(connRSSIReader)
+		if !ok {
+			return 0, errors.New("rssi is not supported by the backend")
+		}
+		return r.readRSSI(l2cap.conn)
+	}
+	if l2cap.command == nil || l2cap.command.Process == nil {
+		return 0, errors.New("l2cap-ble is not started")
+	}
+
+	l2cap.rssiMu.Lock()
+	defer l2cap.rssiMu.Unlock()
+	// drop the answer to a request which timed out
+	select {
+	case <-l2cap.rssi:
+	default:
+	}
+	if err := l2cap.UpdateRssi(); err != nil {
+		return 0, err
+	}
+	t := time.NewTimer(rssiTimeout)
+	defer t.Stop()
+	select {
+	case rssi := <-l2cap.rssi:
+		return rssi, nil
+	case <-l2cap.closing:
+		return 0, ErrDisconnected
+	case <-l2cap.exited:
+		return 0, ErrDisconnected
+	case <-t.C:
+		return 0, errors.New("l2cap-ble: rssi timeout")
+	}
+}
+
 func (l2cap *L2CAP_BLE) UpgradeSecurity() error {
 	return l2cap.command.Process.Signal(syscall.SIGUSR2)
 }
+
+// HCI disconnect reasons, Bluetooth Core Spec Vol 2, Part D.
+const (
+	hciConnectionTimeout           = 0x08
+	hciRemoteUserTerminated        = 0x13
+	hciRemoteLowResources          = 0x14
+	hciRemotePowerOff              = 0x15
+	hciLocalHostTerminated         = 0x16
+	hciConnectionFailedToEstablish = 0x3e
+)
+
+// disconnectReason classifies the HCI reason code which noble gives with
+// its disconnect event ("0x08"), as sent by the node helper.
+func disconnectReason(reason string, local bool) error {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		if local {
+			return ErrLocalHostTerminated
+		}
+		return ErrDisconnected
+	}
+
+	code, err := strconv.ParseUint(strings.TrimPrefix(reason, "0x"), 16, 8)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrDisconnected, reason)
+	}
+	switch code {
+	case hciConnectionTimeout, hciConnectionFailedToEstablish:
+		return ErrSupervisionTimeout
+	case hciRemoteUserTerminated, hciRemoteLowResources, hciRemotePowerOff:
+		return ErrRemoteUserTerminated
+	case hciLocalHostTerminated:
+		return ErrLocalHostTerminated
+	}
+	return fmt.Errorf("%w: reason 0x%02x", ErrDisconnected, code)
+}
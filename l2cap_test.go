@@ -0,0 +1,96 @@
+package noblechild
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_disconnectReason(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(ErrDisconnected, disconnectReason("", false))
+	assert.Equal(ErrLocalHostTerminated, disconnectReason("", true))
+
+	assert.Equal(ErrSupervisionTimeout, disconnectReason("0x08", false))
+	assert.Equal(ErrRemoteUserTerminated, disconnectReason("0x13", false))
+	assert.Equal(ErrRemoteUserTerminated, disconnectReason("15", false))
+	assert.Equal(ErrLocalHostTerminated, disconnectReason("0x16", false))
+
+	err := disconnectReason("0x3b", false)
+	assert.True(errors.Is(err, ErrDisconnected))
+	assert.Equal("disconnected: reason 0x3b", err.Error())
+}
+
+func Test_disconnectRegex(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := disconnectRegex.FindStringSubmatch("disconnect")
+	assert.Equal(2, len(tmp))
+	assert.Equal("", tmp[1])
+
+	tmp = disconnectRegex.FindStringSubmatch("disconnect 11:22:33:44:55:66")
+	assert.Equal(2, len(tmp))
+}
+
+func Test_L2CAPDisconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, local := range []bool{false, true} {
+		reasons := make(chan error, 1)
+		d := &device{l2caps: map[string]*L2CAP_BLE{}}
+		d.Handle(PeripheralDisconnected(func(p gatt.Peripheral, err error) { reasons <- err }))
+		l2cap := &L2CAP_BLE{device: d, Address: "112233445566", ackChan: make(chan string)}
+		d.l2caps[l2cap.Address] = l2cap
+
+		assert.Nil(l2cap.ParseStdout("connect success"))
+		l2cap.localClose.Store(local)
+		// l2cap-ble prints the address, which is not a reason
+		assert.Nil(l2cap.ParseStdout("disconnect 11:22:33:44:55:66"))
+		if local {
+			assert.Equal(ErrLocalHostTerminated, <-reasons)
+		} else {
+			assert.Equal(ErrDisconnected, <-reasons)
+		}
+		assert.Empty(d.l2caps)
+	}
+}
+
+func Test_L2CAPDisconnectDuringMTU(t *testing.T) {
+	assert := assert.New(t)
+
+	// The link drops before the MTU response: the exchange fails, and the
+	// connection is reported before the disconnection.
+	events := make(chan string, 2)
+	d := &device{l2caps: map[string]*L2CAP_BLE{}, dispatcher: newDispatcher(), preferredMTU: 185}
+	defer d.dispatcher.closeAll()
+	d.Handle(
+		PeripheralConnected(func(p gatt.Peripheral, err error) { events <- "connected" }),
+		PeripheralDisconnected(func(p gatt.Peripheral, err error) { events <- "disconnected" }),
+	)
+	stdin := &lineBuffer{}
+	l2cap := &L2CAP_BLE{device: d, Address: "112233445566", ackChan: make(chan string), closing: make(chan struct{}), stdinPipe: stdin}
+	d.l2caps[l2cap.Address] = l2cap
+
+	assert.Nil(l2cap.ParseStdout("connect success"))
+	for i := 0; stdin.String() == "" && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal("02b900\n", stdin.String())
+	assert.Nil(l2cap.ParseStdout("disconnect 11:22:33:44:55:66"))
+	close(l2cap.ackChan)
+
+	for _, want := range []string{"connected", "disconnected"} {
+		select {
+		case e := <-events:
+			assert.Equal(want, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("not %s", want)
+		}
+	}
+	_, err := l2cap.peripheral().sendReq(attOpReadReq, []byte{attOpReadReq, 0x03, 0x00})
+	assert.Equal(ErrDisconnected, err)
+}
@@ -0,0 +1,75 @@
+package noblechild
+
+import (
+	"fmt"
+	"os/exec"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Logger receives the logs of a device. args are key-value pairs, as in
+// log/slog, so a *slog.Logger can be used as is.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// defaultLogger is used by a device without the Logger option.
+var defaultLogger = LogrusLogger(log.StandardLogger())
+
+// LogrusLogger adapts a logrus logger to Logger. The key-value pairs
+// become logrus fields.
+func LogrusLogger(l log.FieldLogger) Logger {
+	return logrusLogger{l}
+}
+
+type logrusLogger struct {
+	l log.FieldLogger
+}
+
+func (l logrusLogger) Debug(msg string, args ...any) { l.l.WithFields(logrusFields(args)).Debug(msg) }
+func (l logrusLogger) Info(msg string, args ...any)  { l.l.WithFields(logrusFields(args)).Info(msg) }
+func (l logrusLogger) Warn(msg string, args ...any)  { l.l.WithFields(logrusFields(args)).Warn(msg) }
+func (l logrusLogger) Error(msg string, args ...any) { l.l.WithFields(logrusFields(args)).Error(msg) }
+
+// logrusFields makes fields of key-value pairs. A key without a value is
+// kept under "!BADKEY" as slog does.
+func logrusFields(args []any) log.Fields {
+	f := make(log.Fields, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			f["!BADKEY"] = args[i]
+			break
+		}
+		f[fmt.Sprint(args[i])] = args[i+1]
+	}
+	return f
+}
+
+// NopLogger discards every log.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// pid returns the pid of cmd, or 0 if it is not started.
+func pid(cmd *exec.Cmd) int {
+	if cmd == nil || cmd.Process == nil {
+		return 0
+	}
+	return cmd.Process.Pid
+}
+
+// opcode formats the ATT opcode of the PDU b for logs.
+func opcode(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("0x%02x", b[0])
+}
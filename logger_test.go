@@ -0,0 +1,56 @@
+package noblechild
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SetLoggerSlog(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	d := &device{}
+	assert.Nil(d.Option(SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))))
+
+	l2cap := &L2CAP_BLE{device: d, Address: "aabbccddeeff"}
+	assert.Nil(l2cap.ParseStdout("write = failed"))
+
+	var rec map[string]any
+	assert.Nil(json.Unmarshal(buf.Bytes(), &rec))
+	assert.Equal("ERROR", rec["level"])
+	assert.Equal("write failed", rec["msg"])
+	assert.Equal("aabbccddeeff", rec["address"])
+	assert.Equal("failed", rec["result"])
+}
+
+func Test_LogrusLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	ll := log.New()
+	ll.Out = &buf
+	ll.Formatter = &log.JSONFormatter{}
+	ll.Level = log.DebugLevel
+
+	l := LogrusLogger(ll)
+	l.Debug("att server request", "opcode", opcode([]byte{0x0a, 0x01}), "pid", 42)
+
+	var rec map[string]any
+	assert.Nil(json.Unmarshal(buf.Bytes(), &rec))
+	assert.Equal("debug", rec["level"])
+	assert.Equal("att server request", rec["msg"])
+	assert.Equal("0x0a", rec["opcode"])
+	assert.Equal(float64(42), rec["pid"])
+
+	assert.Equal(log.Fields{"a": 1, "!BADKEY": "b"}, logrusFields([]any{"a", 1, "b"}))
+
+	// the standard logger is left as it is
+	assert.Equal(log.InfoLevel, log.StandardLogger().Level)
+	NopLogger.Error("nothing")
+	assert.Equal("", opcode(nil))
+}
@@ -0,0 +1,181 @@
+package noblechild
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// Company identifiers of the built-in decoders.
+const (
+	companyMicrosoft = 0x0006
+	companyRuuvi     = 0x0499
+)
+
+// ManufacturerData is a manufacturer specific data in an advertisement.
+// gatt.Advertisement.ManufacturerData, given to the PeripheralDiscovered
+// handler, keeps only the last one; every one is in the Manufacturers of
+// DiscoveryEvent(p), or of Discovery.Event.
+type ManufacturerData struct {
+	CompanyID uint16
+	Data      []byte // the data following the company ID
+
+	// Decoded is the value returned by the decoder registered for
+	// CompanyID, or nil if there is none or it failed.
+	Decoded interface{}
+	// Err is the error returned by the decoder.
+	Err error
+}
+
+// Bytes returns the manufacturer data with the company ID, as in
+// gatt.Advertisement.
+func (md ManufacturerData) Bytes() []byte {
+	b := binary.LittleEndian.AppendUint16(nil, md.CompanyID)
+	return append(b, md.Data...)
+}
+
+// ManufacturerDecoder decodes the manufacturer data of a company. data does
+// not include the company ID. It returns nil without an error when the
+// data is not a format it knows.
+type ManufacturerDecoder func(data []byte) (interface{}, error)
+
+var manufacturerDecoders = struct {
+	sync.RWMutex
+	m map[uint16]ManufacturerDecoder
+}{m: map[uint16]ManufacturerDecoder{
+	companyApple:     decodeApple,
+	companyMicrosoft: decodeMicrosoft,
+	companyRuuvi:     decodeRuuvi,
+}}
+
+// RegisterManufacturerDecoder registers f as the decoder of companyID,
+// replacing the previous one. A nil f removes the decoder.
+func RegisterManufacturerDecoder(companyID uint16, f ManufacturerDecoder) {
+	manufacturerDecoders.Lock()
+	defer manufacturerDecoders.Unlock()
+	if f == nil {
+		delete(manufacturerDecoders.m, companyID)
+		return
+	}
+	manufacturerDecoders.m[companyID] = f
+}
+
+// decodeManufacturerData decodes b, a manufacturer specific data with the
+// company ID. ok is false when b is too short to have one.
+func decodeManufacturerData(b []byte) (md ManufacturerData, ok bool) {
+	if len(b) < 2 {
+		return md, false
+	}
+	md.CompanyID = binary.LittleEndian.Uint16(b)
+	md.Data = b[2:]
+
+	manufacturerDecoders.RLock()
+	f := manufacturerDecoders.m[md.CompanyID]
+	manufacturerDecoders.RUnlock()
+	if f != nil {
+		md.Decoded, md.Err = f(md.Data)
+	}
+	return md, true
+}
+
+// decodeApple decodes iBeacon.
+func decodeApple(b []byte) (interface{}, error) {
+	if len(b) < 2 || b[0] != 0x02 || b[1] != 0x15 {
+		return nil, nil
+	}
+	return parseIBeacon(b)
+}
+
+// MicrosoftCDP is the Connected Devices Platform beacon of Microsoft.
+type MicrosoftCDP struct {
+	ScenarioType byte
+	Version      byte
+	DeviceType   byte
+	Flags        byte
+	Salt         [4]byte
+	DeviceHash   []byte
+}
+
+func decodeMicrosoft(b []byte) (interface{}, error) {
+	if len(b) < 8 || b[0] != 0x01 {
+		return nil, nil
+	}
+	cdp := &MicrosoftCDP{
+		ScenarioType: b[0],
+		Version:      b[1] >> 5,
+		DeviceType:   b[1] & 0x1f,
+		Flags:        b[2],
+		DeviceHash:   b[8:],
+	}
+	copy(cdp.Salt[:], b[4:8])
+	return cdp, nil
+}
+
+// RuuviTag is the data format 5 (RAWv2) of RuuviTag. Fields the tag does
+// not measure are nil.
+type RuuviTag struct {
+	Temperature     *float64 // Celsius
+	Humidity        *float64 // %
+	Pressure        *int     // Pa
+	AccelerationX   *int     // mG
+	AccelerationY   *int     // mG
+	AccelerationZ   *int     // mG
+	BatteryVoltage  *int     // mV
+	TxPower         *int     // dBm
+	MovementCounter *int
+	MeasurementSeq  *int
+	Address         string
+}
+
+func decodeRuuvi(b []byte) (interface{}, error) {
+	if len(b) == 0 || b[0] != 0x05 {
+		return nil, nil
+	}
+	if len(b) != 24 {
+		return nil, fmt.Errorf("ruuvi: invalid RAWv2 length %d", len(b))
+	}
+
+	r := &RuuviTag{}
+	if v := int16(binary.BigEndian.Uint16(b[1:])); v != -0x8000 {
+		t := float64(v) * 0.005
+		r.Temperature = &t
+	}
+	if v := binary.BigEndian.Uint16(b[3:]); v != 0xffff {
+		h := float64(v) * 0.0025
+		r.Humidity = &h
+	}
+	if v := binary.BigEndian.Uint16(b[5:]); v != 0xffff {
+		p := int(v) + 50000
+		r.Pressure = &p
+	}
+	accel := func(off int) *int {
+		v := int16(binary.BigEndian.Uint16(b[off:]))
+		if v == -0x8000 {
+			return nil
+		}
+		a := int(v)
+		return &a
+	}
+	r.AccelerationX = accel(7)
+	r.AccelerationY = accel(9)
+	r.AccelerationZ = accel(11)
+	power := binary.BigEndian.Uint16(b[13:])
+	if v := power >> 5; v != 0x7ff {
+		mv := int(v) + 1600
+		r.BatteryVoltage = &mv
+	}
+	if v := power & 0x1f; v != 0x1f {
+		tx := int(v)*2 - 40
+		r.TxPower = &tx
+	}
+	if v := b[15]; v != 0xff {
+		m := int(v)
+		r.MovementCounter = &m
+	}
+	if v := binary.BigEndian.Uint16(b[16:]); v != 0xffff {
+		s := int(v)
+		r.MeasurementSeq = &s
+	}
+	r.Address = fmt.Sprintf("%x", b[18:24])
+	return r, nil
+}
@@ -0,0 +1,95 @@
+package noblechild
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_decodeRuuvi(t *testing.T) {
+	assert := assert.New(t)
+
+	// the valid test vector of the RAWv2 specification
+	b, _ := hex.DecodeString("0512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F")
+	v, err := decodeRuuvi(b)
+	assert.Nil(err)
+	r := v.(*RuuviTag)
+	assert.InDelta(24.3, *r.Temperature, 0.0001)
+	assert.InDelta(53.49, *r.Humidity, 0.0001)
+	assert.Equal(100044, *r.Pressure)
+	assert.Equal(4, *r.AccelerationX)
+	assert.Equal(-4, *r.AccelerationY)
+	assert.Equal(1036, *r.AccelerationZ)
+	assert.Equal(2977, *r.BatteryVoltage)
+	assert.Equal(4, *r.TxPower)
+	assert.Equal(66, *r.MovementCounter)
+	assert.Equal(205, *r.MeasurementSeq)
+	assert.Equal("cbb8334c884f", r.Address)
+
+	// the invalid values vector
+	b, _ = hex.DecodeString("058000FFFFFFFF800080008000FFFFFFFFFFFFFFFFFFFFFF")
+	v, err = decodeRuuvi(b)
+	assert.Nil(err)
+	r = v.(*RuuviTag)
+	assert.Nil(r.Temperature)
+	assert.Nil(r.Humidity)
+	assert.Nil(r.Pressure)
+	assert.Nil(r.AccelerationZ)
+	assert.Nil(r.BatteryVoltage)
+	assert.Nil(r.TxPower)
+	assert.Nil(r.MeasurementSeq)
+}
+
+func Test_ManufacturersInEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	u := gatt.MustParseUUID("e2c56db5-dffb-48d2-b060-d0f5a71096e0")
+	a, _ := IBeaconPacket(u, 1, 2, -59)
+	eir := appendAD(advPacketBytes(a)[3:], adManufacturerData, []byte{0xff, 0xff, 0x01})
+	e, err := parseEvent("event 00:11:22:33:44:55,random," + hex.EncodeToString(eir) + ",-59")
+	assert.Nil(err)
+
+	assert.Equal(2, len(e.Manufacturers))
+	assert.Equal(uint16(companyApple), e.Manufacturers[0].CompanyID)
+	assert.Equal(&IBeacon{UUID: u, Major: 1, Minor: 2, MeasuredPower: -59}, e.Manufacturers[0].Decoded)
+	assert.Equal(uint16(0xffff), e.Manufacturers[1].CompanyID)
+	assert.Nil(e.Manufacturers[1].Decoded)
+	// the advertisement keeps the last one
+	assert.Equal([]byte{0xff, 0xff, 0x01}, e.Advertisement.ManufacturerData)
+
+	// the beacon is found even if it is not the last one
+	b, err := e.Beacon()
+	assert.Nil(err)
+	assert.NotNil(b.IBeacon)
+}
+
+func Test_RegisterManufacturerDecoder(t *testing.T) {
+	assert := assert.New(t)
+
+	errBad := errors.New("bad")
+	RegisterManufacturerDecoder(0xfffe, func(b []byte) (interface{}, error) {
+		if len(b) == 0 {
+			return nil, errBad
+		}
+		return int(b[0]), nil
+	})
+	defer RegisterManufacturerDecoder(0xfffe, nil)
+
+	md, ok := decodeManufacturerData([]byte{0xfe, 0xff, 0x07})
+	assert.True(ok)
+	assert.Equal(7, md.Decoded)
+	assert.Equal([]byte{0xfe, 0xff, 0x07}, md.Bytes())
+
+	md, _ = decodeManufacturerData([]byte{0xfe, 0xff})
+	assert.Equal(errBad, md.Err)
+
+	RegisterManufacturerDecoder(0xfffe, nil)
+	md, _ = decodeManufacturerData([]byte{0xfe, 0xff, 0x07})
+	assert.Nil(md.Decoded)
+
+	_, ok = decodeManufacturerData([]byte{0x01})
+	assert.False(ok)
+}
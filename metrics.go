@@ -0,0 +1,308 @@
+package noblechild
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// attLatencyBuckets are the upper bounds, in seconds, of the ATT request
+// latency histogram.
+var attLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics counts the scanning, connections and ATT traffic of a device.
+// It is an http.Handler which serves the counters in the Prometheus text
+// format. Rates, e.g. advertisements per second, are left to the
+// scraper.
+//
+// All methods can be called on a nil *Metrics, which counts nothing.
+type Metrics struct {
+	mu sync.Mutex
+
+	advertisements  uint64
+	discoveries     uint64
+	connectAttempts uint64
+	connectFailures uint64
+	disconnects     map[string]uint64 // by disconnectLabel
+	started         map[string]bool   // children started once
+	restarts        map[string]uint64 // by child
+	attLatency      map[byte]*histogram
+	attErrors       map[attEcode]uint64
+	attOtherErrors  uint64            // failures without an ATT error code
+	notifications   map[uint16]uint64 // by handle
+}
+
+// NewMetrics returns empty metrics to be given to the SetMetrics option.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		disconnects:   map[string]uint64{},
+		started:       map[string]bool{},
+		restarts:      map[string]uint64{},
+		attLatency:    map[byte]*histogram{},
+		attErrors:     map[attEcode]uint64{},
+		notifications: map[uint16]uint64{},
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(attLatencyBuckets, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (m *Metrics) advertisement() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.advertisements++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) discovery() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.discoveries++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) connectAttempt() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.connectAttempts++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) connectFailure() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.connectFailures++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) disconnect(reason error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.disconnects[disconnectLabel(reason)]++
+	m.mu.Unlock()
+}
+
+// childStarted counts every start of child after the first as a restart.
+func (m *Metrics) childStarted(child string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if m.started[child] {
+		m.restarts[child]++
+	}
+	m.started[child] = true
+	m.mu.Unlock()
+}
+
+// attResponse records the latency of the request op and the error code of
+// the response r, if any.
+func (m *Metrics) attResponse(op byte, r []byte, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observeLocked(op, d)
+	if len(r) >= 5 && r[0] == attOpError {
+		m.attErrors[attEcode(r[4])]++
+	}
+}
+
+// attResult records the latency and the error of an operation of the
+// BlueZ, node and websocket backends, which do not see the ATT PDUs. op is
+// the request the operation stands for.
+func (m *Metrics) attResult(op byte, err error, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observeLocked(op, d)
+	var ecode attEcode
+	switch {
+	case err == nil:
+	case errors.As(err, &ecode):
+		m.attErrors[ecode]++
+	default:
+		m.attOtherErrors++
+	}
+}
+
+func (m *Metrics) observeLocked(op byte, d time.Duration) {
+	h, ok := m.attLatency[op]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(attLatencyBuckets))}
+		m.attLatency[op] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *Metrics) notification(h uint16) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.notifications[h]++
+	m.mu.Unlock()
+}
+
+// nobleATTOps are the ATT requests the commands of the node helper and the
+// actions of ws-slave stand for.
+var nobleATTOps = map[string]byte{
+	"discoverServices":         attOpReadByGroupReq,
+	"discoverIncludedServices": attOpReadByTypeReq,
+	"discoverCharacteristics":  attOpReadByTypeReq,
+	"discoverDescriptors":      attOpFindInfoReq,
+	"read":                     attOpReadReq,
+	"readDescriptor":           attOpReadReq,
+	"readValue":                attOpReadReq,
+	"write":                    attOpWriteReq,
+	"writeDescriptor":          attOpWriteReq,
+	"writeValue":               attOpWriteReq,
+	"subscribe":                attOpWriteReq,
+	"unsubscribe":              attOpWriteReq,
+	"notify":                   attOpWriteReq,
+}
+
+// nobleATTOp returns the ATT request of a noble command. Writes without
+// response are not timed, like the write commands of the children.
+func nobleATTOp(cmd string, noRsp bool) (byte, bool) {
+	op, ok := nobleATTOps[cmd]
+	return op, ok && !noRsp
+}
+
+// disconnectLabel is the reason label of a disconnect.
+func disconnectLabel(reason error) string {
+	switch {
+	case errors.Is(reason, ErrRemoteUserTerminated):
+		return "remote_user_terminated"
+	case errors.Is(reason, ErrSupervisionTimeout):
+		return "supervision_timeout"
+	case errors.Is(reason, ErrLocalHostTerminated):
+		return "local_host_terminated"
+	case errors.Is(reason, ErrChildExited):
+		return "child_exited"
+	case errors.Is(reason, ErrDisconnected):
+		return "unknown"
+	}
+	return "other"
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	cw := &bytes.Buffer{}
+	m.mu.Lock()
+
+	counter := func(name, help string, v uint64) {
+		metricHeader(cw, name, help, "counter")
+		fmt.Fprintf(cw, "%s %d\n", name, v)
+	}
+	counter("noblechild_advertisements_total", "Advertisements received.", m.advertisements)
+	counter("noblechild_discoveries_total", "Advertisements reported to the PeripheralDiscovered handler.", m.discoveries)
+	counter("noblechild_connect_attempts_total", "Connections requested.", m.connectAttempts)
+	counter("noblechild_connect_failures_total", "Connections which were never established.", m.connectFailures)
+
+	metricHeader(cw, "noblechild_disconnects_total", "Disconnections by reason.", "counter")
+	for _, k := range sortedKeys(m.disconnects) {
+		fmt.Fprintf(cw, "noblechild_disconnects_total{reason=%q} %d\n", k, m.disconnects[k])
+	}
+
+	metricHeader(cw, "noblechild_child_restarts_total", "Restarts of a child process.", "counter")
+	for _, k := range sortedKeys(m.restarts) {
+		fmt.Fprintf(cw, "noblechild_child_restarts_total{child=%q} %d\n", k, m.restarts[k])
+	}
+
+	const latency = "noblechild_att_request_duration_seconds"
+	metricHeader(cw, latency, "ATT request latency by opcode.", "histogram")
+	for _, op := range sortedKeys(m.attLatency) {
+		h := m.attLatency[op]
+		label := fmt.Sprintf("opcode=\"0x%02x\"", op)
+		var n uint64
+		for i, b := range attLatencyBuckets {
+			n += h.counts[i]
+			fmt.Fprintf(cw, "%s_bucket{%s,le=%q} %d\n", latency, label, strconv.FormatFloat(b, 'g', -1, 64), n)
+		}
+		fmt.Fprintf(cw, "%s_bucket{%s,le=\"+Inf\"} %d\n", latency, label, h.count)
+		fmt.Fprintf(cw, "%s_sum{%s} %s\n", latency, label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(cw, "%s_count{%s} %d\n", latency, label, h.count)
+	}
+
+	metricHeader(cw, "noblechild_att_errors_total", "ATT error responses by error code.", "counter")
+	for _, e := range sortedKeys(m.attErrors) {
+		fmt.Fprintf(cw, "noblechild_att_errors_total{ecode=\"0x%02x\"} %d\n", byte(e), m.attErrors[e])
+	}
+	if m.attOtherErrors > 0 {
+		fmt.Fprintf(cw, "noblechild_att_errors_total{ecode=\"other\"} %d\n", m.attOtherErrors)
+	}
+
+	metricHeader(cw, "noblechild_notifications_total", "Notifications and indications by handle.", "counter")
+	for _, h := range sortedKeys(m.notifications) {
+		fmt.Fprintf(cw, "noblechild_notifications_total{handle=\"0x%04x\"} %d\n", h, m.notifications[h])
+	}
+
+	m.mu.Unlock()
+
+	n, err := w.Write(cw.Bytes())
+	return int64(n), err
+}
+
+func metricHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sortedKeys[K string | byte | uint16 | attEcode, V any](m map[K]V) []K {
+	ks := make([]K, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool { return ks[i] < ks[j] })
+	return ks
+}
+
+// stats returns the metrics of d, which may be nil.
+func (d *device) stats() *Metrics {
+	if d == nil {
+		return nil
+	}
+	d.optMu.RLock()
+	defer d.optMu.RUnlock()
+	return d.metrics
+}
@@ -0,0 +1,121 @@
+package noblechild
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Metrics(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewMetrics()
+	m.advertisement()
+	m.advertisement()
+	m.discovery()
+	m.connectAttempt()
+	m.connectFailure()
+	m.disconnect(ErrSupervisionTimeout)
+	m.disconnect(ErrSupervisionTimeout)
+	m.disconnect(ErrChildExited)
+	m.childStarted(ChildHCI)
+	m.childStarted(ChildHCI)
+	m.attResponse(attOpReadReq, []byte{attOpReadRsp, 1}, 20*time.Millisecond)
+	m.attResponse(attOpReadReq, []byte{attOpError, attOpReadReq, 3, 0, byte(attEcodeReadNotPerm)}, 2*time.Second)
+	m.notification(0x0012)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal("text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	out := rec.Body.String()
+
+	for _, l := range []string{
+		"# TYPE noblechild_advertisements_total counter",
+		"noblechild_advertisements_total 2",
+		"noblechild_discoveries_total 1",
+		"noblechild_connect_attempts_total 1",
+		"noblechild_connect_failures_total 1",
+		`noblechild_disconnects_total{reason="child_exited"} 1`,
+		`noblechild_disconnects_total{reason="supervision_timeout"} 2`,
+		`noblechild_child_restarts_total{child="hci-ble"} 1`,
+		"# TYPE noblechild_att_request_duration_seconds histogram",
+		`noblechild_att_request_duration_seconds_bucket{opcode="0x0a",le="0.01"} 0`,
+		`noblechild_att_request_duration_seconds_bucket{opcode="0x0a",le="0.025"} 1`,
+		`noblechild_att_request_duration_seconds_bucket{opcode="0x0a",le="2.5"} 2`,
+		`noblechild_att_request_duration_seconds_bucket{opcode="0x0a",le="+Inf"} 2`,
+		`noblechild_att_request_duration_seconds_sum{opcode="0x0a"} 2.02`,
+		`noblechild_att_request_duration_seconds_count{opcode="0x0a"} 2`,
+		`noblechild_att_errors_total{ecode="0x02"} 1`,
+		`noblechild_notifications_total{handle="0x0012"} 1`,
+	} {
+		assert.Contains(out, l+"\n")
+	}
+
+	// nil counts nothing
+	var nm *Metrics
+	nm.advertisement()
+	n, err := nm.WriteTo(&strings.Builder{})
+	assert.Nil(err)
+	assert.Equal(int64(0), n)
+}
+
+func Test_MetricsATT(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewMetrics()
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+	svcs, table := testServices(make(chan []byte, 1))
+	go NewATTServer(svcs, table, sc).Serve()
+	p := newPeripheral(&device{metrics: m}, nil, cc, "aabbccddeeff")
+
+	_, err := p.DiscoverServices(nil)
+	assert.Nil(err)
+
+	var b strings.Builder
+	m.WriteTo(&b)
+	// the last Read By Group Type request finds no attribute
+	assert.Contains(b.String(), `noblechild_att_request_duration_seconds_count{opcode="0x10"} 3`)
+	assert.Contains(b.String(), `noblechild_att_errors_total{ecode="0x0a"} 1`)
+}
+
+func Test_MetricsATTResult(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewMetrics()
+	m.attResult(attOpReadReq, nil, 20*time.Millisecond)
+	m.attResult(attOpReadReq, attEcodeReadNotPerm, time.Millisecond)
+	m.attResult(attOpWriteReq, errors.New("bluez: Operation failed"), time.Millisecond)
+
+	var b strings.Builder
+	m.WriteTo(&b)
+	assert.Contains(b.String(), `noblechild_att_request_duration_seconds_count{opcode="0x0a"} 2`)
+	assert.Contains(b.String(), `noblechild_att_request_duration_seconds_count{opcode="0x12"} 1`)
+	assert.Contains(b.String(), `noblechild_att_errors_total{ecode="0x02"} 1`)
+	assert.Contains(b.String(), `noblechild_att_errors_total{ecode="other"} 1`)
+
+	op, ok := nobleATTOp("readValue", false)
+	assert.True(ok)
+	assert.Equal(byte(attOpReadReq), op)
+	_, ok = nobleATTOp("write", true)
+	assert.False(ok)
+	_, ok = nobleATTOp("connect", false)
+	assert.False(ok)
+}
+
+func Test_disconnectLabel(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("remote_user_terminated", disconnectLabel(ErrRemoteUserTerminated))
+	assert.Equal("local_host_terminated", disconnectLabel(ErrLocalHostTerminated))
+	assert.Equal("child_exited", disconnectLabel(fmt.Errorf("%w: exit status 1", ErrChildExited)))
+	assert.Equal("unknown", disconnectLabel(disconnectReason("", false)))
+	assert.Equal("other", disconnectLabel(ErrConnectTimeout))
+}
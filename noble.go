@@ -4,11 +4,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/paypal/gatt"
 )
 
@@ -18,48 +16,89 @@ type NobleModule struct {
 	L2CAPPath string
 }
 
-func init() {
-	//	log.SetLevel(log.DebugLevel)
-	log.SetLevel(log.InfoLevel)
+// nobleLayouts are the directories under a search root where hci-ble and
+// l2cap-ble are built. The last entry allows a search root to be the
+// Release directory itself.
+var nobleLayouts = []string{
+	filepath.Join("node_modules", "noble", "build", "Release"),
+	filepath.Join("node_modules", "@abandonware", "noble", "build", "Release"),
+	filepath.Join("build", "Release"),
+	"",
 }
 
-// FindNobleModule finds noble module binaries such as hci-ble and l2cap-ble.
-func FindNobleModule() (NobleModule, error) {
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
-	if err != nil {
-		return NobleModule{}, err
+// DefaultNobleSearchPaths returns the directories searched by
+// FindNobleModule: NOBLE_TOPDIR, the directory of the executable and $HOME.
+func DefaultNobleSearchPaths() []string {
+	var paths []string
+	if p := os.Getenv("NOBLE_TOPDIR"); p != "" {
+		paths = append(paths, p)
 	}
-
-	paths := []string{
-		os.Getenv("NOBLE_TOPDIR"),
-		dir,
-		os.Getenv("HOME"),
+	if dir, err := filepath.Abs(filepath.Dir(os.Args[0])); err == nil {
+		paths = append(paths, dir)
+	}
+	if p := os.Getenv("HOME"); p != "" {
+		paths = append(paths, p)
 	}
+	return paths
+}
 
-	var m NobleModule
-	for _, p := range paths {
-		dir := path.Join(p, "node_modules", "noble", "build", "Release")
+// FindNobleModule finds noble module binaries such as hci-ble and l2cap-ble.
+func FindNobleModule() (NobleModule, error) {
+	return FindNobleModuleIn(DefaultNobleSearchPaths()...)
+}
 
-		hci := path.Join(dir, "hci-ble")
-		_, err := os.Stat(hci)
-		if err != nil {
-			continue
-		}
-		l2cap := path.Join(dir, "l2cap-ble")
-		_, err = os.Stat(l2cap)
-		if err != nil {
+// FindNobleModuleIn finds hci-ble and l2cap-ble under the given roots. Each
+// root may be the top of node_modules, a noble package directory or the
+// Release directory. The binaries must be executable.
+func FindNobleModuleIn(roots ...string) (NobleModule, error) {
+	return findModule(nobleLayouts, roots)
+}
+
+// findModule finds hci-ble and l2cap-ble in the layouts under the roots.
+func findModule(layouts, roots []string) (NobleModule, error) {
+	var tried []string
+	for _, root := range roots {
+		if root == "" {
 			continue
 		}
+		for _, layout := range layouts {
+			dir := filepath.Join(root, layout)
+			tried = append(tried, dir)
 
-		m := NobleModule{
-			Directory: dir,
-			HCIPath:   hci,
-			L2CAPPath: l2cap,
+			hci := filepath.Join(dir, "hci-ble")
+			if err := checkExecutable(hci); err != nil {
+				continue
+			}
+			l2cap := filepath.Join(dir, "l2cap-ble")
+			if err := checkExecutable(l2cap); err != nil {
+				continue
+			}
+
+			m := NobleModule{
+				Directory: dir,
+				HCIPath:   hci,
+				L2CAPPath: l2cap,
+			}
+			return m, nil
 		}
-		return m, nil
 	}
 
-	return m, fmt.Errorf("hci-ble and l2cap-ble not found")
+	return NobleModule{}, fmt.Errorf("hci-ble and l2cap-ble not found in %s", strings.Join(tried, ", "))
+}
+
+// checkExecutable returns an error if p is not an executable file.
+func checkExecutable(p string) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", p)
+	}
+	if fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", p)
+	}
+	return nil
 }
 
 // AddrToCommaAddr converts "aaaaaa" to "aa:aa:aa"
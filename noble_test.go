@@ -1,6 +1,8 @@
 package noblechild
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -34,3 +36,63 @@ func Test_StringToBytes(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal([]byte{0x10, 0x01, 0x00, 0xff, 0xff, 0x00, 0x28}, b2)
 }
+
+func writeBinary(t *testing.T, dir, name string, mode os.FileMode) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_FindNobleModuleIn(t *testing.T) {
+	assert := assert.New(t)
+
+	top := t.TempDir()
+	_, err := FindNobleModuleIn(top)
+	assert.NotNil(err)
+
+	// not executable
+	old := filepath.Join(top, "node_modules", "noble", "build", "Release")
+	writeBinary(t, old, "hci-ble", 0644)
+	writeBinary(t, old, "l2cap-ble", 0644)
+	_, err = FindNobleModuleIn(top)
+	assert.NotNil(err)
+
+	fork := filepath.Join(top, "node_modules", "@abandonware", "noble", "build", "Release")
+	writeBinary(t, fork, "hci-ble", 0755)
+	writeBinary(t, fork, "l2cap-ble", 0755)
+	m, err := FindNobleModuleIn("", top)
+	assert.Nil(err)
+	assert.Equal(fork, m.Directory)
+	assert.Equal(filepath.Join(fork, "hci-ble"), m.HCIPath)
+	assert.Equal(filepath.Join(fork, "l2cap-ble"), m.L2CAPPath)
+
+	// a Release directory itself
+	m, err = FindNobleModuleIn(fork)
+	assert.Nil(err)
+	assert.Equal(fork, m.Directory)
+}
+
+func Test_NoblePaths(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	writeBinary(t, dir, "hci", 0755)
+	writeBinary(t, dir, "l2cap", 0644)
+
+	d := &device{}
+	assert.Nil(d.Option(NoblePaths(filepath.Join(dir, "hci"), "")))
+	_, err := d.findNobleModule()
+	assert.NotNil(err)
+
+	assert.Nil(d.Option(NoblePaths(filepath.Join(dir, "hci"), filepath.Join(dir, "l2cap"))))
+	_, err = d.findNobleModule()
+	assert.NotNil(err)
+
+	os.Chmod(filepath.Join(dir, "l2cap"), 0755)
+	m, err := d.findNobleModule()
+	assert.Nil(err)
+	assert.Equal(filepath.Join(dir, "l2cap"), m.L2CAPPath)
+}
@@ -0,0 +1,894 @@
+package noblechild
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	gatt "github.com/paypal/gatt"
+)
+
+// nodeHelperScript drives noble for BackendNode. It is given to node with
+// -e, so nothing is installed next to noble.
+//
+//go:embed nodehelper.js
+var nodeHelperScript string
+
+// ChildNode is the name of the noble helper in the metrics.
+const ChildNode = "noble-helper"
+
+// nobleJSPackages are the noble packages BackendNode can load, the
+// maintained fork first.
+var nobleJSPackages = []string{"@abandonware/noble", "noble"}
+
+// ErrNodeHelperExited is returned by the requests which were pending when
+// the noble helper exited.
+var ErrNodeHelperExited = errors.New("noble helper exited")
+
+// findNobleJS finds a node_modules directory with a noble package under
+// the roots. Each root may be node_modules itself or its parent.
+func findNobleJS(roots []string) (modules, pkg string, err error) {
+	var tried []string
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		for _, dir := range []string{filepath.Join(root, "node_modules"), root} {
+			for _, pkg := range nobleJSPackages {
+				p := filepath.Join(dir, filepath.FromSlash(pkg))
+				tried = append(tried, p)
+				if _, err := os.Stat(filepath.Join(p, "package.json")); err == nil {
+					return dir, pkg, nil
+				}
+			}
+		}
+	}
+	return "", "", fmt.Errorf("noble not found in %s", strings.Join(tried, ", "))
+}
+
+// nodeRequest is a line written to the helper.
+type nodeRequest struct {
+	ID              int    `json:"id"`
+	Cmd             string `json:"cmd"`
+	Address         string `json:"address,omitempty"`
+	Path            []int  `json:"path,omitempty"`
+	Data            string `json:"data,omitempty"`
+	AllowDuplicates bool   `json:"allowDuplicates,omitempty"`
+	WithoutResponse bool   `json:"withoutResponse,omitempty"`
+}
+
+// nodeMessage is a line printed by the helper: the response to a request
+// if Event is empty, or an event.
+type nodeMessage struct {
+	ID     int             `json:"id,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+
+	Event         string             `json:"event,omitempty"`
+	State         string             `json:"state,omitempty"`
+	Address       string             `json:"address,omitempty"`
+	AddressType   string             `json:"addressType,omitempty"`
+	RSSI          int                `json:"rssi,omitempty"`
+	Advertisement *nodeAdvertisement `json:"advertisement,omitempty"`
+	Reason        string             `json:"reason,omitempty"`
+	Path          []int              `json:"path,omitempty"`
+	Data          string             `json:"data,omitempty"`
+}
+
+// nodeAdvertisement is peripheral.advertisement of noble, as the node
+// helper and ws-slave give it.
+type nodeAdvertisement struct {
+	LocalName        string            `json:"localName,omitempty"`
+	TxPowerLevel     *int              `json:"txPowerLevel,omitempty"`
+	ServiceUUIDs     []string          `json:"serviceUuids,omitempty"`
+	ManufacturerData string            `json:"manufacturerData,omitempty"`
+	ServiceData      []nodeServiceData `json:"serviceData,omitempty"`
+}
+
+type nodeServiceData struct {
+	UUID string `json:"uuid"`
+	Data string `json:"data"`
+}
+
+// nodeAttribute is a discovered service, characteristic or descriptor.
+type nodeAttribute struct {
+	UUID       string   `json:"uuid"`
+	Properties []string `json:"properties,omitempty"`
+}
+
+// nodeStates maps the states of noble.
+var nodeStates = map[string]gatt.State{
+	"unknown":      gatt.StateUnknown,
+	"resetting":    gatt.StateResetting,
+	"unsupported":  gatt.StateUnsupported,
+	"unauthorized": gatt.StateUnauthorized,
+	"poweredOff":   gatt.StatePoweredOff,
+	"poweredOn":    gatt.StatePoweredOn,
+}
+
+// nodeProps maps the properties of a noble characteristic.
+var nodeProps = map[string]gatt.Property{
+	"broadcast":                 gatt.CharBroadcast,
+	"read":                      gatt.CharRead,
+	"writeWithoutResponse":      gatt.CharWriteNR,
+	"write":                     gatt.CharWrite,
+	"notify":                    gatt.CharNotify,
+	"indicate":                  gatt.CharIndicate,
+	"authenticatedSignedWrites": gatt.CharSignedWrite,
+	"extendedProperties":        gatt.CharExtended,
+}
+
+// nodeHelper is the node backend. It runs nodehelper.js over the noble
+// found in the search paths, so noble versions without hci-ble and
+// l2cap-ble can be used.
+type nodeHelper struct {
+	device  *device
+	node    string
+	modules string
+	pkg     string
+
+	wmu sync.Mutex // serializes the writes to stdin
+
+	mu      sync.Mutex // protects the fields below
+	cmd     *exec.Cmd  // nil when closed
+	stdin   io.WriteCloser
+	exited  chan struct{}
+	closing bool
+	nextID  int
+	pending map[int]chan nodeMessage
+	conns   map[string]*nodePeripheral // connecting or connected, by address
+}
+
+// newNodeHelper finds node, given by NodePath or in $PATH, and noble.
+func newNodeHelper(d *device) (backend, error) {
+	node := d.nodePath
+	if node == "" {
+		node = "node"
+	}
+	node, err := exec.LookPath(node)
+	if err != nil {
+		return nil, fmt.Errorf("node helper: %w", err)
+	}
+	modules, pkg, err := findNobleJS(append(d.nobleSearchPaths, DefaultNobleSearchPaths()...))
+	if err != nil {
+		return nil, fmt.Errorf("node helper: %w", err)
+	}
+	return &nodeHelper{
+		device:  d,
+		node:    node,
+		modules: modules,
+		pkg:     pkg,
+		conns:   map[string]*nodePeripheral{},
+	}, nil
+}
+
+// Init starts the helper. noble reports the adapter state by itself.
+func (n *nodeHelper) Init() error {
+	cmd := exec.Command(n.node, "-e", nodeHelperScript)
+	cmd.Env = append(n.device.childEnv(), "NODE_PATH="+n.modules, "NOBLECHILD_NOBLE="+n.pkg)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("node helper: %w", err)
+	}
+	n.device.stats().childStarted(ChildNode)
+
+	n.mu.Lock()
+	n.cmd = cmd
+	n.stdin = stdin
+	n.exited = make(chan struct{})
+	n.closing = false
+	n.pending = map[int]chan nodeMessage{}
+	go n.loop(cmd, stdout, n.exited)
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *nodeHelper) loop(cmd *exec.Cmd, stdout io.Reader, exited chan struct{}) {
+	defer close(exited)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var m nodeMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			n.device.log().Error("invalid noble helper output", "pid", pid(cmd), "line", scanner.Text())
+			continue
+		}
+		n.handle(m)
+	}
+	cmd.Wait()
+
+	n.mu.Lock()
+	for _, ch := range n.pending {
+		close(ch)
+	}
+	n.pending = map[int]chan nodeMessage{}
+	ps := make([]*nodePeripheral, 0, len(n.conns))
+	for _, p := range n.conns {
+		ps = append(ps, p)
+	}
+	closing := n.closing
+	n.cmd, n.stdin = nil, nil
+	n.mu.Unlock()
+
+	for _, p := range ps {
+		p.mu.Lock()
+		local := p.localClose
+		p.mu.Unlock()
+		if local {
+			n.disconnected(p, ErrLocalHostTerminated)
+		} else {
+			n.disconnected(p, fmt.Errorf("%w: noble helper", ErrChildExited))
+		}
+	}
+	if !closing {
+		n.device.log().Error("noble helper exited", "pid", pid(cmd))
+		n.device.setState(gatt.StatePoweredOff)
+	}
+}
+
+func (n *nodeHelper) handle(m nodeMessage) {
+	switch m.Event {
+	case "":
+		n.mu.Lock()
+		ch, ok := n.pending[m.ID]
+		delete(n.pending, m.ID)
+		n.mu.Unlock()
+		if ok {
+			ch <- m
+		}
+	case "state":
+		s, ok := nodeStates[m.State]
+		if !ok {
+			n.device.log().Error("unknown noble state", "state", m.State)
+			return
+		}
+		switch s {
+		case gatt.StateUnsupported:
+			n.device.log().Error("noble: adapter does not support Bluetooth Low Energy (BLE, Bluetooth Smart)")
+		case gatt.StateUnauthorized:
+			n.device.log().Error("noble: adapter state unauthorized, please run as root or with sudo")
+		}
+		n.device.setState(s)
+	case "discover":
+		e, err := nodeEvent(m)
+		if err != nil {
+			n.device.log().Error("invalid noble discover event", "address", m.Address, "error", err)
+			return
+		}
+		n.device.handleEvent(e)
+	case "disconnect":
+		n.mu.Lock()
+		p := n.conns[m.Address]
+		n.mu.Unlock()
+		if p != nil {
+			p.mu.Lock()
+			local := p.localClose
+			p.mu.Unlock()
+			n.disconnected(p, disconnectReason(m.Reason, local))
+		}
+	case "notify":
+		n.mu.Lock()
+		p := n.conns[m.Address]
+		n.mu.Unlock()
+		if p == nil {
+			return
+		}
+		data, err := hex.DecodeString(m.Data)
+		if err != nil {
+			n.device.log().Error("invalid noble notification", "address", m.Address, "error", err)
+			return
+		}
+		if f, h := p.notifier(m.Path); f != nil {
+			n.device.stats().notification(h)
+			go f(data)
+		}
+	default:
+		n.device.log().Error("unknown noble helper event", "event", m.Event)
+	}
+}
+
+// nodeEvent makes an HCIEvent from a discover event.
+func nodeEvent(m nodeMessage) (HCIEvent, error) {
+	return nobleEvent(m.Address, m.AddressType, m.RSSI, m.Advertisement)
+}
+
+// nobleEvent makes an HCIEvent from a peripheral discovered by noble. The
+// advertising data is rebuilt from the fields parsed by noble.
+func nobleEvent(address, addressType string, rssi int, a *nodeAdvertisement) (HCIEvent, error) {
+	e := HCIEvent{
+		Address:     strings.ToLower(strings.Replace(address, ":", "", -1)),
+		AddressType: addressType,
+		RSSI:        rssi,
+	}
+	if e.Address == "" {
+		return e, errors.New("no address")
+	}
+	if e.AddressType == "" {
+		e.AddressType = "public"
+	}
+
+	var f advFields
+	if a != nil {
+		f.name = a.LocalName
+		f.txPower = a.TxPowerLevel
+		for _, s := range a.ServiceUUIDs {
+			u, err := gatt.ParseUUID(s)
+			if err != nil {
+				return e, err
+			}
+			f.uuids = append(f.uuids, u)
+		}
+		if a.ManufacturerData != "" {
+			b, err := hex.DecodeString(a.ManufacturerData)
+			if err != nil {
+				return e, err
+			}
+			f.manufacturer = append(f.manufacturer, b)
+		}
+		for _, sd := range a.ServiceData {
+			u, err := gatt.ParseUUID(sd.UUID)
+			if err != nil {
+				return e, err
+			}
+			b, err := hex.DecodeString(sd.Data)
+			if err != nil {
+				return e, err
+			}
+			f.serviceData = append(f.serviceData, gatt.ServiceData{UUID: u, Data: b})
+		}
+	}
+
+	eir := f.eir()
+	e.EIR = hex.EncodeToString(eir)
+	return e, e.setEIR(eir)
+}
+
+// call sends req and waits for the response. result, if not nil, is
+// decoded from it.
+func (n *nodeHelper) call(req nodeRequest, result interface{}) error {
+	n.mu.Lock()
+	if n.stdin == nil {
+		n.mu.Unlock()
+		return errors.New("node helper: not running")
+	}
+	n.nextID++
+	req.ID = n.nextID
+	ch := make(chan nodeMessage, 1)
+	n.pending[req.ID] = ch
+	stdin := n.stdin
+	n.mu.Unlock()
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	n.wmu.Lock()
+	_, err = stdin.Write(append(b, '\n'))
+	n.wmu.Unlock()
+	if err != nil {
+		n.mu.Lock()
+		delete(n.pending, req.ID)
+		n.mu.Unlock()
+		return fmt.Errorf("node helper: %w", err)
+	}
+
+	m, ok := <-ch
+	if !ok {
+		return ErrNodeHelperExited
+	}
+	if m.Error != "" {
+		return fmt.Errorf("node helper: %s: %s", req.Cmd, m.Error)
+	}
+	if result != nil {
+		return json.Unmarshal(m.Result, result)
+	}
+	return nil
+}
+
+func (n *nodeHelper) startScan(dup bool) error {
+	n.device.log().Debug("start scan", "duplicates", dup)
+	return n.call(nodeRequest{Cmd: "startScanning", AllowDuplicates: dup}, nil)
+}
+
+func (n *nodeHelper) StopScan() error {
+	return n.call(nodeRequest{Cmd: "stopScanning"}, nil)
+}
+
+// Close closes the stdin of the helper, which then stops scanning and
+// disconnects. It is killed if it does not exit within stopTimeout.
+func (n *nodeHelper) Close() error {
+	n.mu.Lock()
+	cmd, stdin, exited := n.cmd, n.stdin, n.exited
+	n.closing = true
+	ps := make([]*nodePeripheral, 0, len(n.conns))
+	for _, p := range n.conns {
+		ps = append(ps, p)
+	}
+	n.mu.Unlock()
+	if cmd == nil {
+		return nil
+	}
+
+	for _, p := range ps {
+		p.mu.Lock()
+		p.localClose = true
+		p.mu.Unlock()
+	}
+	stdin.Close()
+	t := n.device.stopTimeoutOption()
+	if t <= 0 {
+		t = DefaultStopTimeout
+	}
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(t):
+	}
+	return stopProcess(n.device.log(), cmd.Process, exited, t)
+}
+
+func (n *nodeHelper) newL2CAP(address, addressType string) (*L2CAP_BLE, error) {
+	return nil, errors.New("node helper: connections are made by noble")
+}
+
+func (n *nodeHelper) newPeripheral(e *HCIEvent) gatt.Peripheral {
+	return &nodePeripheral{
+		n:       n,
+		event:   e,
+		address: e.Address,
+		name:    e.Advertisement.LocalName,
+	}
+}
+
+// connect asks noble to connect p, and reports the result.
+func (n *nodeHelper) connect(gp gatt.Peripheral) {
+	p, ok := gp.(*nodePeripheral)
+	if !ok {
+		n.device.log().Error("not a noble helper peripheral", "address", gp.ID())
+		return
+	}
+	n.mu.Lock()
+	if _, ok := n.conns[p.address]; ok {
+		n.mu.Unlock()
+		n.device.log().Info("already connected peripheral", "address", p.address)
+		return
+	}
+	n.conns[p.address] = p
+	n.mu.Unlock()
+	cancel := make(chan struct{})
+	p.mu.Lock()
+	p.cancel = cancel
+	p.localClose = false
+	p.mu.Unlock()
+
+	go func() {
+		done := make(chan error, 1)
+		go func() { done <- n.call(nodeRequest{Cmd: "connect", Address: p.address}, nil) }()
+		var timeout <-chan time.Time
+		if t := n.device.connectTimeoutOption(); t > 0 {
+			timer := time.NewTimer(t)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		var err error
+		select {
+		case err = <-done:
+		case <-timeout:
+			err = ErrConnectTimeout
+		case <-cancel:
+			err = ErrLocalHostTerminated
+		}
+		f := n.device.peripheralConnected
+		if err != nil {
+			n.forget(p)
+			n.device.stats().connectFailure()
+			n.call(nodeRequest{Cmd: "disconnect", Address: p.address}, nil)
+			if f != nil {
+				n.device.dispatch(func() { f(p, err) })
+			}
+			return
+		}
+		// The connection is queued while p.mu is held, so that the
+		// disconnection, which waits for p.mu, is reported after it.
+		p.mu.Lock()
+		p.connected = true
+		p.cancel = nil
+		if f != nil {
+			n.device.dispatch(func() { f(p, nil) })
+		}
+		p.mu.Unlock()
+	}()
+}
+
+func (n *nodeHelper) cancelConnection(gp gatt.Peripheral) {
+	p, ok := gp.(*nodePeripheral)
+	if !ok {
+		return
+	}
+	n.mu.Lock()
+	_, ok = n.conns[p.address]
+	n.mu.Unlock()
+	if !ok {
+		n.device.log().Info("no such peripheral connected", "address", p.address)
+		return
+	}
+	p.mu.Lock()
+	p.localClose = true
+	connected := p.connected
+	if !connected && p.cancel != nil {
+		// the connect goroutine reports the failure
+		close(p.cancel)
+		p.cancel = nil
+	}
+	p.mu.Unlock()
+	if !connected {
+		return
+	}
+	if err := n.call(nodeRequest{Cmd: "disconnect", Address: p.address}, nil); err != nil {
+		n.device.log().Error("noble disconnect failed", "address", p.address, "error", err)
+	}
+	n.disconnected(p, ErrLocalHostTerminated)
+}
+
+func (n *nodeHelper) forget(p *nodePeripheral) {
+	n.mu.Lock()
+	if n.conns[p.address] == p {
+		delete(n.conns, p.address)
+	}
+	n.mu.Unlock()
+}
+
+// disconnected reports the end of the connection of p once.
+func (n *nodeHelper) disconnected(p *nodePeripheral, reason error) {
+	p.mu.Lock()
+	connected := p.connected
+	p.connected = false
+	p.mu.Unlock()
+	if !connected {
+		return
+	}
+	n.forget(p)
+	n.device.stats().disconnect(reason)
+	if f := n.device.peripheralDisconnected; f != nil {
+		n.device.dispatch(func() { f(p, reason) })
+	}
+}
+
+// nodePeripheral is a peripheral of the node backend. noble does not
+// give the attribute handles, so they are numbered in the order of
+// discovery.
+type nodePeripheral struct {
+	n       *nodeHelper
+	event   *HCIEvent
+	address string
+	name    string
+
+	mu         sync.Mutex    // protects the fields below
+	cancel     chan struct{} // closed by cancelConnection while connecting
+	connected  bool
+	localClose bool
+	svcs       []*gatt.Service
+	all        []*gatt.Service // not filtered by DiscoverServices
+	handle     uint16
+	paths      map[interface{}][]int // of services, characteristics and descriptors
+	notify     map[string]func([]byte)
+	notifyH    map[string]uint16
+}
+
+func (p *nodePeripheral) Device() gatt.Device { return p.n.device }
+func (p *nodePeripheral) ID() string          { return strings.ToUpper(p.address) }
+func (p *nodePeripheral) Name() string        { return p.name }
+
+func (p *nodePeripheral) Services() []*gatt.Service {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.svcs
+}
+
+// nextHandle returns the next synthetic handle.
+func (p *nodePeripheral) nextHandle() uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handle++
+	return p.handle
+}
+
+func (p *nodePeripheral) pathOf(a interface{}) ([]int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	path, ok := p.paths[a]
+	if !ok {
+		return nil, errors.New("node helper: attribute is not discovered")
+	}
+	return path, nil
+}
+
+func (p *nodePeripheral) setPath(a interface{}, parent []int, i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paths == nil {
+		p.paths = map[interface{}][]int{}
+	}
+	p.paths[a] = append(append([]int(nil), parent...), i)
+}
+
+func (p *nodePeripheral) notifier(path []int) (func([]byte), uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	k := fmt.Sprint(path)
+	return p.notify[k], p.notifyH[k]
+}
+
+// call sends a request about p, which must be connected. noble may not
+// answer requests on a disconnected peripheral.
+func (p *nodePeripheral) call(req nodeRequest, result interface{}) error {
+	p.mu.Lock()
+	connected := p.connected
+	p.mu.Unlock()
+	if !connected {
+		return errors.New("node helper: peripheral is not connected")
+	}
+	req.Address = p.address
+	op, ok := nobleATTOp(req.Cmd, req.WithoutResponse)
+	if !ok {
+		return p.n.call(req, result)
+	}
+	start := time.Now()
+	err := p.n.call(req, result)
+	p.n.device.stats().attResult(op, err, time.Since(start))
+	return err
+}
+
+// discover asks for the attributes under path.
+func (p *nodePeripheral) discover(cmd string, path []int) ([]nodeAttribute, error) {
+	var as []nodeAttribute
+	err := p.call(nodeRequest{Cmd: cmd, Path: path}, &as)
+	if err != nil {
+		return nil, err
+	}
+	return as, nil
+}
+
+func (p *nodePeripheral) DiscoverServices(ss []gatt.UUID) ([]*gatt.Service, error) {
+	as, err := p.discover("discoverServices", nil)
+	if err != nil {
+		return nil, err
+	}
+	var ret, all []*gatt.Service
+	for i, a := range as {
+		u, err := gatt.ParseUUID(a.UUID)
+		if err != nil {
+			return nil, err
+		}
+		s := gatt.NewService(u)
+		h := p.nextHandle()
+		s.SetHandle(h)
+		s.SetEndHandle(h)
+		p.setPath(s, nil, i)
+		all = append(all, s)
+		if len(ss) == 0 || IncludesUUID(u, ss) {
+			ret = append(ret, s)
+		}
+	}
+	p.mu.Lock()
+	p.svcs, p.all = ret, all
+	p.mu.Unlock()
+	return ret, nil
+}
+
+// DiscoverIncludedServices returns the services included by s. noble gives
+// only their UUIDs, so an included service is the service of the same UUID
+// found by DiscoverServices, if any. The others can not be explored.
+func (p *nodePeripheral) DiscoverIncludedServices(ss []gatt.UUID, s *gatt.Service) ([]*gatt.Service, error) {
+	sp, err := p.pathOf(s)
+	if err != nil {
+		return nil, err
+	}
+	as, err := p.discover("discoverIncludedServices", sp)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*gatt.Service
+	for _, a := range as {
+		u, err := gatt.ParseUUID(a.UUID)
+		if err != nil {
+			return nil, err
+		}
+		if len(ss) > 0 && !IncludesUUID(u, ss) {
+			continue
+		}
+		inc := p.service(u)
+		if inc == nil {
+			inc = gatt.NewService(u)
+			h := p.nextHandle()
+			inc.SetHandle(h)
+			inc.SetEndHandle(h)
+		}
+		ret = append(ret, inc)
+	}
+	return ret, nil
+}
+
+// service returns the first service of UUID u found by the last
+// DiscoverServices, or nil.
+func (p *nodePeripheral) service(u gatt.UUID) *gatt.Service {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.all {
+		if s.UUID().Equal(u) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (p *nodePeripheral) DiscoverCharacteristics(cs []gatt.UUID, s *gatt.Service) ([]*gatt.Characteristic, error) {
+	sp, err := p.pathOf(s)
+	if err != nil {
+		return nil, err
+	}
+	as, err := p.discover("discoverCharacteristics", sp)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*gatt.Characteristic
+	for i, a := range as {
+		u, err := gatt.ParseUUID(a.UUID)
+		if err != nil {
+			return nil, err
+		}
+		var prop gatt.Property
+		for _, name := range a.Properties {
+			prop |= nodeProps[name]
+		}
+		h := p.nextHandle()
+		vh := p.nextHandle()
+		c := gatt.NewCharacteristic(u, s, prop, h, vh)
+		c.SetEndHandle(vh)
+		p.setPath(c, sp, i)
+		if len(cs) == 0 || IncludesUUID(u, cs) {
+			ret = append(ret, c)
+		}
+	}
+	s.SetCharacteristics(ret)
+	return ret, nil
+}
+
+func (p *nodePeripheral) DiscoverDescriptors(ds []gatt.UUID, c *gatt.Characteristic) ([]*gatt.Descriptor, error) {
+	cp, err := p.pathOf(c)
+	if err != nil {
+		return nil, err
+	}
+	as, err := p.discover("discoverDescriptors", cp)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*gatt.Descriptor
+	for i, a := range as {
+		u, err := gatt.ParseUUID(a.UUID)
+		if err != nil {
+			return nil, err
+		}
+		d := gatt.NewDescriptor(u, p.nextHandle(), c)
+		p.setPath(d, cp, i)
+		if u.Equal(attrClientCharacteristicConfigUUID) {
+			c.SetDescriptor(d)
+		}
+		if len(ds) == 0 || IncludesUUID(u, ds) {
+			ret = append(ret, d)
+		}
+	}
+	c.SetDescriptors(ret)
+	return ret, nil
+}
+
+func (p *nodePeripheral) read(cmd string, a interface{}) ([]byte, error) {
+	path, err := p.pathOf(a)
+	if err != nil {
+		return nil, err
+	}
+	var s string
+	if err := p.call(nodeRequest{Cmd: cmd, Path: path}, &s); err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(s)
+}
+
+func (p *nodePeripheral) write(cmd string, a interface{}, b []byte, noRsp bool) error {
+	path, err := p.pathOf(a)
+	if err != nil {
+		return err
+	}
+	return p.call(nodeRequest{Cmd: cmd, Path: path, Data: hex.EncodeToString(b), WithoutResponse: noRsp}, nil)
+}
+
+func (p *nodePeripheral) ReadCharacteristic(c *gatt.Characteristic) ([]byte, error) {
+	return p.read("read", c)
+}
+
+// ReadLongCharacteristic is ReadCharacteristic, as noble reads the whole
+// value.
+func (p *nodePeripheral) ReadLongCharacteristic(c *gatt.Characteristic) ([]byte, error) {
+	return p.read("read", c)
+}
+
+func (p *nodePeripheral) ReadDescriptor(d *gatt.Descriptor) ([]byte, error) {
+	return p.read("readDescriptor", d)
+}
+
+func (p *nodePeripheral) WriteCharacteristic(c *gatt.Characteristic, b []byte, noRsp bool) error {
+	return p.write("write", c, b, noRsp)
+}
+
+func (p *nodePeripheral) WriteDescriptor(d *gatt.Descriptor, b []byte) error {
+	return p.write("writeDescriptor", d, b, false)
+}
+
+// SetNotifyValue subscribes to c, or unsubscribes if f is nil. noble
+// writes the CCCD.
+func (p *nodePeripheral) SetNotifyValue(c *gatt.Characteristic, f func(*gatt.Characteristic, []byte, error)) error {
+	path, err := p.pathOf(c)
+	if err != nil {
+		return err
+	}
+	k := fmt.Sprint(path)
+	if f == nil {
+		p.mu.Lock()
+		delete(p.notify, k)
+		p.mu.Unlock()
+		return p.call(nodeRequest{Cmd: "unsubscribe", Path: path}, nil)
+	}
+	p.mu.Lock()
+	if p.notify == nil {
+		p.notify = map[string]func([]byte){}
+		p.notifyH = map[string]uint16{}
+	}
+	p.notify[k] = func(b []byte) { f(c, b, nil) }
+	p.notifyH[k] = c.VHandle()
+	p.mu.Unlock()
+	if err := p.call(nodeRequest{Cmd: "subscribe", Path: path}, nil); err != nil {
+		p.mu.Lock()
+		delete(p.notify, k)
+		p.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// SetIndicateValue is SetNotifyValue; noble chooses indications when c
+// does not notify.
+func (p *nodePeripheral) SetIndicateValue(c *gatt.Characteristic, f func(*gatt.Characteristic, []byte, error)) error {
+	return p.SetNotifyValue(c, f)
+}
+
+// ReadRSSI asks noble to read the RSSI of the connection, or returns -1.
+func (p *nodePeripheral) ReadRSSI() int {
+	var rssi int
+	if err := p.call(nodeRequest{Cmd: "rssi"}, &rssi); err != nil {
+		return -1
+	}
+	return rssi
+}
+
+// SetMTU does nothing, as noble exchanges the MTU by itself.
+func (p *nodePeripheral) SetMTU(mtu uint16) error {
+	return nil
+}
@@ -0,0 +1,182 @@
+// noble helper of the node backend of noblechild.
+//
+// It drives noble through its JavaScript API and exchanges JSON lines on
+// stdio. Requests have an id and a cmd; each is answered by
+// {"id":..,"result":..} or {"id":..,"error":".."}. Events have an event
+// field: state, discover, disconnect and notify. Services,
+// characteristics and descriptors are addressed by their indices in the
+// discovered arrays.
+'use strict';
+
+const noble = require(process.env.NOBLECHILD_NOBLE || '@abandonware/noble');
+const readline = require('readline');
+
+const peripherals = {};
+
+function send(m) {
+  process.stdout.write(JSON.stringify(m) + '\n');
+}
+
+function hex(b) {
+  return b ? b.toString('hex') : '';
+}
+
+noble.on('stateChange', (state) => send({ event: 'state', state: state }));
+
+noble.on('discover', (p) => {
+  peripherals[p.id] = p;
+  const a = p.advertisement || {};
+  send({
+    event: 'discover',
+    address: p.id,
+    addressType: p.addressType,
+    rssi: p.rssi,
+    advertisement: {
+      localName: a.localName,
+      txPowerLevel: a.txPowerLevel,
+      serviceUuids: a.serviceUuids || [],
+      manufacturerData: hex(a.manufacturerData),
+      serviceData: (a.serviceData || []).map((s) => ({ uuid: s.uuid, data: hex(s.data) })),
+    },
+  });
+});
+
+function peripheral(m) {
+  const p = peripherals[m.address];
+  if (!p) {
+    throw new Error('unknown peripheral ' + m.address);
+  }
+  return p;
+}
+
+function attribute(m) {
+  const p = peripheral(m);
+  const path = m.path || [];
+  const s = (p.services || [])[path[0]];
+  if (!s) {
+    throw new Error('unknown service ' + path);
+  }
+  if (path.length < 2) {
+    return s;
+  }
+  const c = (s.characteristics || [])[path[1]];
+  if (!c) {
+    throw new Error('unknown characteristic ' + path);
+  }
+  if (path.length < 3) {
+    return c;
+  }
+  const d = (c.descriptors || [])[path[2]];
+  if (!d) {
+    throw new Error('unknown descriptor ' + path);
+  }
+  return d;
+}
+
+// listen replaces the listener of the helper for event on o. noble keeps
+// its own listeners, e.g. of data for read, so the others are left alone.
+function listen(o, event, f) {
+  o._noblechild = o._noblechild || {};
+  if (o._noblechild[event]) {
+    o.removeListener(event, o._noblechild[event]);
+  }
+  o._noblechild[event] = f;
+  if (f) {
+    o.on(event, f);
+  }
+}
+
+function disconnectReason(reason) {
+  return typeof reason === 'number' ? '0x' + reason.toString(16) : '';
+}
+
+const commands = {
+  startScanning: (m, done) => noble.startScanning([], !!m.allowDuplicates, done),
+  stopScanning: (m, done) => {
+    noble.stopScanning();
+    done();
+  },
+  connect: (m, done) => {
+    const p = peripheral(m);
+    listen(p, 'disconnect', (reason) =>
+      send({ event: 'disconnect', address: p.id, reason: disconnectReason(reason) }));
+    p.connect(done);
+  },
+  disconnect: (m, done) => peripheral(m).disconnect(() => done()),
+  discoverServices: (m, done) =>
+    peripheral(m).discoverServices([], (err, ss) =>
+      done(err, (ss || []).map((s) => ({ uuid: s.uuid })))),
+  discoverIncludedServices: (m, done) =>
+    attribute(m).discoverIncludedServices([], (err, uuids) =>
+      done(err, (uuids || []).map((uuid) => ({ uuid })))),
+  discoverCharacteristics: (m, done) =>
+    attribute(m).discoverCharacteristics([], (err, cs) =>
+      done(err, (cs || []).map((c) => ({ uuid: c.uuid, properties: c.properties })))),
+  discoverDescriptors: (m, done) =>
+    attribute(m).discoverDescriptors((err, ds) =>
+      done(err, (ds || []).map((d) => ({ uuid: d.uuid })))),
+  read: (m, done) => attribute(m).read((err, data) => done(err, hex(data))),
+  write: (m, done) => attribute(m).write(Buffer.from(m.data || '', 'hex'), !!m.withoutResponse, done),
+  readDescriptor: (m, done) => attribute(m).readValue((err, data) => done(err, hex(data))),
+  writeDescriptor: (m, done) => attribute(m).writeValue(Buffer.from(m.data || '', 'hex'), done),
+  subscribe: (m, done) => {
+    const c = attribute(m);
+    listen(c, 'data', (data, isNotification) => {
+      if (isNotification) {
+        send({ event: 'notify', address: m.address, path: m.path, data: hex(data) });
+      }
+    });
+    c.subscribe(done);
+  },
+  unsubscribe: (m, done) => {
+    const c = attribute(m);
+    listen(c, 'data', null);
+    c.unsubscribe(done);
+  },
+  rssi: (m, done) => peripheral(m).updateRssi(done),
+};
+
+function handle(m) {
+  let answered = false;
+  const done = (err, result) => {
+    if (answered) {
+      return;
+    }
+    answered = true;
+    if (err) {
+      send({ id: m.id, error: String(err.message || err) });
+    } else {
+      send({ id: m.id, result: result === undefined ? null : result });
+    }
+  };
+  const f = commands[m.cmd];
+  if (!f) {
+    done(new Error('unknown command ' + m.cmd));
+    return;
+  }
+  try {
+    f(m, done);
+  } catch (err) {
+    done(err);
+  }
+}
+
+readline.createInterface({ input: process.stdin }).on('line', (line) => {
+  let m;
+  try {
+    m = JSON.parse(line);
+  } catch (err) {
+    return;
+  }
+  handle(m);
+});
+
+process.stdin.on('end', () => {
+  noble.stopScanning();
+  Object.keys(peripherals).forEach((id) => {
+    if (peripherals[id].state === 'connected') {
+      peripherals[id].disconnect();
+    }
+  });
+  setTimeout(() => process.exit(0), 100);
+});
@@ -0,0 +1,307 @@
+package noblechild
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gatt "github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNodeEnv makes the test binary run fakeNodeHelper, so it can be
+// given to NodePath.
+const fakeNodeEnv = "NOBLECHILD_FAKE_NODE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeNodeEnv) != "" {
+		fakeNodeHelper(os.Stdin, os.Stdout)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeNodeHelper stands in for nodehelper.js with one peripheral. Writing
+// "ff" makes the peripheral disconnect.
+func fakeNodeHelper(r io.Reader, w io.Writer) {
+	enc := json.NewEncoder(w)
+	enc.Encode(nodeMessage{Event: "state", State: "poweredOn"})
+
+	raw := func(v interface{}) json.RawMessage {
+		b, _ := json.Marshal(v)
+		return b
+	}
+	tx := -8
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var req nodeRequest
+		if json.Unmarshal(scanner.Bytes(), &req) != nil {
+			continue
+		}
+		rsp := nodeMessage{ID: req.ID, Result: raw(nil)}
+		var events []nodeMessage
+		switch req.Cmd {
+		case "startScanning":
+			events = append(events, nodeMessage{
+				Event:       "discover",
+				Address:     "aabbccddeeff",
+				AddressType: "random",
+				RSSI:        -42,
+				Advertisement: &nodeAdvertisement{
+					LocalName:        "fake",
+					TxPowerLevel:     &tx,
+					ServiceUUIDs:     []string{"180f"},
+					ManufacturerData: "590001",
+					ServiceData:      []nodeServiceData{{UUID: "feaa", Data: "10"}},
+				},
+			})
+		case "stopScanning", "connect", "unsubscribe", "writeDescriptor":
+		case "disconnect":
+			events = append(events, nodeMessage{Event: "disconnect", Address: req.Address, Reason: "0x16"})
+		case "discoverServices":
+			rsp.Result = raw([]nodeAttribute{{UUID: "180f"}, {UUID: "1800"}})
+		case "discoverIncludedServices":
+			rsp.Result = raw([]nodeAttribute{{UUID: "1800"}, {UUID: "180a"}})
+		case "discoverCharacteristics":
+			rsp.Result = raw([]nodeAttribute{{UUID: "2a19", Properties: []string{"read", "write", "notify"}}})
+		case "discoverDescriptors":
+			rsp.Result = raw([]nodeAttribute{{UUID: "2902"}})
+		case "read":
+			rsp.Result = raw("64")
+		case "readDescriptor":
+			rsp.Result = raw("0000")
+		case "write":
+			if req.Data == "ff" {
+				events = append(events, nodeMessage{Event: "disconnect", Address: req.Address, Reason: "0x13"})
+			}
+		case "subscribe":
+			events = append(events, nodeMessage{Event: "notify", Address: req.Address, Path: req.Path, Data: "63"})
+		case "rssi":
+			rsp.Result = raw(-40)
+		default:
+			rsp = nodeMessage{ID: req.ID, Error: "unknown command " + req.Cmd}
+		}
+		enc.Encode(rsp)
+		for _, e := range events {
+			enc.Encode(e)
+		}
+	}
+}
+
+// fakeNoble makes a node_modules directory with an empty noble package.
+func fakeNoble(t *testing.T) string {
+	root := t.TempDir()
+	dir := filepath.Join(root, "node_modules", "@abandonware", "noble")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func Test_NodeHelper(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv(fakeNodeEnv, "1")
+	m := NewMetrics()
+	d, err := NewDevice(SetBackend(BackendNode), NodePath(os.Args[0]), NobleSearchPaths(fakeNoble(t)), SetMetrics(m))
+	if !assert.Nil(err) {
+		return
+	}
+
+	discovered := make(chan gatt.Peripheral, 1)
+	connected := make(chan error, 1)
+	disconnected := make(chan error, 1)
+	d.Handle(
+		PeripheralDiscovered(func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+			assert.Equal("fake", a.LocalName)
+			assert.Equal([]gatt.UUID{gatt.UUID16(0x180f)}, a.Services)
+			assert.Equal(-8, a.TxPowerLevel)
+			assert.Equal(-42, rssi)
+			select {
+			case discovered <- p:
+			default:
+			}
+		}),
+		PeripheralConnected(func(p gatt.Peripheral, err error) { connected <- err }),
+		PeripheralDisconnected(func(p gatt.Peripheral, err error) { disconnected <- err }),
+	)
+	states := make(chan gatt.State, 1)
+	assert.Nil(d.Init(func(d gatt.Device, s gatt.State) { states <- s }))
+	defer d.Stop()
+	assert.Equal(gatt.StatePoweredOn, <-states)
+
+	d.Scan(nil, false)
+	var p gatt.Peripheral
+	select {
+	case p = <-discovered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not discovered")
+	}
+	assert.Equal("AABBCCDDEEFF", p.ID())
+	e, ok := DiscoveryEvent(p)
+	assert.True(ok)
+	assert.Equal("random", e.AddressType)
+	assert.Equal(uint16(0x0059), e.Manufacturers[0].CompanyID)
+
+	d.Connect(p)
+	select {
+	case err := <-connected:
+		assert.Nil(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	ss, err := p.DiscoverServices([]gatt.UUID{gatt.UUID16(0x180f)})
+	assert.Nil(err)
+	assert.Equal(1, len(ss))
+	assert.Equal("180f", ss[0].UUID().String())
+
+	// 1800 is the service found by DiscoverServices, 180a is only included
+	inc, err := p.DiscoverIncludedServices(nil, ss[0])
+	assert.Nil(err)
+	if assert.Equal(2, len(inc)) {
+		assert.Equal("1800", inc[0].UUID().String())
+		assert.Equal(uint16(2), inc[0].Handle())
+		assert.Equal("180a", inc[1].UUID().String())
+		_, err = p.DiscoverCharacteristics(nil, inc[1])
+		assert.NotNil(err)
+	}
+	inc, err = p.DiscoverIncludedServices([]gatt.UUID{gatt.UUID16(0x180a)}, ss[0])
+	assert.Nil(err)
+	assert.Equal(1, len(inc))
+
+	cs, err := p.DiscoverCharacteristics(nil, ss[0])
+	assert.Nil(err)
+	assert.Equal(1, len(cs))
+	assert.Equal("2a19", cs[0].UUID().String())
+	assert.Equal(gatt.CharRead|gatt.CharWrite|gatt.CharNotify, cs[0].Properties())
+
+	ds, err := p.DiscoverDescriptors(nil, cs[0])
+	assert.Nil(err)
+	assert.Equal(1, len(ds))
+	assert.Equal(ds[0], cs[0].Descriptor())
+
+	b, err := p.ReadCharacteristic(cs[0])
+	assert.Nil(err)
+	assert.Equal([]byte{0x64}, b)
+	assert.Nil(p.WriteCharacteristic(cs[0], []byte{0x01}, true))
+	b, err = p.ReadDescriptor(ds[0])
+	assert.Nil(err)
+	assert.Equal([]byte{0, 0}, b)
+	assert.Equal(-40, p.ReadRSSI())
+
+	notified := make(chan []byte, 1)
+	assert.Nil(p.SetNotifyValue(cs[0], func(c *gatt.Characteristic, b []byte, err error) { notified <- b }))
+	select {
+	case b := <-notified:
+		assert.Equal([]byte{0x63}, b)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not notified")
+	}
+
+	// the write without response is not timed
+	var mb strings.Builder
+	m.WriteTo(&mb)
+	assert.Contains(mb.String(), `noblechild_att_request_duration_seconds_count{opcode="0x0a"} 2`)
+	assert.Contains(mb.String(), `noblechild_att_request_duration_seconds_count{opcode="0x12"} 1`)
+	assert.Contains(mb.String(), `noblechild_att_request_duration_seconds_count{opcode="0x08"} 3`)
+
+	d.CancelConnection(p)
+	select {
+	case err := <-disconnected:
+		assert.Equal(ErrLocalHostTerminated, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not disconnected")
+	}
+
+	// disconnected by the peripheral
+	d.Connect(p)
+	assert.Nil(<-connected)
+	ss, err = p.DiscoverServices(nil)
+	assert.Nil(err)
+	assert.Equal(2, len(ss))
+	cs, err = p.DiscoverCharacteristics(nil, ss[0])
+	assert.Nil(err)
+	assert.Nil(p.WriteCharacteristic(cs[0], []byte{0xff}, false))
+	select {
+	case err := <-disconnected:
+		assert.True(errors.Is(err, ErrRemoteUserTerminated))
+	case <-time.After(5 * time.Second):
+		t.Fatal("not disconnected")
+	}
+	assert.NotNil(p.WriteCharacteristic(cs[0], []byte{0x01}, false))
+}
+
+func Test_NodeHelperLost(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv(fakeNodeEnv, "1")
+	d, err := NewDevice(SetBackend(BackendNode), NodePath(os.Args[0]), NobleSearchPaths(fakeNoble(t)), LostTimeout(200*time.Millisecond))
+	if !assert.Nil(err) {
+		return
+	}
+	lost := make(chan Discovery, 1)
+	d.Handle(PeripheralLost(func(di Discovery) { lost <- di }))
+	states := make(chan gatt.State, 1)
+	assert.Nil(d.Init(func(d gatt.Device, s gatt.State) { states <- s }))
+	defer d.Stop()
+	assert.Equal(gatt.StatePoweredOn, <-states)
+
+	// the fake helper advertises once
+	d.Scan(nil, false)
+	select {
+	case di := <-lost:
+		assert.Equal("aabbccddeeff", di.Address)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not lost")
+	}
+	assert.Empty(Discoveries(d))
+}
+
+func Test_findNobleJS(t *testing.T) {
+	assert := assert.New(t)
+
+	root := fakeNoble(t)
+	modules, pkg, err := findNobleJS([]string{"", root})
+	assert.Nil(err)
+	assert.Equal(filepath.Join(root, "node_modules"), modules)
+	assert.Equal("@abandonware/noble", pkg)
+	_, _, err = findNobleJS([]string{modules})
+	assert.Nil(err)
+	_, _, err = findNobleJS([]string{t.TempDir()})
+	assert.NotNil(err)
+}
+
+func Test_nodeEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := -4
+	e, err := nodeEvent(nodeMessage{
+		Address: "aa:bb:cc:dd:ee:ff",
+		RSSI:    -70,
+		Advertisement: &nodeAdvertisement{
+			LocalName:    "hello",
+			TxPowerLevel: &tx,
+			ServiceUUIDs: []string{"feaa"},
+			ServiceData:  []nodeServiceData{{UUID: "feaa", Data: "10"}},
+		},
+	})
+	assert.Nil(err)
+	assert.Equal("aabbccddeeff", e.Address)
+	assert.Equal("public", e.AddressType)
+	assert.Equal("060968656c6c6f020afc0303aafe0416aafe10", e.EIR)
+
+	_, err = nodeEvent(nodeMessage{})
+	assert.NotNil(err)
+	_, err = nodeEvent(nodeMessage{Address: "aabbccddeeff", Advertisement: &nodeAdvertisement{ManufacturerData: "zz"}})
+	assert.NotNil(err)
+}
@@ -0,0 +1,362 @@
+package noblechild
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+var (
+	// ErrUnsupportedOption is returned when an option is not for the
+	// noblechild device, e.g. an option of paypal/gatt.
+	ErrUnsupportedOption = errors.New("unsupported option")
+	// ErrOptionAfterNewDevice is returned when an option which can only be
+	// given to NewDevice is applied later.
+	ErrOptionAfterNewDevice = errors.New("option can only be given to NewDevice")
+)
+
+// ScanMode selects how hci-ble reports duplicate advertisements.
+type ScanMode int
+
+const (
+	// ScanModeDefault follows the dup argument of Scan.
+	ScanModeDefault ScanMode = iota
+	// ScanModeFilterDuplicates lets the controller drop duplicates.
+	ScanModeFilterDuplicates
+	// ScanModeAllowDuplicates reports every advertisement.
+	ScanModeAllowDuplicates
+)
+
+// option makes a gatt.Option which applies f to the noblechild device.
+func option(name string, f func(d *device) error) gatt.Option {
+	return func(gd gatt.Device) error {
+		d, ok := gd.(*device)
+		if !ok {
+			return fmt.Errorf("%s: %w: not a noblechild device", name, ErrUnsupportedOption)
+		}
+		if d.backendKind.ignores(name) {
+			return fmt.Errorf("%s: %w: %s backend", name, ErrUnsupportedOption, d.backendKind)
+		}
+		if err := f(d); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if !d.created {
+			d.given = append(d.given, name)
+		}
+		return nil
+	}
+}
+
+// ignoredOptions are the options which have no effect on a backend: the
+// paths of the children it does not run, and the MTU exchange done by
+// BlueZ or noble.
+var ignoredOptions = map[Backend][]string{
+	BackendBlueZ:     {"NoblePaths", "NobleSearchPaths", "BlenoPaths", "PreferredMTU"},
+	BackendNode:      {"NoblePaths", "BlenoPaths", "PreferredMTU"},
+	BackendWebSocket: {"NoblePaths", "NobleSearchPaths", "BlenoPaths", "PreferredMTU"},
+}
+
+// ignores reports whether the option name has no effect on b.
+func (b Backend) ignores(name string) bool {
+	return slices.Contains(ignoredOptions[b], name)
+}
+
+// checkGivenOptions returns ErrUnsupportedOption for the options given to
+// NewDevice before a SetBackend which ignores them.
+func (d *device) checkGivenOptions() error {
+	var errs []error
+	for _, name := range d.given {
+		if d.backendKind.ignores(name) {
+			errs = append(errs, fmt.Errorf("%s: %w: %s backend", name, ErrUnsupportedOption, d.backendKind))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// discoveryOption is an option which changes the registry of discovered
+// peripherals under its lock.
+func discoveryOption(name string, f func(r *registry) error) gatt.Option {
+	return option(name, func(d *device) error {
+		if d.discoveries == nil {
+			return errors.New("device has no discovery registry")
+		}
+		d.discoveries.mu.Lock()
+		defer d.discoveries.mu.Unlock()
+		return f(d.discoveries)
+	})
+}
+
+// newDeviceOption is an option which can only be given to NewDevice.
+func newDeviceOption(name string, f func(d *device) error) gatt.Option {
+	return option(name, func(d *device) error {
+		if d.created {
+			return ErrOptionAfterNewDevice
+		}
+		return f(d)
+	})
+}
+
+// HCIDeviceID selects the adapter (hciN) used by the device. It is passed
+// to every child process as NOBLE_HCI_DEVICE_ID, so two devices on
+// different adapters can run in one process.
+func HCIDeviceID(id int) gatt.Option {
+	return newDeviceOption("HCIDeviceID", func(d *device) error {
+		if id < 0 {
+			return fmt.Errorf("invalid hci device id: %d", id)
+		}
+		d.hciDeviceID = id
+		return nil
+	})
+}
+
+// SetBackend chooses how the device scans and connects. BackendAuto uses
+// the Bluetooth sockets if the adapter can be opened, and the children
+// otherwise.
+func SetBackend(b Backend) gatt.Option {
+	return newDeviceOption("SetBackend", func(d *device) error {
+		switch b {
+		case BackendChildren, BackendSocket, BackendAuto, BackendBlueZ, BackendNode, BackendWebSocket:
+		default:
+			return fmt.Errorf("invalid backend: %s", b)
+		}
+		d.backendKind = b
+		return nil
+	})
+}
+
+// NoblePaths gives the paths of hci-ble and l2cap-ble explicitly. No
+// search is done. It is not supported by the BlueZ, node and websocket
+// backends.
+func NoblePaths(hciPath, l2capPath string) gatt.Option {
+	return newDeviceOption("NoblePaths", func(d *device) error {
+		d.hciPath = hciPath
+		d.l2capPath = l2capPath
+		return nil
+	})
+}
+
+// NobleSearchPaths adds directories which are searched for hci-ble and
+// l2cap-ble before the default ones. See FindNobleModuleIn. It is not
+// supported by the BlueZ and websocket backends.
+func NobleSearchPaths(roots ...string) gatt.Option {
+	return newDeviceOption("NobleSearchPaths", func(d *device) error {
+		d.nobleSearchPaths = append(d.nobleSearchPaths, roots...)
+		return nil
+	})
+}
+
+// NodePath gives the node binary run by BackendNode. The default is node
+// in $PATH. noble is searched like hci-ble, see NobleSearchPaths.
+func NodePath(node string) gatt.Option {
+	return newDeviceOption("NodePath", func(d *device) error {
+		d.nodePath = node
+		return nil
+	})
+}
+
+// WebSocketURL gives the ws-slave used by BackendWebSocket, e.g.
+// ws://gateway:8080. The user information of the URL is sent as basic
+// authentication.
+func WebSocketURL(u string) gatt.Option {
+	return newDeviceOption("WebSocketURL", func(d *device) error {
+		d.wsURL = u
+		return nil
+	})
+}
+
+// BlenoPaths gives the paths of bleno's hci-ble and l2cap-ble, which are
+// used for the peripheral role. No search is done. It is not supported by
+// the BlueZ, node and websocket backends.
+func BlenoPaths(hciPath, l2capPath string) gatt.Option {
+	return option("BlenoPaths", func(d *device) error {
+		d.blenoHCIPath = hciPath
+		d.blenoL2CAPPath = l2capPath
+		return nil
+	})
+}
+
+// SetLogger sets the logger used by the device, e.g. a *slog.Logger or
+// LogrusLogger(l). NopLogger silences the device. The default is the
+// standard logrus logger.
+func SetLogger(l Logger) gatt.Option {
+	return option("SetLogger", func(d *device) error {
+		if l == nil {
+			return errors.New("nil logger")
+		}
+		d.optMu.Lock()
+		d.logger = l
+		d.optMu.Unlock()
+		return nil
+	})
+}
+
+// PreferredMTU makes the device exchange the ATT MTU after a connection is
+// established, before the PeripheralConnected handler is called. It is not
+// supported by the BlueZ, node and websocket backends, which exchange the
+// MTU themselves.
+func PreferredMTU(mtu uint16) gatt.Option {
+	return option("PreferredMTU", func(d *device) error {
+		if mtu < defaultMTU || mtu > maxMTU {
+			return fmt.Errorf("mtu must be between %d and %d: %d", defaultMTU, maxMTU, mtu)
+		}
+		d.optMu.Lock()
+		d.preferredMTU = mtu
+		d.optMu.Unlock()
+		return nil
+	})
+}
+
+// ConnectTimeout gives up a connection which is not established within t.
+// The PeripheralConnected handler gets ErrConnectTimeout. Zero waits
+// forever.
+func ConnectTimeout(t time.Duration) gatt.Option {
+	return option("ConnectTimeout", func(d *device) error {
+		if t < 0 {
+			return fmt.Errorf("negative timeout: %s", t)
+		}
+		d.optMu.Lock()
+		d.connectTimeout = t
+		d.optMu.Unlock()
+		return nil
+	})
+}
+
+// StopTimeout sets how long Stop waits for each child process to exit
+// before it is killed.
+func StopTimeout(t time.Duration) gatt.Option {
+	return option("StopTimeout", func(d *device) error {
+		if t <= 0 {
+			return fmt.Errorf("timeout must be positive: %s", t)
+		}
+		d.optMu.Lock()
+		d.stopTimeout = t
+		d.optMu.Unlock()
+		return nil
+	})
+}
+
+// LostTimeout sets how long a discovered peripheral may be unseen before
+// it is forgotten and reported to the PeripheralLost handler. Zero keeps
+// peripherals until they are evicted by MaxDiscoveries.
+func LostTimeout(t time.Duration) gatt.Option {
+	return discoveryOption("LostTimeout", func(r *registry) error {
+		if t < 0 {
+			return fmt.Errorf("negative timeout: %s", t)
+		}
+		r.lostAfter = t
+		return nil
+	})
+}
+
+// MaxDiscoveries bounds the number of discovered peripherals remembered.
+// The least recently seen one is forgotten first.
+func MaxDiscoveries(n int) gatt.Option {
+	return discoveryOption("MaxDiscoveries", func(r *registry) error {
+		if n <= 0 {
+			return fmt.Errorf("must be positive: %d", n)
+		}
+		r.max = n
+		return nil
+	})
+}
+
+// SmoothRSSI filters the RSSI of each peripheral with a filter made by
+// newFilter, e.g. NewMovingAverage or NewKalman. The PeripheralDiscovered
+// handler gets the smoothed RSSI. nil turns it off.
+func SmoothRSSI(newFilter func() RSSIFilter) gatt.Option {
+	return discoveryOption("SmoothRSSI", func(r *registry) error {
+		r.newFilter = newFilter
+		for _, di := range r.m {
+			di.filter = nil
+		}
+		return nil
+	})
+}
+
+// ProximityZones classifies discovered peripherals into zones by the
+// smoothed RSSI. Changes are given to the PeripheralZoneChanged handler.
+func ProximityZones(zs Zones) gatt.Option {
+	return discoveryOption("ProximityZones", func(r *registry) error {
+		if err := zs.validate(); err != nil {
+			return err
+		}
+		r.zones = &zs
+		return nil
+	})
+}
+
+// SetReportPolicy sets when discovered peripherals are reported to the
+// PeripheralDiscovered handler. The default is ReportEvenEvents.
+func SetReportPolicy(p ReportPolicy) gatt.Option {
+	return discoveryOption("SetReportPolicy", func(r *registry) error {
+		if p == nil {
+			return errors.New("nil report policy")
+		}
+		r.policy = p
+		return nil
+	})
+}
+
+// ScanFilter reports only the advertisements passing f. It takes effect
+// from the next Scan. nil removes the filter.
+func ScanFilter(f Filter) gatt.Option {
+	return option("ScanFilter", func(d *device) error {
+		d.mu.Lock()
+		d.scanFilter = f
+		d.mu.Unlock()
+		return nil
+	})
+}
+
+// Trace calls f with every ATT PDU sent or received on the connections of
+// the device, in both roles. f is called on the goroutine handling the
+// connection and must not block. Give BtsnoopWriter.Trace to capture a
+// file for Wireshark. nil stops tracing.
+func Trace(f func(TracePDU)) gatt.Option {
+	return option("Trace", func(d *device) error {
+		d.optMu.Lock()
+		d.tracer = f
+		d.optMu.Unlock()
+		return nil
+	})
+}
+
+// Record writes every line exchanged with hci-ble and l2cap-ble to r, to
+// be replayed later by Replay. nil stops recording.
+func Record(r *Recorder) gatt.Option {
+	return option("Record", func(d *device) error {
+		d.optMu.Lock()
+		d.recorder = r
+		d.optMu.Unlock()
+		return nil
+	})
+}
+
+// SetMetrics counts the scanning, connections and ATT traffic of the device
+// in m. nil stops counting.
+func SetMetrics(m *Metrics) gatt.Option {
+	return option("SetMetrics", func(d *device) error {
+		d.optMu.Lock()
+		d.metrics = m
+		d.optMu.Unlock()
+		return nil
+	})
+}
+
+// SetScanMode overrides the dup argument of Scan.
+func SetScanMode(m ScanMode) gatt.Option {
+	return option("SetScanMode", func(d *device) error {
+		switch m {
+		case ScanModeDefault, ScanModeFilterDuplicates, ScanModeAllowDuplicates:
+		default:
+			return fmt.Errorf("unknown scan mode: %d", m)
+		}
+		d.optMu.Lock()
+		d.scanMode = m
+		d.optMu.Unlock()
+		return nil
+	})
+}
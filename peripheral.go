@@ -9,8 +9,8 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/paypal/gatt"
 )
 
@@ -23,6 +23,8 @@ type peripheral struct {
 
 	svcs []*gatt.Service
 
+	event *HCIEvent // the event which discovered the peripheral
+
 	sub *subscriber
 
 	mtu uint16
@@ -33,11 +35,18 @@ type peripheral struct {
 }
 
 func NewPeripheral(d *device, l2cap *L2CAP_BLE, address string) peripheral {
+	return newPeripheral(d, l2cap, l2cap, address)
+}
+
+// newPeripheral makes a peripheral which exchanges ATT PDUs over l2c.
+func newPeripheral(d *device, l2cap *L2CAP_BLE, l2c io.ReadWriteCloser, address string) peripheral {
 	p := peripheral{
 		d:       d,
 		l2cap:   l2cap,
-		l2c:     l2cap,
+		l2c:     l2c,
 		Address: address,
+		sub:     newSubscriber(),
+		mtu:     defaultMTU,
 		reqc:    make(chan message),
 		quitc:   make(chan struct{}),
 	}
@@ -46,6 +55,30 @@ func NewPeripheral(d *device, l2cap *L2CAP_BLE, address string) peripheral {
 	return p
 }
 
+// DiscoveryEvent returns the event by which p was discovered. ok is false
+// when p is not a discovered peripheral of this package.
+func DiscoveryEvent(p gatt.Peripheral) (e HCIEvent, ok bool) {
+	switch pp := p.(type) {
+	case *peripheral:
+		if pp.event != nil {
+			return *pp.event, true
+		}
+	case *bluezPeripheral:
+		if pp.event != nil {
+			return *pp.event, true
+		}
+	case *nodePeripheral:
+		if pp.event != nil {
+			return *pp.event, true
+		}
+	case *wsPeripheral:
+		if pp.event != nil {
+			return *pp.event, true
+		}
+	}
+	return HCIEvent{}, false
+}
+
 func (p *peripheral) Device() gatt.Device       { return p.d }
 func (p *peripheral) ID() string                { return strings.ToUpper(p.Address) }
 func (p *peripheral) Name() string              { return p.LocalName }
@@ -74,11 +107,14 @@ func (p *peripheral) DiscoverServices(filter []gatt.UUID) ([]*gatt.Service, erro
 		binary.LittleEndian.PutUint16(b[3:5], 0xFFFF)
 		binary.LittleEndian.PutUint16(b[5:7], 0x2800)
 
-		b = p.sendReq(op, b)
+		b, err := p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
 		if finish(op, start, b) {
 			break
 		}
-		log.Debugf("p read:%v", b)
+		p.d.log().Debug("peripheral read", "address", p.Address, "opcode", opcode(b), "pdu", fmt.Sprintf("%x", b))
 		b = b[1:]
 		l, b := int(b[0]), b[1:]
 		switch {
@@ -128,7 +164,10 @@ func (p *peripheral) DiscoverCharacteristics(cs []gatt.UUID, s *gatt.Service) ([
 		binary.LittleEndian.PutUint16(b[3:5], s.EndHandle())
 		binary.LittleEndian.PutUint16(b[5:7], 0x2803)
 
-		b = p.sendReq(op, b)
+		b, err := p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
 		if finish(op, start, b) {
 			break
 		}
@@ -152,7 +191,7 @@ func (p *peripheral) DiscoverCharacteristics(cs []gatt.UUID, s *gatt.Service) ([
 			}
 			s := searchService(p.svcs, h, vh)
 			if s == nil {
-				log.Printf("Can't find service range that contains 0x%04X - 0x%04X", h, vh)
+				p.d.log().Error("can't find service range", "address", p.Address, "handle", fmt.Sprintf("0x%04X", h), "valueHandle", fmt.Sprintf("0x%04X", vh))
 				return nil, fmt.Errorf("Can't find service range that contains 0x%04X - 0x%04X", h, vh)
 			}
 			c := gatt.NewCharacteristic(u, s, props, h, vh)
@@ -190,7 +229,10 @@ func (p *peripheral) DiscoverDescriptors(ds []gatt.UUID, c *gatt.Characteristic)
 		binary.LittleEndian.PutUint16(b[1:3], start)
 		binary.LittleEndian.PutUint16(b[3:5], c.EndHandle())
 
-		b = p.sendReq(op, b)
+		b, err := p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
 		if finish(attOpFindInfoReq, start, b) {
 			break
 		}
@@ -232,7 +274,13 @@ func (p *peripheral) ReadCharacteristic(c *gatt.Characteristic) ([]byte, error)
 	b[0] = op
 	binary.LittleEndian.PutUint16(b[1:3], c.VHandle())
 
-	b = p.sendReq(op, b)
+	b, err := p.sendReq(op, b)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] == attOpError {
+		return nil, attEcode(b[4])
+	}
 	b = b[1:]
 	return b, nil
 }
@@ -256,7 +304,16 @@ func (p *peripheral) ReadLongCharacteristic(c *gatt.Characteristic) ([]byte, err
 		binary.LittleEndian.PutUint16(b[1:3], c.VHandle())
 		binary.LittleEndian.PutUint16(b[3:5], off)
 
-		b = p.sendReq(op, b)
+		b, err = p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == attOpError {
+			if attEcode(b[4]) == attEcodeAttrNotLong {
+				break
+			}
+			return nil, attEcode(b[4])
+		}
 		b = b[1:]
 		if len(b) == 0 {
 			break
@@ -281,12 +338,15 @@ func (p *peripheral) WriteCharacteristic(c *gatt.Characteristic, value []byte, n
 	copy(b[3:], value)
 
 	if noRsp {
-		p.sendCmd(op, b)
-		return nil
+		return p.sendCmd(op, b)
+	}
+	b, err := p.sendReq(op, b)
+	if err != nil {
+		return err
+	}
+	if b[0] == attOpError {
+		return attEcode(b[4])
 	}
-	b = p.sendReq(op, b)
-	// TODO: error handling
-	b = b[1:]
 	return nil
 }
 
@@ -296,9 +356,14 @@ func (p *peripheral) ReadDescriptor(d *gatt.Descriptor) ([]byte, error) {
 	b[0] = op
 	binary.LittleEndian.PutUint16(b[1:3], d.Handle())
 
-	b = p.sendReq(op, b)
+	b, err := p.sendReq(op, b)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] == attOpError {
+		return nil, attEcode(b[4])
+	}
 	b = b[1:]
-	// TODO: error handling
 	return b, nil
 }
 
@@ -309,15 +374,19 @@ func (p *peripheral) WriteDescriptor(d *gatt.Descriptor, value []byte) error {
 	binary.LittleEndian.PutUint16(b[1:3], d.Handle())
 	copy(b[3:], value)
 
-	b = p.sendReq(op, b)
-	b = b[1:]
-	// TODO: error handling
+	b, err := p.sendReq(op, b)
+	if err != nil {
+		return err
+	}
+	if b[0] == attOpError {
+		return attEcode(b[4])
+	}
 	return nil
 }
 
 func (p *peripheral) setNotifyValue(c *gatt.Characteristic, flag uint16,
 	f func(*gatt.Characteristic, []byte, error)) error {
-	if c.Descriptor == nil {
+	if c.Descriptor() == nil {
 		return errors.New("no cccd") // FIXME
 	}
 	ccc := uint16(0)
@@ -331,12 +400,16 @@ func (p *peripheral) setNotifyValue(c *gatt.Characteristic, flag uint16,
 	binary.LittleEndian.PutUint16(b[1:3], c.Descriptor().Handle())
 	binary.LittleEndian.PutUint16(b[3:5], ccc)
 
-	b = p.sendReq(op, b)
-	b = b[1:]
-	// TODO: error handling
+	b, err := p.sendReq(op, b)
 	if f == nil {
 		p.sub.unsubscribe(c.VHandle())
 	}
+	if err != nil {
+		return err
+	}
+	if b[0] == attOpError {
+		return attEcode(b[4])
+	}
 	return nil
 }
 
@@ -350,9 +423,25 @@ func (p *peripheral) SetIndicateValue(c *gatt.Characteristic,
 	return p.setNotifyValue(c, gattCCCIndicateFlag, f)
 }
 
+// ReadRSSI reads the RSSI of the connection, by l2cap-ble or by HCI Read
+// RSSI on the socket backend. It returns -1 if the peripheral is not
+// connected or the RSSI can not be read.
 func (p *peripheral) ReadRSSI() int {
-	// TODO: implement
-	return -1
+	if p.d == nil {
+		return -1
+	}
+	p.d.mu.Lock()
+	l2cap := p.d.l2caps[p.ID()]
+	p.d.mu.Unlock()
+	if l2cap == nil {
+		return -1
+	}
+	rssi, err := l2cap.readRSSI()
+	if err != nil {
+		p.d.log().Info("read rssi failed", "address", p.Address, "error", err)
+		return -1
+	}
+	return rssi
 }
 
 func (p *peripheral) SetMTU(mtu uint16) error {
@@ -361,7 +450,13 @@ func (p *peripheral) SetMTU(mtu uint16) error {
 	b[0] = op
 	binary.LittleEndian.PutUint16(b[1:3], uint16(mtu))
 
-	b = p.sendReq(op, b)
+	b, err := p.sendReq(op, b)
+	if err != nil {
+		return err
+	}
+	if b[0] == attOpError {
+		return attEcode(b[4])
+	}
 	serverMTU := binary.LittleEndian.Uint16(b[1:3])
 	if serverMTU < mtu {
 		mtu = serverMTU
@@ -385,14 +480,32 @@ type message struct {
 	rspc chan []byte
 }
 
-func (p *peripheral) sendCmd(op byte, b []byte) {
-	p.reqc <- message{op: op, b: b}
+// sendCmd sends a command. It fails with ErrDisconnected once the
+// connection has ended.
+func (p *peripheral) sendCmd(op byte, b []byte) error {
+	select {
+	case p.reqc <- message{op: op, b: b}:
+		return nil
+	case <-p.quitc:
+		return ErrDisconnected
+	}
 }
 
-func (p *peripheral) sendReq(op byte, b []byte) []byte {
-	m := message{op: op, b: b, rspc: make(chan []byte)}
-	p.reqc <- m
-	return <-m.rspc
+// sendReq sends a request and waits for its response. It fails with
+// ErrDisconnected once the connection has ended.
+func (p *peripheral) sendReq(op byte, b []byte) ([]byte, error) {
+	m := message{op: op, b: b, rspc: make(chan []byte, 1)}
+	select {
+	case p.reqc <- m:
+	case <-p.quitc:
+		return nil, ErrDisconnected
+	}
+	select {
+	case r := <-m.rspc:
+		return r, nil
+	case <-p.quitc:
+		return nil, ErrDisconnected
+	}
 }
 
 func (p *peripheral) loop() {
@@ -404,17 +517,24 @@ func (p *peripheral) loop() {
 		for {
 			select {
 			case req := <-p.reqc:
-				log.Debugf("peripheral loop reqc: %v", req.b)
+				p.d.log().Debug("peripheral request", "address", p.Address, "opcode", fmt.Sprintf("0x%02x", req.op), "pdu", fmt.Sprintf("%x", req.b))
+				start := time.Now()
 				p.l2c.Write(req.b)
 				if req.rspc == nil {
 					break
 				}
-				r := <-rspc
+				var r []byte
+				select {
+				case r = <-rspc:
+				case <-p.quitc:
+					return
+				}
+				p.d.stats().attResponse(req.b[0], r, time.Since(start))
 				switch reqOp, rspOp := req.b[0], r[0]; {
 				case rspOp == attRspFor[reqOp]:
 				case rspOp == attOpError && r[1] == reqOp:
 				default:
-					log.Printf("Request 0x%02x got a mismatched response: 0x%02x", reqOp, rspOp)
+					p.d.log().Error("mismatched response", "address", p.Address, "opcode", fmt.Sprintf("0x%02x", reqOp), "response", fmt.Sprintf("0x%02x", rspOp))
 					// FIXME: terminate the connection?
 				}
 				req.rspc <- r
@@ -445,9 +565,10 @@ func (p *peripheral) loop() {
 		}
 
 		h := binary.LittleEndian.Uint16(b[1:3])
+		p.d.stats().notification(h)
 		f := p.sub.fn(h)
 		if f == nil {
-			log.Printf("notified by unsubscribed handle")
+			p.d.log().Info("notified by unsubscribed handle", "address", p.Address)
 			// FIXME: terminate the connection?
 		} else {
 			go f(b[3:], nil)
@@ -0,0 +1,79 @@
+package noblechild
+
+import "time"
+
+// ReportPolicy decides whether an advertisement of a peripheral is reported
+// to the PeripheralDiscovered handler.
+type ReportPolicy func(s ReportState) bool
+
+// ReportState is what a ReportPolicy decides on.
+type ReportState struct {
+	// Event is the advertisement. Its Count is 0 on the first sighting.
+	Event HCIEvent
+	// RSSI is the smoothed RSSI which would be reported.
+	RSSI int
+	Now  time.Time
+
+	// Reported is true when the peripheral was reported before, at
+	// LastReport with LastRSSI.
+	Reported   bool
+	LastReport time.Time
+	LastRSSI   int
+	// AdvChanged is true when the advertising data differs from the last
+	// reported one.
+	AdvChanged bool
+}
+
+// ReportEvenEvents reports every second advertisement, from the first. It
+// is the default, which gives hci-ble a chance to get the scan response
+// before the peripheral is reported.
+func ReportEvenEvents() ReportPolicy {
+	return func(s ReportState) bool { return s.Event.Count%2 == 0 }
+}
+
+// ReportEveryPacket reports every advertisement.
+func ReportEveryPacket() ReportPolicy {
+	return func(s ReportState) bool { return true }
+}
+
+// ReportFirstSighting reports a peripheral once, until it is lost.
+func ReportFirstSighting() ReportPolicy {
+	return func(s ReportState) bool { return !s.Reported }
+}
+
+// ReportOnChange reports when the advertising data changes.
+func ReportOnChange() ReportPolicy {
+	return func(s ReportState) bool { return s.AdvChanged }
+}
+
+// ReportInterval reports a peripheral at most once in d.
+func ReportInterval(d time.Duration) ReportPolicy {
+	return func(s ReportState) bool {
+		return !s.Reported || s.Now.Sub(s.LastReport) >= d
+	}
+}
+
+// ReportRSSIChange reports when the RSSI moves more than db from the last
+// reported one.
+func ReportRSSIChange(db int) ReportPolicy {
+	return func(s ReportState) bool {
+		if !s.Reported {
+			return true
+		}
+		diff := s.RSSI - s.LastRSSI
+		return diff > db || diff < -db
+	}
+}
+
+// ReportAny reports when any of ps does, e.g.
+// ReportAny(ReportOnChange(), ReportInterval(time.Minute)).
+func ReportAny(ps ...ReportPolicy) ReportPolicy {
+	return func(s ReportState) bool {
+		for _, p := range ps {
+			if p(s) {
+				return true
+			}
+		}
+		return false
+	}
+}
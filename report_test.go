@@ -0,0 +1,57 @@
+package noblechild
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reported feeds the events to a registry with p and returns which were
+// reported. The events are 1s apart.
+func reported(p ReportPolicy, es ...HCIEvent) []bool {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	r := newRegistry()
+	r.now = clock.now
+	r.policy = p
+
+	var ret []bool
+	for _, e := range es {
+		clock.add(time.Second)
+		ret = append(ret, r.seen(e).report)
+	}
+	return ret
+}
+
+func Test_ReportPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	es := []HCIEvent{
+		{Address: "aa", EIR: "0201", RSSI: -60},
+		{Address: "aa", EIR: "0201", RSSI: -62},
+		{Address: "aa", EIR: "0202", RSSI: -66},
+		{Address: "aa", EIR: "0202", RSSI: -66},
+		{Address: "bb", EIR: "0201", RSSI: -60},
+	}
+
+	assert.Equal([]bool{true, false, true, false, true}, reported(ReportEvenEvents(), es...))
+	assert.Equal([]bool{true, true, true, true, true}, reported(ReportEveryPacket(), es...))
+	assert.Equal([]bool{true, false, false, false, true}, reported(ReportFirstSighting(), es...))
+	assert.Equal([]bool{true, false, true, false, true}, reported(ReportOnChange(), es...))
+	assert.Equal([]bool{true, false, true, false, true}, reported(ReportInterval(2*time.Second), es...))
+	assert.Equal([]bool{true, false, true, false, true}, reported(ReportRSSIChange(3), es...))
+	assert.Equal([]bool{true, false, false, false, true},
+		reported(ReportAny(ReportFirstSighting(), ReportRSSIChange(10)), es...))
+	assert.Equal([]bool{true, true, true, true, true},
+		reported(ReportAny(ReportOnChange(), ReportInterval(time.Second)), es...))
+}
+
+func Test_SetReportPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &device{discoveries: newRegistry()}
+	assert.NotNil(d.Option(SetReportPolicy(nil)))
+	assert.Nil(d.Option(SetReportPolicy(ReportEveryPacket())))
+	assert.True(d.discoveries.seen(HCIEvent{Address: "aa"}).report)
+	assert.True(d.discoveries.seen(HCIEvent{Address: "aa"}).report)
+}
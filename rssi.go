@@ -0,0 +1,156 @@
+package noblechild
+
+import (
+	"fmt"
+	"math"
+)
+
+// RSSIFilter smooths the RSSI of one peripheral.
+type RSSIFilter interface {
+	// Filter adds rssi and returns the smoothed value.
+	Filter(rssi int) float64
+}
+
+// MovingAverage is the mean of the last N RSSI values.
+type MovingAverage struct {
+	N   int
+	buf []int
+	sum int
+}
+
+// NewMovingAverage returns a filter averaging the last n values.
+func NewMovingAverage(n int) *MovingAverage {
+	if n < 1 {
+		n = 1
+	}
+	return &MovingAverage{N: n}
+}
+
+func (m *MovingAverage) Filter(rssi int) float64 {
+	m.buf = append(m.buf, rssi)
+	m.sum += rssi
+	if len(m.buf) > m.N {
+		m.sum -= m.buf[0]
+		m.buf = m.buf[1:]
+	}
+	return float64(m.sum) / float64(len(m.buf))
+}
+
+// Kalman is a one dimensional Kalman filter for a slowly changing RSSI.
+type Kalman struct {
+	// ProcessNoise is how much the true RSSI is expected to change between
+	// two values.
+	ProcessNoise float64
+	// MeasurementNoise is how much a value is off the true RSSI.
+	MeasurementNoise float64
+
+	x, p   float64
+	primed bool
+}
+
+// NewKalman returns a Kalman filter. 0.008 and 4 are a good start for a
+// still peripheral.
+func NewKalman(processNoise, measurementNoise float64) *Kalman {
+	return &Kalman{ProcessNoise: processNoise, MeasurementNoise: measurementNoise}
+}
+
+func (k *Kalman) Filter(rssi int) float64 {
+	z := float64(rssi)
+	if !k.primed {
+		k.x, k.p, k.primed = z, k.MeasurementNoise, true
+		return k.x
+	}
+	p := k.p + k.ProcessNoise
+	g := p / (p + k.MeasurementNoise)
+	k.x += g * (z - k.x)
+	k.p = (1 - g) * p
+	return k.x
+}
+
+// Zone is a proximity zone of a peripheral.
+type Zone int
+
+const (
+	ZoneUnknown Zone = iota
+	ZoneImmediate
+	ZoneNear
+	ZoneFar
+)
+
+func (z Zone) String() string {
+	switch z {
+	case ZoneImmediate:
+		return "immediate"
+	case ZoneNear:
+		return "near"
+	case ZoneFar:
+		return "far"
+	}
+	return "unknown"
+}
+
+// Zones classifies the smoothed RSSI into zones. A peripheral enters a
+// zone when the RSSI passes the boundary by Hysteresis, so it does not
+// flap on the boundary.
+type Zones struct {
+	Immediate  float64 // RSSI at or above which it is immediate
+	Near       float64 // RSSI at or above which it is near
+	Hysteresis float64 // dB
+}
+
+// DefaultZones are the zones for a typical beacon.
+var DefaultZones = Zones{Immediate: -55, Near: -75, Hysteresis: 3}
+
+func (zs Zones) validate() error {
+	if zs.Near > zs.Immediate {
+		return fmt.Errorf("near %v is above immediate %v", zs.Near, zs.Immediate)
+	}
+	if zs.Hysteresis < 0 || math.IsNaN(zs.Hysteresis) {
+		return fmt.Errorf("invalid hysteresis: %v", zs.Hysteresis)
+	}
+	return nil
+}
+
+// Classify returns the zone of rssi for a peripheral which is in cur.
+func (zs Zones) Classify(cur Zone, rssi float64) Zone {
+	raw := ZoneFar
+	switch {
+	case rssi >= zs.Immediate:
+		raw = ZoneImmediate
+	case rssi >= zs.Near:
+		raw = ZoneNear
+	}
+	if cur == ZoneUnknown || raw == cur {
+		return raw
+	}
+
+	// the boundary between cur and raw must be passed by the hysteresis
+	h := zs.Hysteresis
+	if raw < cur {
+		// closer
+		if rssi >= zs.boundary(raw)+h {
+			return raw
+		}
+		// it may still pass one boundary
+		if raw == ZoneImmediate && cur == ZoneFar && rssi >= zs.Near+h {
+			return ZoneNear
+		}
+		return cur
+	}
+	// farther
+	if rssi < zs.boundary(cur)-h {
+		if raw == ZoneFar && cur == ZoneImmediate && rssi >= zs.Near-h {
+			return ZoneNear
+		}
+		return raw
+	}
+	return cur
+}
+
+// boundary is the lowest RSSI of z.
+func (zs Zones) boundary(z Zone) float64 {
+	if z == ZoneImmediate {
+		return zs.Immediate
+	}
+	return zs.Near
+}
@@ -0,0 +1,94 @@
+package noblechild
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MovingAverage(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewMovingAverage(3)
+	assert.Equal(-60.0, m.Filter(-60))
+	assert.Equal(-65.0, m.Filter(-70))
+	assert.Equal(-70.0, m.Filter(-80))
+	assert.Equal(-80.0, m.Filter(-90))
+}
+
+func Test_Kalman(t *testing.T) {
+	assert := assert.New(t)
+
+	k := NewKalman(0.008, 4)
+	assert.Equal(-60.0, k.Filter(-60))
+	// a jump is damped
+	v := k.Filter(-70)
+	assert.True(v < -60 && v > -70)
+	for i := 0; i < 200; i++ {
+		v = k.Filter(-70)
+	}
+	assert.InDelta(-70, v, 0.5)
+}
+
+func Test_ZonesClassify(t *testing.T) {
+	assert := assert.New(t)
+
+	zs := DefaultZones
+	assert.Equal(ZoneImmediate, zs.Classify(ZoneUnknown, -50))
+	assert.Equal(ZoneNear, zs.Classify(ZoneUnknown, -60))
+	assert.Equal(ZoneFar, zs.Classify(ZoneUnknown, -90))
+
+	// closer
+	assert.Equal(ZoneFar, zs.Classify(ZoneFar, -73))
+	assert.Equal(ZoneNear, zs.Classify(ZoneFar, -72))
+	assert.Equal(ZoneNear, zs.Classify(ZoneFar, -53))
+	assert.Equal(ZoneImmediate, zs.Classify(ZoneFar, -52))
+	assert.Equal(ZoneNear, zs.Classify(ZoneNear, -54))
+
+	// farther
+	assert.Equal(ZoneImmediate, zs.Classify(ZoneImmediate, -58))
+	assert.Equal(ZoneNear, zs.Classify(ZoneImmediate, -59))
+	assert.Equal(ZoneNear, zs.Classify(ZoneImmediate, -78))
+	assert.Equal(ZoneFar, zs.Classify(ZoneImmediate, -79))
+	assert.Equal(ZoneNear, zs.Classify(ZoneNear, -78))
+	assert.Equal(ZoneFar, zs.Classify(ZoneNear, -79))
+
+	assert.NotNil(Zones{Immediate: -80, Near: -60}.validate())
+	assert.Equal("near", ZoneNear.String())
+}
+
+func Test_registrySmoothing(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	d := &device{discoveries: newRegistry()}
+	d.discoveries.now = clock.now
+	assert.Nil(d.Option(
+		SmoothRSSI(func() RSSIFilter { return NewMovingAverage(2) }),
+		ProximityZones(DefaultZones),
+	))
+	r := d.discoveries
+
+	s := r.seen(HCIEvent{Address: "aa", RSSI: -50})
+	assert.Equal(-50, s.rssi)
+	assert.Equal(ZoneImmediate, s.zc.di.Zone)
+	assert.Equal(ZoneUnknown, s.zc.from)
+
+	// another peripheral has its own filter
+	s = r.seen(HCIEvent{Address: "bb", RSSI: -90})
+	assert.Equal(-90, s.rssi)
+
+	s = r.seen(HCIEvent{Address: "aa", RSSI: -61})
+	assert.Equal(-56, s.rssi) // -55.5 rounded
+	assert.Nil(s.zc)
+
+	s = r.seen(HCIEvent{Address: "aa", RSSI: -61})
+	assert.Equal(-61, s.rssi)
+	assert.Equal(ZoneNear, s.zc.di.Zone)
+	assert.Equal(ZoneImmediate, s.zc.from)
+
+	di, _ := r.get("aa")
+	assert.Equal(-61.0, di.SmoothedRSSI)
+	assert.Equal(-61, di.Event.RSSI)
+}
@@ -0,0 +1,174 @@
+package noblechild
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/paypal/gatt"
+)
+
+// uuidXiaomi is the service data UUID of MiBeacon.
+var uuidXiaomi = gatt.UUID16(0xfe95)
+
+// ServiceData is a service data in an advertisement.
+type ServiceData struct {
+	UUID gatt.UUID
+	Data []byte
+
+	// Decoded is the value returned by the decoder registered for UUID,
+	// or nil if there is none or it failed.
+	Decoded interface{}
+	// Err is the error returned by the decoder.
+	Err error
+}
+
+// ServiceDataDecoder decodes the service data of a service. It returns nil
+// without an error when the data is not a format it knows.
+type ServiceDataDecoder func(data []byte) (interface{}, error)
+
+var serviceDataDecoders = struct {
+	sync.RWMutex
+	m map[string]ServiceDataDecoder
+}{m: map[string]ServiceDataDecoder{
+	uuidXiaomi.String(): decodeMiBeacon,
+}}
+
+// RegisterServiceDataDecoder registers f as the decoder of the service data
+// of u, replacing the previous one. A nil f removes the decoder.
+func RegisterServiceDataDecoder(u gatt.UUID, f ServiceDataDecoder) {
+	serviceDataDecoders.Lock()
+	defer serviceDataDecoders.Unlock()
+	if f == nil {
+		delete(serviceDataDecoders.m, u.String())
+		return
+	}
+	serviceDataDecoders.m[u.String()] = f
+}
+
+// decodeServiceData decodes the service data sd.
+func decodeServiceData(sd gatt.ServiceData) ServiceData {
+	ret := ServiceData{UUID: sd.UUID, Data: sd.Data}
+
+	serviceDataDecoders.RLock()
+	f := serviceDataDecoders.m[sd.UUID.String()]
+	serviceDataDecoders.RUnlock()
+	if f != nil {
+		ret.Decoded, ret.Err = f(sd.Data)
+	}
+	return ret
+}
+
+// MiBeacon frame control bits.
+const (
+	miEncrypted  = 1 << 3
+	miMAC        = 1 << 4
+	miCapability = 1 << 5
+	miObject     = 1 << 6
+)
+
+// MiBeacon is the beacon of Xiaomi (MiJia) sensors. The object of an
+// encrypted beacon is not decoded. The measurements the beacon does not
+// carry are nil.
+type MiBeacon struct {
+	Version      int
+	ProductID    uint16
+	FrameCounter byte
+	Encrypted    bool
+	Address      string // "" if not included
+	Capability   byte
+
+	ObjectType uint16 // 0 if no object
+	Object     []byte
+
+	Temperature  *float64 // Celsius
+	Humidity     *float64 // %
+	Battery      *int     // %
+	Illuminance  *int     // lux
+	Moisture     *int     // %
+	Conductivity *int     // µS/cm
+}
+
+func decodeMiBeacon(b []byte) (interface{}, error) {
+	if len(b) < 5 {
+		return nil, nil
+	}
+	fc := binary.LittleEndian.Uint16(b)
+	m := &MiBeacon{
+		Version:      int(fc >> 12),
+		ProductID:    binary.LittleEndian.Uint16(b[2:]),
+		FrameCounter: b[4],
+		Encrypted:    fc&miEncrypted != 0,
+	}
+	b = b[5:]
+	if fc&miMAC != 0 {
+		if len(b) < 6 {
+			return nil, errors.New("mibeacon: short address")
+		}
+		m.Address = fmt.Sprintf("%02x%02x%02x%02x%02x%02x", b[5], b[4], b[3], b[2], b[1], b[0])
+		b = b[6:]
+	}
+	if fc&miCapability != 0 {
+		if len(b) < 1 {
+			return nil, errors.New("mibeacon: short capability")
+		}
+		m.Capability = b[0]
+		b = b[1:]
+		// version 5 adds the I/O capability
+		if m.Version >= 5 && m.Capability&0x20 != 0 {
+			if len(b) < 2 {
+				return nil, errors.New("mibeacon: short I/O capability")
+			}
+			b = b[2:]
+		}
+	}
+	if fc&miObject == 0 || m.Encrypted {
+		return m, nil
+	}
+	if len(b) < 3 || len(b) < 3+int(b[2]) {
+		return nil, errors.New("mibeacon: short object")
+	}
+	m.ObjectType = binary.LittleEndian.Uint16(b)
+	m.Object = b[3 : 3+int(b[2])]
+	m.decodeObject()
+	return m, nil
+}
+
+// decodeObject sets the measurements of the object.
+func (m *MiBeacon) decodeObject() {
+	o := m.Object
+	temperature := func(b []byte) {
+		t := float64(int16(binary.LittleEndian.Uint16(b))) / 10
+		m.Temperature = &t
+	}
+	humidity := func(b []byte) {
+		h := float64(binary.LittleEndian.Uint16(b)) / 10
+		m.Humidity = &h
+	}
+	integer := func(b []byte) *int {
+		var v int
+		for i := len(b) - 1; i >= 0; i-- {
+			v = v<<8 | int(b[i])
+		}
+		return &v
+	}
+
+	switch {
+	case m.ObjectType == 0x1004 && len(o) == 2:
+		temperature(o)
+	case m.ObjectType == 0x1006 && len(o) == 2:
+		humidity(o)
+	case m.ObjectType == 0x1007 && len(o) == 3:
+		m.Illuminance = integer(o)
+	case m.ObjectType == 0x1008 && len(o) == 1:
+		m.Moisture = integer(o)
+	case m.ObjectType == 0x1009 && len(o) == 2:
+		m.Conductivity = integer(o)
+	case m.ObjectType == 0x100a && len(o) == 1:
+		m.Battery = integer(o)
+	case m.ObjectType == 0x100d && len(o) == 4:
+		temperature(o)
+		humidity(o[2:])
+	}
+}
@@ -0,0 +1,73 @@
+package noblechild
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MiBeaconInEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	// LYWSDCGQ thermometer: 25.4 C, 58.4 %
+	eir := "020106" + "151695fe" + "5020aa01da2c5c4b38c1a40d1004fe004802"
+	e, err := parseEvent("event a4:c1:38:4b:5c:2c,public," + eir + ",-70")
+	assert.Nil(err)
+
+	assert.Equal(1, len(e.ServiceData))
+	sd := e.ServiceData[0]
+	assert.True(sd.UUID.Equal(gatt.UUID16(0xfe95)))
+	assert.Nil(sd.Err)
+	m := sd.Decoded.(*MiBeacon)
+	assert.Equal(2, m.Version)
+	assert.Equal(uint16(0x01aa), m.ProductID)
+	assert.Equal(byte(0xda), m.FrameCounter)
+	assert.False(m.Encrypted)
+	assert.Equal("a4c1384b5c2c", m.Address)
+	assert.Equal(uint16(0x100d), m.ObjectType)
+	assert.InDelta(25.4, *m.Temperature, 0.0001)
+	assert.InDelta(58.4, *m.Humidity, 0.0001)
+	assert.Nil(m.Battery)
+}
+
+func Test_decodeMiBeacon(t *testing.T) {
+	assert := assert.New(t)
+
+	// battery 93 %
+	b, _ := hex.DecodeString("5020aa01db2c5c4b38c1a40a10015d")
+	v, err := decodeMiBeacon(b)
+	assert.Nil(err)
+	assert.Equal(93, *v.(*MiBeacon).Battery)
+
+	// the object of an encrypted beacon is left as it is
+	b, _ = hex.DecodeString("5858aa01dc2c5c4b38c1a4deadbeef")
+	v, err = decodeMiBeacon(b)
+	assert.Nil(err)
+	assert.True(v.(*MiBeacon).Encrypted)
+	assert.Equal(uint16(0), v.(*MiBeacon).ObjectType)
+
+	b, _ = hex.DecodeString("5020aa01dd2c5c4b38c1a40d1004fe")
+	_, err = decodeMiBeacon(b)
+	assert.NotNil(err)
+
+	v, err = decodeMiBeacon([]byte{0x50})
+	assert.Nil(err)
+	assert.Nil(v)
+}
+
+func Test_RegisterServiceDataDecoder(t *testing.T) {
+	assert := assert.New(t)
+
+	u := gatt.UUID16(0xfffe)
+	RegisterServiceDataDecoder(u, func(b []byte) (interface{}, error) { return len(b), nil })
+	defer RegisterServiceDataDecoder(u, nil)
+
+	sd := decodeServiceData(gatt.ServiceData{UUID: u, Data: []byte{1, 2}})
+	assert.Equal(2, sd.Decoded)
+
+	RegisterServiceDataDecoder(u, nil)
+	sd = decodeServiceData(gatt.ServiceData{UUID: u, Data: []byte{1, 2}})
+	assert.Nil(sd.Decoded)
+}
@@ -0,0 +1,220 @@
+package noblechild
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+// SessionFormat and SessionVersion identify a recorded session file.
+const (
+	SessionFormat  = "noblechild-session"
+	SessionVersion = 1
+)
+
+// Children and directions in a session.
+const (
+	ChildHCI   = "hci-ble"
+	ChildL2CAP = "l2cap-ble"
+
+	DirOut    = "out"    // a line printed by the child
+	DirIn     = "in"     // a line written to the child
+	DirSignal = "signal" // a signal sent to the child
+)
+
+// ErrSessionVersion is returned when a session file is not a version this
+// package reads.
+var ErrSessionVersion = errors.New("unsupported session version")
+
+// sessionHeader is the first line of a session file.
+type sessionHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// SessionRecord is a line exchanged with a child. The session file is the
+// header followed by one JSON record per line.
+type SessionRecord struct {
+	Time    time.Time `json:"t"`
+	Child   string    `json:"child"`
+	Address string    `json:"address,omitempty"` // the peripheral of l2cap-ble
+	PID     int       `json:"pid,omitempty"`
+	Dir     string    `json:"dir"`
+	Line    string    `json:"line"`
+}
+
+// Recorder writes the lines exchanged with the children as a session file.
+// Give it to the Record option.
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewRecorder writes the session header to w.
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(sessionHeader{Format: SessionFormat, Version: SessionVersion, Created: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{enc: enc}, nil
+}
+
+// Err returns the first write error. Nothing is written after it.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) write(rec SessionRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(rec)
+}
+
+// record gives a line to the recorder of the device, if any.
+func (d *device) record(child, address string, pid int, dir, line string) {
+	if d == nil {
+		return
+	}
+	d.optMu.RLock()
+	r := d.recorder
+	d.optMu.RUnlock()
+	if r == nil {
+		return
+	}
+	r.write(SessionRecord{
+		Time:    time.Now(),
+		Child:   child,
+		Address: address,
+		PID:     pid,
+		Dir:     dir,
+		Line:    line,
+	})
+}
+
+// ReadSession reads a session file.
+func ReadSession(r io.Reader) ([]SessionRecord, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("empty session")
+	}
+	var hdr sessionHeader
+	if err := json.Unmarshal(s.Bytes(), &hdr); err != nil {
+		return nil, fmt.Errorf("session header: %s", err)
+	}
+	if hdr.Format != SessionFormat {
+		return nil, fmt.Errorf("not a session: %q", hdr.Format)
+	}
+	if hdr.Version != SessionVersion {
+		return nil, fmt.Errorf("%w: %d", ErrSessionVersion, hdr.Version)
+	}
+
+	var recs []SessionRecord
+	for n := 2; s.Scan(); n++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var rec SessionRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("session line %d: %s", n, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, s.Err()
+}
+
+// NewReplayDevice makes a device which starts no child. Its hci-ble and
+// l2cap-ble output is given by Replay, so a recorded session runs without
+// hardware. Connect and CancelConnection only track the connections, and
+// what is written to l2cap-ble is discarded.
+func NewReplayDevice(opts ...gatt.Option) (gatt.Device, error) {
+	d := &device{
+		l2caps:      map[string]*L2CAP_BLE{},
+		discoveries: newRegistry(),
+		dispatcher:  newDispatcher(),
+		attrs:       NewAttributeTable(),
+		stopTimeout: DefaultStopTimeout,
+		hciDeviceID: -1,
+		replay:      true,
+	}
+	if err := d.Option(opts...); err != nil {
+		return d, err
+	}
+	hci, err := NewHCI(d, "")
+	if err != nil {
+		return d, err
+	}
+	d.hci = hci
+	d.backend = hci
+	d.created = true
+	return d, nil
+}
+
+// Replay feeds the child output in the session r to d, made by
+// NewReplayDevice, as fast as it is parsed. The l2cap-ble of an address is
+// made on its first line if the handlers have not connected it yet.
+func Replay(d gatt.Device, r io.Reader) error {
+	dd, ok := d.(*device)
+	if !ok || !dd.replay {
+		return errors.New("not a replay device")
+	}
+	recs, err := ReadSession(r)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range recs {
+		if rec.Dir != DirOut {
+			continue
+		}
+		switch rec.Child {
+		case ChildHCI:
+			dd.hci.ParseStdout(rec.Line)
+		case ChildL2CAP:
+			l2cap := dd.replayL2CAP(rec.Address)
+			if err := l2cap.ParseStdout(rec.Line); err != nil {
+				dd.log().Error("l2cap-ble output", "address", rec.Address, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// replayL2CAP returns the connection of address, making one if needed.
+func (d *device) replayL2CAP(address string) *L2CAP_BLE {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.replayL2CAPLocked(address)
+}
+
+func (d *device) replayL2CAPLocked(address string) *L2CAP_BLE {
+	if l2cap, ok := d.l2caps[address]; ok {
+		return l2cap
+	}
+	l2cap, _ := NewL2CAP(d, "")
+	l2cap.Address = address
+	l2cap.stdinPipe = nopWriteCloser{io.Discard}
+	d.l2caps[address] = l2cap
+	return l2cap
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,104 @@
+package noblechild
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RecordSession(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	r, err := NewRecorder(&buf)
+	assert.Nil(err)
+	d := &device{}
+	assert.Nil(d.Option(Record(r)))
+
+	l2cap := &L2CAP_BLE{device: d, Address: "AABBCCDDEEFF", stdinPipe: &lineBuffer{}}
+	l2cap.Write([]byte{0x0a, 0x03, 0x00})
+	d.record(ChildHCI, "", 100, DirOut, "adapterState poweredOn")
+	assert.Nil(r.Err())
+
+	recs, err := ReadSession(&buf)
+	assert.Nil(err)
+	assert.Equal(2, len(recs))
+	assert.Equal(ChildL2CAP, recs[0].Child)
+	assert.Equal("AABBCCDDEEFF", recs[0].Address)
+	assert.Equal(DirIn, recs[0].Dir)
+	assert.Equal("0a0300", recs[0].Line)
+	assert.Equal(100, recs[1].PID)
+	assert.False(recs[1].Time.IsZero())
+
+	_, err = ReadSession(strings.NewReader(`{"format":"noblechild-session","version":2}`))
+	assert.True(errors.Is(err, ErrSessionVersion))
+	_, err = ReadSession(strings.NewReader(`{"format":"other","version":1}`))
+	assert.NotNil(err)
+}
+
+func Test_ReplaySession(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewReplayDevice()
+	assert.Nil(err)
+
+	discovered := make(chan gatt.Peripheral, 1)
+	connected := make(chan gatt.Peripheral, 1)
+	disconnected := make(chan error, 1)
+	d.Handle(
+		PeripheralDiscovered(func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+			assert.Equal(-90, rssi)
+			assert.Equal(1, len(a.Services))
+			discovered <- p
+		}),
+		PeripheralConnected(func(p gatt.Peripheral, err error) {
+			assert.Nil(err)
+			connected <- p
+		}),
+		PeripheralDisconnected(func(p gatt.Peripheral, err error) {
+			disconnected <- err
+		}),
+	)
+	state := make(chan gatt.State, 1)
+	assert.Nil(d.Init(func(d gatt.Device, s gatt.State) { state <- s }))
+	d.Scan(nil, false)
+
+	f, err := os.Open("testdata/session_v1.jsonl")
+	assert.Nil(err)
+	defer f.Close()
+	assert.Nil(Replay(d, f))
+
+	select {
+	case s := <-state:
+		assert.Equal(gatt.StatePoweredOn, s)
+	case <-time.After(time.Second):
+		t.Fatal("no state")
+	}
+	select {
+	case p := <-discovered:
+		assert.Equal("A0143D472502", p.ID())
+	case <-time.After(time.Second):
+		t.Fatal("not discovered")
+	}
+	select {
+	case p := <-connected:
+		assert.Equal("A0143D472502", p.ID())
+	case <-time.After(time.Second):
+		t.Fatal("not connected")
+	}
+	select {
+	case err := <-disconnected:
+		assert.True(errors.Is(err, ErrDisconnected))
+	case <-time.After(time.Second):
+		t.Fatal("not disconnected")
+	}
+
+	assert.NotNil(Replay(&device{}, strings.NewReader("")))
+	assert.Nil(d.Stop())
+}
@@ -0,0 +1,274 @@
+package noblechild
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/paypal/gatt"
+	"gopkg.in/yaml.v3"
+)
+
+// SnapshotFormat and SnapshotVersion identify a GATT snapshot document.
+const (
+	SnapshotFormat  = "noblechild-gatt"
+	SnapshotVersion = 1
+)
+
+// ErrSnapshotVersion is returned when a snapshot is not a version this
+// package reads.
+var ErrSnapshotVersion = errors.New("unsupported snapshot version")
+
+// Snapshot is the attribute table of a peripheral. It is written as JSON
+// or YAML with the same field names.
+type Snapshot struct {
+	Format   string            `json:"format" yaml:"format"`
+	Version  int               `json:"version" yaml:"version"`
+	Address  string            `json:"address,omitempty" yaml:"address,omitempty"`
+	Name     string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Services []ServiceSnapshot `json:"services" yaml:"services"`
+}
+
+// ServiceSnapshot is a service and its characteristics.
+type ServiceSnapshot struct {
+	UUID            string                   `json:"uuid" yaml:"uuid"`
+	Handle          uint16                   `json:"handle" yaml:"handle"`
+	EndHandle       uint16                   `json:"endHandle" yaml:"endHandle"`
+	Characteristics []CharacteristicSnapshot `json:"characteristics,omitempty" yaml:"characteristics,omitempty"`
+}
+
+// CharacteristicSnapshot is a characteristic and its descriptors.
+// Properties are named as by BlueZ ("read", "write-without-response"...).
+// Value is nil if the value was not read, and empty if it was read empty.
+// ReadError is the error of reading the value, if any.
+type CharacteristicSnapshot struct {
+	UUID        string               `json:"uuid" yaml:"uuid"`
+	Handle      uint16               `json:"handle" yaml:"handle"`
+	ValueHandle uint16               `json:"valueHandle" yaml:"valueHandle"`
+	EndHandle   uint16               `json:"endHandle" yaml:"endHandle"`
+	Properties  []string             `json:"properties" yaml:"properties,flow"`
+	Value       *HexBytes            `json:"value,omitempty" yaml:"value,omitempty"`
+	ReadError   string               `json:"readError,omitempty" yaml:"readError,omitempty"`
+	Descriptors []DescriptorSnapshot `json:"descriptors,omitempty" yaml:"descriptors,omitempty"`
+}
+
+// DescriptorSnapshot is a descriptor. Value is as in
+// CharacteristicSnapshot.
+type DescriptorSnapshot struct {
+	UUID      string    `json:"uuid" yaml:"uuid"`
+	Handle    uint16    `json:"handle" yaml:"handle"`
+	Value     *HexBytes `json:"value,omitempty" yaml:"value,omitempty"`
+	ReadError string    `json:"readError,omitempty" yaml:"readError,omitempty"`
+}
+
+// HexBytes is a value written as a hex string.
+type HexBytes []byte
+
+// hexValue returns b as the Value of a snapshot, empty rather than nil.
+func hexValue(b []byte) *HexBytes {
+	v := HexBytes(b)
+	if v == nil {
+		v = HexBytes{}
+	}
+	return &v
+}
+
+func (b HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func (b *HexBytes) UnmarshalText(text []byte) error {
+	v, err := hex.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid hex value %q: %s", text, err)
+	}
+	*b = v
+	return nil
+}
+
+// propertyNames returns the names of the bits of p, as used by BlueZ.
+func propertyNames(p gatt.Property) []string {
+	names := []string{}
+	for bit := gatt.CharBroadcast; bit != 0 && bit <= gatt.CharExtended; bit <<= 1 {
+		if p&bit == 0 {
+			continue
+		}
+		for name, q := range bluezProps {
+			if q == bit {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// SnapshotOptions tell NewServicesSnapshot how to read the values. A nil
+// reader leaves the values out.
+type SnapshotOptions struct {
+	// ReadCharacteristic reads the characteristics which have CharRead.
+	ReadCharacteristic func(*gatt.Characteristic) ([]byte, error)
+	// ReadDescriptor reads every descriptor.
+	ReadDescriptor func(*gatt.Descriptor) ([]byte, error)
+}
+
+// NewServicesSnapshot returns the snapshot of ss, with the values read by
+// opts. The values which can not be read are left out with their
+// ReadError.
+func NewServicesSnapshot(ss []*gatt.Service, opts SnapshotOptions) *Snapshot {
+	snap := &Snapshot{Format: SnapshotFormat, Version: SnapshotVersion, Services: []ServiceSnapshot{}}
+	for _, s := range ss {
+		ssnap := ServiceSnapshot{UUID: s.UUID().String(), Handle: s.Handle(), EndHandle: s.EndHandle()}
+		for _, c := range s.Characteristics() {
+			csnap := CharacteristicSnapshot{
+				UUID:        c.UUID().String(),
+				Handle:      c.Handle(),
+				ValueHandle: c.VHandle(),
+				EndHandle:   c.EndHandle(),
+				Properties:  propertyNames(c.Properties()),
+			}
+			if opts.ReadCharacteristic != nil && c.Properties()&gatt.CharRead != 0 {
+				b, err := opts.ReadCharacteristic(c)
+				if err != nil {
+					csnap.ReadError = err.Error()
+				} else {
+					csnap.Value = hexValue(b)
+				}
+			}
+			for _, d := range c.Descriptors() {
+				dsnap := DescriptorSnapshot{UUID: d.UUID().String(), Handle: d.Handle()}
+				if opts.ReadDescriptor != nil {
+					b, err := opts.ReadDescriptor(d)
+					if err != nil {
+						dsnap.ReadError = err.Error()
+					} else {
+						dsnap.Value = hexValue(b)
+					}
+				}
+				csnap.Descriptors = append(csnap.Descriptors, dsnap)
+			}
+			ssnap.Characteristics = append(ssnap.Characteristics, csnap)
+		}
+		snap.Services = append(snap.Services, ssnap)
+	}
+	return snap
+}
+
+// NewSnapshot returns the snapshot of the services of p, as discovered by
+// DiscoverServices, DiscoverCharacteristics and DiscoverDescriptors. With
+// readValues, the readable characteristics and every descriptor are read
+// from p.
+func NewSnapshot(p gatt.Peripheral, readValues bool) *Snapshot {
+	var opts SnapshotOptions
+	if readValues {
+		opts.ReadCharacteristic = p.ReadLongCharacteristic
+		opts.ReadDescriptor = p.ReadDescriptor
+	}
+	snap := NewServicesSnapshot(p.Services(), opts)
+	snap.Address = p.ID()
+	snap.Name = p.Name()
+	return snap
+}
+
+// GattServices builds the services of the snapshot, with their handles.
+// The values are registered in t, if not nil, so an ATTServer can serve
+// them. With the children and the socket backends, the characteristics and
+// descriptors can be given to a connected peripheral of the same device
+// without discovery, as they are addressed by handle.
+func (snap *Snapshot) GattServices(t *AttributeTable) ([]*gatt.Service, error) {
+	var ss []*gatt.Service
+	for _, ssnap := range snap.Services {
+		u, err := gatt.ParseUUID(ssnap.UUID)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %s", ssnap.UUID, err)
+		}
+		s := gatt.NewService(u)
+		s.SetHandle(ssnap.Handle)
+		s.SetEndHandle(ssnap.EndHandle)
+
+		var cs []*gatt.Characteristic
+		for _, csnap := range ssnap.Characteristics {
+			u, err := gatt.ParseUUID(csnap.UUID)
+			if err != nil {
+				return nil, fmt.Errorf("characteristic %q: %s", csnap.UUID, err)
+			}
+			var props gatt.Property
+			for _, name := range csnap.Properties {
+				p, ok := bluezProps[name]
+				if !ok {
+					return nil, fmt.Errorf("characteristic %s: unknown property %q", csnap.UUID, name)
+				}
+				props |= p
+			}
+			c := gatt.NewCharacteristic(u, s, props, csnap.Handle, csnap.ValueHandle)
+			c.SetEndHandle(csnap.EndHandle)
+			if t != nil && csnap.Value != nil {
+				t.SetValue(c, *csnap.Value)
+			}
+
+			var ds []*gatt.Descriptor
+			for _, dsnap := range csnap.Descriptors {
+				u, err := gatt.ParseUUID(dsnap.UUID)
+				if err != nil {
+					return nil, fmt.Errorf("descriptor %q: %s", dsnap.UUID, err)
+				}
+				d := gatt.NewDescriptor(u, dsnap.Handle, c)
+				if t != nil && dsnap.Value != nil {
+					t.SetDescriptorValue(d, *dsnap.Value)
+				}
+				if u.Equal(attrClientCharacteristicConfigUUID) {
+					c.SetDescriptor(d)
+				}
+				ds = append(ds, d)
+			}
+			c.SetDescriptors(ds)
+			cs = append(cs, c)
+		}
+		s.SetCharacteristics(cs)
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
+// WriteJSON writes the snapshot as indented JSON.
+func (snap *Snapshot) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snap)
+}
+
+// WriteYAML writes the snapshot as YAML.
+func (snap *Snapshot) WriteYAML(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(snap); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// ReadSnapshot reads a snapshot written by WriteJSON or WriteYAML.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if len(bytes.TrimSpace(b)) > 0 && bytes.TrimSpace(b)[0] == '{' {
+		err = json.Unmarshal(b, &snap)
+	} else {
+		err = yaml.Unmarshal(b, &snap)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if snap.Format != SnapshotFormat {
+		return nil, fmt.Errorf("not a GATT snapshot: format %q", snap.Format)
+	}
+	if snap.Version != SnapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+	return &snap, nil
+}
@@ -0,0 +1,154 @@
+package noblechild
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	gatt "github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+// snapshotPeripheral is a discovered peripheral whose descriptors can not
+// be read.
+type snapshotPeripheral struct {
+	gatt.Peripheral
+	ss []*gatt.Service
+}
+
+func (p *snapshotPeripheral) ID() string                { return "AABBCCDDEEFF" }
+func (p *snapshotPeripheral) Name() string              { return "fake" }
+func (p *snapshotPeripheral) Services() []*gatt.Service { return p.ss }
+func (p *snapshotPeripheral) ReadLongCharacteristic(c *gatt.Characteristic) ([]byte, error) {
+	return []byte{0x64}, nil
+}
+func (p *snapshotPeripheral) ReadDescriptor(d *gatt.Descriptor) ([]byte, error) {
+	return nil, errors.New("insufficient authentication")
+}
+
+func snapshotServices() []*gatt.Service {
+	s := gatt.NewService(gatt.UUID16(0x180f))
+	s.SetHandle(0x0010)
+	s.SetEndHandle(0x0014)
+	c := gatt.NewCharacteristic(gatt.UUID16(0x2a19), s, gatt.CharRead|gatt.CharNotify, 0x0011, 0x0012)
+	c.SetEndHandle(0x0014)
+	d := gatt.NewDescriptor(gatt.UUID16(0x2902), 0x0013, c)
+	c.SetDescriptors([]*gatt.Descriptor{d})
+	c.SetDescriptor(d)
+	s.SetCharacteristics([]*gatt.Characteristic{c})
+	return []*gatt.Service{s}
+}
+
+func Test_Snapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	snap := NewSnapshot(&snapshotPeripheral{ss: snapshotServices()}, true)
+	assert.Equal("AABBCCDDEEFF", snap.Address)
+	c := snap.Services[0].Characteristics[0]
+	assert.Equal(CharacteristicSnapshot{
+		UUID:        "2a19",
+		Handle:      0x0011,
+		ValueHandle: 0x0012,
+		EndHandle:   0x0014,
+		Properties:  []string{"read", "notify"},
+		Value:       &HexBytes{0x64},
+		Descriptors: []DescriptorSnapshot{{UUID: "2902", Handle: 0x0013, ReadError: "insufficient authentication"}},
+	}, c)
+
+	var js, ys bytes.Buffer
+	assert.Nil(snap.WriteJSON(&js))
+	assert.Contains(js.String(), `"value": "64"`)
+	assert.Nil(snap.WriteYAML(&ys))
+	assert.Contains(ys.String(), "properties: [read, notify]")
+	for _, b := range []*bytes.Buffer{&js, &ys} {
+		got, err := ReadSnapshot(b)
+		assert.Nil(err)
+		assert.Equal(snap, got)
+	}
+
+	table := NewAttributeTable()
+	ss, err := snap.GattServices(table)
+	assert.Nil(err)
+	assert.Equal(1, len(ss))
+	assert.Equal(uint16(0x0014), ss[0].EndHandle())
+	gc := ss[0].Characteristics()[0]
+	assert.Equal(gatt.CharRead|gatt.CharNotify, gc.Properties())
+	assert.Equal(uint16(0x0012), gc.VHandle())
+	assert.Equal([]byte{0x64}, table.charEntry(gc).value)
+	assert.Equal(uint16(0x0013), gc.Descriptor().Handle())
+
+	// without values, the table is the same as the one it was built from
+	snap = NewSnapshot(&snapshotPeripheral{ss: ss}, false)
+	assert.Equal(NewSnapshot(&snapshotPeripheral{ss: snapshotServices()}, false), snap)
+	assert.Nil(snap.Services[0].Characteristics[0].Value)
+
+	// the values come from the readers only
+	snap = NewServicesSnapshot(snapshotServices(), SnapshotOptions{
+		ReadCharacteristic: func(c *gatt.Characteristic) ([]byte, error) { return []byte{0x01}, nil },
+	})
+	assert.Equal(&HexBytes{0x01}, snap.Services[0].Characteristics[0].Value)
+	assert.Nil(snap.Services[0].Characteristics[0].Descriptors[0].Value)
+	assert.Empty(snap.Services[0].Characteristics[0].Descriptors[0].ReadError)
+
+	// an empty value is kept apart from one not read
+	snap = NewServicesSnapshot(snapshotServices(), SnapshotOptions{
+		ReadCharacteristic: func(c *gatt.Characteristic) ([]byte, error) { return nil, nil },
+		ReadDescriptor:     func(d *gatt.Descriptor) ([]byte, error) { return []byte{}, nil },
+	})
+	js.Reset()
+	ys.Reset()
+	assert.Nil(snap.WriteJSON(&js))
+	assert.Contains(js.String(), `"value": ""`)
+	assert.Nil(snap.WriteYAML(&ys))
+	for _, b := range []*bytes.Buffer{&js, &ys} {
+		got, err := ReadSnapshot(b)
+		assert.Nil(err)
+		assert.Equal(&HexBytes{}, got.Services[0].Characteristics[0].Value)
+		assert.Equal(&HexBytes{}, got.Services[0].Characteristics[0].Descriptors[0].Value)
+	}
+	table = NewAttributeTable()
+	ss, err = snap.GattServices(table)
+	assert.Nil(err)
+	e := table.charEntry(ss[0].Characteristics()[0])
+	assert.NotNil(e.value)
+	assert.Empty(e.value)
+}
+
+func Test_ReadSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	snap, err := ReadSnapshot(strings.NewReader(`
+format: noblechild-gatt
+version: 1
+services:
+  - uuid: 1800
+    handle: 1
+    endHandle: 3
+    characteristics:
+      - uuid: 2a00
+        handle: 2
+        valueHandle: 3
+        endHandle: 3
+        properties: [read, write-without-response]
+        value: "4142"
+`))
+	assert.Nil(err)
+	table := NewAttributeTable()
+	ss, err := snap.GattServices(table)
+	assert.Nil(err)
+	assert.Equal("1800", ss[0].UUID().String())
+	assert.Equal(gatt.CharRead|gatt.CharWriteNR, ss[0].Characteristics()[0].Properties())
+	assert.Equal([]byte("AB"), table.charEntry(ss[0].Characteristics()[0]).value)
+
+	_, err = ReadSnapshot(strings.NewReader(`{"format":"noblechild-gatt","version":2}`))
+	assert.Equal(ErrSnapshotVersion, err)
+	_, err = ReadSnapshot(strings.NewReader(`{"format":"noblechild-session","version":1}`))
+	assert.NotNil(err)
+	_, err = ReadSnapshot(strings.NewReader(`{"format":"noblechild-gatt","version":1,"services":[{"uuid":"180f","characteristics":[{"uuid":"2a19","value":"zz"}]}]}`))
+	assert.NotNil(err)
+
+	snap = &Snapshot{Services: []ServiceSnapshot{{UUID: "180f", Characteristics: []CharacteristicSnapshot{{UUID: "2a19", Properties: []string{"fly"}}}}}}
+	_, err = snap.GattServices(nil)
+	assert.NotNil(err)
+}
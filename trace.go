@@ -0,0 +1,134 @@
+package noblechild
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// Direction is the direction of a traced PDU.
+type Direction int
+
+const (
+	// DirectionSent is a PDU sent to the remote device.
+	DirectionSent Direction = iota
+	// DirectionReceived is a PDU received from the remote device.
+	DirectionReceived
+)
+
+func (d Direction) String() string {
+	if d == DirectionReceived {
+		return "received"
+	}
+	return "sent"
+}
+
+// TracePDU is an ATT PDU seen on a connection.
+type TracePDU struct {
+	Time      time.Time
+	Address   string
+	Direction Direction
+	PDU       []byte
+}
+
+// trace gives an ATT PDU to the Trace hook.
+func (d *device) trace(address string, dir Direction, b []byte) {
+	if d == nil {
+		return
+	}
+	d.optMu.RLock()
+	f := d.tracer
+	d.optMu.RUnlock()
+	if f == nil {
+		return
+	}
+	f(TracePDU{
+		Time:      time.Now(),
+		Address:   address,
+		Direction: dir,
+		PDU:       append([]byte(nil), b...),
+	})
+}
+
+// btsnoop, as written by Android and read by Wireshark.
+const (
+	btsnoopVersion  = 1
+	btsnoopH4       = 1002 // HCI UART (H4) datalink
+	btsnoopReceived = 0x01 // flag of a packet from the controller
+
+	// btsnoopEpochDelta is the Unix epoch in microseconds since 0 AD.
+	btsnoopEpochDelta = 0x00dcddb30f2f8000
+
+	h4ACL     = 0x02
+	attCID    = 0x0004
+	aclStart  = 0x2000 // first automatically flushable packet
+	aclHandle = 0x0040 // the handle of the first address
+)
+
+// BtsnoopWriter writes traced PDUs as a btsnoop file. Each PDU is wrapped
+// in an L2CAP and ACL header, with a connection handle per address, so
+// Wireshark decodes the ATT protocol.
+type BtsnoopWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	handles map[string]uint16
+	err     error
+}
+
+// NewBtsnoopWriter writes the btsnoop header to w. Give its Trace to the
+// Trace option.
+func NewBtsnoopWriter(w io.Writer) (*BtsnoopWriter, error) {
+	hdr := make([]byte, 0, 16)
+	hdr = append(hdr, "btsnoop\x00"...)
+	hdr = binary.BigEndian.AppendUint32(hdr, btsnoopVersion)
+	hdr = binary.BigEndian.AppendUint32(hdr, btsnoopH4)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &BtsnoopWriter{w: w, handles: map[string]uint16{}}, nil
+}
+
+// Trace writes t. After a write error, nothing is written and the error is
+// returned by Err.
+func (bw *BtsnoopWriter) Trace(t TracePDU) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if bw.err != nil {
+		return
+	}
+
+	h, ok := bw.handles[t.Address]
+	if !ok {
+		h = aclHandle + uint16(len(bw.handles))
+		bw.handles[t.Address] = h
+	}
+
+	pkt := make([]byte, 0, 9+len(t.PDU))
+	pkt = append(pkt, h4ACL)
+	pkt = binary.LittleEndian.AppendUint16(pkt, h|aclStart)
+	pkt = binary.LittleEndian.AppendUint16(pkt, uint16(4+len(t.PDU)))
+	pkt = binary.LittleEndian.AppendUint16(pkt, uint16(len(t.PDU)))
+	pkt = binary.LittleEndian.AppendUint16(pkt, attCID)
+	pkt = append(pkt, t.PDU...)
+
+	var flags uint32
+	if t.Direction == DirectionReceived {
+		flags |= btsnoopReceived
+	}
+	rec := make([]byte, 0, 24+len(pkt))
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(pkt)))
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(pkt)))
+	rec = binary.BigEndian.AppendUint32(rec, flags)
+	rec = binary.BigEndian.AppendUint32(rec, 0) // cumulative drops
+	rec = binary.BigEndian.AppendUint64(rec, uint64(t.Time.UnixMicro()+btsnoopEpochDelta))
+	rec = append(rec, pkt...)
+	_, bw.err = bw.w.Write(rec)
+}
+
+// Err returns the first write error.
+func (bw *BtsnoopWriter) Err() error {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return bw.err
+}
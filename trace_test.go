@@ -0,0 +1,70 @@
+package noblechild
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TraceL2CAP(t *testing.T) {
+	assert := assert.New(t)
+
+	var pdus []TracePDU
+	d := &device{}
+	assert.Nil(d.Option(Trace(func(p TracePDU) { pdus = append(pdus, p) })))
+
+	l2cap := &L2CAP_BLE{
+		device:    d,
+		Address:   "aabbccddeeff",
+		stdinPipe: &lineBuffer{},
+		ackChan:   make(chan string, 1),
+	}
+	_, err := l2cap.Write([]byte{attOpMtuReq, 0xb9, 0x00})
+	assert.Nil(err)
+	l2cap.ackChan <- "039e00"
+	b := make([]byte, 23)
+	n, err := l2cap.Read(b)
+	assert.Nil(err)
+	assert.Equal(3, n)
+
+	assert.Equal(2, len(pdus))
+	assert.Equal(DirectionSent, pdus[0].Direction)
+	assert.Equal("aabbccddeeff", pdus[0].Address)
+	assert.Equal([]byte{attOpMtuReq, 0xb9, 0x00}, pdus[0].PDU)
+	assert.Equal(DirectionReceived, pdus[1].Direction)
+	assert.Equal([]byte{attOpMtuRsp, 0x9e, 0x00}, pdus[1].PDU)
+	assert.False(pdus[1].Time.IsZero())
+}
+
+func Test_BtsnoopWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	bw, err := NewBtsnoopWriter(&buf)
+	assert.Nil(err)
+	ts := time.Date(2016, 1, 2, 3, 4, 5, 6000, time.UTC)
+	bw.Trace(TracePDU{Time: ts, Address: "aa", Direction: DirectionSent, PDU: []byte{0x0a, 0x03, 0x00}})
+	bw.Trace(TracePDU{Time: ts, Address: "bb", Direction: DirectionReceived, PDU: []byte{0x0b}})
+	assert.Nil(bw.Err())
+
+	b := buf.Bytes()
+	assert.Equal([]byte("btsnoop\x00\x00\x00\x00\x01\x00\x00\x03\xea"), b[:16])
+
+	rec := b[16:]
+	assert.Equal(uint32(12), binary.BigEndian.Uint32(rec[0:]))
+	assert.Equal(uint32(12), binary.BigEndian.Uint32(rec[4:]))
+	assert.Equal(uint32(0), binary.BigEndian.Uint32(rec[8:]))
+	assert.Equal(uint64(ts.UnixMicro()+btsnoopEpochDelta), binary.BigEndian.Uint64(rec[16:]))
+	assert.Equal([]byte{
+		0x02, 0x40, 0x20, 0x07, 0x00, // ACL, handle 0x0040
+		0x03, 0x00, 0x04, 0x00, // L2CAP, ATT channel
+		0x0a, 0x03, 0x00,
+	}, rec[24:36])
+
+	rec = rec[36:]
+	assert.Equal(uint32(btsnoopReceived), binary.BigEndian.Uint32(rec[8:]))
+	assert.Equal([]byte{0x02, 0x41, 0x20, 0x05, 0x00, 0x01, 0x00, 0x04, 0x00, 0x0b}, rec[24:])
+}
@@ -0,0 +1,889 @@
+package noblechild
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	gatt "github.com/paypal/gatt"
+)
+
+// ErrWebSocketConnect is returned by the websocket backend where an
+// L2CAP_BLE is asked for. Its peripherals are connected by ws-slave.
+var ErrWebSocketConnect = errors.New("websocket: connections are made by ws-slave")
+
+// errWSClosed is the reason of the disconnects caused by the end of the
+// websocket connection.
+var errWSClosed = fmt.Errorf("%w: websocket closed", ErrDisconnected)
+
+// wsMessage is a message of the ws-slave protocol of noble: a command
+// with an action, or an event with a type.
+type wsMessage struct {
+	Action string `json:"action,omitempty"`
+	Type   string `json:"type,omitempty"`
+
+	State              string           `json:"state,omitempty"`
+	PeripheralUUID     string           `json:"peripheralUuid,omitempty"`
+	Address            string           `json:"address,omitempty"`
+	AddressType        string           `json:"addressType,omitempty"`
+	Advertisement      *wsAdvertisement `json:"advertisement,omitempty"`
+	RSSI               int              `json:"rssi,omitempty"`
+	ServiceUUIDs       []string         `json:"serviceUuids,omitempty"`
+	IncludedUUIDs      []string         `json:"includedServiceUuids,omitempty"`
+	ServiceUUID        string           `json:"serviceUuid,omitempty"`
+	CharacteristicUUID string           `json:"characteristicUuid,omitempty"`
+	Characteristics    []nodeAttribute  `json:"characteristics,omitempty"`
+	DescriptorUUID     string           `json:"descriptorUuid,omitempty"`
+	Descriptors        []string         `json:"descriptors,omitempty"`
+	AllowDuplicates    bool             `json:"allowDuplicates,omitempty"`
+	Data               string           `json:"data,omitempty"`
+	WithoutResponse    bool             `json:"withoutResponse,omitempty"`
+	Notify             *bool            `json:"notify,omitempty"`
+	IsNotification     bool             `json:"isNotification,omitempty"`
+}
+
+// wsAdvertisement is the advertisement of a discover event. Depending on
+// the noble version, ws-slave gives serviceData as an array or as a
+// broken string, which is ignored.
+type wsAdvertisement struct {
+	nodeAdvertisement
+	ServiceData json.RawMessage `json:"serviceData,omitempty"`
+}
+
+func (a *wsAdvertisement) parse() *nodeAdvertisement {
+	if a == nil {
+		return nil
+	}
+	ret := a.nodeAdvertisement
+	if len(a.ServiceData) > 0 && a.ServiceData[0] == '[' {
+		json.Unmarshal(a.ServiceData, &ret.ServiceData)
+	}
+	return &ret
+}
+
+// wsKey identifies the event answering a command: its type and the
+// attribute it is about.
+func wsKey(typ string, m wsMessage) string {
+	k := []string{typ, m.PeripheralUUID}
+	for _, u := range []string{m.ServiceUUID, m.CharacteristicUUID, m.DescriptorUUID} {
+		if u != "" {
+			k = append(k, u)
+		}
+	}
+	return strings.Join(k, "/")
+}
+
+// wsSlave is the websocket backend. It connects to noble's ws-slave.js,
+// which runs next to a radio on another host.
+type wsSlave struct {
+	device *device
+	url    string
+	// callTimeout is how long call waits for the event of a command.
+	callTimeout time.Duration
+
+	wmu sync.Mutex // serializes the writes
+
+	mu      sync.Mutex      // protects the fields below
+	conn    *websocket.Conn // nil when closed
+	exited  chan struct{}
+	closing bool
+	waiters map[string][]chan wsMessage // by wsKey
+	conns   map[string]*wsPeripheral    // connecting or connected, by peripheralUuid
+	uuids   map[string]string           // peripheralUuid by address
+}
+
+// newWSSlave checks that the ws-slave given by WebSocketURL answers.
+func newWSSlave(d *device) (backend, error) {
+	u, err := url.Parse(d.wsURL)
+	if err != nil {
+		return nil, fmt.Errorf("websocket: %w", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("websocket: invalid url: %q", d.wsURL)
+	}
+	w := &wsSlave{
+		device:      d,
+		url:         d.wsURL,
+		callTimeout: wsCallTimeout,
+		waiters:     map[string][]chan wsMessage{},
+		conns:       map[string]*wsPeripheral{},
+		uuids:       map[string]string{},
+	}
+	conn, err := w.dial()
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return w, nil
+}
+
+func (w *wsSlave) dial() (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(w.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("websocket: %w", err)
+	}
+	return conn, nil
+}
+
+// Init connects to ws-slave, which then reports the adapter state.
+func (w *wsSlave) Init() error {
+	conn, err := w.dial()
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	old := w.conn
+	w.conn = conn
+	w.closing = false
+	w.exited = make(chan struct{})
+	go w.loop(conn, w.exited)
+	w.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (w *wsSlave) loop(conn *websocket.Conn, exited chan struct{}) {
+	defer close(exited)
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			w.mu.Lock()
+			closing := w.closing || w.conn != conn
+			w.mu.Unlock()
+			if !closing {
+				w.device.log().Error("websocket read failed", "url", w.url, "error", err)
+			}
+			break
+		}
+		var m wsMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			w.device.log().Error("invalid ws-slave message", "url", w.url, "message", string(b))
+			continue
+		}
+		w.handle(m)
+	}
+
+	w.mu.Lock()
+	if w.conn != conn {
+		w.mu.Unlock()
+		return
+	}
+	closing := w.closing
+	w.conn = nil
+	for k, chs := range w.waiters {
+		for _, ch := range chs {
+			close(ch)
+		}
+		delete(w.waiters, k)
+	}
+	ps := make([]*wsPeripheral, 0, len(w.conns))
+	for _, p := range w.conns {
+		ps = append(ps, p)
+	}
+	w.mu.Unlock()
+
+	for _, p := range ps {
+		p.mu.Lock()
+		local := p.localClose
+		p.mu.Unlock()
+		if local {
+			w.disconnected(p, ErrLocalHostTerminated)
+		} else {
+			w.disconnected(p, errWSClosed)
+		}
+	}
+	if !closing {
+		w.device.setState(gatt.StatePoweredOff)
+	}
+}
+
+func (w *wsSlave) handle(m wsMessage) {
+	switch m.Type {
+	case "stateChange":
+		s, ok := nodeStates[m.State]
+		if !ok {
+			w.device.log().Error("unknown noble state", "state", m.State)
+			return
+		}
+		w.device.setState(s)
+	case "discover":
+		address := m.Address
+		if address == "" || address == "unknown" {
+			address = m.PeripheralUUID
+		}
+		e, err := nobleEvent(address, m.AddressType, m.RSSI, m.Advertisement.parse())
+		if err != nil {
+			w.device.log().Error("invalid ws-slave discover event", "peripheral", m.PeripheralUUID, "error", err)
+			return
+		}
+		w.mu.Lock()
+		w.uuids[e.Address] = m.PeripheralUUID
+		w.mu.Unlock()
+		w.device.handleEvent(e)
+	case "disconnect":
+		w.mu.Lock()
+		p := w.conns[m.PeripheralUUID]
+		w.mu.Unlock()
+		w.answer(m)
+		w.failWaiters(m.PeripheralUUID)
+		if p != nil {
+			p.mu.Lock()
+			local := p.localClose
+			p.mu.Unlock()
+			if local {
+				w.disconnected(p, ErrLocalHostTerminated)
+			} else {
+				w.disconnected(p, ErrDisconnected)
+			}
+		}
+	case "read":
+		if m.IsNotification {
+			w.notified(m)
+			return
+		}
+		w.answer(m)
+	default:
+		w.answer(m)
+	}
+}
+
+// answer gives m to the oldest command waiting for it.
+func (w *wsSlave) answer(m wsMessage) {
+	k := wsKey(m.Type, m)
+	w.mu.Lock()
+	chs := w.waiters[k]
+	if len(chs) == 0 {
+		w.mu.Unlock()
+		return
+	}
+	ch := chs[0]
+	if len(chs) == 1 {
+		delete(w.waiters, k)
+	} else {
+		w.waiters[k] = chs[1:]
+	}
+	w.mu.Unlock()
+	ch <- m
+}
+
+func (w *wsSlave) notified(m wsMessage) {
+	w.mu.Lock()
+	p := w.conns[m.PeripheralUUID]
+	w.mu.Unlock()
+	if p == nil {
+		return
+	}
+	data, err := hex.DecodeString(m.Data)
+	if err != nil {
+		w.device.log().Error("invalid ws-slave notification", "peripheral", m.PeripheralUUID, "error", err)
+		return
+	}
+	if f, h := p.notifier(m.ServiceUUID, m.CharacteristicUUID); f != nil {
+		w.device.stats().notification(h)
+		go f(data)
+	}
+}
+
+func (w *wsSlave) send(m wsMessage) error {
+	w.mu.Lock()
+	conn := w.conn
+	w.mu.Unlock()
+	if conn == nil {
+		return errors.New("websocket: not connected")
+	}
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	if err := conn.WriteJSON(m); err != nil {
+		return fmt.Errorf("websocket: %w", err)
+	}
+	return nil
+}
+
+// wsCallTimeout is how long a command waits for its event by default.
+const wsCallTimeout = 30 * time.Second
+
+// call sends m and waits for the event of type typ about the same
+// attribute. ws-slave reports no errors, so it also returns when the
+// peripheral is disconnected, or after callTimeout.
+func (w *wsSlave) call(m wsMessage, typ string) (wsMessage, error) {
+	k := wsKey(typ, m)
+	ch := make(chan wsMessage, 1)
+	w.mu.Lock()
+	w.waiters[k] = append(w.waiters[k], ch)
+	w.mu.Unlock()
+
+	if err := w.send(m); err != nil {
+		w.cancelWait(k, ch)
+		return wsMessage{}, err
+	}
+	t := time.NewTimer(w.callTimeout)
+	defer t.Stop()
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return r, fmt.Errorf("websocket: %s: %w", m.Action, ErrDisconnected)
+		}
+		return r, nil
+	case <-t.C:
+		w.cancelWait(k, ch)
+		return wsMessage{}, fmt.Errorf("websocket: %s: no %s event within %s", m.Action, typ, w.callTimeout)
+	}
+}
+
+func (w *wsSlave) cancelWait(k string, ch chan wsMessage) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	chs := w.waiters[k]
+	for i, c := range chs {
+		if c == ch {
+			w.waiters[k] = append(chs[:i:i], chs[i+1:]...)
+			break
+		}
+	}
+	if len(w.waiters[k]) == 0 {
+		delete(w.waiters, k)
+	}
+}
+
+// failWaiters ends the commands waiting for events about a peripheral.
+func (w *wsSlave) failWaiters(peripheralUUID string) {
+	prefix := "/" + peripheralUUID
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for k, chs := range w.waiters {
+		i := strings.Index(k, "/")
+		if i < 0 || !(k[i:] == prefix || strings.HasPrefix(k[i:], prefix+"/")) {
+			continue
+		}
+		for _, ch := range chs {
+			close(ch)
+		}
+		delete(w.waiters, k)
+	}
+}
+
+func (w *wsSlave) startScan(dup bool) error {
+	w.device.log().Debug("start scan", "url", w.url, "duplicates", dup)
+	return w.send(wsMessage{Action: "startScanning", AllowDuplicates: dup})
+}
+
+func (w *wsSlave) StopScan() error {
+	return w.send(wsMessage{Action: "stopScanning"})
+}
+
+// Close disconnects the peripherals and closes the websocket.
+func (w *wsSlave) Close() error {
+	w.mu.Lock()
+	conn, exited := w.conn, w.exited
+	w.closing = true
+	ps := make([]*wsPeripheral, 0, len(w.conns))
+	for _, p := range w.conns {
+		ps = append(ps, p)
+	}
+	w.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+
+	w.StopScan()
+	for _, p := range ps {
+		w.cancelConnection(p)
+	}
+	w.wmu.Lock()
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	w.wmu.Unlock()
+	err := conn.Close()
+	<-exited
+	return err
+}
+
+func (w *wsSlave) newL2CAP(address, addressType string) (*L2CAP_BLE, error) {
+	return nil, ErrWebSocketConnect
+}
+
+func (w *wsSlave) newPeripheral(e *HCIEvent) gatt.Peripheral {
+	w.mu.Lock()
+	uuid, ok := w.uuids[e.Address]
+	w.mu.Unlock()
+	if !ok {
+		uuid = e.Address
+	}
+	return &wsPeripheral{
+		w:       w,
+		event:   e,
+		uuid:    uuid,
+		address: e.Address,
+		name:    e.Advertisement.LocalName,
+	}
+}
+
+// connect asks ws-slave to connect p, and reports the result.
+func (w *wsSlave) connect(gp gatt.Peripheral) {
+	p, ok := gp.(*wsPeripheral)
+	if !ok {
+		w.device.log().Error("not a websocket peripheral", "address", gp.ID())
+		return
+	}
+	w.mu.Lock()
+	if _, ok := w.conns[p.uuid]; ok {
+		w.mu.Unlock()
+		w.device.log().Info("already connected peripheral", "address", p.address)
+		return
+	}
+	w.conns[p.uuid] = p
+	w.mu.Unlock()
+	cancel := make(chan struct{})
+	p.mu.Lock()
+	p.cancel = cancel
+	p.localClose = false
+	p.mu.Unlock()
+
+	go func() {
+		done := make(chan error, 1)
+		go func() {
+			_, err := w.call(wsMessage{Action: "connect", PeripheralUUID: p.uuid}, "connect")
+			done <- err
+		}()
+		var timeout <-chan time.Time
+		if t := w.device.connectTimeoutOption(); t > 0 {
+			timer := time.NewTimer(t)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		var err error
+		select {
+		case err = <-done:
+		case <-timeout:
+			err = ErrConnectTimeout
+		case <-cancel:
+			err = ErrLocalHostTerminated
+		}
+		f := w.device.peripheralConnected
+		if err != nil {
+			w.forget(p)
+			w.failWaiters(p.uuid)
+			w.device.stats().connectFailure()
+			w.disconnect(p.uuid)
+			if f != nil {
+				w.device.dispatch(func() { f(p, err) })
+			}
+			return
+		}
+		// The connection is queued while p.mu is held, so that the
+		// disconnection, which waits for p.mu, is reported after it.
+		p.mu.Lock()
+		p.connected = true
+		p.cancel = nil
+		if f != nil {
+			w.device.dispatch(func() { f(p, nil) })
+		}
+		p.mu.Unlock()
+	}()
+}
+
+func (w *wsSlave) cancelConnection(gp gatt.Peripheral) {
+	p, ok := gp.(*wsPeripheral)
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	_, ok = w.conns[p.uuid]
+	w.mu.Unlock()
+	if !ok {
+		w.device.log().Info("no such peripheral connected", "address", p.address)
+		return
+	}
+	p.mu.Lock()
+	p.localClose = true
+	connected := p.connected
+	if !connected && p.cancel != nil {
+		// the connect goroutine reports the failure
+		close(p.cancel)
+		p.cancel = nil
+	}
+	p.mu.Unlock()
+	if !connected {
+		return
+	}
+	if err := w.disconnect(p.uuid); err != nil {
+		w.device.log().Error("ws-slave disconnect failed", "address", p.address, "error", err)
+	}
+	w.disconnected(p, ErrLocalHostTerminated)
+}
+
+// disconnect asks ws-slave to disconnect a peripheral, and waits for the
+// disconnect event, so it is not taken for the end of a later connection.
+func (w *wsSlave) disconnect(peripheralUUID string) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.call(wsMessage{Action: "disconnect", PeripheralUUID: peripheralUUID}, "disconnect")
+		done <- err
+	}()
+	t := w.device.stopTimeoutOption()
+	if t <= 0 {
+		t = DefaultStopTimeout
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(t):
+		return errors.New("websocket: disconnect timeout")
+	}
+}
+
+func (w *wsSlave) forget(p *wsPeripheral) {
+	w.mu.Lock()
+	if w.conns[p.uuid] == p {
+		delete(w.conns, p.uuid)
+	}
+	w.mu.Unlock()
+}
+
+// disconnected reports the end of the connection of p once.
+func (w *wsSlave) disconnected(p *wsPeripheral, reason error) {
+	p.mu.Lock()
+	connected := p.connected
+	p.connected = false
+	p.mu.Unlock()
+	if !connected {
+		return
+	}
+	w.forget(p)
+	w.failWaiters(p.uuid)
+	w.device.stats().disconnect(reason)
+	if f := w.device.peripheralDisconnected; f != nil {
+		w.device.dispatch(func() { f(p, reason) })
+	}
+}
+
+// wsAttribute locates an attribute by the UUIDs ws-slave knows it by.
+type wsAttribute struct {
+	service, characteristic, descriptor string
+}
+
+// wsPeripheral is a peripheral of the websocket backend. The protocol
+// gives no handles, so they are numbered in the order of discovery, and
+// attributes are told apart by UUID only.
+type wsPeripheral struct {
+	w       *wsSlave
+	event   *HCIEvent
+	uuid    string // peripheralUuid of ws-slave
+	address string
+	name    string
+
+	mu         sync.Mutex    // protects the fields below
+	cancel     chan struct{} // closed by cancelConnection while connecting
+	connected  bool
+	localClose bool
+	svcs       []*gatt.Service
+	handle     uint16
+	attrs      map[interface{}]wsAttribute
+	notify     map[wsAttribute]func([]byte)
+	notifyH    map[wsAttribute]uint16
+}
+
+func (p *wsPeripheral) Device() gatt.Device { return p.w.device }
+func (p *wsPeripheral) ID() string          { return strings.ToUpper(p.address) }
+func (p *wsPeripheral) Name() string        { return p.name }
+
+func (p *wsPeripheral) Services() []*gatt.Service {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.svcs
+}
+
+// nextHandle returns the next synthetic handle.
+func (p *wsPeripheral) nextHandle() uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handle++
+	return p.handle
+}
+
+func (p *wsPeripheral) attrOf(a interface{}) (wsAttribute, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	at, ok := p.attrs[a]
+	if !ok {
+		return at, errors.New("websocket: attribute is not discovered")
+	}
+	return at, nil
+}
+
+func (p *wsPeripheral) setAttr(a interface{}, at wsAttribute) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.attrs == nil {
+		p.attrs = map[interface{}]wsAttribute{}
+	}
+	p.attrs[a] = at
+}
+
+func (p *wsPeripheral) notifier(service, characteristic string) (func([]byte), uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	at := wsAttribute{service: service, characteristic: characteristic}
+	return p.notify[at], p.notifyH[at]
+}
+
+// call sends a command about the attribute at of p, which must be
+// connected, and waits for the event of type typ.
+func (p *wsPeripheral) call(m wsMessage, at wsAttribute, typ string) (wsMessage, error) {
+	p.mu.Lock()
+	connected := p.connected
+	p.mu.Unlock()
+	if !connected {
+		return wsMessage{}, errors.New("websocket: peripheral is not connected")
+	}
+	m.PeripheralUUID = p.uuid
+	m.ServiceUUID, m.CharacteristicUUID, m.DescriptorUUID = at.service, at.characteristic, at.descriptor
+	op, ok := nobleATTOp(m.Action, m.WithoutResponse)
+	if !ok {
+		return p.w.call(m, typ)
+	}
+	start := time.Now()
+	r, err := p.w.call(m, typ)
+	p.w.device.stats().attResult(op, err, time.Since(start))
+	return r, err
+}
+
+func (p *wsPeripheral) DiscoverServices(ss []gatt.UUID) ([]*gatt.Service, error) {
+	r, err := p.call(wsMessage{Action: "discoverServices"}, wsAttribute{}, "servicesDiscover")
+	if err != nil {
+		return nil, err
+	}
+	var ret []*gatt.Service
+	for _, su := range r.ServiceUUIDs {
+		u, err := gatt.ParseUUID(su)
+		if err != nil {
+			return nil, err
+		}
+		s := gatt.NewService(u)
+		h := p.nextHandle()
+		s.SetHandle(h)
+		s.SetEndHandle(h)
+		p.setAttr(s, wsAttribute{service: su})
+		if len(ss) == 0 || IncludesUUID(u, ss) {
+			ret = append(ret, s)
+		}
+	}
+	p.mu.Lock()
+	p.svcs = ret
+	p.mu.Unlock()
+	return ret, nil
+}
+
+// DiscoverIncludedServices returns the services included by s. ws-slave
+// gives only their UUIDs, so an included service is the service of the
+// same UUID found by DiscoverServices, if any.
+func (p *wsPeripheral) DiscoverIncludedServices(ss []gatt.UUID, s *gatt.Service) ([]*gatt.Service, error) {
+	at, err := p.attrOf(s)
+	if err != nil {
+		return nil, err
+	}
+	r, err := p.call(wsMessage{Action: "discoverIncludedServices"}, at, "includedServicesDiscover")
+	if err != nil {
+		return nil, err
+	}
+	var ret []*gatt.Service
+	for _, su := range r.IncludedUUIDs {
+		u, err := gatt.ParseUUID(su)
+		if err != nil {
+			return nil, err
+		}
+		if len(ss) > 0 && !IncludesUUID(u, ss) {
+			continue
+		}
+		inc := p.service(su)
+		if inc == nil {
+			inc = gatt.NewService(u)
+			h := p.nextHandle()
+			inc.SetHandle(h)
+			inc.SetEndHandle(h)
+			p.setAttr(inc, wsAttribute{service: su})
+		}
+		ret = append(ret, inc)
+	}
+	return ret, nil
+}
+
+// service returns the last discovered service of UUID su, or nil.
+func (p *wsPeripheral) service(su string) *gatt.Service {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ret *gatt.Service
+	for a, at := range p.attrs {
+		s, ok := a.(*gatt.Service)
+		if ok && at.service == su && (ret == nil || s.Handle() > ret.Handle()) {
+			ret = s
+		}
+	}
+	return ret
+}
+
+func (p *wsPeripheral) DiscoverCharacteristics(cs []gatt.UUID, s *gatt.Service) ([]*gatt.Characteristic, error) {
+	at, err := p.attrOf(s)
+	if err != nil {
+		return nil, err
+	}
+	r, err := p.call(wsMessage{Action: "discoverCharacteristics"}, at, "characteristicsDiscover")
+	if err != nil {
+		return nil, err
+	}
+	var ret []*gatt.Characteristic
+	for _, a := range r.Characteristics {
+		u, err := gatt.ParseUUID(a.UUID)
+		if err != nil {
+			return nil, err
+		}
+		var prop gatt.Property
+		for _, name := range a.Properties {
+			prop |= nodeProps[name]
+		}
+		h := p.nextHandle()
+		vh := p.nextHandle()
+		c := gatt.NewCharacteristic(u, s, prop, h, vh)
+		c.SetEndHandle(vh)
+		p.setAttr(c, wsAttribute{service: at.service, characteristic: a.UUID})
+		if len(cs) == 0 || IncludesUUID(u, cs) {
+			ret = append(ret, c)
+		}
+	}
+	s.SetCharacteristics(ret)
+	return ret, nil
+}
+
+func (p *wsPeripheral) DiscoverDescriptors(ds []gatt.UUID, c *gatt.Characteristic) ([]*gatt.Descriptor, error) {
+	at, err := p.attrOf(c)
+	if err != nil {
+		return nil, err
+	}
+	r, err := p.call(wsMessage{Action: "discoverDescriptors"}, at, "descriptorsDiscover")
+	if err != nil {
+		return nil, err
+	}
+	var ret []*gatt.Descriptor
+	for _, du := range r.Descriptors {
+		u, err := gatt.ParseUUID(du)
+		if err != nil {
+			return nil, err
+		}
+		d := gatt.NewDescriptor(u, p.nextHandle(), c)
+		p.setAttr(d, wsAttribute{service: at.service, characteristic: at.characteristic, descriptor: du})
+		if u.Equal(attrClientCharacteristicConfigUUID) {
+			c.SetDescriptor(d)
+		}
+		if len(ds) == 0 || IncludesUUID(u, ds) {
+			ret = append(ret, d)
+		}
+	}
+	c.SetDescriptors(ret)
+	return ret, nil
+}
+
+func (p *wsPeripheral) ReadCharacteristic(c *gatt.Characteristic) ([]byte, error) {
+	at, err := p.attrOf(c)
+	if err != nil {
+		return nil, err
+	}
+	r, err := p.call(wsMessage{Action: "read"}, at, "read")
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(r.Data)
+}
+
+// ReadLongCharacteristic is ReadCharacteristic, as noble reads the whole
+// value.
+func (p *wsPeripheral) ReadLongCharacteristic(c *gatt.Characteristic) ([]byte, error) {
+	return p.ReadCharacteristic(c)
+}
+
+func (p *wsPeripheral) ReadDescriptor(d *gatt.Descriptor) ([]byte, error) {
+	at, err := p.attrOf(d)
+	if err != nil {
+		return nil, err
+	}
+	r, err := p.call(wsMessage{Action: "readValue"}, at, "valueRead")
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(r.Data)
+}
+
+func (p *wsPeripheral) WriteCharacteristic(c *gatt.Characteristic, b []byte, noRsp bool) error {
+	at, err := p.attrOf(c)
+	if err != nil {
+		return err
+	}
+	_, err = p.call(wsMessage{Action: "write", Data: hex.EncodeToString(b), WithoutResponse: noRsp}, at, "write")
+	return err
+}
+
+func (p *wsPeripheral) WriteDescriptor(d *gatt.Descriptor, b []byte) error {
+	at, err := p.attrOf(d)
+	if err != nil {
+		return err
+	}
+	_, err = p.call(wsMessage{Action: "writeValue", Data: hex.EncodeToString(b)}, at, "valueWrite")
+	return err
+}
+
+// SetNotifyValue starts the notifications of c, or stops them if f is
+// nil. noble writes the CCCD.
+func (p *wsPeripheral) SetNotifyValue(c *gatt.Characteristic, f func(*gatt.Characteristic, []byte, error)) error {
+	at, err := p.attrOf(c)
+	if err != nil {
+		return err
+	}
+	on := f != nil
+	p.mu.Lock()
+	if p.notify == nil {
+		p.notify = map[wsAttribute]func([]byte){}
+		p.notifyH = map[wsAttribute]uint16{}
+	}
+	if on {
+		p.notify[at] = func(b []byte) { f(c, b, nil) }
+		p.notifyH[at] = c.VHandle()
+	} else {
+		delete(p.notify, at)
+	}
+	p.mu.Unlock()
+
+	_, err = p.call(wsMessage{Action: "notify", Notify: &on}, at, "notify")
+	if err != nil && on {
+		p.mu.Lock()
+		delete(p.notify, at)
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// SetIndicateValue is SetNotifyValue; noble chooses indications when c
+// does not notify.
+func (p *wsPeripheral) SetIndicateValue(c *gatt.Characteristic, f func(*gatt.Characteristic, []byte, error)) error {
+	return p.SetNotifyValue(c, f)
+}
+
+// ReadRSSI asks ws-slave to read the RSSI of the connection, or returns
+// -1.
+func (p *wsPeripheral) ReadRSSI() int {
+	r, err := p.call(wsMessage{Action: "updateRssi"}, wsAttribute{}, "rssiUpdate")
+	if err != nil {
+		return -1
+	}
+	return r.RSSI
+}
+
+// SetMTU does nothing, as noble exchanges the MTU by itself.
+func (p *wsPeripheral) SetMTU(mtu uint16) error {
+	return nil
+}
@@ -0,0 +1,297 @@
+package noblechild
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	gatt "github.com/paypal/gatt"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeWSSlave stands in for ws-slave.js with one peripheral. Writing
+// "ff" makes the peripheral disconnect.
+type fakeWSSlave struct {
+	mu      sync.Mutex
+	actions []wsMessage
+}
+
+func (f *fakeWSSlave) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.WriteJSON(wsMessage{Type: "stateChange", State: "poweredOn"})
+
+	tx := -8
+	for {
+		var m wsMessage
+		if err := conn.ReadJSON(&m); err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.actions = append(f.actions, m)
+		f.mu.Unlock()
+
+		r := wsMessage{PeripheralUUID: m.PeripheralUUID, ServiceUUID: m.ServiceUUID, CharacteristicUUID: m.CharacteristicUUID, DescriptorUUID: m.DescriptorUUID}
+		var events []wsMessage
+		switch m.Action {
+		case "startScanning":
+			events = append(events, wsMessage{
+				Type:           "discover",
+				PeripheralUUID: "aabbccddeeff",
+				Address:        "aa:bb:cc:dd:ee:ff",
+				AddressType:    "random",
+				RSSI:           -42,
+				Advertisement: &wsAdvertisement{
+					nodeAdvertisement: nodeAdvertisement{
+						LocalName:        "fake",
+						TxPowerLevel:     &tx,
+						ServiceUUIDs:     []string{"180f"},
+						ManufacturerData: "590001",
+					},
+					ServiceData: json.RawMessage(`[{"uuid":"feaa","data":"10"}]`),
+				},
+			})
+		case "connect":
+			r.Type = "connect"
+		case "disconnect":
+			r.Type = "disconnect"
+		case "discoverServices":
+			r.Type = "servicesDiscover"
+			r.ServiceUUIDs = []string{"180f", "1800"}
+		case "discoverIncludedServices":
+			r.Type = "includedServicesDiscover"
+			r.IncludedUUIDs = []string{"1800", "180a"}
+		case "discoverCharacteristics":
+			r.Type = "characteristicsDiscover"
+			r.Characteristics = []nodeAttribute{{UUID: "2a19", Properties: []string{"read", "write", "notify"}}}
+		case "discoverDescriptors":
+			r.Type = "descriptorsDiscover"
+			r.Descriptors = []string{"2902"}
+		case "read":
+			r.Type, r.Data = "read", "64"
+		case "readValue":
+			r.Type, r.Data = "valueRead", "0000"
+		case "write":
+			r.Type = "write"
+			if m.Data == "ff" {
+				r = wsMessage{Type: "disconnect", PeripheralUUID: m.PeripheralUUID}
+			}
+		case "notify":
+			r.Type = "notify"
+			if *m.Notify {
+				n := r
+				n.Type, n.Data, n.IsNotification = "read", "63", true
+				events = append(events, n)
+			}
+		case "updateRssi":
+			r.Type, r.RSSI = "rssiUpdate", -40
+		}
+		if r.Type != "" {
+			conn.WriteJSON(r)
+		}
+		for _, e := range events {
+			conn.WriteJSON(e)
+		}
+	}
+}
+
+func (f *fakeWSSlave) last() wsMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.actions[len(f.actions)-1]
+}
+
+func Test_WebSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeWSSlave{}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	m := NewMetrics()
+	d, err := NewDevice(SetBackend(BackendWebSocket), WebSocketURL("ws"+strings.TrimPrefix(s.URL, "http")), SetMetrics(m))
+	if !assert.Nil(err) {
+		return
+	}
+
+	discovered := make(chan gatt.Peripheral, 1)
+	connected := make(chan error, 1)
+	disconnected := make(chan error, 1)
+	d.Handle(
+		PeripheralDiscovered(func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+			assert.Equal("fake", a.LocalName)
+			assert.Equal([]gatt.UUID{gatt.UUID16(0x180f)}, a.Services)
+			assert.Equal(-42, rssi)
+			select {
+			case discovered <- p:
+			default:
+			}
+		}),
+		PeripheralConnected(func(p gatt.Peripheral, err error) { connected <- err }),
+		PeripheralDisconnected(func(p gatt.Peripheral, err error) { disconnected <- err }),
+	)
+	states := make(chan gatt.State, 1)
+	assert.Nil(d.Init(func(d gatt.Device, s gatt.State) { states <- s }))
+	defer d.Stop()
+	assert.Equal(gatt.StatePoweredOn, <-states)
+
+	d.Scan(nil, true)
+	var p gatt.Peripheral
+	select {
+	case p = <-discovered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not discovered")
+	}
+	assert.Equal("AABBCCDDEEFF", p.ID())
+	e, ok := DiscoveryEvent(p)
+	assert.True(ok)
+	assert.Equal("random", e.AddressType)
+	assert.Equal(uint16(0x0059), e.Manufacturers[0].CompanyID)
+	assert.Equal(1, len(e.Advertisement.ServiceData))
+
+	d.Connect(p)
+	select {
+	case err := <-connected:
+		assert.Nil(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	ss, err := p.DiscoverServices([]gatt.UUID{gatt.UUID16(0x180f)})
+	assert.Nil(err)
+	assert.Equal(1, len(ss))
+	inc, err := p.DiscoverIncludedServices(nil, ss[0])
+	assert.Nil(err)
+	if assert.Equal(2, len(inc)) {
+		assert.Equal("180f", f.last().ServiceUUID)
+		assert.Equal("1800", inc[0].UUID().String())
+		assert.Equal(uint16(2), inc[0].Handle())
+		assert.Equal("180a", inc[1].UUID().String())
+	}
+	cs, err := p.DiscoverCharacteristics(nil, ss[0])
+	assert.Nil(err)
+	assert.Equal(1, len(cs))
+	assert.Equal(gatt.CharRead|gatt.CharWrite|gatt.CharNotify, cs[0].Properties())
+	ds, err := p.DiscoverDescriptors(nil, cs[0])
+	assert.Nil(err)
+	assert.Equal(1, len(ds))
+	assert.Equal(ds[0], cs[0].Descriptor())
+
+	b, err := p.ReadCharacteristic(cs[0])
+	assert.Nil(err)
+	assert.Equal([]byte{0x64}, b)
+	assert.Nil(p.WriteCharacteristic(cs[0], []byte{0x01}, true))
+	last := f.last()
+	assert.Equal("180f", last.ServiceUUID)
+	assert.Equal("2a19", last.CharacteristicUUID)
+	assert.Equal("01", last.Data)
+	assert.True(last.WithoutResponse)
+	b, err = p.ReadDescriptor(ds[0])
+	assert.Nil(err)
+	assert.Equal([]byte{0, 0}, b)
+	assert.Equal(-40, p.ReadRSSI())
+
+	notified := make(chan []byte, 1)
+	assert.Nil(p.SetNotifyValue(cs[0], func(c *gatt.Characteristic, b []byte, err error) { notified <- b }))
+	select {
+	case b := <-notified:
+		assert.Equal([]byte{0x63}, b)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not notified")
+	}
+	assert.Nil(p.SetNotifyValue(cs[0], nil))
+	assert.False(*f.last().Notify)
+
+	// the write without response is not timed
+	var mb strings.Builder
+	m.WriteTo(&mb)
+	assert.Contains(mb.String(), `noblechild_att_request_duration_seconds_count{opcode="0x0a"} 2`)
+	assert.Contains(mb.String(), `noblechild_att_request_duration_seconds_count{opcode="0x12"} 2`)
+	assert.Contains(mb.String(), `noblechild_att_request_duration_seconds_count{opcode="0x10"} 1`)
+	assert.Contains(mb.String(), `noblechild_att_request_duration_seconds_count{opcode="0x08"} 2`)
+
+	d.CancelConnection(p)
+	select {
+	case err := <-disconnected:
+		assert.Equal(ErrLocalHostTerminated, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not disconnected")
+	}
+
+	// disconnected by the peripheral while writing
+	d.Connect(p)
+	assert.Nil(<-connected)
+	ss, err = p.DiscoverServices(nil)
+	assert.Nil(err)
+	cs, err = p.DiscoverCharacteristics(nil, ss[0])
+	assert.Nil(err)
+	err = p.WriteCharacteristic(cs[0], []byte{0xff}, false)
+	assert.True(errors.Is(err, ErrDisconnected))
+	select {
+	case err := <-disconnected:
+		assert.Equal(ErrDisconnected, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not disconnected")
+	}
+	assert.NotNil(p.WriteCharacteristic(cs[0], []byte{0x01}, false))
+}
+
+func Test_WebSocketCallTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeWSSlave{}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	d, err := NewDevice(SetBackend(BackendWebSocket), WebSocketURL("ws"+strings.TrimPrefix(s.URL, "http")))
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Nil(d.Init(func(gatt.Device, gatt.State) {}))
+	defer d.Stop()
+
+	// ws-slave sends nothing when noble fails
+	w := d.(*device).backend.(*wsSlave)
+	w.callTimeout = 50 * time.Millisecond
+	_, err = w.call(wsMessage{Action: "readHandle", PeripheralUUID: "aabbccddeeff"}, "handleRead")
+	assert.NotNil(err)
+	w.mu.Lock()
+	assert.Empty(w.waiters)
+	w.mu.Unlock()
+}
+
+func Test_WebSocketURL(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewDevice(SetBackend(BackendWebSocket))
+	assert.NotNil(err)
+	_, err = NewDevice(SetBackend(BackendWebSocket), WebSocketURL("http://localhost"))
+	assert.NotNil(err)
+	assert.Equal("websocket", BackendWebSocket.String())
+}
+
+func Test_wsAdvertisement(t *testing.T) {
+	assert := assert.New(t)
+
+	var m wsMessage
+	// serviceData of ws-slave with noble 1.x
+	assert.Nil(json.Unmarshal([]byte(`{"type":"discover","advertisement":{"localName":"a","serviceData":"[object Object]","manufacturerData":null}}`), &m))
+	a := m.Advertisement.parse()
+	assert.Equal("a", a.LocalName)
+	assert.Nil(a.ServiceData)
+	assert.Nil(m.Advertisement.parse().TxPowerLevel)
+
+	assert.Nil(json.Unmarshal([]byte(`{"advertisement":{"serviceData":[{"uuid":"feaa","data":"10"}]}}`), &m))
+	assert.Equal([]nodeServiceData{{UUID: "feaa", Data: "10"}}, m.Advertisement.parse().ServiceData)
+
+	assert.Equal("read/p/s/c", wsKey("read", wsMessage{PeripheralUUID: "p", ServiceUUID: "s", CharacteristicUUID: "c"}))
+}